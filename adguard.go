@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Version of the AdGuard Home API emulated by the /control endpoints.
+const adguardVersion string = "v0.107.0"
+
+type AdGuardStatus struct {
+	Version           string   `json:"version"`
+	Language          string   `json:"language"`
+	DNSAddresses      []string `json:"dns_addresses"`
+	DNSPort           int      `json:"dns_port"`
+	HTTPPort          int      `json:"http_port"`
+	ProtectionEnabled bool     `json:"protection_enabled"`
+	Running           bool     `json:"running"`
+}
+
+type AdGuardFilteringStatus struct {
+	Enabled          bool     `json:"enabled"`
+	Interval         int      `json:"interval"`
+	Filters          []any    `json:"filters"`
+	WhitelistFilters []any    `json:"whitelist_filters"`
+	UserRules        []string `json:"user_rules"`
+}
+
+type AdGuardSetRules struct {
+	Rules []string `json:"rules"`
+}
+
+type AdGuardRule struct {
+	FilterListID int    `json:"filter_list_id"`
+	Text         string `json:"text"`
+}
+
+type AdGuardCheckHost struct {
+	Reason string        `json:"reason"`
+	Rules  []AdGuardRule `json:"rules"`
+}
+
+// adguardRule renders an entry in AdGuard syntax: "||" matches the domain
+// with its subdomains, "|" anchors the pattern at the start of the name and
+// slashes enclose a regular expression.
+func adguardRule(entry DomainEntry) string {
+	switch entry.Mode {
+	case ModeSubdomain:
+		return "||" + entry.Domain + "^"
+	case ModeRegex:
+		return "/" + entry.Domain + "/"
+	}
+	return "|" + entry.Domain + "^"
+}
+
+// parseAdGuardRule converts a "||domain^", "|domain^" or bare domain rule
+// into an entry. Comments and empty lines yield ok == true and an empty
+// entry.
+func parseAdGuardRule(rule string) (entry DomainEntry, ok bool) {
+	rule = strings.TrimSpace(rule)
+	if rule == "" || strings.HasPrefix(rule, "!") || strings.HasPrefix(rule, "#") {
+		return DomainEntry{}, true
+	}
+	entry.Mode = ModeExact
+	if strings.HasPrefix(rule, "||") {
+		entry.Mode = ModeSubdomain
+		rule = rule[2:]
+	} else if strings.HasPrefix(rule, "|") {
+		rule = rule[1:]
+	}
+	rule = strings.TrimSuffix(rule, "^")
+	if strings.Contains(rule, "*") {
+		entry.Mode = ModeWildcard
+	}
+	entry.Domain = rule
+	if strings.ContainsAny(rule, "|^@$/ \t") || entry.normalize() != nil {
+		return DomainEntry{}, false
+	}
+	return entry, true
+}
+
+func adguardStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	respondWithJSON(w, AdGuardStatus{
+		Version:           adguardVersion,
+		DNSAddresses:      []string{},
+		ProtectionEnabled: true,
+		Running:           true,
+	})
+}
+
+func adguardFilteringStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	// Only the manual entries are user rules; those of remote sources are
+	// managed by their sync.
+	rows, err := db.QueryContext(r.Context(), selectManualStmt)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	status := AdGuardFilteringStatus{
+		Enabled:          true,
+		Filters:          []any{},
+		WhitelistFilters: []any{},
+		UserRules:        []string{},
+	}
+	for rows.Next() {
+		var entry DomainEntry
+		if err := rows.Scan(&entry.Domain, &entry.Mode); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		status.UserRules = append(status.UserRules, adguardRule(entry))
+	}
+	if err := rows.Err(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	respondWithJSON(w, status)
+}
+
+// adguardSetRulesHandler replaces the whole blocklist with the domains
+// described by the submitted user rules.
+func adguardSetRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensureValidPOST(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	var body AdGuardSetRules
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted object with \"rules\" array; got invalid JSON."), Status: "error"})
+		return
+	}
+
+	wanted := make(map[string]string, len(body.Rules))
+	errs := make([]APIError, 0)
+	for index, rule := range body.Rules {
+		entry, ok := parseAdGuardRule(rule)
+		if !ok {
+			errs = append(errs, APIError{
+				Code:       CodeUnsupportedRule,
+				Status:     "error",
+				StatusCode: http.StatusBadRequest,
+				Message:    localize(r, "Rule \"%s\" (%d in the array) isn't supported; only \"||domain^\" and \"|domain^\" rules are.", rule, index),
+			})
+			continue
+		}
+		if entry.Domain != "" {
+			wanted[entry.Domain] = entry.Mode
+		}
+	}
+	if len(errs) != 0 {
+		respondWithError(w, &APIError{Code: CodeUnsupportedRule, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Some of the rules aren't supported."), Errors: errs})
+		return
+	}
+
+	tx, err := beginChange(r.Context())
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(selectManualStmt)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	removed := make([]DomainEntry, 0)
+	for rows.Next() {
+		var entry DomainEntry
+		if err := rows.Scan(&entry.Domain, &entry.Mode); err != nil {
+			rows.Close()
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if wanted[entry.Domain] == entry.Mode {
+			delete(wanted, entry.Domain)
+		} else {
+			removed = append(removed, entry)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	for _, entry := range removed {
+		if _, err := tx.Exec(deleteStmt, entry.Domain); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if err := tx.record(entry, true); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+	}
+	names := make([]string, 0, len(wanted))
+	for name := range wanted {
+		names = append(names, name)
+	}
+	sourced, err := sourcedNames(tx, names)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	for name, mode := range wanted {
+		if sourced[name] {
+			// Already blocked by a remote source.
+			continue
+		}
+		entry := DomainEntry{Domain: name, Mode: mode}
+		if _, err := tx.Exec(insertStmt, entry.Domain, entry.Mode); err != nil {
+			if isUniqueConstraintError(err) {
+				// Already blocked by a remote source.
+				continue
+			}
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if err := tx.record(entry, false); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func adguardCheckHostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		respondWithError(w, &APIError{
+			Code:       CodeMissingParameter,
+			Status:     "error",
+			StatusCode: http.StatusBadRequest,
+			Message:    localize(r, "Parameter \"%s\" wasn't provided in the query!", "name"),
+		})
+		return
+	}
+
+	name, apiErr := checkedDomain(r, name)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	result := AdGuardCheckHost{Reason: "NotFilteredNotFound", Rules: []AdGuardRule{}}
+	if entry := matchBlocked(name); entry != nil {
+		result.Reason = "FilteredBlackList"
+		result.Rules = append(result.Rules, AdGuardRule{Text: adguardRule(*entry)})
+		// Exceptions are written the AdGuard way, as "@@" rules.
+		if allowed := allowlist.match(name); allowed != nil {
+			result.Reason = "NotFilteredWhiteList"
+			result.Rules = []AdGuardRule{{Text: "@@" + adguardRule(*allowed)}}
+		}
+	}
+	respondWithJSON(w, result)
+}
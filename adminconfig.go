@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The configuration of an instance, which GET /admin/config exports so
+// POST /admin/config can set up another one like it: the settings, the
+// sources, the named policies with their clients, the schedules, the
+// disabled categories and the API keys. Secrets are never exported; they
+// are replaced by ${NAME} references to environment variables of the
+// importing instance. The entries themselves are in GET /domains/export.
+const configVersion = 1
+
+const exportSourcesStmt string = "SELECT url, update_interval, canary_until FROM blocklist_sources ORDER BY id"
+
+var secretReference = regexp.MustCompile(`\$\{([A-Z0-9_]+)\}`)
+
+// Kinds of ConfigItemSchema.
+const (
+	configSource   = "source"
+	configPolicy   = "policy"
+	configSchedule = "schedule"
+	configKey      = "key"
+)
+
+type ConfigKeySchema struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+	// Whether the key is one of -api-keys rather than issued through the
+	// API.
+	Configured bool       `json:"configured"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+}
+
+type ConfigSchema struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exportedAt"`
+	// The settings differing from their defaults, keyed by their flag
+	// names like in -config.
+	Settings           map[string]string   `json:"settings"`
+	Sources            []NewSourceSchema   `json:"sources"`
+	Policies           []NewPolicySchema   `json:"policies"`
+	Schedules          []NewScheduleSchema `json:"schedules"`
+	DisabledCategories []string            `json:"disabledCategories"`
+	Keys               []ConfigKeySchema   `json:"keys"`
+}
+
+type ConfigItemSchema struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+type ConfigImportSchema struct {
+	Sources    int `json:"sources"`
+	Policies   int `json:"policies"`
+	Schedules  int `json:"schedules"`
+	Categories int `json:"categories"`
+	// New keys of the owners of the issued keys, whose secrets aren't
+	// exported. They are only ever shown here.
+	Keys []IssuedAPIKeySchema `json:"keys"`
+	// What the instance already had, or couldn't take, and was left as it
+	// is.
+	Skipped []ConfigItemSchema `json:"skipped"`
+	// The settings differing from the running ones, which only take effect
+	// once set in the configuration of the instance and restarted.
+	Settings []string `json:"settings"`
+}
+
+// referenceName turns a name into the one of an environment variable.
+func referenceName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(name))
+}
+
+// urlReference replaces the password of a URL, if it has one, by a
+// reference to the environment variable.
+func urlReference(value string, reference string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); !ok {
+		return value
+	}
+	return strings.Replace(u.Redacted(), ":xxxxx@", ":${"+reference+"}@", 1)
+}
+
+// settingReference is the value of a setting with its secrets replaced by
+// references.
+func settingReference(name string, value string) string {
+	if name == "api-keys" {
+		keys, _ := parseAPIKeys(value)
+		pairs := make([]string, 0, len(keys))
+		for _, key := range keys {
+			pairs = append(pairs, key.name+":${"+referenceName(envPrefix+"api-key-"+key.name)+"}")
+		}
+		return strings.Join(pairs, ",")
+	}
+	if secretSettings[name] {
+		if value == "" {
+			return ""
+		}
+		return "${" + envName(name) + "}"
+	}
+	return urlReference(value, envName(name)+"_PASSWORD")
+}
+
+func exportedSettings() map[string]string {
+	settings := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if metaSettings[f.Name] || f.Value.String() == f.DefValue {
+			return
+		}
+		settings[f.Name] = settingReference(f.Name, f.Value.String())
+	})
+	return settings
+}
+
+// resolveReferences replaces the references of the URL by the variables of
+// the environment, escaped as passwords. It returns the first one that
+// isn't set, if any.
+func resolveReferences(value string) (string, string) {
+	missing := ""
+	resolved := secretReference.ReplaceAllStringFunc(value, func(reference string) string {
+		name := secretReference.FindStringSubmatch(reference)[1]
+		secret, ok := os.LookupEnv(name)
+		if !ok && missing == "" {
+			missing = name
+		}
+		return strings.TrimPrefix(url.UserPassword("", secret).String(), ":")
+	})
+	return resolved, missing
+}
+
+func exportConfig(ctx context.Context) (ConfigSchema, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	schema := ConfigSchema{
+		Version:            configVersion,
+		ExportedAt:         now,
+		Settings:           exportedSettings(),
+		Sources:            make([]NewSourceSchema, 0),
+		Policies:           make([]NewPolicySchema, 0),
+		Schedules:          make([]NewScheduleSchema, 0),
+		DisabledCategories: make([]string, 0),
+		Keys:               make([]ConfigKeySchema, 0),
+	}
+
+	rows, err := db.QueryContext(ctx, exportSourcesStmt)
+	if err != nil {
+		return schema, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sourceURL string
+		var interval int64
+		var canaryUntil sql.NullInt64
+		if err := rows.Scan(&sourceURL, &interval, &canaryUntil); err != nil {
+			return schema, err
+		}
+		source := NewSourceSchema{
+			URL:      urlReference(sourceURL, fmt.Sprintf("%sSOURCE_%d_PASSWORD", envPrefix, len(schema.Sources)+1)),
+			Interval: (time.Duration(interval) * time.Second).String(),
+		}
+		// A source still in its canary period is imported with the days
+		// left of it.
+		if left := time.Unix(canaryUntil.Int64, 0).Sub(now); canaryUntil.Valid && left > 0 {
+			source.CanaryDays = min(int((left+24*time.Hour-1)/(24*time.Hour)), maxCanaryDays)
+		}
+		schema.Sources = append(schema.Sources, source)
+	}
+	if err := rows.Err(); err != nil {
+		return schema, err
+	}
+
+	namedPolicies.mu.RLock()
+	for _, p := range namedPolicies.policies {
+		schema.Policies = append(schema.Policies, p.schema.NewPolicySchema)
+	}
+	namedPolicies.mu.RUnlock()
+	for _, s := range schedulesSchema(scheduleNow()).Schedules {
+		schema.Schedules = append(schema.Schedules, s.NewScheduleSchema)
+	}
+	for _, category := range categories.schema().Categories {
+		if !category.Enabled {
+			schema.DisabledCategories = append(schema.DisabledCategories, category.Name)
+		}
+	}
+	for _, entry := range apiKeyring.valid(now) {
+		key := ConfigKeySchema{Name: entry.name, Owner: entry.owner, Configured: !strings.Contains(entry.name, "#")}
+		if entry.expiresAt != 0 {
+			expiresAt := time.Unix(entry.expiresAt, 0).UTC()
+			key.ExpiresAt = &expiresAt
+		}
+		schema.Keys = append(schema.Keys, key)
+	}
+	return schema, nil
+}
+
+// adminConfigHandler serves GET and POST /admin/config.
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		schema, err := exportConfig(r.Context())
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		respondWithJSON(w, schema)
+	case http.MethodPost:
+		importConfigHandler(w, r)
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, POST"))
+	}
+}
+
+// scheduleKey tells apart schedules that differ in more than their ID.
+func scheduleKey(s NewScheduleSchema) string {
+	return fmt.Sprintf("%v", s)
+}
+
+// importConfigHandler serves POST /admin/config, which adds what the
+// exported configuration of the body has and the instance hasn't. Sources
+// are told apart by URL, policies by name and keys by owner; nothing the
+// instance has is changed. The settings can't change while it runs, so
+// the ones differing are only reported.
+func importConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensureJSON(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	var doc ConfigSchema
+	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted a configuration exported by GET /admin/config; got invalid JSON."), Status: "error"})
+		return
+	}
+	invalid := func(message string, args ...any) *APIError {
+		return &APIError{Code: CodeInvalidConfig, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, message, args...)}
+	}
+	if doc.Version != configVersion {
+		respondWithError(w, invalid("Configuration version %d isn't supported; excepted %d.", doc.Version, configVersion))
+		return
+	}
+
+	result := ConfigImportSchema{Keys: make([]IssuedAPIKeySchema, 0), Skipped: make([]ConfigItemSchema, 0), Settings: make([]string, 0)}
+	running := exportedSettings()
+	for name, value := range doc.Settings {
+		if flag.Lookup(name) == nil || metaSettings[name] {
+			respondWithError(w, invalid("Setting \"%s\" is unknown.", name))
+			return
+		}
+		if running[name] != value {
+			result.Settings = append(result.Settings, name)
+		}
+	}
+	for name := range running {
+		if _, ok := doc.Settings[name]; !ok {
+			result.Settings = append(result.Settings, name)
+		}
+	}
+	slices.Sort(result.Settings)
+
+	// Everything is checked before anything is added.
+	resolved := make([]string, len(doc.Sources))
+	intervals := make([]time.Duration, len(doc.Sources))
+	for i, source := range doc.Sources {
+		var missing string
+		if resolved[i], missing = resolveReferences(source.URL); missing != "" {
+			respondWithError(w, invalid("Secret reference \"%s\" isn't set in the environment.", missing))
+			return
+		}
+		var apiErr *APIError
+		if intervals[i], apiErr = validateSource(r, NewSourceSchema{URL: resolved[i], Interval: source.Interval, CanaryDays: source.CanaryDays}); apiErr != nil {
+			if resolved[i] != source.URL {
+				// The message may show the secret.
+				apiErr.Message = localize(r, "Source \"%s\" is invalid.", source.URL)
+			}
+			respondWithError(w, apiErr)
+			return
+		}
+	}
+	imported := make(map[string]bool)
+	for i := range doc.Policies {
+		if apiErr := validatePolicy(r, &doc.Policies[i]); apiErr != nil {
+			respondWithError(w, apiErr)
+			return
+		}
+		imported[doc.Policies[i].Name] = true
+	}
+	schedules := make([]*schedule, 0, len(doc.Schedules))
+	for _, body := range doc.Schedules {
+		s, err := newSchedule(ScheduleSchema{NewScheduleSchema: body})
+		if err != nil {
+			respondWithError(w, &APIError{Code: CodeInvalidSchedule, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Schedule is invalid: %v.", err)})
+			return
+		}
+		if s.schema.Policy != "" && !imported[s.schema.Policy] && namedPolicies.find(s.schema.Policy) == nil {
+			respondWithError(w, policyNotFound(r, s.schema.Policy))
+			return
+		}
+		schedules = append(schedules, s)
+	}
+	for i, category := range doc.DisabledCategories {
+		doc.DisabledCategories[i] = strings.ToLower(category)
+		if err := validateCategory(doc.DisabledCategories[i]); err != nil {
+			respondWithError(w, &APIError{Code: CodeInvalidCategory, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Category \"%s\" is invalid: %v.", category, err)})
+			return
+		}
+	}
+	owners := make([]string, 0)
+	for _, key := range doc.Keys {
+		if key.Configured || slices.Contains(owners, key.Owner) {
+			continue
+		}
+		if err := validateKeyOwner(key.Owner); err != nil {
+			respondWithError(w, &APIError{Code: CodeInvalidParameter, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Owner \"%s\" is invalid: %v.", key.Owner, err)})
+			return
+		}
+		owners = append(owners, key.Owner)
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	for i, source := range doc.Sources {
+		var id int64
+		err := tx.QueryRow(sourceIDStmt, resolved[i]).Scan(&id)
+		if err == nil {
+			result.Skipped = append(result.Skipped, ConfigItemSchema{Kind: configSource, Name: source.URL})
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if _, err := tx.Exec(insertSourceStmt, resolved[i], int64(intervals[i]/time.Second), sourceCanaryUntil(source.CanaryDays)); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		result.Sources++
+	}
+
+	for _, body := range doc.Policies {
+		if namedPolicies.find(body.Name) != nil {
+			result.Skipped = append(result.Skipped, ConfigItemSchema{Kind: configPolicy, Name: body.Name})
+			continue
+		}
+		if _, err := tx.Exec(insertPolicyStmt, body.Name, body.Default, body.Monitor, time.Now().Unix()); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		var id int64
+		if err := tx.QueryRow(policyIDStmt, body.Name).Scan(&id); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		assigned, err := storePolicy(tx, id, body)
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if assigned != "" {
+			respondWithError(w, &APIError{Code: CodeClientAssigned, Status: "error", StatusCode: http.StatusConflict, Message: localize(r, "Client \"%s\" already belongs to another policy.", assigned)})
+			return
+		}
+		if err := audit(r.Context(), tx, auditPolicies, DomainEntry{Domain: body.Name}, false); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		result.Policies++
+	}
+
+	existing := make(map[string]bool)
+	for _, s := range schedulesSchema(scheduleNow()).Schedules {
+		existing[scheduleKey(s.NewScheduleSchema)] = true
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, s := range schedules {
+		schema := s.schema
+		key := scheduleKey(schema.NewScheduleSchema)
+		if existing[key] {
+			result.Skipped = append(result.Skipped, ConfigItemSchema{Kind: configSchedule, Name: fmt.Sprintf("%s %s-%s", schema.target().Domain, schema.Start, schema.End)})
+			continue
+		}
+		existing[key] = true
+		if _, err := tx.Exec(insertScheduleStmt, schema.Category, schema.Domain, schema.Mode, schema.Policy, schema.Action, strings.Join(schema.Days, ","), schema.Start, schema.End, schema.Weight, now.Unix()); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if err := audit(r.Context(), tx, auditSchedules, schema.target(), false); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		result.Schedules++
+	}
+
+	held := make(map[string]bool)
+	for _, entry := range apiKeyring.valid(time.Now()) {
+		held[entry.owner] = true
+	}
+	for _, owner := range owners {
+		if held[owner] || !apiKeyring.enabled() {
+			result.Skipped = append(result.Skipped, ConfigItemSchema{Kind: configKey, Name: owner})
+			continue
+		}
+		issued, err := issueKey(r.Context(), tx, owner, *apiKeyOverlap)
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		result.Keys = append(result.Keys, issued)
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	for _, load := range []func() error{namedPolicies.load, loadSchedules, apiKeyring.load} {
+		if err := load(); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+	}
+	if result.Sources != 0 {
+		select {
+		case sourcesChanged <- struct{}{}:
+		default:
+		}
+	}
+	disabled := make(map[string]bool)
+	for _, category := range categories.schema().Categories {
+		disabled[category.Name] = !category.Enabled
+	}
+	for _, category := range doc.DisabledCategories {
+		if disabled[category] {
+			continue
+		}
+		disabled[category] = true
+		categories.setEnabled(category, false)
+		result.Categories++
+	}
+	requestLogger(r).Info("Configuration imported", "sources", result.Sources, "policies", result.Policies, "schedules", result.Schedules, "keys", len(result.Keys))
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, result)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const insertOverrideStmt string = "INSERT INTO allowed_domains(domain_name, mode, source) VALUES (?, ?, ?)"
+
+const deleteOverridesStmt string = "DELETE FROM allowed_domains WHERE source = ?"
+
+const entrySourceStmt string = `SELECT s.id, s.url FROM feed_domains d
+    JOIN blocklist_sources s ON s.id = d.source
+    WHERE d.domain_name = ?`
+
+const insertAllowedStmt string = "INSERT INTO allowed_domains(domain_name, mode) VALUES (?, ?)"
+
+const deleteAllowedStmt string = "DELETE FROM allowed_domains WHERE domain_name = ?"
+
+const lookupAllowedStmt string = "SELECT mode FROM allowed_domains WHERE domain_name = ?"
+
+const selectAllowedStmt string = "SELECT domain_name, mode FROM allowed_domains"
+
+const countAllowedStmt string = "SELECT COUNT(*) FROM allowed_domains"
+
+const listAllowedStmt string = "SELECT domain_name, mode FROM allowed_domains ORDER BY domain_name LIMIT ? OFFSET ?"
+
+var allowlist = newMemoryBlocklist(selectAllowedStmt)
+
+// blockingEntry returns the entry blocking the name, or nil if the name
+// isn't blocked or is allowed. Entries of disabled categories don't block.
+func blockingEntry(name string) *DomainEntry {
+	return blockingEntryFor(name, "")
+}
+
+// blockingEntryFor is blockingEntry for the clients of the named policy.
+func blockingEntryFor(name string, policy string) *DomainEntry {
+	entry := matchBlockedFor(name, policy)
+	if entry == nil || allowlist.match(name) != nil {
+		return nil
+	}
+	return entry
+}
+
+type SourceRef struct {
+	ID  int64  `json:"id"`
+	URL string `json:"url"`
+}
+
+// MatchSchema is the entry blocking a name along with the source it comes
+// from, which is nil for entries added by hand, its imported note and the
+// time it expires at, if it does.
+type MatchSchema struct {
+	DomainEntry
+	EntryNote
+	Source    *SourceRef `json:"source,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Origin    string     `json:"origin,omitempty"`
+}
+
+// entrySource returns the source the stored entry comes from, or nil.
+func entrySource(r *http.Request, domain string) (*SourceRef, error) {
+	var source SourceRef
+	err := db.QueryRowContext(r.Context(), entrySourceStmt, domain).Scan(&source.ID, &source.URL)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &source, nil
+}
+
+// overrideHandler serves POST /domains/{name}/override. It allows the
+// entry of a source blocking the name, in the same mode, so the name is no
+// longer blocked. Unlike removing the entry, which the next sync would add
+// back, the override lasts as long as the source.
+func overrideHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensurePOST(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	name, apiErr := checkedDomain(r, r.PathValue("name"))
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	entry := blockingEntry(name)
+	if entry == nil {
+		respondWithError(w, &APIError{
+			Code:       CodeDomainNotFound,
+			Status:     "error",
+			StatusCode: http.StatusNotFound,
+			Message:    localize(r, "Domain \"%s\" isn't blocked.", name),
+		})
+		return
+	}
+	source, err := entrySource(r, entry.Domain)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if source == nil {
+		respondWithError(w, &APIError{
+			Code:       CodeInvalidRequest,
+			Status:     "error",
+			StatusCode: http.StatusConflict,
+			Message:    localize(r, "Domain \"%s\" is blocked by \"%s\", which was added by hand; remove it instead.", name, entry.Domain),
+		})
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(insertOverrideStmt, entry.Domain, entry.Mode, source.ID); err != nil {
+		if isUniqueConstraintError(err) {
+			respondWithError(w, &APIError{
+				Code:       CodeDomainExists,
+				Status:     "error",
+				StatusCode: http.StatusConflict,
+				Message:    localize(r, "Domain \"%s\" is already in the allowlist.", entry.Domain),
+			})
+			return
+		}
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := commitAllowlist(r.Context(), tx, []DomainEntry{*entry}, nil); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(MatchSchema{DomainEntry: *entry, Source: source})
+}
+
+// commitAllowlist audits the added and removed entries, commits the
+// transaction and applies them to the in-memory allowlist, like changeTx
+// does for the blocklist.
+func commitAllowlist(ctx context.Context, tx *sql.Tx, added []DomainEntry, removed []DomainEntry) error {
+	for _, entry := range added {
+		if err := audit(ctx, tx, auditAllowlist, entry, false); err != nil {
+			return err
+		}
+	}
+	for _, entry := range removed {
+		if err := audit(ctx, tx, auditAllowlist, entry, true); err != nil {
+			return err
+		}
+	}
+	allowlist.mu.Lock()
+	defer allowlist.mu.Unlock()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, entry := range added {
+		allowlist.add(entry)
+	}
+	for _, entry := range removed {
+		allowlist.remove(entry)
+	}
+	return nil
+}
+
+func allowlistHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listAllowedHandler(w, r)
+	case http.MethodPost:
+		allowHandler(w, r)
+	case http.MethodDelete:
+		if err := ensureJSON(r); err != nil {
+			respondWithError(w, err)
+			return
+		}
+		var names []string
+		if err := json.NewDecoder(r.Body).Decode(&names); err != nil {
+			respondWithError(w, localized(r, InvalidJSON))
+			return
+		}
+		disallowDomains(w, r, names)
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, POST, DELETE"))
+	}
+}
+
+func allowedHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	switch r.Method {
+	case http.MethodGet:
+		name, apiErr := checkedDomain(r, name)
+		if apiErr != nil {
+			respondWithError(w, apiErr)
+			return
+		}
+		entry := allowlist.match(name)
+		if entry == nil {
+			respondWithError(w, &APIError{
+				Code:       CodeDomainNotFound,
+				Status:     "error",
+				StatusCode: http.StatusNotFound,
+				Message:    localize(r, "Domain \"%s\" isn't allowed.", name),
+			})
+			return
+		}
+		respondWithJSON(w, entry)
+	case http.MethodDelete:
+		disallowDomains(w, r, []string{name})
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, DELETE"))
+	}
+}
+
+func listAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	page, apiErr := parsePage(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	schema := ListSchema{Domains: []DomainEntry{}, Page: page}
+	if err := tx.QueryRow(countAllowedStmt).Scan(&schema.Total); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	rows, err := tx.Query(listAllowedStmt, schema.Limit, schema.Offset)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry DomainEntry
+		if err := rows.Scan(&entry.Domain, &entry.Mode); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		schema.Domains = append(schema.Domains, entry)
+	}
+	if err := rows.Err(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	respondWithPage(w, r, &schema.Page, &schema)
+}
+
+func allowHandler(w http.ResponseWriter, r *http.Request) {
+	newDomains, ok := decodeEntries(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	added := make([]DomainEntry, 0, len(newDomains))
+	errs := make([]APIError, 0)
+	for index, entry := range newDomains {
+		if _, err := tx.Exec(insertAllowedStmt, entry.Domain, entry.Mode); err != nil {
+			if isUniqueConstraintError(err) {
+				errs = append(errs, APIError{
+					Code:       CodeDomainExists,
+					StatusCode: http.StatusConflict,
+					Message:    localize(r, "Domain \"%s\" (%d in the array) is already in the allowlist.", entry.Domain, index),
+					Status:     "error",
+				})
+				continue
+			}
+			respondWithInternalError(w, r, err)
+			return
+		}
+		added = append(added, entry.DomainEntry)
+	}
+	if err := commitAllowlist(r.Context(), tx, added, nil); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if len(added) == 0 {
+		respondWithError(w, &APIError{Code: CodeDomainExists, Status: "error", StatusCode: http.StatusConflict, Message: localize(r, "All of the domains are already in the allowlist.")})
+	} else if len(errs) == 0 {
+		respondWithError(w, &APIError{Code: CodeOK, StatusCode: http.StatusCreated, Message: localize(r, "Succesfully allowed all of the domains."), Status: "success"})
+	} else {
+		respondWithError(w, &APIError{Code: CodeDomainExists, Status: "partial", StatusCode: http.StatusCreated, Message: localize(r, "Some of the domains are already in the allowlist."), Errors: errs})
+	}
+}
+
+func disallowDomains(w http.ResponseWriter, r *http.Request, names []string) {
+	if len(names) == 0 {
+		respondWithError(w, &APIError{Code: CodeNoDomains, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "No domains provided.")})
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	removed := make([]DomainEntry, 0, len(names))
+	errs := make([]APIError, 0)
+	for index, raw := range names {
+		name, err := normalizeDomain(raw)
+		if err != nil {
+			errs = append(errs, *invalidDomain(r, err, "Domain \"%s\" (%d in the array) is invalid: %v.", raw, index, err))
+			continue
+		}
+		entry := DomainEntry{Domain: name}
+		err = tx.QueryRow(lookupAllowedStmt, name).Scan(&entry.Mode)
+		if errors.Is(err, sql.ErrNoRows) {
+			errs = append(errs, APIError{
+				Code:       CodeDomainNotFound,
+				Status:     "error",
+				StatusCode: http.StatusNotFound,
+				Message:    localize(r, "Domain \"%s\" (%d in the array) isn't in the allowlist.", name, index),
+			})
+			continue
+		}
+		if err == nil {
+			_, err = tx.Exec(deleteAllowedStmt, name)
+		}
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		removed = append(removed, entry)
+	}
+	if err := commitAllowlist(r.Context(), tx, nil, removed); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if len(removed) == 0 {
+		respondWithError(w, &APIError{Code: CodeDomainNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "All of the domains aren't in the allowlist.")})
+	} else if len(errs) == 0 {
+		respondWithError(w, &APIError{Code: CodeOK, StatusCode: http.StatusOK, Message: localize(r, "Succesfully removed all of the specified domains."), Status: "success"})
+	} else {
+		respondWithError(w, &APIError{Code: CodeDomainNotFound, Status: "partial", StatusCode: http.StatusOK, Message: localize(r, "Some of the domains aren't in the allowlist."), Errors: errs})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+const insertAuditStmt string = "INSERT INTO audit_log(recorded_at, actor, client_addr, list, action, domain_name, mode) VALUES (?, ?, ?, ?, ?, ?, ?)"
+
+// The rows of auditAll are appended with valuesList.
+const insertAuditRowsStmt string = "INSERT INTO audit_log(recorded_at, actor, client_addr, list, action, domain_name, mode) VALUES "
+
+const auditFilter string = " WHERE (? = '' OR actor = ?) AND (? = '' OR domain_name = ?) AND recorded_at >= ? AND recorded_at <= ?"
+
+const countAuditStmt string = "SELECT COUNT(*) FROM audit_log" + auditFilter
+
+const listAuditStmt string = "SELECT recorded_at, actor, client_addr, list, action, domain_name, mode FROM audit_log" + auditFilter + " ORDER BY id DESC LIMIT ? OFFSET ?"
+
+const (
+	auditBlocklist  = "blocklist"
+	auditAllowlist  = "allowlist"
+	auditPatterns   = "patterns"
+	auditKeys       = "keys"
+	auditPolicies   = "policies"
+	auditSchedules  = "schedules"
+	auditBlockPages = "blockpages"
+	auditAdd        = "add"
+	auditRemove     = "remove"
+)
+
+type AuditEntrySchema struct {
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor,omitempty"`
+	ClientAddr string    `json:"clientAddr"`
+	List       string    `json:"list"`
+	Action     string    `json:"action"`
+	Domain     string    `json:"domain"`
+	Mode       string    `json:"mode"`
+}
+
+type AuditSchema struct {
+	Entries []AuditEntrySchema `json:"entries"`
+	Page
+}
+
+// audit records the change in the transaction if it is made by a request.
+func audit(ctx context.Context, tx *sql.Tx, list string, entry DomainEntry, removal bool) error {
+	addr, ok := ctx.Value(clientAddrKey{}).(netip.Addr)
+	if !ok {
+		return nil
+	}
+	actor, _ := ctx.Value(apiKeyNameKey{}).(string)
+	action := auditAdd
+	if removal {
+		action = auditRemove
+	}
+	client, err := sealField(FieldClientAddr, addr.String())
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, insertAuditStmt, time.Now().Unix(), actor, client, list, action, entry.Domain, entry.Mode)
+	return err
+}
+
+// auditAll records the changes of the entries like audit, with a statement
+// for every batch of them.
+func auditAll(ctx context.Context, tx *sql.Tx, list string, entries []DomainEntry, removal bool) error {
+	addr, ok := ctx.Value(clientAddrKey{}).(netip.Addr)
+	if !ok {
+		return nil
+	}
+	actor, _ := ctx.Value(apiKeyNameKey{}).(string)
+	action := auditAdd
+	if removal {
+		action = auditRemove
+	}
+	client, err := sealField(FieldClientAddr, addr.String())
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for start := 0; start < len(entries); start += insertBatchSize {
+		batch := entries[start:min(start+insertBatchSize, len(entries))]
+		args := make([]any, 0, len(batch)*7)
+		for _, entry := range batch {
+			args = append(args, now, actor, client, list, action, entry.Domain, entry.Mode)
+		}
+		if _, err := tx.ExecContext(ctx, insertAuditRowsStmt+valuesList(len(batch), 7), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditHandler serves GET /audit, filtered by the name of the API key, the
+// domain and the time of the change. The latest changes come first.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	page, apiErr := parsePage(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	since, apiErr := queryTime(r, "since", time.Unix(0, 0))
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	until, apiErr := queryTime(r, "until", time.Now())
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	actor := r.URL.Query().Get("actor")
+	domain := r.URL.Query().Get("domain")
+	if domain != "" {
+		normalized, err := normalizeDomain(domain)
+		if err != nil {
+			respondWithError(w, &APIError{
+				Code:       CodeInvalidParameter,
+				Status:     "error",
+				StatusCode: http.StatusBadRequest,
+				Message:    localize(r, "Domain \"%s\" is invalid: %v.", domain, err),
+			})
+			return
+		}
+		domain = normalized
+	}
+	args := []any{actor, actor, domain, domain, since.Unix(), until.Unix()}
+
+	tx, err := db.BeginTx(r.Context(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	schema := AuditSchema{Entries: []AuditEntrySchema{}, Page: page}
+	if err := tx.QueryRow(countAuditStmt, args...).Scan(&schema.Total); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	rows, err := tx.Query(listAuditStmt, append(args, schema.Limit, schema.Offset)...)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry AuditEntrySchema
+		var recordedAt int64
+		if err := rows.Scan(&recordedAt, &entry.Actor, &entry.ClientAddr, &entry.List, &entry.Action, &entry.Domain, &entry.Mode); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if entry.ClientAddr, err = openField(FieldClientAddr, entry.ClientAddr); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		entry.Time = time.Unix(recordedAt, 0).UTC()
+		schema.Entries = append(schema.Entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	respondWithPage(w, r, &schema.Page, &schema)
+}
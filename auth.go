@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var apiKeys *string = flag.String("api-keys", "", "comma-separated name:key pairs; the API requires one of the keys as a bearer token (no authentication if empty)")
+
+var publicCheck *bool = flag.Bool("public-check", false, "serve GET /domains/check without authentication, rate limited per client")
+
+var publicCheckRate *int = flag.Int("public-check-rate", 30, "requests a minute a client may send to the public /domains/check")
+
+// Paths served without a key. Probes can't be expected to hold one.
+var unauthenticatedPaths = map[string]bool{
+	"/readyz":       true,
+	"/openapi.json": true,
+	// The admin UI asks for a key itself.
+	"/ui":           true,
+	"/ui/":          true,
+	"/ui/app.js":    true,
+	"/ui/style.css": true,
+}
+
+const publicCheckPath = "/domains/check"
+
+// isPublicCheck reports whether the request is a single check, which
+// -public-check serves without authentication. Batches of names stay
+// authenticated, as the limiter counts requests rather than names.
+func isPublicCheck(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.URL.Path == publicCheckPath
+}
+
+type apiKey struct {
+	name string
+	key  string
+}
+
+type apiKeyNameKey struct{}
+
+// parseAPIKeys parses "name:key" pairs. The names identify who used the
+// API; the keys are the secrets.
+func parseAPIKeys(list string) ([]apiKey, error) {
+	keys := make([]apiKey, 0)
+	names := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		name, key, ok := strings.Cut(item, ":")
+		if !ok || name == "" || key == "" {
+			return nil, errors.New("excepted name:key pairs")
+		}
+		// Issued keys are named after their owner and a "#".
+		if strings.Contains(name, "#") {
+			return nil, errors.New("key name \"" + name + "\" can't contain \"#\"")
+		}
+		if names[name] {
+			return nil, errors.New("key \"" + name + "\" is given twice")
+		}
+		names[name] = true
+		keys = append(keys, apiKey{name: name, key: key})
+	}
+	return keys, nil
+}
+
+// apiKeyName returns the name of the key the request was authenticated
+// with, or "" if it wasn't.
+func apiKeyName(r *http.Request) string {
+	name, _ := r.Context().Value(apiKeyNameKey{}).(string)
+	return name
+}
+
+// authenticate returns the name of the key in the Authorization header.
+func authenticate(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	return apiKeyring.authenticate(token, time.Now())
+}
+
+// withAuth requires a key for every request once keys are configured. With
+// -public-check, /domains/check is served to anyone instead, rate limited
+// per client address.
+func withAuth(keys []apiKey, public limiter, next http.Handler) http.Handler {
+	if len(keys) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name, ok := authenticate(r); ok {
+			keyUsage.used(name)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyNameKey{}, name)))
+			return
+		}
+		if unauthenticatedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if public != nil && isPublicCheck(r) {
+			if ok, retry := public.allow(clientAddr(r).String()); !ok {
+				respondWithError(w, tooManyRequests(w, r, retry))
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		events.publish(Event{Type: EventAuthFailed, Client: clientAddr(r).String()})
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		respondWithError(w, &APIError{
+			Code:       CodeUnauthorized,
+			Status:     "error",
+			StatusCode: http.StatusUnauthorized,
+			Message:    localize(r, "Excepted a valid API key as a bearer token."),
+		})
+	})
+}
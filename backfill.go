@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const entryOriginStmt string = "SELECT origin FROM blocked_domains WHERE domain_name = ?"
+
+// Formats of the lists a device can be backfilled from.
+const (
+	backfillHosts  = "hosts"
+	backfillUBlock = "ublock"
+	backfillJSON   = "json"
+)
+
+const maxDeviceLength = 64
+
+// entryOrigin returns the device the stored entry was backfilled from, or
+// "" if it wasn't.
+func entryOrigin(r *http.Request, domain string) (string, error) {
+	var origin string
+	err := db.QueryRowContext(r.Context(), entryOriginStmt, domain).Scan(&origin)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return origin, err
+}
+
+// parseBackfillHostsLine parses a line of the hosts file of a device. Only
+// names mapped to an unspecified or loopback address are blocked; the
+// others are the device's own names for hosts on its network.
+func parseBackfillHostsLine(line string) ([]DomainEntry, EntryNote, bool) {
+	rule, _ := parseInlineComment(strings.TrimSpace(line))
+	if fields := strings.Fields(rule); len(fields) >= 2 {
+		if addr, err := netip.ParseAddr(fields[0]); err == nil && !addr.IsUnspecified() && !addr.IsLoopback() {
+			return nil, EntryNote{}, true
+		}
+	}
+	return parseImportLine(line)
+}
+
+// parseBackfillItem parses an item of a browser extension's site list: a
+// name, a URL or a match pattern like "*://*.example.com/*", where "*."
+// blocks the subdomains as well.
+func parseBackfillItem(item string) (DomainEntry, bool) {
+	item = strings.TrimSpace(item)
+	if _, rest, ok := strings.Cut(item, "://"); ok {
+		item = rest
+	}
+	item, _, _ = strings.Cut(item, "/")
+	if at := strings.LastIndex(item, "@"); at != -1 {
+		item = item[at+1:]
+	}
+	if host, _, err := net.SplitHostPort(item); err == nil {
+		item = host
+	}
+	entry := DomainEntry{Domain: item, Mode: ModeExact}
+	if name, ok := strings.CutPrefix(item, "*."); ok {
+		entry = DomainEntry{Domain: name, Mode: ModeSubdomain}
+	}
+	if entry.normalize() != nil {
+		return DomainEntry{}, false
+	}
+	return entry, true
+}
+
+// backfillItems parses the JSON site list of a browser extension: an array
+// of names, URLs or objects holding one under "url", "domain", "hostname" or
+// "host".
+func backfillItems(r *http.Request, list *importedList, raw []json.RawMessage) {
+	for i, item := range raw {
+		var site string
+		if json.Unmarshal(item, &site) != nil {
+			var fields map[string]any
+			json.Unmarshal(item, &fields)
+			for _, key := range []string{"url", "domain", "hostname", "host"} {
+				if value, ok := fields[key].(string); ok {
+					site = value
+					break
+				}
+			}
+		}
+		entry, ok := parseBackfillItem(site)
+		if !ok {
+			list.reject(r, i+1, string(item))
+			continue
+		}
+		list.add([]DomainEntry{entry}, EntryNote{})
+	}
+}
+
+// backfillHandler serves POST /domains/backfill?device=, which merges the
+// blocking a device did on its own into the blocklist, so it can move to
+// the proxy. It takes the device's hosts file as text/plain, or as
+// application/json a uBlock Origin backup or the site list of a blocking
+// extension. The entries added are attributed to the device.
+func backfillHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensurePOST(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if err := ensureMediaType(r, "text/plain", "application/json"); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	device := strings.TrimSpace(r.URL.Query().Get("device"))
+	if device == "" {
+		respondWithError(w, &APIError{Code: CodeMissingParameter, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Parameter \"%s\" wasn't provided in the query!", "device")})
+		return
+	}
+	if len(device) > maxDeviceLength || strings.ContainsFunc(device, func(c rune) bool { return c < ' ' || c == 0x7f }) {
+		respondWithError(w, &APIError{Code: CodeInvalidParameter, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Device must be at most %d printable characters long.", maxDeviceLength)})
+		return
+	}
+
+	list := newImportedList()
+	format := backfillHosts
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "text/plain" {
+		if err := list.scan(r, r.Body, parseBackfillHostsLine); err != nil {
+			respondWithError(w, err)
+			return
+		}
+	} else {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			respondWithError(w, &APIError{Code: CodeInvalidBody, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Reading of the list failed: %v.", err)})
+			return
+		}
+		var backup struct {
+			UserFilters *string `json:"userFilters"`
+		}
+		var items []json.RawMessage
+		switch {
+		case json.Unmarshal(body, &backup) == nil && backup.UserFilters != nil:
+			format = backfillUBlock
+			// Cosmetic and other filters the proxy can't enforce are
+			// reported as unsupported lines.
+			list.scan(r, strings.NewReader(*backup.UserFilters), parseImportLine)
+		case json.Unmarshal(body, &items) == nil:
+			format = backfillJSON
+			backfillItems(r, list, items)
+		default:
+			respondWithError(w, &APIError{Code: CodeInvalidJSON, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted a uBlock Origin backup or an array of sites; got invalid JSON.")})
+			return
+		}
+	}
+	list.merge(w, r, format+":"+device)
+}
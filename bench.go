@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request kinds of the -mix flag of "proxy bench".
+var benchKinds = []string{"check", "http", "connect", "socks", "dns"}
+
+// maxBenchInFlight bounds the requests waiting for a response, so an
+// overloaded instance slows the benchmark down instead of piling up
+// goroutines.
+const maxBenchInFlight = 1000
+
+type benchWeight struct {
+	kind   string
+	weight int
+}
+
+// parseMix parses "check=60,dns=40" into weights of the request kinds.
+func parseMix(mix string) ([]benchWeight, int, error) {
+	weights := make([]benchWeight, 0)
+	total := 0
+	for _, part := range strings.Split(mix, ",") {
+		kind, weightText, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			return nil, 0, fmt.Errorf("excepted kind=weight, got: \"%s\"", part)
+		}
+		if !slices.Contains(benchKinds, kind) {
+			return nil, 0, fmt.Errorf("unknown kind \"%s\"; excepted one of %s", kind, strings.Join(benchKinds, ", "))
+		}
+		weight, err := strconv.Atoi(weightText)
+		if err != nil || weight < 0 {
+			return nil, 0, fmt.Errorf("weight of \"%s\" must be a non-negative integer", kind)
+		}
+		weights = append(weights, benchWeight{kind: kind, weight: weight})
+		total += weight
+	}
+	if total == 0 {
+		return nil, 0, fmt.Errorf("mix has no weight")
+	}
+	return weights, total, nil
+}
+
+type benchStats struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+}
+
+func (s *benchStats) record(kind string, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors[kind]++
+		return
+	}
+	s.latencies[kind] = append(s.latencies[kind], latency)
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[min(len(sorted)-1, int(float64(len(sorted))*p))]
+}
+
+func (s *benchStats) report(w io.Writer, elapsed time.Duration) {
+	fmt.Fprintf(w, "%-8s %8s %8s %7s %10s %10s %10s %10s\n", "kind", "requests", "errors", "err%", "p50", "p90", "p99", "max")
+	total := 0
+	for _, kind := range benchKinds {
+		latencies, errors := s.latencies[kind], s.errors[kind]
+		requests := len(latencies) + errors
+		total += requests
+		if requests == 0 {
+			continue
+		}
+		slices.Sort(latencies)
+		fmt.Fprintf(w, "%-8s %8d %8d %6.1f%% %10s %10s %10s %10s\n", kind, requests, errors,
+			100*float64(errors)/float64(requests),
+			percentile(latencies, 0.5).Round(time.Microsecond), percentile(latencies, 0.9).Round(time.Microsecond),
+			percentile(latencies, 0.99).Round(time.Microsecond), percentile(latencies, 1).Round(time.Microsecond))
+	}
+	fmt.Fprintf(w, "%d requests in %s, %.1f/s\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+}
+
+// runBench sends a weighted mix of requests at a fixed rate to a running
+// instance and reports latency percentiles and error rates per kind. It
+// returns the exit status.
+func runBench(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	apiAddress := flags.String("api", "127.0.0.1:8000", "address of the API")
+	proxy := flags.String("proxy", "127.0.0.1:8080", "address of the HTTP proxy")
+	socks := flags.String("socks", "", "address of the SOCKS5 proxy")
+	rpz := flags.String("rpz", "", "address of the RPZ server")
+	zone := flags.String("rpz-zone", "rpz.local.", "name of the RPZ zone")
+	qps := flags.Int("qps", 100, "requests per second")
+	duration := flags.Duration("duration", 10*time.Second, "duration of the benchmark")
+	mix := flags.String("mix", "check=1", "comma-separated weights of the request kinds ("+strings.Join(benchKinds, ", ")+")")
+	domains := flags.String("domains", "example.com", "comma-separated names the requests pick from")
+	key := flags.String("api-key", "", "API key sent as a bearer token")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	weights, total, err := parseMix(*mix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-mix: %v\n", err)
+		return 2
+	}
+	if *qps <= 0 {
+		fmt.Fprintln(os.Stderr, "-qps must be positive")
+		return 2
+	}
+	bound := boundAddresses{API: *apiAddress, Proxy: *proxy, Socks: *socks, RPZ: *rpz}
+	for _, w := range weights {
+		if w.weight != 0 && benchAddress(bound, w.kind) == "" {
+			fmt.Fprintf(os.Stderr, "-mix: \"%s\" requests need the address of their service\n", w.kind)
+			return 2
+		}
+	}
+	*rpzZone = *zone
+	names := strings.Split(*domains, ",")
+
+	runner := &scenarioRunner{
+		bound:  bound,
+		client: &http.Client{Timeout: scenarioTimeout, Transport: &http.Transport{MaxIdleConnsPerHost: maxBenchInFlight}},
+		apiKey: *key,
+	}
+	stats := &benchStats{latencies: make(map[string][]time.Duration), errors: make(map[string]int)}
+	inFlight := make(chan struct{}, maxBenchInFlight)
+	var wg sync.WaitGroup
+
+	ticker := time.NewTicker(time.Second / time.Duration(*qps))
+	defer ticker.Stop()
+	start := time.Now()
+	for time.Since(start) < *duration {
+		<-ticker.C
+		pick := rand.Intn(total)
+		kind := weights[0].kind
+		for _, w := range weights {
+			if pick < w.weight {
+				kind = w.kind
+				break
+			}
+			pick -= w.weight
+		}
+		name := strings.TrimSpace(names[rand.Intn(len(names))])
+
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-inFlight
+				wg.Done()
+			}()
+			began := time.Now()
+			err := runner.benchRequest(kind, name)
+			stats.record(kind, time.Since(began), err)
+		}()
+	}
+	wg.Wait()
+	stats.report(os.Stdout, time.Since(start))
+	return 0
+}
+
+func benchAddress(bound boundAddresses, kind string) string {
+	switch kind {
+	case "check":
+		return bound.API
+	case "http", "connect":
+		return bound.Proxy
+	case "socks":
+		return bound.Socks
+	}
+	return bound.RPZ
+}
+
+// benchRequest makes a single request of the kind. Decisions don't count
+// as errors, only requests that failed to complete do.
+func (r *scenarioRunner) benchRequest(kind string, name string) error {
+	var err error
+	switch kind {
+	case "check":
+		_, err = r.check(name)
+	case "http":
+		_, err = r.http(name)
+	case "connect":
+		_, err = r.connect(name + ":443")
+	case "socks":
+		_, err = r.socks(name + ":443")
+	case "dns":
+		_, err = r.queryRPZ(name)
+	}
+	return err
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const selectBlockPagesStmt string = "SELECT category, template, updated_at FROM block_pages ORDER BY category"
+
+const updateBlockPageStmt string = "UPDATE block_pages SET template = ?, updated_at = ? WHERE category = ?"
+
+const insertBlockPageStmt string = "INSERT INTO block_pages(category, template, updated_at) VALUES (?, ?, ?)"
+
+const deleteBlockPageStmt string = "DELETE FROM block_pages WHERE category = ?"
+
+const (
+	defaultBlockPage = "default"
+	// Largest template kept, which fits a MEDIUMTEXT of MySQL with room.
+	maxBlockPageSize = 256 << 10
+	// Name the preview is rendered for without ?domain.
+	previewDomain = "example.com"
+)
+
+// BlockPageData is what the templates are executed with, like
+// {{.Domain}}.
+type BlockPageData struct {
+	Domain   string
+	Category string
+	Client   string
+	URL      string
+	Time     time.Time
+}
+
+type BlockPageSchema struct {
+	Category  string    `json:"category"`
+	Size      int       `json:"size"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type BlockPagesSchema struct {
+	Pages []BlockPageSchema `json:"pages"`
+}
+
+type blockPage struct {
+	schema   BlockPageSchema
+	source   string
+	template *template.Template
+}
+
+type blockPageSet struct {
+	mu    sync.RWMutex
+	pages map[string]*blockPage
+}
+
+var blockPages = &blockPageSet{pages: make(map[string]*blockPage)}
+
+func parseBlockPage(category string, source string) (*template.Template, error) {
+	return template.New(category).Option("missingkey=error").Parse(source)
+}
+
+func (s *blockPageSet) load() error {
+	rows, err := db.Query(selectBlockPagesStmt)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	pages := make(map[string]*blockPage)
+	for rows.Next() {
+		page := &blockPage{}
+		var updatedAt int64
+		if err := rows.Scan(&page.schema.Category, &page.source, &updatedAt); err != nil {
+			return err
+		}
+		page.schema.Size = len(page.source)
+		page.schema.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+		if page.template, err = parseBlockPage(page.schema.Category, page.source); err != nil {
+			// Templates are parsed when uploaded, so this one was stored
+			// by hand; it is skipped rather than failing the service.
+			continue
+		}
+		pages[page.schema.Category] = page
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pages = pages
+	return nil
+}
+
+func (s *blockPageSet) find(category string) *blockPage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pages[category]
+}
+
+// forName returns the page of the first category of the entry blocking the
+// name that has one, or else the default page, if any, along with the
+// category shown.
+func (s *blockPageSet) forName(name string) (*blockPage, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.pages) == 0 {
+		return nil, ""
+	}
+	var list []string
+	if entry := matchBlocked(name); entry != nil {
+		list = categories.of(entry.Domain)
+	}
+	for _, category := range list {
+		if page := s.pages[category]; page != nil {
+			return page, category
+		}
+	}
+	if len(list) != 0 {
+		return s.pages[defaultBlockPage], list[0]
+	}
+	return s.pages[defaultBlockPage], ""
+}
+
+// render executes the page into a buffer first, so a failing template
+// doesn't leave a partial response.
+func (page *blockPage) render(w http.ResponseWriter, status int, data BlockPageData) error {
+	var buf bytes.Buffer
+	if err := page.template.Execute(&buf, data); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// serve answers the blocked request of a browser with its block page. It
+// reports whether it did; a request through a tunnel, of another client or
+// without a page is left to the caller.
+func (s *blockPageSet) serve(w http.ResponseWriter, r *http.Request, client netip.Addr, hostname string) bool {
+	if r.Method == http.MethodConnect || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return false
+	}
+	name := lookupName(hostname)
+	page, category := s.forName(name)
+	if page == nil {
+		return false
+	}
+	data := BlockPageData{Domain: name, Category: category, Client: client.String(), URL: r.URL.String(), Time: time.Now()}
+	if err := page.render(w, http.StatusForbidden, data); err != nil {
+		slog.Warn("Rendering of the block page failed", "category", page.schema.Category, "error", err)
+		return false
+	}
+	return true
+}
+
+func (s *blockPageSet) schema() BlockPagesSchema {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	schema := BlockPagesSchema{Pages: make([]BlockPageSchema, 0, len(s.pages))}
+	for _, page := range s.pages {
+		schema.Pages = append(schema.Pages, page.schema)
+	}
+	slices.SortFunc(schema.Pages, func(a, b BlockPageSchema) int {
+		return strings.Compare(a.Category, b.Category)
+	})
+	return schema
+}
+
+// blockPageCategory validates the category of the path, which is
+// "default" for the default page.
+func blockPageCategory(r *http.Request) (string, *APIError) {
+	category := strings.ToLower(r.PathValue("category"))
+	if category == defaultBlockPage {
+		return category, nil
+	}
+	if err := validateCategory(category); err != nil {
+		return "", &APIError{Code: CodeInvalidCategory, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Category \"%s\" is invalid: %v.", category, err)}
+	}
+	return category, nil
+}
+
+func blockPageNotFound(r *http.Request, category string) *APIError {
+	return &APIError{Code: CodeBlockPageNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "Block page \"%s\" doesn't exist.", category)}
+}
+
+// blockPagesHandler serves GET /blockpages.
+func blockPagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	respondWithJSON(w, blockPages.schema())
+}
+
+// blockPageHandler serves GET, PUT and DELETE /blockpages/{category}.
+func blockPageHandler(w http.ResponseWriter, r *http.Request) {
+	category, apiErr := blockPageCategory(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		page := blockPages.find(category)
+		if page == nil {
+			respondWithError(w, blockPageNotFound(r, category))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, page.source)
+	case http.MethodPut:
+		saveBlockPage(w, r, category)
+	case http.MethodDelete:
+		removeBlockPage(w, r, category)
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, PUT, DELETE"))
+	}
+}
+
+func saveBlockPage(w http.ResponseWriter, r *http.Request, category string) {
+	if err := ensureMediaType(r, "text/html"); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBlockPageSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondWithError(w, &APIError{Code: CodeInvalidBody, Status: "error", StatusCode: http.StatusRequestEntityTooLarge, Message: localize(r, "Excepted at most %d bytes.", tooLarge.Limit)})
+			return
+		}
+		respondWithInternalError(w, r, err)
+		return
+	}
+	source := string(data)
+	if _, err := parseBlockPage(category, source); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidBlockPage, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Block page is invalid: %v.", err)})
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	created, err := storeBlockPage(tx, category, source, now.Unix())
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := audit(r.Context(), tx, auditBlockPages, DomainEntry{Domain: category}, false); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := blockPages.load(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(BlockPageSchema{Category: category, Size: len(source), UpdatedAt: now})
+}
+
+// storeBlockPage replaces the page of the category or adds it, reporting
+// whether it was added.
+func storeBlockPage(tx *sql.Tx, category string, source string, now int64) (bool, error) {
+	result, err := tx.Exec(updateBlockPageStmt, source, now, category)
+	if err != nil {
+		return false, err
+	}
+	if rows, _ := result.RowsAffected(); rows != 0 {
+		return false, nil
+	}
+	_, err = tx.Exec(insertBlockPageStmt, category, source, now)
+	if isUniqueConstraintError(err) {
+		// MySQL doesn't count a row the update left as it was.
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func removeBlockPage(w http.ResponseWriter, r *http.Request, category string) {
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(deleteBlockPageStmt, category)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		respondWithError(w, blockPageNotFound(r, category))
+		return
+	}
+	if err := audit(r.Context(), tx, auditBlockPages, DomainEntry{Domain: category}, true); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := blockPages.load(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	respondWithError(w, &APIError{Code: CodeOK, StatusCode: http.StatusOK, Message: localize(r, "Succesfully removed the block page."), Status: "success"})
+}
+
+// blockPagePreviewHandler serves GET /blockpages/{category}/preview, the
+// page as a browser asking for ?domain would see it.
+func blockPagePreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	category, apiErr := blockPageCategory(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	page := blockPages.find(category)
+	if page == nil {
+		respondWithError(w, blockPageNotFound(r, category))
+		return
+	}
+	name := previewDomain
+	if domain := r.URL.Query().Get("domain"); domain != "" {
+		var apiErr *APIError
+		if name, apiErr = checkedDomain(r, domain); apiErr != nil {
+			respondWithError(w, apiErr)
+			return
+		}
+	}
+	client, _ := r.Context().Value(clientAddrKey{}).(netip.Addr)
+	data := BlockPageData{Domain: name, Client: client.String(), URL: "http://" + name + "/", Time: time.Now()}
+	if category != defaultBlockPage {
+		data.Category = category
+	}
+	if err := page.render(w, http.StatusOK, data); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidBlockPage, Status: "error", StatusCode: http.StatusUnprocessableEntity, Message: localize(r, "Block page is invalid: %v.", err)})
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxBulkCheckSize = 1 << 30
+	bulkJobRetention = 24 * time.Hour
+)
+
+const (
+	BulkJobRunning = "running"
+	BulkJobDone    = "done"
+	BulkJobFailed  = "failed"
+)
+
+type BulkJobSchema struct {
+	ID       string     `json:"id"`
+	Status   string     `json:"status"`
+	Checked  int        `json:"checked"`
+	Blocked  int        `json:"blocked"`
+	Error    string     `json:"error,omitempty"`
+	Results  string     `json:"results,omitempty"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+type bulkJob struct {
+	BulkJobSchema
+	results string
+}
+
+// bulkJobs keeps the jobs in memory. They are forgotten on restart and
+// bulkJobRetention after they finish, together with their result files.
+var bulkJobs = struct {
+	sync.Mutex
+	jobs map[string]*bulkJob
+}{jobs: make(map[string]*bulkJob)}
+
+// bulkCheckHandler spools the uploaded list to a temporary file and checks
+// it in the background, as a list of millions of domains takes longer than
+// a client would wait for a response.
+func bulkCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, unexceptedMethod(r, http.MethodPost))
+		return
+	}
+	if err := ensureMediaType(r, "text/plain", "text/csv"); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	upload, err := os.CreateTemp("", "proxy-bulk-*.txt")
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	_, err = io.Copy(upload, http.MaxBytesReader(w, r.Body, maxBulkCheckSize))
+	if err == nil {
+		_, err = upload.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		upload.Close()
+		os.Remove(upload.Name())
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondWithError(w, &APIError{
+				Code:       CodeInvalidBody,
+				Status:     "error",
+				StatusCode: http.StatusRequestEntityTooLarge,
+				Message:    localize(r, "Excepted at most %d bytes.", tooLarge.Limit),
+			})
+			return
+		}
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	job := &bulkJob{BulkJobSchema: BulkJobSchema{ID: newRequestID(), Status: BulkJobRunning, Created: time.Now().UTC()}}
+	bulkJobs.Lock()
+	bulkJobs.jobs[job.ID] = job
+	bulkJobs.Unlock()
+	go job.run(upload)
+
+	w.Header().Set("Location", "/domains/check/bulk/"+job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job.schema())
+}
+
+func (job *bulkJob) schema() BulkJobSchema {
+	bulkJobs.Lock()
+	defer bulkJobs.Unlock()
+	return job.BulkJobSchema
+}
+
+// run checks every domain of the upload, which it removes afterwards, and
+// writes a "domain,blocked,rule,mode" line per domain to the results.
+func (job *bulkJob) run(upload *os.File) {
+	defer os.Remove(upload.Name())
+	defer upload.Close()
+
+	results, err := os.CreateTemp("", "proxy-bulk-*.csv")
+	if err == nil {
+		err = job.check(upload, results)
+		if closeErr := results.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	bulkJobs.Lock()
+	finished := time.Now().UTC()
+	job.Finished = &finished
+	if err != nil {
+		slog.Error("Bulk check failed", "job", job.ID, "error", err)
+		job.Status, job.Error = BulkJobFailed, err.Error()
+		if results != nil {
+			os.Remove(results.Name())
+		}
+	} else {
+		job.Status, job.results = BulkJobDone, results.Name()
+		job.Results = "/domains/check/bulk/" + job.ID + "/results"
+	}
+	bulkJobs.Unlock()
+
+	time.AfterFunc(bulkJobRetention, func() {
+		bulkJobs.Lock()
+		delete(bulkJobs.jobs, job.ID)
+		bulkJobs.Unlock()
+		if job.results != "" {
+			os.Remove(job.results)
+		}
+	})
+}
+
+// check reads the domain from the first column of every line, so both
+// plain lists and CSV exports of inventories work. A "domain" header and
+// "#" comments are skipped.
+func (job *bulkJob) check(upload io.Reader, results io.Writer) error {
+	reader := csv.NewReader(bufio.NewReader(upload))
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	reader.LazyQuotes = true
+	reader.ReuseRecord = true
+
+	buffered := bufio.NewWriter(results)
+	writer := csv.NewWriter(buffered)
+	writer.Write([]string{"domain", "blocked", "rule", "mode"})
+
+	first := true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := lookupName(strings.TrimSpace(record[0]))
+		if name == "" || first && name == "domain" {
+			first = false
+			continue
+		}
+		first = false
+
+		row := []string{name, "false", "", ""}
+		entry := blockingEntry(name)
+		if entry != nil {
+			row = []string{name, "true", entry.Domain, string(entry.Mode)}
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+
+		bulkJobs.Lock()
+		job.Checked++
+		if entry != nil {
+			job.Blocked++
+		}
+		bulkJobs.Unlock()
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+func findBulkJob(w http.ResponseWriter, r *http.Request) *bulkJob {
+	bulkJobs.Lock()
+	job, ok := bulkJobs.jobs[r.PathValue("id")]
+	bulkJobs.Unlock()
+	if !ok {
+		respondWithError(w, &APIError{
+			Code:       CodeJobNotFound,
+			Status:     "error",
+			StatusCode: http.StatusNotFound,
+			Message:    localize(r, "Job \"%s\" doesn't exist.", r.PathValue("id")),
+		})
+		return nil
+	}
+	return job
+}
+
+func bulkJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	if job := findBulkJob(w, r); job != nil {
+		respondWithJSON(w, job.schema())
+	}
+}
+
+func bulkResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	job := findBulkJob(w, r)
+	if job == nil {
+		return
+	}
+	if schema := job.schema(); schema.Status != BulkJobDone {
+		respondWithError(w, &APIError{
+			Code:       CodeJobNotFinished,
+			Status:     "error",
+			StatusCode: http.StatusConflict,
+			Message:    localize(r, "Results of job \"%s\" aren't available; its status is \"%s\".", schema.ID, schema.Status),
+		})
+		return
+	}
+
+	results, err := os.Open(job.results)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer results.Close()
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"bulk-check-"+job.ID+".csv\"")
+	if info, err := results.Stat(); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	}
+	io.Copy(w, results)
+}
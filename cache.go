@@ -0,0 +1,255 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+)
+
+// suffixNode is a node of a trie keyed by the labels of a name from right
+// to left, so "ads.example.com" lives under "com" -> "example" -> "ads".
+type suffixNode struct {
+	children  map[string]*suffixNode
+	subdomain bool
+}
+
+// memoryBlocklist mirrors a table of entries, so checks never hit the
+// database: blocked_domains with feed_domains, updated by changeTx when a
+// change is committed, or allowed_domains. With a memory budget, the exact
+// entries it can't fit are looked up in the database instead.
+type memoryBlocklist struct {
+	query     string
+	mu        sync.RWMutex
+	exact     map[string]bool
+	suffixes  suffixNode
+	wildcards []string
+
+	// Estimates of the memory the entries take, by mode.
+	exactBytes, suffixBytes, wildcardBytes int64
+	// budget is the bytes the entries may take, or 0 if unlimited, and
+	// lookup the query selecting an exact entry by name once they don't
+	// fit. Until the next load, spilled mirrors then keep the exact ones
+	// only in lookups.
+	budget  int64
+	lookup  string
+	spilled bool
+	lookups *lookupCache
+
+	// hot keeps the matches of the most checked names, or is nil. They
+	// are valid as long as generation, bumped by every change, is the
+	// same.
+	hot        *hotSet
+	generation uint64
+
+	// warm is closed once the blocklist was loaded for the first time.
+	warm     chan struct{}
+	warmOnce sync.Once
+}
+
+const selectAllStmt string = "SELECT domain_name, mode FROM " + allEntries
+
+// The manual entries only, without those the sources manage.
+const selectManualStmt string = "SELECT domain_name, mode FROM blocked_domains"
+
+var blocklist = newMemoryBlocklist(selectAllStmt)
+
+// newMemoryBlocklist returns an empty blocklist loaded by the query, which
+// selects the name and the mode of the entries.
+func newMemoryBlocklist(query string) *memoryBlocklist {
+	return &memoryBlocklist{query: query, exact: make(map[string]bool), warm: make(chan struct{})}
+}
+
+// load replaces the contents of the blocklist with the database ones. The
+// blocklist stays locked meanwhile, so commits can't slip in between.
+func (b *memoryBlocklist) load() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rows, err := db.Query(b.query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	fresh := newMemoryBlocklist(b.query)
+	fresh.budget, fresh.lookup = b.budget, b.lookup
+	for rows.Next() {
+		var entry DomainEntry
+		if err := rows.Scan(&entry.Domain, &entry.Mode); err != nil {
+			return err
+		}
+		fresh.add(entry)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	b.exact, b.suffixes, b.wildcards = fresh.exact, fresh.suffixes, fresh.wildcards
+	b.exactBytes, b.suffixBytes, b.wildcardBytes = fresh.exactBytes, fresh.suffixBytes, fresh.wildcardBytes
+	b.spilled, b.lookups = fresh.spilled, nil
+	b.generation++
+	if b.spilled {
+		b.lookups = newLookupCache(b.budget - b.suffixBytes - b.wildcardBytes)
+	}
+	b.warmOnce.Do(func() { close(b.warm) })
+	return nil
+}
+
+// add and remove must be called with mu held for writing.
+func (b *memoryBlocklist) add(entry DomainEntry) {
+	b.generation++
+	switch entry.Mode {
+	case ModeExact:
+		if b.spilled {
+			b.lookups.update(entry.Domain, true)
+			return
+		}
+		if !b.exact[entry.Domain] {
+			b.exactBytes += exactEntryBytes(entry.Domain)
+		}
+		b.exact[entry.Domain] = true
+		if b.budget > 0 && b.exactBytes+b.suffixBytes+b.wildcardBytes > b.budget {
+			b.spill()
+		}
+	case ModeSubdomain:
+		b.suffixBytes += suffixEntryBytes(entry.Domain)
+		node := &b.suffixes
+		for _, label := range reversedLabels(entry.Domain) {
+			child, ok := node.children[label]
+			if !ok {
+				if node.children == nil {
+					node.children = make(map[string]*suffixNode)
+				}
+				child = &suffixNode{}
+				node.children[label] = child
+			}
+			node = child
+		}
+		node.subdomain = true
+	case ModeWildcard:
+		b.wildcardBytes += wildcardEntryBytes(entry.Domain)
+		b.wildcards = append(b.wildcards, entry.Domain)
+	}
+}
+
+func (b *memoryBlocklist) remove(entry DomainEntry) {
+	b.generation++
+	switch entry.Mode {
+	case ModeExact:
+		if b.spilled {
+			b.lookups.update(entry.Domain, false)
+			return
+		}
+		if b.exact[entry.Domain] {
+			b.exactBytes -= exactEntryBytes(entry.Domain)
+		}
+		delete(b.exact, entry.Domain)
+	case ModeSubdomain:
+		b.suffixBytes = max(b.suffixBytes-suffixEntryBytes(entry.Domain), 0)
+		removeSuffix(&b.suffixes, reversedLabels(entry.Domain))
+	case ModeWildcard:
+		for i, pattern := range b.wildcards {
+			if pattern == entry.Domain {
+				b.wildcardBytes -= wildcardEntryBytes(entry.Domain)
+				b.wildcards = append(b.wildcards[:i], b.wildcards[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// removeSuffix unmarks the name and prunes the nodes left empty. It
+// reports whether the node itself became empty.
+func removeSuffix(node *suffixNode, labels []string) bool {
+	if len(labels) == 0 {
+		node.subdomain = false
+	} else if child, ok := node.children[labels[0]]; ok && removeSuffix(child, labels[1:]) {
+		delete(node.children, labels[0])
+	}
+	return !node.subdomain && len(node.children) == 0
+}
+
+// match returns the most specific entry blocking the name, or nil if the
+// name isn't blocked. Before the first load it waits instead of answering
+// from an empty list.
+func (b *memoryBlocklist) match(name string) *DomainEntry {
+	return b.matchExcept(name, nil)
+}
+
+// matchExcept is match ignoring the entries skip reports, by name. skip
+// may be nil. The match of a hot name ignoring none still answers unless
+// skip reports it, as skipping only ever gives way to a less specific
+// entry.
+func (b *memoryBlocklist) matchExcept(name string, skip func(domain string) bool) *DomainEntry {
+	<-b.warm
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.hot == nil {
+		return b.matchLocked(name, skip)
+	}
+	entry, ok := b.hot.get(name, b.generation)
+	if !ok {
+		entry = b.matchLocked(name, nil)
+		b.hot.put(name, b.generation, entry)
+	}
+	if entry == nil || skip == nil || !skip(entry.Domain) {
+		return entry
+	}
+	return b.matchLocked(name, skip)
+}
+
+// matchLocked must be called with mu held.
+func (b *memoryBlocklist) matchLocked(name string, skip func(domain string) bool) *DomainEntry {
+	skipped := func(domain string) bool {
+		return skip != nil && skip(domain)
+	}
+	if b.hasExact(name) && !skipped(name) {
+		return &DomainEntry{Domain: name, Mode: ModeExact}
+	}
+
+	labels := reversedLabels(name)
+	deepest := ""
+	node := &b.suffixes
+	for i, label := range labels {
+		child, ok := node.children[label]
+		if !ok {
+			break
+		}
+		if child.subdomain {
+			if suffix := joinReversed(labels[:i+1]); !skipped(suffix) {
+				deepest = suffix
+			}
+		}
+		node = child
+	}
+	if deepest != "" {
+		return &DomainEntry{Domain: deepest, Mode: ModeSubdomain}
+	}
+
+	for _, pattern := range b.wildcards {
+		if skipped(pattern) {
+			continue
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return &DomainEntry{Domain: pattern, Mode: ModeWildcard}
+		}
+	}
+	return nil
+}
+
+// joinReversed is the name of labels returned by reversedLabels.
+func joinReversed(labels []string) string {
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[len(labels)-1-i] = label
+	}
+	return strings.Join(parts, ".")
+}
+
+func reversedLabels(name string) []string {
+	labels := strings.Split(name, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const selectCanarySourcesStmt string = "SELECT id, url, canary_until FROM blocklist_sources WHERE canary_until IS NOT NULL"
+
+const selectCanaryEntriesStmt string = "SELECT domain_name, mode FROM canary_entries WHERE source = ?"
+
+const insertCanaryEntryStmt string = "INSERT INTO canary_entries(source, domain_name, mode) VALUES (?, ?, ?)"
+
+const deleteCanaryEntriesStmt string = "DELETE FROM canary_entries WHERE source = ?"
+
+const countCanaryEntriesStmt string = "SELECT COUNT(*) FROM canary_entries WHERE source = ?"
+
+const addCanaryHitsStmt string = "UPDATE canary_hits SET hits = hits + ?, last_seen = CASE WHEN last_seen < ? THEN ? ELSE last_seen END WHERE source = ? AND domain_name = ?"
+
+const insertCanaryHitsStmt string = "INSERT INTO canary_hits(source, domain_name, hits, last_seen) VALUES (?, ?, ?, ?)"
+
+const deleteCanaryHitsStmt string = "DELETE FROM canary_hits WHERE source = ?"
+
+const canaryTotalsStmt string = "SELECT COUNT(*), COALESCE(SUM(hits), 0) FROM canary_hits WHERE source = ?"
+
+const topCanaryHitsStmt string = "SELECT domain_name, hits, last_seen FROM canary_hits WHERE source = ? ORDER BY hits DESC, domain_name LIMIT ?"
+
+const sourceCanaryStmt string = "SELECT url, canary_until FROM blocklist_sources WHERE id = ?"
+
+const promoteSourceStmt string = "UPDATE blocklist_sources SET canary_until = NULL WHERE id = ?"
+
+const (
+	maxCanaryDays         = 90
+	canaryFlushInterval   = 10 * time.Second
+	canaryReportedDomains = 20
+)
+
+type CanaryHitSchema struct {
+	Domain   string    `json:"domain"`
+	Hits     int64     `json:"hits"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// CanaryReportSchema is the impact a source in its canary period would
+// have had: the requests for names it would have blocked, none of which
+// anything else blocks, and the names most requested.
+type CanaryReportSchema struct {
+	ID          int64             `json:"id"`
+	URL         string            `json:"url"`
+	CanaryUntil time.Time         `json:"canaryUntil"`
+	Ended       bool              `json:"ended"`
+	Entries     int               `json:"entries"`
+	Domains     int               `json:"domains"`
+	Hits        int64             `json:"hits"`
+	Top         []CanaryHitSchema `json:"top"`
+}
+
+type canaryFeed struct {
+	id      int64
+	url     string
+	entries *memoryBlocklist
+}
+
+type canaryHit struct {
+	source int64
+	domain string
+}
+
+// canarySet mirrors the entries of the sources in their canary period and
+// counts their hits in memory, like keyUsageTracker.
+type canarySet struct {
+	mu       sync.RWMutex
+	feeds    []*canaryFeed
+	pending  map[canaryHit]int64
+	lastSeen map[canaryHit]int64
+}
+
+var canaries = &canarySet{pending: make(map[canaryHit]int64), lastSeen: make(map[canaryHit]int64)}
+
+func (c *canarySet) load() error {
+	rows, err := db.Query(selectCanarySourcesStmt)
+	if err != nil {
+		return err
+	}
+	feeds := make([]*canaryFeed, 0)
+	for rows.Next() {
+		var feed canaryFeed
+		var until int64
+		if err := rows.Scan(&feed.id, &feed.url, &until); err != nil {
+			rows.Close()
+			return err
+		}
+		feeds = append(feeds, &feed)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, feed := range feeds {
+		rows, err := db.Query(selectCanaryEntriesStmt, feed.id)
+		if err != nil {
+			return err
+		}
+		entries := make([]DomainEntry, 0)
+		for rows.Next() {
+			var entry DomainEntry
+			if err := rows.Scan(&entry.Domain, &entry.Mode); err != nil {
+				rows.Close()
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		feed.entries = newEntrySet(entries)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.feeds = feeds
+	return nil
+}
+
+// observe logs and counts the request for a name nothing blocked if a
+// source in its canary period would have.
+func (c *canarySet) observe(client netip.Addr, host string, via string) {
+	c.mu.RLock()
+	if len(c.feeds) == 0 {
+		c.mu.RUnlock()
+		return
+	}
+	name := lookupName(host)
+	if allowlist.match(name) != nil {
+		c.mu.RUnlock()
+		return
+	}
+	matched := make([]*canaryFeed, 0)
+	for _, feed := range c.feeds {
+		if feed.entries.match(name) != nil {
+			matched = append(matched, feed)
+		}
+	}
+	c.mu.RUnlock()
+
+	for _, feed := range matched {
+		slog.Info("Canary source would have blocked", "source", feed.url, "domain", name, "client", client, "via", via)
+		c.mu.Lock()
+		hit := canaryHit{source: feed.id, domain: name}
+		c.pending[hit]++
+		c.lastSeen[hit] = time.Now().Unix()
+		c.mu.Unlock()
+	}
+}
+
+// forget drops the hits of the source not flushed yet, once it is promoted
+// or removed.
+func (c *canarySet) forget(id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for hit := range c.pending {
+		if hit.source == id {
+			delete(c.pending, hit)
+			delete(c.lastSeen, hit)
+		}
+	}
+}
+
+// flush adds the hits counted since the last flush to the database. The
+// hits that couldn't be written are kept for the next one.
+func (c *canarySet) flush(ctx context.Context) error {
+	c.mu.Lock()
+	pending, lastSeen := c.pending, c.lastSeen
+	c.pending, c.lastSeen = make(map[canaryHit]int64), make(map[canaryHit]int64)
+	c.mu.Unlock()
+
+	for hit, hits := range pending {
+		if err := addCanaryHits(ctx, hit, hits, lastSeen[hit]); err != nil {
+			c.mu.Lock()
+			for hit, hits := range pending {
+				c.pending[hit] += hits
+				c.lastSeen[hit] = max(c.lastSeen[hit], lastSeen[hit])
+			}
+			c.mu.Unlock()
+			return err
+		}
+		delete(pending, hit)
+	}
+	return nil
+}
+
+func addCanaryHits(ctx context.Context, hit canaryHit, hits int64, seen int64) error {
+	result, err := db.ExecContext(ctx, addCanaryHitsStmt, hits, seen, seen, hit.source, hit.domain)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows != 0 {
+		return nil
+	}
+	_, err = db.ExecContext(ctx, insertCanaryHitsStmt, hit.source, hit.domain, hits, seen)
+	if isUniqueConstraintError(err) {
+		// Another instance sharing the database inserted it meanwhile.
+		_, err = db.ExecContext(ctx, addCanaryHitsStmt, hits, seen, seen, hit.source, hit.domain)
+	}
+	return err
+}
+
+func (c *canarySet) run(ctx context.Context) {
+	ticker := time.NewTicker(canaryFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := c.flush(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("Writing of the canary hits failed", "error", err)
+		}
+	}
+}
+
+// storeCanary replaces the entries of the source in its canary period.
+func storeCanary(ctx context.Context, id int64, wanted map[string]string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(deleteCanaryEntriesStmt, id); err != nil {
+		return err
+	}
+	for name, mode := range wanted {
+		if _, err := tx.Exec(insertCanaryEntryStmt, id, name, mode); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return canaries.load()
+}
+
+// canaryReport reports the impact of the source, counting the hits not
+// flushed yet. It returns sql.ErrNoRows if the source isn't in its canary
+// period.
+func canaryReport(ctx context.Context, id int64, now time.Time) (CanaryReportSchema, error) {
+	if err := canaries.flush(ctx); err != nil {
+		return CanaryReportSchema{}, err
+	}
+	report := CanaryReportSchema{ID: id, Top: []CanaryHitSchema{}}
+	var until sql.NullInt64
+	if err := db.QueryRowContext(ctx, sourceCanaryStmt, id).Scan(&report.URL, &until); err != nil {
+		return report, err
+	}
+	if !until.Valid {
+		return report, sql.ErrNoRows
+	}
+	report.CanaryUntil = time.Unix(until.Int64, 0).UTC()
+	report.Ended = !now.Before(report.CanaryUntil)
+	if err := db.QueryRowContext(ctx, countCanaryEntriesStmt, id).Scan(&report.Entries); err != nil {
+		return report, err
+	}
+	if err := db.QueryRowContext(ctx, canaryTotalsStmt, id).Scan(&report.Domains, &report.Hits); err != nil {
+		return report, err
+	}
+	rows, err := db.QueryContext(ctx, topCanaryHitsStmt, id, canaryReportedDomains)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hit CanaryHitSchema
+		var seen int64
+		if err := rows.Scan(&hit.Domain, &hit.Hits, &seen); err != nil {
+			return report, err
+		}
+		hit.LastSeen = time.Unix(seen, 0).UTC()
+		report.Top = append(report.Top, hit)
+	}
+	return report, rows.Err()
+}
+
+func sourceID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, &APIError{Code: CodeSourceNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "Source \"%s\" doesn't exist.", r.PathValue("id"))})
+		return 0, false
+	}
+	return id, true
+}
+
+// canaryHandler serves GET /sources/{id}/canary.
+func canaryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	id, ok := sourceID(w, r)
+	if !ok {
+		return
+	}
+	report, err := canaryReport(r.Context(), id, time.Now())
+	if errors.Is(err, sql.ErrNoRows) && report.URL != "" {
+		respondWithError(w, &APIError{Code: CodeSourceEnforced, Status: "error", StatusCode: http.StatusConflict, Message: localize(r, "Source \"%s\" isn't in a canary period.", report.URL)})
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, &APIError{Code: CodeSourceNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "Source \"%s\" doesn't exist.", r.PathValue("id"))})
+		return
+	}
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	respondWithJSON(w, report)
+}
+
+// promoteHandler serves POST /sources/{id}/promote, which ends the canary
+// period of the source: its entries move to the blocklist and are
+// enforced from then on.
+func promoteHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensurePOST(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	id, ok := sourceID(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := beginChange(r.Context())
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var sourceURL string
+	var until sql.NullInt64
+	err = tx.QueryRow(sourceCanaryStmt, id).Scan(&sourceURL, &until)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, &APIError{Code: CodeSourceNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "Source \"%s\" doesn't exist.", r.PathValue("id"))})
+		return
+	}
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if !until.Valid {
+		respondWithError(w, &APIError{Code: CodeSourceEnforced, Status: "error", StatusCode: http.StatusConflict, Message: localize(r, "Source \"%s\" isn't in a canary period.", sourceURL)})
+		return
+	}
+
+	rows, err := tx.Query(selectCanaryEntriesStmt, id)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	wanted := make(map[string]string)
+	for rows.Next() {
+		var entry DomainEntry
+		if err := rows.Scan(&entry.Domain, &entry.Mode); err != nil {
+			rows.Close()
+			respondWithInternalError(w, r, err)
+			return
+		}
+		wanted[entry.Domain] = entry.Mode
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	added, _, err := applySource(tx, id, wanted)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	for _, stmt := range []string{promoteSourceStmt, deleteCanaryEntriesStmt, deleteCanaryHitsStmt} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	canaries.forget(id)
+	if err := canaries.load(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	requestLogger(r).Info("Source promoted", "source", sourceURL, "added", added)
+	respondWithError(w, &APIError{Code: CodeOK, StatusCode: http.StatusOK, Message: localize(r, "Succesfully promoted the source; %d domains are blocked now.", added), Status: "success"})
+}
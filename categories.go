@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var disabledCategories *string = flag.String("disabled-categories", "", "comma-separated categories whose entries aren't enforced")
+
+// Categories are stored between commas, e.g. ",ads,tracking,", so a
+// category can be looked up with LIKE in every backend.
+const selectCategoriesStmt string = "SELECT domain_name, categories FROM blocked_domains WHERE categories <> ''"
+
+const countCategoryStmt string = "SELECT COUNT(*) FROM blocked_domains WHERE categories LIKE ?"
+
+const listCategoryStmt string = "SELECT domain_name, mode FROM blocked_domains WHERE categories LIKE ? ORDER BY domain_name LIMIT ? OFFSET ?"
+
+const maxCategoryLength = 32
+
+// categoryIndex mirrors the categories of the blocked entries that have
+// any, and the schedules of the categories. An entry none of whose
+// categories is enforced, because they are disabled or out of their
+// windows, doesn't block; one with an enforced category still does.
+type categoryIndex struct {
+	mu        sync.RWMutex
+	entries   map[string][]string
+	disabled  map[string]bool
+	schedules map[string][]*schedule
+}
+
+var categories = &categoryIndex{entries: make(map[string][]string), disabled: make(map[string]bool), schedules: make(map[string][]*schedule)}
+
+// validateCategory accepts lowercase letters, digits and dashes, which
+// need no escaping in LIKE patterns or in the stored list.
+func validateCategory(category string) error {
+	if category == "" || len(category) > maxCategoryLength {
+		return fmt.Errorf("category must be 1 to %d characters long", maxCategoryLength)
+	}
+	for _, c := range category {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return fmt.Errorf("category \"%s\" may only contain lowercase letters, digits and dashes", category)
+		}
+	}
+	return nil
+}
+
+// normalizeCategories lowercases the categories and drops repeated ones.
+func normalizeCategories(list []string) ([]string, error) {
+	normalized := make([]string, 0, len(list))
+	for _, category := range list {
+		category = strings.ToLower(strings.TrimSpace(category))
+		if err := validateCategory(category); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(normalized, category) {
+			normalized = append(normalized, category)
+		}
+	}
+	if len(joinCategories(normalized)) > maxCategoriesLength {
+		return nil, errors.New("categories are too long")
+	}
+	return normalized, nil
+}
+
+func joinCategories(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	return "," + strings.Join(list, ",") + ","
+}
+
+func splitCategories(stored string) []string {
+	stored = strings.Trim(stored, ",")
+	if stored == "" {
+		return nil
+	}
+	return strings.Split(stored, ",")
+}
+
+func parseCategories(list string) ([]string, error) {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return normalizeCategories(items)
+}
+
+func (c *categoryIndex) load() error {
+	rows, err := db.Query(selectCategoriesStmt)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	entries := make(map[string][]string)
+	for rows.Next() {
+		var domain, stored string
+		if err := rows.Scan(&domain, &stored); err != nil {
+			return err
+		}
+		if list := splitCategories(stored); len(list) != 0 {
+			entries[domain] = list
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = entries
+	return nil
+}
+
+// of returns the categories of the stored entry.
+func (c *categoryIndex) of(domain string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.entries[domain]
+}
+
+// set and forget must be called with blocklist.mu held for writing, so
+// checks see the entry and its categories change together.
+func (c *categoryIndex) set(domain string, list []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(list) == 0 {
+		delete(c.entries, domain)
+		return
+	}
+	c.entries[domain] = list
+}
+
+func (c *categoryIndex) forget(domain string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, domain)
+}
+
+// suppressed reports whether none of the categories of the entry is
+// enforced for the clients of the policy, "" for those without one, at the
+// time.
+func (c *categoryIndex) suppressed(domain string, policy string, now time.Time) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.disabled) == 0 && len(c.schedules) == 0 {
+		return false
+	}
+	list := c.entries[domain]
+	if len(list) == 0 {
+		return false
+	}
+	for _, category := range list {
+		if c.enforcedLocked(category, policy, now) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *categoryIndex) setEnabled(category string, enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if enabled {
+		delete(c.disabled, category)
+	} else {
+		c.disabled[category] = true
+	}
+}
+
+type CategorySchema struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+	Enabled bool   `json:"enabled"`
+	// Whether the entries block now for clients without a policy, which
+	// the schedules of the category decide.
+	Enforced bool `json:"enforced"`
+}
+
+type CategoriesSchema struct {
+	Categories []CategorySchema `json:"categories"`
+}
+
+// schema lists the categories in use and the disabled ones, by name.
+func (c *categoryIndex) schema() CategoriesSchema {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	counts := make(map[string]int)
+	for _, list := range c.entries {
+		for _, category := range list {
+			counts[category]++
+		}
+	}
+	for category := range c.disabled {
+		if _, ok := counts[category]; !ok {
+			counts[category] = 0
+		}
+	}
+	schema := CategoriesSchema{Categories: make([]CategorySchema, 0, len(counts))}
+	now := scheduleNow()
+	for category, count := range counts {
+		schema.Categories = append(schema.Categories, CategorySchema{Name: category, Entries: count, Enabled: !c.disabled[category], Enforced: c.enforcedLocked(category, "", now)})
+	}
+	slices.SortFunc(schema.Categories, func(a, b CategorySchema) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return schema
+}
+
+func categoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	respondWithJSON(w, categories.schema())
+}
+
+type CategoryStateSchema struct {
+	Enabled bool `json:"enabled"`
+}
+
+// categoryHandler serves PUT /categories/{name}, which enables or disables
+// the enforcement of the category until the next restart.
+func categoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		respondWithError(w, unexceptedMethod(r, http.MethodPut))
+		return
+	}
+	if err := ensureJSON(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	name := strings.ToLower(r.PathValue("name"))
+	if err := validateCategory(name); err != nil {
+		respondWithError(w, &APIError{
+			Code:       CodeInvalidCategory,
+			Status:     "error",
+			StatusCode: http.StatusBadRequest,
+			Message:    localize(r, "Category \"%s\" is invalid: %v.", name, err),
+		})
+		return
+	}
+	var body CategoryStateSchema
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted {\"enabled\"} object; got invalid JSON."), Status: "error"})
+		return
+	}
+	categories.setEnabled(name, body.Enabled)
+	requestLogger(r).Info("Category set", "category", name, "enabled", body.Enabled)
+	respondWithJSON(w, categories.schema())
+}
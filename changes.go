@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const insertChangeStmt string = "INSERT INTO domain_changes(domain_name, mode, removed, changed_at) VALUES (?, ?, ?, ?)"
+
+// The rows of recordAll are appended with valuesList.
+const insertChangeRowsStmt string = "INSERT INTO domain_changes(domain_name, mode, removed, changed_at) VALUES "
+
+const latestSerialStmt string = "SELECT COALESCE(MAX(serial), 0) FROM domain_changes"
+
+const changesSinceStmt string = "SELECT domain_name, mode, removed FROM domain_changes WHERE serial > ? ORDER BY serial"
+
+type ChangesSchema struct {
+	Since   int64         `json:"since"`
+	Serial  int64         `json:"serial"`
+	Added   []DomainEntry `json:"added"`
+	Removed []DomainEntry `json:"removed"`
+}
+
+type change struct {
+	entry   DomainEntry
+	removal bool
+}
+
+// changeTx is a transaction modifying the blocklist. Every change made in
+// it is journaled through record, so the serial number never gets ahead of
+// the blocklist, and the in-memory blocklist follows on commit.
+type changeTx struct {
+	*sql.Tx
+	ctx        context.Context
+	changes    []change
+	categories map[string][]string
+}
+
+func beginChange(ctx context.Context) (*changeTx, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &changeTx{Tx: tx, ctx: ctx}, nil
+}
+
+// record appends the change to the journal and the audit log.
+func (tx *changeTx) record(entry DomainEntry, removal bool) error {
+	if _, err := tx.Exec(insertChangeStmt, entry.Domain, entry.Mode, removal, time.Now().Unix()); err != nil {
+		return err
+	}
+	if err := audit(tx.ctx, tx.Tx, auditBlocklist, entry, removal); err != nil {
+		return err
+	}
+	tx.changes = append(tx.changes, change{entry: entry, removal: removal})
+	return nil
+}
+
+// recordAll records the changes of the entries like record, with a
+// statement for every batch of them.
+func (tx *changeTx) recordAll(entries []DomainEntry, removal bool) error {
+	now := time.Now().Unix()
+	for start := 0; start < len(entries); start += insertBatchSize {
+		batch := entries[start:min(start+insertBatchSize, len(entries))]
+		args := make([]any, 0, len(batch)*4)
+		for _, entry := range batch {
+			args = append(args, entry.Domain, entry.Mode, removal, now)
+		}
+		if _, err := tx.Exec(insertChangeRowsStmt+valuesList(len(batch), 4), args...); err != nil {
+			return err
+		}
+	}
+	if err := auditAll(tx.ctx, tx.Tx, auditBlocklist, entries, removal); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		tx.changes = append(tx.changes, change{entry: entry, removal: removal})
+	}
+	return nil
+}
+
+// categorize sets the categories of an entry added in the transaction.
+// Entries added without are uncategorized.
+func (tx *changeTx) categorize(domain string, list []string) {
+	if tx.categories == nil {
+		tx.categories = make(map[string][]string)
+	}
+	tx.categories[domain] = list
+}
+
+// Commit commits the transaction and applies its changes to the in-memory
+// blocklist and categories. The blocklist stays locked in between, so no
+// check can see the database and the memory disagree.
+func (tx *changeTx) Commit() error {
+	blocklist.mu.Lock()
+	defer blocklist.mu.Unlock()
+	if err := tx.Tx.Commit(); err != nil {
+		return err
+	}
+	for _, c := range tx.changes {
+		if c.removal {
+			blocklist.remove(c.entry)
+			categories.forget(c.entry.Domain)
+		} else {
+			blocklist.add(c.entry)
+			categories.set(c.entry.Domain, tx.categories[c.entry.Domain])
+		}
+	}
+	for _, c := range tx.changes {
+		entry := c.entry
+		if c.removal {
+			events.publish(Event{Type: EventEntryRemoved, Entry: &entry})
+		} else {
+			events.publish(Event{Type: EventEntryAdded, Entry: &entry})
+		}
+	}
+	return nil
+}
+
+// changesHandler returns the net adds and removes since the given serial,
+// so downstream resolvers can sync deltas instead of full dumps.
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+
+	var since int64
+	if param := r.URL.Query().Get("since"); param != "" {
+		var err error
+		since, err = strconv.ParseInt(param, 10, 64)
+		if err != nil || since < 0 {
+			respondWithError(w, &APIError{
+				Code:       CodeInvalidParameter,
+				Status:     "error",
+				StatusCode: http.StatusBadRequest,
+				Message:    localize(r, "Parameter \"%s\" must be a non-negative integer, got: \"%s\".", "since", param),
+			})
+			return
+		}
+	}
+
+	tx, err := db.BeginTx(r.Context(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	schema := ChangesSchema{Since: since}
+	if err := tx.QueryRow(latestSerialStmt).Scan(&schema.Serial); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	if since == 0 {
+		// The blocklist was empty at serial 0, so all of it was added
+		// since, including the entries stored before the journal existed,
+		// which it doesn't list.
+		schema.Added, err = currentEntries(tx)
+		schema.Removed = []DomainEntry{}
+	} else {
+		schema.Added, schema.Removed, err = netChanges(tx, since)
+	}
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	respondWithJSON(w, schema)
+}
+
+// currentEntries returns every entry of the blocklist, manual or of a
+// source.
+func currentEntries(tx *sql.Tx) ([]DomainEntry, error) {
+	rows, err := tx.Query(selectAllStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]DomainEntry, 0)
+	for rows.Next() {
+		var entry DomainEntry
+		if err := rows.Scan(&entry.Domain, &entry.Mode); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// netChanges collapses the journal after the given serial into the entries
+// that were absent at that serial and present now, and the other way round.
+// Entries that were added and removed again in between are left out.
+func netChanges(tx *sql.Tx, since int64) (added []DomainEntry, removed []DomainEntry, err error) {
+	rows, err := tx.Query(changesSinceStmt, since)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	type span struct{ first, last change }
+	spans := make(map[string]*span)
+	order := make([]string, 0)
+	for rows.Next() {
+		var c change
+		if err := rows.Scan(&c.entry.Domain, &c.entry.Mode, &c.removal); err != nil {
+			return nil, nil, err
+		}
+		if s, ok := spans[c.entry.Domain]; ok {
+			s.last = c
+			continue
+		}
+		spans[c.entry.Domain] = &span{first: c, last: c}
+		order = append(order, c.entry.Domain)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	added, removed = []DomainEntry{}, []DomainEntry{}
+	for _, name := range order {
+		// The first change tells whether the domain existed at the serial
+		// and in which mode, the last one whether and how it exists now.
+		s := spans[name]
+		existed, exists := s.first.removal, !s.last.removal
+		if existed && exists && s.first.entry.Mode == s.last.entry.Mode {
+			continue
+		}
+		if existed {
+			removed = append(removed, s.first.entry)
+		}
+		if exists {
+			added = append(added, s.last.entry)
+		}
+	}
+	return added, removed, nil
+}
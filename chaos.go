@@ -0,0 +1,178 @@
+//go:build chaos
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Binaries built with -tags chaos accept faults through /control/chaos,
+// so operators can check how the service degrades. The faults are off
+// until set.
+
+var chaosDrivers = struct {
+	sync.Mutex
+	registered map[string]bool
+}{registered: make(map[string]bool)}
+
+// databaseDriver registers a chaos variant of the named driver on first use
+// and returns its name.
+func databaseDriver(name string) string {
+	chaosDrivers.Lock()
+	defer chaosDrivers.Unlock()
+	chaosName := name + "-chaos"
+	if chaosDrivers.registered[name] {
+		return chaosName
+	}
+	// Opening a database doesn't connect yet, so any name gives the driver.
+	db, err := sql.Open(name, "")
+	if err != nil {
+		return name
+	}
+	sql.Register(chaosName, chaosDriver{db.Driver()})
+	db.Close()
+	chaosDrivers.registered[name] = true
+	return chaosName
+}
+
+type FaultsSchema struct {
+	// Delay before every database statement and transaction.
+	DBLatency string `json:"dbLatency"`
+	// Share of outbound connections that fail as if refused, 0 to 1.
+	UpstreamFailureRate float64 `json:"upstreamFailureRate"`
+	// Delay before every DNS response.
+	PacketDelay string `json:"packetDelay"`
+}
+
+type faultSet struct {
+	mu                  sync.RWMutex
+	dbLatency           time.Duration
+	upstreamFailureRate float64
+	packetDelay         time.Duration
+}
+
+var faults faultSet
+
+func (f *faultSet) schema() FaultsSchema {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return FaultsSchema{
+		DBLatency:           f.dbLatency.String(),
+		UpstreamFailureRate: f.upstreamFailureRate,
+		PacketDelay:         f.packetDelay.String(),
+	}
+}
+
+func (f *faultSet) set(schema FaultsSchema) error {
+	dbLatency, err := time.ParseDuration(schema.DBLatency)
+	if err != nil {
+		return fmt.Errorf("\"dbLatency\" is invalid: %v", err)
+	}
+	packetDelay, err := time.ParseDuration(schema.PacketDelay)
+	if err != nil {
+		return fmt.Errorf("\"packetDelay\" is invalid: %v", err)
+	}
+	if schema.UpstreamFailureRate < 0 || schema.UpstreamFailureRate > 1 {
+		return fmt.Errorf("\"upstreamFailureRate\" must be between 0 and 1")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dbLatency, f.upstreamFailureRate, f.packetDelay = dbLatency, schema.UpstreamFailureRate, packetDelay
+	return nil
+}
+
+func (f *faultSet) delay(d *time.Duration) {
+	f.mu.RLock()
+	delay := *d
+	f.mu.RUnlock()
+	time.Sleep(delay)
+}
+
+func injectUpstreamFailure(address string) error {
+	faults.mu.RLock()
+	rate := faults.upstreamFailureRate
+	faults.mu.RUnlock()
+	if rand.Float64() < rate {
+		return fmt.Errorf("dial %s: injected fault: %w", address, syscall.ECONNREFUSED)
+	}
+	return nil
+}
+
+func delayPacket() {
+	faults.delay(&faults.packetDelay)
+}
+
+// chaosDriver delays every connection to the database. It deliberately doesn't
+// expose the fast paths of the connection, so database/sql prepares every
+// statement through it.
+type chaosDriver struct {
+	driver.Driver
+}
+
+func (d chaosDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return chaosConn{conn}, nil
+}
+
+type chaosConn struct {
+	driver.Conn
+}
+
+func (c chaosConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	faults.delay(&faults.dbLatency)
+	return c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+}
+
+func (c chaosConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	faults.delay(&faults.dbLatency)
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func chaosHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	respondWithJSON(w, faults.schema())
+}
+
+func setChaosHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensureValidPOST(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	body := FaultsSchema{DBLatency: "0s", PacketDelay: "0s"}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted {\"dbLatency\", \"upstreamFailureRate\", \"packetDelay\"} object; got invalid JSON."), Status: "error"})
+		return
+	}
+	if err := faults.set(body); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidParameter, StatusCode: http.StatusBadRequest, Message: localize(r, "Faults are invalid: %v.", err), Status: "error"})
+		return
+	}
+	requestLogger(r).Info("Faults set", "faults", fmt.Sprintf("%+v", body))
+	respondWithJSON(w, faults.schema())
+}
+
+var chaosOperations = []apiOperation{
+	{method: http.MethodGet, path: "/control/chaos", id: "getFaults", summary: "Returns the faults injected.", response: FaultsSchema{}},
+	{method: http.MethodPost, path: "/control/chaos/set", id: "setFaults", summary: "Sets the faults injected.", body: FaultsSchema{}, response: FaultsSchema{}},
+}
+
+func registerChaosHandlers() {
+	http.HandleFunc("/control/chaos", chaosHandler)
+	http.HandleFunc("/control/chaos/set", setChaosHandler)
+}
@@ -0,0 +1,104 @@
+// Package client is a Go client of the proxy's API. The methods and types
+// are generated from the OpenAPI document the service serves at
+// /openapi.json; regenerate them with "make client" after changing the API.
+package client
+
+//go:generate go run ./internal/gen -spec openapi.json -o client_gen.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client sends requests to an instance of the service.
+type Client struct {
+	// BaseURL is the address of the API, like "http://localhost:8000".
+	BaseURL string
+	// Key is the API key sent as a bearer token; none is sent if empty.
+	Key        string
+	HTTPClient *http.Client
+}
+
+func New(baseURL string, key string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Key: key, HTTPClient: http.DefaultClient}
+}
+
+// Error makes the APIError of a failed request an error.
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// send sends the request and returns its response. A response with an
+// error status is returned as an *APIError instead.
+func (c *Client) send(ctx context.Context, method string, path string, query url.Values, header http.Header, contentType string, body io.Reader) (*http.Response, error) {
+	target := c.BaseURL + path
+	if len(query) != 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Key)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < http.StatusBadRequest {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	apiErr := &APIError{}
+	if json.Unmarshal(data, apiErr) != nil || apiErr.Code == "" {
+		apiErr = &APIError{Status: "error", StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	}
+	return nil, apiErr
+}
+
+// do sends the request and returns the body of its response. A response
+// with an error status is returned as an *APIError.
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, header http.Header, contentType string, body io.Reader) ([]byte, error) {
+	resp, err := c.send(ctx, method, path, query, header, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// doJSON sends in, unless it is nil, as the JSON body of the request and
+// decodes the response into out, unless it is nil.
+func (c *Client) doJSON(ctx context.Context, method string, path string, query url.Values, header http.Header, in any, out any) error {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(data), "application/json"
+	}
+	data, err := c.do(ctx, method, path, query, header, contentType, body)
+	if err != nil || out == nil || len(data) == 0 {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,374 @@
+// Command gen generates the methods and types of the client package from
+// the OpenAPI document of the service.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var specPath *string = flag.String("spec", "openapi.json", "OpenAPI document to generate from")
+var outPath *string = flag.String("o", "client_gen.go", "file to write")
+
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	Items                *schema            `json:"items"`
+	AdditionalProperties *schema            `json:"additionalProperties"`
+}
+
+type mediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+type parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Required    bool    `json:"required"`
+	Description string  `json:"description"`
+	Schema      *schema `json:"schema"`
+}
+
+type response struct {
+	Content map[string]mediaType `json:"content"`
+}
+
+type operation struct {
+	OperationID string      `json:"operationId"`
+	Summary     string      `json:"summary"`
+	Parameters  []parameter `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]mediaType `json:"content"`
+	} `json:"requestBody"`
+	Responses  map[string]response `json:"responses"`
+	Deprecated bool                `json:"deprecated"`
+}
+
+type document struct {
+	Paths      map[string]map[string]*operation `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+// Words spelled in capitals in Go names.
+var initialisms = map[string]bool{"api": true, "ca": true, "csv": true, "dns": true, "http": true, "id": true, "ip": true, "json": true, "mitm": true, "ttl": true, "url": true}
+
+var wordPattern = regexp.MustCompile(`[A-Z]+[a-z0-9]*|[a-z0-9]+`)
+
+// goName turns a snake or camel case name into an exported Go name.
+func goName(name string) string {
+	var b strings.Builder
+	for _, word := range wordPattern.FindAllString(name, -1) {
+		lower := strings.ToLower(word)
+		if initialisms[lower] {
+			b.WriteString(strings.ToUpper(lower))
+			continue
+		}
+		b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	return b.String()
+}
+
+func refName(ref string) string {
+	return strings.TrimPrefix(ref, "#/components/schemas/")
+}
+
+// goType returns the Go type of the schema. Optional values that have no
+// empty form, such as times and objects, are pointers.
+func goType(s *schema, required bool) string {
+	pointer := ""
+	if !required {
+		pointer = "*"
+	}
+	switch {
+	case s == nil:
+		return "any"
+	case s.Ref != "":
+		return pointer + refName(s.Ref)
+	case s.Type == "string" && s.Format == "date-time":
+		return pointer + "time.Time"
+	case s.Type == "string":
+		return "string"
+	case s.Type == "integer":
+		return "int"
+	case s.Type == "number":
+		return "float64"
+	case s.Type == "boolean":
+		return "bool"
+	case s.Type == "array":
+		return "[]" + goType(s.Items, true)
+	case s.Type == "object" && s.AdditionalProperties != nil:
+		return "map[string]" + goType(s.AdditionalProperties, true)
+	}
+	return "any"
+}
+
+// comment turns a summary into the doc comment of the named declaration.
+func comment(name string, summary string) string {
+	if summary == "" {
+		return ""
+	}
+	return fmt.Sprintf("// %s %s\n", name, strings.ToLower(summary[:1])+summary[1:])
+}
+
+func generateType(b *bytes.Buffer, name string, s *schema) {
+	fmt.Fprintf(b, "type %s struct {\n", name)
+	required := make(map[string]bool)
+	for _, property := range s.Required {
+		required[property] = true
+	}
+	properties := make([]string, 0, len(s.Properties))
+	for property := range s.Properties {
+		properties = append(properties, property)
+	}
+	sort.Strings(properties)
+	for _, property := range properties {
+		tag := property
+		if !required[property] {
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(b, "\t%s %s `json:\"%s\"`\n", goName(property), goType(s.Properties[property], required[property]), tag)
+	}
+	b.WriteString("}\n\n")
+}
+
+// pathExpr returns the Go expression of the path, with its parameters
+// escaped.
+func pathExpr(path string) string {
+	expr := regexp.MustCompile(`\{([a-z]+)\}`).ReplaceAllString(path, `" + url.PathEscape($1) + "`)
+	return strings.TrimSuffix(`"`+expr+`"`, ` + ""`)
+}
+
+// queryValue returns the expression of the parameter's value in a query.
+func queryValue(expr string, s *schema) string {
+	switch goType(s, true) {
+	case "int":
+		return "strconv.Itoa(" + expr + ")"
+	case "bool":
+		return "strconv.FormatBool(" + expr + ")"
+	case "time.Time":
+		return expr + ".Format(time.RFC3339)"
+	}
+	return expr
+}
+
+func zeroCheck(expr string, s *schema) string {
+	switch goType(s, true) {
+	case "int":
+		return expr + " != 0"
+	case "bool":
+		return expr
+	case "time.Time":
+		return "!" + expr + ".IsZero()"
+	}
+	return expr + ` != ""`
+}
+
+func mediaTypes(content map[string]mediaType) []string {
+	types := make([]string, 0, len(content))
+	for t := range content {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func generateOperation(b *bytes.Buffer, method string, path string, op *operation) {
+	name := goName(op.OperationID)
+	args := []string{"ctx context.Context"}
+	var optional []parameter
+	query := make([]parameter, 0)
+	for _, p := range op.Parameters {
+		switch {
+		case p.In == "path":
+			args = append(args, p.Name+" string")
+		case p.Required:
+			args = append(args, p.Name+" "+goType(p.Schema, true))
+			query = append(query, p)
+		default:
+			optional = append(optional, p)
+		}
+	}
+	if len(optional) != 0 {
+		fmt.Fprintf(b, "// %sParams are the optional parameters of %s.\n", name, name)
+		fmt.Fprintf(b, "type %sParams struct {\n", name)
+		for _, p := range optional {
+			if p.Description != "" {
+				fmt.Fprintf(b, "\t// %s\n", strings.ToUpper(p.Description[:1])+p.Description[1:]+".")
+			}
+			fmt.Fprintf(b, "\t%s %s\n", goName(p.Name), goType(p.Schema, true))
+		}
+		b.WriteString("}\n\n")
+		args = append(args, "params *"+name+"Params")
+	}
+
+	body := "nil"
+	var raw []string
+	if op.RequestBody != nil {
+		if content, ok := op.RequestBody.Content["application/json"]; ok && len(op.RequestBody.Content) == 1 {
+			args = append(args, "body "+goType(content.Schema, true))
+			body = "body"
+		} else {
+			raw = mediaTypes(op.RequestBody.Content)
+			if len(raw) > 1 {
+				args = append(args, "contentType string")
+			}
+			args = append(args, "body io.Reader")
+		}
+	}
+
+	// The success response is the one that isn't "default".
+	result := ""
+	rawResult, streamResult := false, false
+	for status, resp := range op.Responses {
+		if status == "default" {
+			continue
+		}
+		if _, ok := resp.Content["text/event-stream"]; ok {
+			result, streamResult = "io.ReadCloser", true
+		} else if content, ok := resp.Content["application/json"]; ok && len(resp.Content) == 1 && content.Schema != nil && (content.Schema.Ref != "" || content.Schema.Type != "string") {
+			result = goType(content.Schema, content.Schema.Ref == "")
+		} else if len(resp.Content) != 0 {
+			result, rawResult = "[]byte", true
+		}
+	}
+
+	b.WriteString(comment(name, op.Summary))
+	if streamResult {
+		b.WriteString("//\n// The events are read from the body as they come; the caller closes it.\n")
+	}
+	if op.Deprecated {
+		b.WriteString("//\n// Deprecated: the endpoint is kept for old clients.\n")
+	}
+	if result != "" {
+		fmt.Fprintf(b, "func (c *Client) %s(%s) (%s, error) {\n", name, strings.Join(args, ", "), result)
+	} else {
+		fmt.Fprintf(b, "func (c *Client) %s(%s) error {\n", name, strings.Join(args, ", "))
+	}
+
+	b.WriteString("\tquery := url.Values{}\n\theader := http.Header{}\n")
+	for _, p := range query {
+		fmt.Fprintf(b, "\tquery.Set(%q, %s)\n", p.Name, queryValue(p.Name, p.Schema))
+	}
+	if len(optional) != 0 {
+		b.WriteString("\tif params != nil {\n")
+		for _, p := range optional {
+			field := "params." + goName(p.Name)
+			set := "query.Set"
+			if p.In == "header" {
+				set = "header.Set"
+			}
+			fmt.Fprintf(b, "\t\tif %s {\n\t\t\t%s(%q, %s)\n\t\t}\n", zeroCheck(field, p.Schema), set, p.Name, queryValue(field, p.Schema))
+		}
+		b.WriteString("\t}\n")
+	}
+
+	call := fmt.Sprintf("%q, %s, query, header", method, pathExpr(path))
+	switch {
+	case streamResult:
+		if body != "nil" || raw != nil {
+			log.Fatalf("%s: a body with a streamed response isn't supported", op.OperationID)
+		}
+		fmt.Fprintf(b, "\tresp, err := c.send(ctx, %s, \"\", nil)\n\tif err != nil {\n\t\treturn nil, err\n\t}\n\treturn resp.Body, nil\n", call)
+	case raw != nil || rawResult:
+		contentType := `""`
+		switch {
+		case len(raw) == 1:
+			contentType = fmt.Sprintf("%q", raw[0])
+		case len(raw) > 1:
+			contentType = "contentType"
+		}
+		reader := "nil"
+		if raw != nil {
+			reader = "body"
+		} else if body != "nil" {
+			log.Fatalf("%s: a JSON body with a raw response isn't supported", op.OperationID)
+		}
+		if rawResult {
+			fmt.Fprintf(b, "\treturn c.do(ctx, %s, %s, %s)\n", call, contentType, reader)
+		} else if result != "" {
+			fmt.Fprintf(b, "\tdata, err := c.do(ctx, %s, %s, %s)\n\tif err != nil {\n\t\treturn nil, err\n\t}\n", call, contentType, reader)
+			fmt.Fprintf(b, "\tout := new(%s)\n\treturn out, json.Unmarshal(data, out)\n", strings.TrimPrefix(result, "*"))
+		} else {
+			fmt.Fprintf(b, "\t_, err := c.do(ctx, %s, %s, %s)\n\treturn err\n", call, contentType, reader)
+		}
+	case result == "":
+		fmt.Fprintf(b, "\treturn c.doJSON(ctx, %s, %s, nil)\n", call, body)
+	case strings.HasPrefix(result, "*"):
+		fmt.Fprintf(b, "\tout := new(%s)\n\tif err := c.doJSON(ctx, %s, %s, out); err != nil {\n\t\treturn nil, err\n\t}\n\treturn out, nil\n", result[1:], call, body)
+	default:
+		fmt.Fprintf(b, "\tvar out %s\n\tif err := c.doJSON(ctx, %s, %s, &out); err != nil {\n\t\treturn nil, err\n\t}\n\treturn out, nil\n", result, call, body)
+	}
+	b.WriteString("}\n\n")
+}
+
+func generate(doc *document) ([]byte, error) {
+	var code bytes.Buffer
+	names := make([]string, 0, len(doc.Components.Schemas))
+	for name := range doc.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		generateType(&code, name, doc.Components.Schemas[name])
+	}
+
+	paths := make([]string, 0, len(doc.Paths))
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		for _, method := range []string{"get", "put", "post", "delete"} {
+			if op := doc.Paths[path][method]; op != nil {
+				generateOperation(&code, strings.ToUpper(method), path, op)
+			}
+		}
+	}
+
+	imports := make([]string, 0)
+	for _, pkg := range []string{"context", "encoding/json", "io", "net/http", "net/url", "strconv", "time"} {
+		short := pkg[strings.LastIndex(pkg, "/")+1:]
+		if regexp.MustCompile(`\b` + short + `\.`).Match(code.Bytes()) {
+			imports = append(imports, fmt.Sprintf("%q", pkg))
+		}
+	}
+	var b bytes.Buffer
+	b.WriteString("// Code generated by internal/gen from openapi.json; DO NOT EDIT.\n\n")
+	b.WriteString("package client\n\n")
+	fmt.Fprintf(&b, "import (\n%s\n)\n\n", strings.Join(imports, "\n"))
+	b.Write(code.Bytes())
+	return format.Source(b.Bytes())
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.Parse()
+	data, err := os.ReadFile(*specPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		log.Fatalf("%s: %v", *specPath, err)
+	}
+	code, err := generate(&doc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*outPath, code, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+var trustedProxies *string = flag.String("trusted-proxies", "", "comma-separated subnets of reverse proxies whose X-Forwarded-For and X-Real-IP headers are honored")
+
+type clientAddrKey struct{}
+
+// clientAddr returns the address of the client that made the request, as
+// determined by withClientAddr.
+func clientAddr(r *http.Request) netip.Addr {
+	addr, _ := r.Context().Value(clientAddrKey{}).(netip.Addr)
+	return addr
+}
+
+// realClientAddr returns the peer address, unless the peer is a trusted
+// proxy. Then the X-Forwarded-For hops are walked from the right, skipping
+// trusted proxies, and X-Real-IP is used if there are none. Headers sent
+// by untrusted peers are ignored, as anyone can forge them.
+func realClientAddr(r *http.Request, trusted []netip.Prefix) netip.Addr {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr := peer.Addr().Unmap()
+	if !containsAddr(trusted, addr) {
+		return addr
+	}
+
+	hops := make([]string, 0)
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return realIP.Unmap()
+		}
+		return addr
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !containsAddr(trusted, addr) {
+			break
+		}
+	}
+	return addr
+}
+
+func withClientAddr(trusted []netip.Prefix, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := realClientAddr(r, trusted)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientAddrKey{}, addr)))
+	})
+}
@@ -0,0 +1,396 @@
+// Command proxyctl manages a running proxy through its REST API:
+//
+//	proxyctl [-api address] [-api-key key] [-o table|json] command [arguments]
+//
+// The commands are block, unblock, check, list, import and backfill.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: proxyctl [-api address] [-api-key key] [-o table|json] command [arguments]
+
+commands:
+  block [-mode mode] [-ttl duration] [-categories list] domain...
+  unblock domain...
+  check domain...
+  list [-limit n] [-offset n] [-category name]
+  import file
+  backfill [-device name] file...
+`
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// client sends requests to the API and prints their results.
+type client struct {
+	base   string
+	key    string
+	output string
+	http   *http.Client
+}
+
+// apiError is the body of the responses that carry no data.
+type apiError struct {
+	Code       string     `json:"code"`
+	Status     string     `json:"status"`
+	Message    string     `json:"message"`
+	StatusCode int        `json:"statusCode"`
+	Errors     []apiError `json:"additionalErrors"`
+}
+
+type entry struct {
+	Domain string `json:"domain"`
+	Mode   string `json:"mode"`
+}
+
+type newEntry struct {
+	Domain     string   `json:"domain"`
+	Mode       string   `json:"mode"`
+	Categories []string `json:"categories,omitempty"`
+	TTL        string   `json:"ttl,omitempty"`
+}
+
+type match struct {
+	entry
+	Comment    string     `json:"comment,omitempty"`
+	Categories []string   `json:"categories,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	Source     *struct {
+		URL string `json:"url"`
+	} `json:"source,omitempty"`
+}
+
+type listPage struct {
+	Domains []entry `json:"domains"`
+	Total   int     `json:"total"`
+	Limit   int     `json:"limit"`
+	Offset  int     `json:"offset"`
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	flags := flag.NewFlagSet("proxyctl", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	apiAddress := flags.String("api", "127.0.0.1:8000", "address or URL of the API")
+	key := flags.String("api-key", os.Getenv("PROXY_API_KEY"), "API key sent as a bearer token (default $PROXY_API_KEY)")
+	output := flags.String("o", outputTable, "output format: table or json")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *output != outputTable && *output != outputJSON {
+		fmt.Fprintf(os.Stderr, "-o: output format \"%s\" is invalid; excepted %s or %s\n", *output, outputTable, outputJSON)
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	base := *apiAddress
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	c := &client{base: strings.TrimSuffix(base, "/"), key: *key, output: *output, http: &http.Client{Timeout: time.Minute}}
+
+	command, rest := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "block":
+		return c.block(rest)
+	case "unblock":
+		return c.unblock(rest)
+	case "check":
+		return c.check(rest)
+	case "list":
+		return c.list(rest)
+	case "import":
+		return c.importList(rest)
+	case "backfill":
+		return c.backfill(rest)
+	}
+	fmt.Fprintf(os.Stderr, "unknown command \"%s\"\n%s", command, usage)
+	return 2
+}
+
+// do sends a request and returns the status and the body of the response.
+func (c *client) do(method string, path string, query url.Values, contentType string, body io.Reader) (int, []byte, error) {
+	u := c.base + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.key)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// sendJSON sends v as the body of the request.
+func (c *client) sendJSON(method string, path string, v any) (int, []byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0, nil, err
+	}
+	return c.do(method, path, nil, "application/json", bytes.NewReader(data))
+}
+
+// printJSON prints a response body indented.
+func printJSON(data []byte) {
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, data, "", "  "); err != nil {
+		os.Stdout.Write(data)
+		return
+	}
+	indented.WriteByte('\n')
+	indented.WriteTo(os.Stdout)
+}
+
+// report prints a response without data, like that of a change, and
+// returns the exit status.
+func (c *client) report(status int, data []byte, err error) int {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	code := 0
+	if status >= http.StatusBadRequest {
+		code = 1
+	}
+	if c.output == outputJSON {
+		printJSON(data)
+		return code
+	}
+	var result apiError
+	if err := json.Unmarshal(data, &result); err != nil {
+		fmt.Fprintf(os.Stderr, "API responded with %d: %s\n", status, bytes.TrimSpace(data))
+		return 1
+	}
+	out := os.Stdout
+	if code != 0 {
+		out = os.Stderr
+	}
+	fmt.Fprintln(out, result.Message)
+	for _, e := range result.Errors {
+		fmt.Fprintln(out, "  "+e.Message)
+	}
+	return code
+}
+
+func (c *client) block(args []string) int {
+	flags := flag.NewFlagSet("block", flag.ContinueOnError)
+	mode := flags.String("mode", "exact", "match mode: exact, subdomain or wildcard")
+	ttl := flags.String("ttl", "", "duration after which the entries expire, e.g. \"2h\" (never if empty)")
+	list := flags.String("categories", "", "comma-separated categories of the entries")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: proxyctl block [-mode mode] [-ttl duration] [-categories list] domain...")
+		return 2
+	}
+	var categories []string
+	for _, category := range strings.Split(*list, ",") {
+		if category = strings.TrimSpace(category); category != "" {
+			categories = append(categories, category)
+		}
+	}
+	entries := make([]newEntry, 0, flags.NArg())
+	for _, domain := range flags.Args() {
+		entries = append(entries, newEntry{Domain: domain, Mode: *mode, Categories: categories, TTL: *ttl})
+	}
+	return c.report(c.sendJSON(http.MethodPost, "/domains", entries))
+}
+
+func (c *client) unblock(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: proxyctl unblock domain...")
+		return 2
+	}
+	return c.report(c.sendJSON(http.MethodDelete, "/domains", args))
+}
+
+// check looks up the entry blocking each domain. It exits with 1 if any
+// of them couldn't be checked.
+func (c *client) check(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: proxyctl check domain...")
+		return 2
+	}
+	type result struct {
+		Domain  string `json:"domain"`
+		Blocked bool   `json:"blocked"`
+		Entry   *match `json:"entry,omitempty"`
+	}
+	results := make([]result, 0, len(args))
+	code := 0
+	for _, domain := range args {
+		status, data, err := c.do(http.MethodGet, "/domains/"+url.PathEscape(domain), nil, "", nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		switch status {
+		case http.StatusOK:
+			var m match
+			if err := json.Unmarshal(data, &m); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", domain, err)
+				return 1
+			}
+			results = append(results, result{Domain: domain, Blocked: true, Entry: &m})
+		case http.StatusNotFound:
+			results = append(results, result{Domain: domain})
+		default:
+			code = 1
+			var e apiError
+			if json.Unmarshal(data, &e) == nil && e.Message != "" {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", domain, e.Message)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s: API responded with %d\n", domain, status)
+			}
+		}
+	}
+
+	if c.output == outputJSON {
+		data, _ := json.Marshal(results)
+		printJSON(data)
+		return code
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "DOMAIN\tBLOCKED\tENTRY\tMODE\tEXPIRES\tSOURCE")
+	for _, r := range results {
+		if r.Entry == nil {
+			fmt.Fprintf(table, "%s\tno\t\t\t\t\n", r.Domain)
+			continue
+		}
+		expires, source := "", ""
+		if r.Entry.ExpiresAt != nil {
+			expires = r.Entry.ExpiresAt.Local().Format(time.DateTime)
+		}
+		if r.Entry.Source != nil {
+			source = r.Entry.Source.URL
+		}
+		fmt.Fprintf(table, "%s\tyes\t%s\t%s\t%s\t%s\n", r.Domain, r.Entry.Domain, r.Entry.Mode, expires, source)
+	}
+	table.Flush()
+	return code
+}
+
+func (c *client) list(args []string) int {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	limit := flags.Int("limit", 100, "number of entries listed")
+	offset := flags.Int("offset", 0, "number of entries skipped")
+	category := flags.String("category", "", "list only the entries of the category")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	query := url.Values{"limit": {strconv.Itoa(*limit)}, "offset": {strconv.Itoa(*offset)}}
+	if *category != "" {
+		query.Set("category", *category)
+	}
+	status, data, err := c.do(http.MethodGet, "/domains", query, "", nil)
+	if err != nil || status != http.StatusOK {
+		return c.report(status, data, err)
+	}
+	if c.output == outputJSON {
+		printJSON(data)
+		return 0
+	}
+	var page listPage
+	if err := json.Unmarshal(data, &page); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "DOMAIN\tMODE")
+	for _, e := range page.Domains {
+		fmt.Fprintf(table, "%s\t%s\n", e.Domain, e.Mode)
+	}
+	table.Flush()
+	if len(page.Domains) != 0 {
+		fmt.Printf("\n%d-%d of %d\n", page.Offset+1, page.Offset+len(page.Domains), page.Total)
+	} else {
+		fmt.Printf("\n0 of %d\n", page.Total)
+	}
+	return 0
+}
+
+// importList uploads a list file, or the standard input for "-".
+func (c *client) importList(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: proxyctl import file")
+		return 2
+	}
+	var body io.Reader = os.Stdin
+	if path := args[0]; path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+		body = file
+	}
+	return c.report(c.do(http.MethodPost, "/domains/import", nil, "text/plain", body))
+}
+
+// backfill uploads the hosts files or browser extension exports of a
+// device, named after this host by default. Files ending with ".json" are
+// sent as exports, others as hosts files.
+func (c *client) backfill(args []string) int {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	hostname, _ := os.Hostname()
+	device := flags.String("device", hostname, "name of the device the files come from")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 || *device == "" {
+		fmt.Fprintln(os.Stderr, "usage: proxyctl backfill [-device name] file...")
+		return 2
+	}
+	code := 0
+	for _, path := range flags.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		contentType := "text/plain"
+		if strings.EqualFold(filepath.Ext(path), ".json") {
+			contentType = "application/json"
+		}
+		fmt.Fprintf(os.Stderr, "%s:\n", path)
+		code = max(code, c.report(c.do(http.MethodPost, "/domains/backfill", url.Values{"device": {*device}}, contentType, file)))
+		file.Close()
+	}
+	return code
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var configPath *string = flag.String("config", "", "path to a YAML file with settings keyed by their flag names")
+
+var printConfig *bool = flag.Bool("print-config", false, "print the effective configuration, including defaults, and exit")
+
+// Prefix of the environment variables overriding settings, e.g.
+// PROXY_PROXY_ADDRESS for -proxy-address.
+const envPrefix string = "PROXY_"
+
+// Settings that only control how the configuration itself is loaded.
+var metaSettings = map[string]bool{"config": true, "print-config": true}
+
+// Settings holding secrets, which -print-config doesn't show. The
+// connection strings of MySQL and the keyword ones of PostgreSQL aren't
+// URLs, so -database is hidden whole rather than only its password.
+var secretSettings = map[string]bool{"api-keys": true, "primary-api-key": true, "database": true}
+
+func envName(setting string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+// loadConfig fills in the settings not given on the command line from the
+// environment and, with lower precedence, from the configuration file.
+func loadConfig() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if *configPath != "" {
+		if err := applyConfigFile(*configPath, explicit); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || explicit[f.Name] || metaSettings[f.Name] || err != nil {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("%s: %v", envName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// applyConfigFile sets the settings listed in the file. Unknown settings
+// are rejected with their position, so typos don't go unnoticed.
+func applyConfigFile(path string, explicit map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d:%d: excepted a mapping of settings", path, root.Line, root.Column)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, node := root.Content[i], root.Content[i+1]
+		f := flag.Lookup(key.Value)
+		if f == nil || metaSettings[key.Value] {
+			return fmt.Errorf("%s:%d:%d: unknown setting \"%s\"", path, key.Line, key.Column, key.Value)
+		}
+		if seen[key.Value] {
+			return fmt.Errorf("%s:%d:%d: setting \"%s\" is repeated", path, key.Line, key.Column, key.Value)
+		}
+		seen[key.Value] = true
+
+		value, err := settingValue(node)
+		if err != nil {
+			return fmt.Errorf("%s:%d:%d: %s: %v", path, node.Line, node.Column, key.Value, err)
+		}
+		if explicit[key.Value] {
+			continue
+		}
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("%s:%d:%d: %s: %v", path, node.Line, node.Column, key.Value, err)
+		}
+	}
+	return nil
+}
+
+// settingValue converts a scalar or a list of scalars, which becomes a
+// comma-separated value, into the flag syntax.
+func settingValue(node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Value, nil
+	case yaml.SequenceNode:
+		items := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", errors.New("excepted a list of scalars")
+			}
+			items = append(items, item.Value)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", errors.New("excepted a scalar or a list of scalars")
+}
+
+// printEffectiveConfig writes every setting with its effective value, in
+// the same order as -help lists them and in the configuration file syntax.
+// Credentials are redacted.
+func printEffectiveConfig(w io.Writer) {
+	flag.VisitAll(func(f *flag.Flag) {
+		if metaSettings[f.Name] {
+			return
+		}
+		value := f.Value.String()
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			value = u.Redacted()
+		}
+		if secretSettings[f.Name] && value != "" {
+			value = "xxxxx"
+		}
+		fmt.Fprintf(w, "%s: %q\n", f.Name, value)
+	})
+}
+
+// validateConfig checks the settings up front, so a typo fails the start
+// with a message naming the setting instead of surfacing later.
+func validateConfig() error {
+	addresses := []struct {
+		name     string
+		value    string
+		optional bool
+	}{
+		{"address", *address, false},
+		{"proxy-address", *proxyAddress, true},
+		{"socks-address", *socksAddress, true},
+		{"rpz-address", *rpzAddress, true},
+		{"dns-address", *dnsAddress, true},
+	}
+	for _, a := range addresses {
+		if a.value == "" && a.optional {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(a.value); err != nil {
+			return fmt.Errorf("-%s: %v", a.name, err)
+		}
+	}
+	if err := validateLocale(*locale); err != nil {
+		return fmt.Errorf("-locale: %v", err)
+	}
+	if _, err := parsePrefixes(*trustedProxies); err != nil {
+		return fmt.Errorf("-trusted-proxies: %v", err)
+	}
+	if _, err := newLogHandler(*logFormat, *logLevel); err != nil {
+		return fmt.Errorf("logging settings: %v", err)
+	}
+	if _, err := parsePolicies(*defaultPolicy, *clientPolicies); err != nil {
+		return fmt.Errorf("policy settings: %v", err)
+	}
+	if _, err := parseCORS(*corsOrigins, *corsMethods, *corsHeaders); err != nil {
+		return fmt.Errorf("CORS settings: %v", err)
+	}
+	if _, err := parseAPIKeys(*apiKeys); err != nil {
+		return fmt.Errorf("-api-keys: %v", err)
+	}
+	if _, err := newAPITLSConfig(); err != nil {
+		return fmt.Errorf("TLS settings: %v", err)
+	}
+	if _, err := newStore(*databaseBackend); err != nil {
+		return fmt.Errorf("-database-backend: %v", err)
+	}
+	if *clientRateLimit < 0 || *keyRateLimit < 0 {
+		return errors.New("-rate-limit-per-ip and -rate-limit-per-key can't be negative")
+	}
+	if *rateLimitBurst <= 0 {
+		return errors.New("-rate-limit-burst must be positive")
+	}
+	if *publicCheckRate <= 0 {
+		return errors.New("-public-check-rate must be positive")
+	}
+	if _, err := parseFieldHooks(*fieldHooks); err != nil {
+		return fmt.Errorf("-field-hooks: %v", err)
+	}
+	if *publicExportMaxAge < 0 {
+		return errors.New("-public-export-max-age can't be negative")
+	}
+	if *httpCacheMemory < 0 || *httpCacheDisk < 0 {
+		return errors.New("-http-cache-memory and -http-cache-disk can't be negative")
+	}
+	if *httpCacheMaxObject <= 0 {
+		return errors.New("-http-cache-max-object must be positive")
+	}
+	if _, err := parsePrefixes(*proxyPrivateNetworks); err != nil {
+		return fmt.Errorf("-proxy-private-networks: %v", err)
+	}
+	if _, err := parseConnectPorts(*connectPorts); err != nil {
+		return fmt.Errorf("-connect-ports: %v", err)
+	}
+	if _, err := parseCacheTTLs(*httpCacheTTL); err != nil {
+		return fmt.Errorf("-http-cache-ttl: %v", err)
+	}
+	if _, err := parseCategories(*disabledCategories); err != nil {
+		return fmt.Errorf("-disabled-categories: %v", err)
+	}
+	if _, err := parseTimezone(*timezone); err != nil {
+		return fmt.Errorf("-timezone: %v", err)
+	}
+	if _, err := parseFeatures(*enabledFeatures); err != nil {
+		return fmt.Errorf("-features: %v", err)
+	}
+	if _, err := parseMITMHosts(*mitmHosts); err != nil {
+		return fmt.Errorf("-mitm-hosts: %v", err)
+	}
+	if _, err := parsePrimary(*primaryURL); err != nil {
+		return fmt.Errorf("-primary: %v", err)
+	}
+	if *statsRetention < 0 {
+		return errors.New("-stats-retention can't be negative")
+	}
+	if *mirrorMemory < 0 {
+		return errors.New("-mirror-memory can't be negative")
+	}
+	if *hotDomains < 0 {
+		return errors.New("-hot-domains can't be negative")
+	}
+	if *replicaSyncInterval <= 0 {
+		return errors.New("-replica-sync-interval must be positive")
+	}
+	if _, err := parseUpstream(*proxyUpstream); err != nil {
+		return fmt.Errorf("-proxy-upstream: %v", err)
+	}
+	if *dnsAddress != "" {
+		if _, err := newDNSServer(*dnsUpstream, *dnsSinkhole); err != nil {
+			return fmt.Errorf("DNS settings: %v", err)
+		}
+	}
+	if *rpzAddress != "" {
+		if _, err := newRPZServer(*rpzZone, *rpzNotify, *rpzAllow, *rpzLanding); err != nil {
+			return fmt.Errorf("RPZ settings: %v", err)
+		}
+	}
+	return nil
+}
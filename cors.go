@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var corsOrigins *string = flag.String("cors-origins", "", "comma-separated origins, like https://admin.example.com, browsers may call the API from, or * for any (none if empty)")
+
+var corsMethods *string = flag.String("cors-methods", "GET, POST, PUT, PATCH, DELETE", "comma-separated methods cross-origin requests may use")
+
+var corsHeaders *string = flag.String("cors-headers", "Authorization, Content-Type, If-Match, Accept-Language", "comma-separated headers cross-origin requests may send")
+
+// How long browsers may cache the answer to a preflight request.
+const corsMaxAge = 10 * time.Minute
+
+// Headers of the responses the scripts of other origins may read.
+const corsExposedHeaders = "ETag, Location, Link, Retry-After, Deprecation, Content-Disposition, X-Request-ID"
+
+type corsPolicy struct {
+	// nil allows any origin.
+	origins []string
+	methods string
+	headers string
+}
+
+// parseCORS parses the settings of -cors-origins, -cors-methods and
+// -cors-headers, returning nil if no origin is allowed.
+func parseCORS(origins string, methods string, headers string) (*corsPolicy, error) {
+	list := splitList(origins)
+	if len(list) == 0 {
+		return nil, nil
+	}
+	policy := &corsPolicy{methods: strings.Join(splitList(methods), ", "), headers: strings.Join(splitList(headers), ", ")}
+	if !slices.Contains(list, "*") {
+		for _, origin := range list {
+			u, err := url.Parse(origin)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+				return nil, fmt.Errorf("origin \"%s\" isn't a scheme and a host, like https://admin.example.com", origin)
+			}
+			policy.origins = append(policy.origins, strings.ToLower(origin))
+		}
+	}
+	for _, method := range splitList(methods) {
+		if method != strings.ToUpper(method) || strings.ContainsAny(method, " ;") {
+			return nil, fmt.Errorf("method \"%s\" isn't an uppercase method", method)
+		}
+	}
+	return policy, nil
+}
+
+// splitList splits a comma-separated setting, dropping the spaces and the
+// empty items.
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (p *corsPolicy) allows(origin string) bool {
+	return p.origins == nil || slices.Contains(p.origins, strings.ToLower(origin))
+}
+
+// withCORS lets browsers call the API from the origins of the policy. It
+// answers preflight requests itself, before the authentication, as browsers
+// send them without the credentials. A nil policy adds nothing.
+func withCORS(policy *corsPolicy, next http.Handler) http.Handler {
+	if policy == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !policy.allows(origin) {
+			if preflight {
+				respondWithError(w, &APIError{Code: CodeOriginNotAllowed, Status: "error", StatusCode: http.StatusForbidden, Message: localize(r, "Origin \"%s\" isn't allowed to call the API.", origin)})
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", policy.methods)
+		w.Header().Set("Access-Control-Allow-Headers", policy.headers)
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const decisionsFilter string = statsFilter + " AND domain_name = ?"
+
+const countDecisionsStmt string = "SELECT COUNT(*) FROM query_stats" + decisionsFilter
+
+const listDecisionsStmt string = "SELECT bucket, client, via, blocked, hits FROM query_stats" + decisionsFilter + " ORDER BY bucket, client, via, blocked LIMIT ? OFFSET ?"
+
+// The names the changes may be of are appended with valuesList, closed by
+// ruleChangesOrder.
+const ruleChangesStmt string = "SELECT id, recorded_at, actor, client_addr, list, action, domain_name, mode FROM audit_log WHERE list IN (?, ?) AND recorded_at < ? AND (mode = ? OR domain_name IN "
+
+const ruleChangesOrder string = ") ORDER BY id"
+
+// RuleChangeSchema is a change of the audit log to an entry of the
+// blocklist or the allowlist covering the name.
+type RuleChangeSchema struct {
+	ID int64 `json:"id"`
+	AuditEntrySchema
+}
+
+// DecisionSchema counts the same decisions for a client in a minute.
+type DecisionSchema struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Via      string    `json:"via"`
+	Decision string    `json:"decision"`
+	Hits     int64     `json:"hits"`
+	// ID of the change the rules covering the name were at, or 0 if they
+	// weren't changed since the audit log began.
+	RuleChange int64 `json:"ruleChange,omitempty"`
+}
+
+type DecisionLogSchema struct {
+	Domain string    `json:"domain"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+	// The changes in the range, after the last one before it, which the
+	// rules were at when it began.
+	Changes   []RuleChangeSchema `json:"changes"`
+	Decisions []DecisionSchema   `json:"decisions"`
+	Page
+}
+
+// coveredBy reports whether the entry matches the name.
+func coveredBy(name string, entry DomainEntry) bool {
+	switch entry.Mode {
+	case ModeSubdomain:
+		return name == entry.Domain || strings.HasSuffix(name, "."+entry.Domain)
+	case ModeWildcard:
+		matched, _ := path.Match(entry.Domain, name)
+		return matched
+	}
+	return name == entry.Domain
+}
+
+// decisionsHandler serves GET /domains/{name}/decisions, the decisions
+// recorded for the name in the range of ?since and ?until, and the
+// changes of the audit log to the entries of the blocklist and the
+// allowlist covering it. Every decision refers to the latest change made
+// before the end of its minute. Changes the service makes on its own and
+// those to patterns, policies and schedules aren't in the audit log.
+func decisionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	name, apiErr := checkedDomain(r, r.PathValue("name"))
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	q, apiErr := parseStatsQuery(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	page, apiErr := parsePage(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+
+	schema := DecisionLogSchema{Domain: name, Since: q.since, Until: q.until, Changes: make([]RuleChangeSchema, 0), Decisions: make([]DecisionSchema, 0), Page: page}
+	args := append(q.args(), name)
+	if err := db.QueryRowContext(r.Context(), countDecisionsStmt, args...).Scan(&schema.Total); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	changes, err := ruleChanges(r, name, q.until)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	first := slices.IndexFunc(changes, func(change RuleChangeSchema) bool { return !change.Time.Before(q.since) })
+	if first == -1 {
+		first = len(changes)
+	}
+	schema.Changes = append(schema.Changes, changes[max(first-1, 0):]...)
+
+	rows, err := db.QueryContext(r.Context(), listDecisionsStmt, append(args, page.Limit, page.Offset)...)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	next := 0
+	var ruleChange int64
+	for rows.Next() {
+		var bucket int64
+		var blocked bool
+		var decision DecisionSchema
+		if err := rows.Scan(&bucket, &decision.Client, &decision.Via, &blocked, &decision.Hits); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if decision.Client, err = openField(FieldClientAddr, decision.Client); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		decision.Time = time.Unix(bucket, 0).UTC()
+		decision.Decision = decisionAllowed
+		if blocked {
+			decision.Decision = decisionBlocked
+		}
+		end := decision.Time.Add(statsBucket)
+		for ; next < len(changes) && changes[next].Time.Before(end); next++ {
+			ruleChange = changes[next].ID
+		}
+		decision.RuleChange = ruleChange
+		schema.Decisions = append(schema.Decisions, decision)
+	}
+	if err := rows.Err(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	respondWithPage(w, r, &schema.Page, &schema)
+}
+
+// ruleChanges returns the changes to the entries covering the name made
+// before until, oldest first.
+func ruleChanges(r *http.Request, name string, until time.Time) ([]RuleChangeSchema, error) {
+	names := []string{name}
+	for parent := name; strings.Contains(parent, "."); {
+		_, parent, _ = strings.Cut(parent, ".")
+		names = append(names, parent)
+	}
+	args := []any{auditBlocklist, auditAllowlist, until.Unix(), ModeWildcard}
+	for _, candidate := range names {
+		args = append(args, candidate)
+	}
+	rows, err := db.QueryContext(r.Context(), ruleChangesStmt+valuesList(1, len(names))+ruleChangesOrder, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := make([]RuleChangeSchema, 0)
+	for rows.Next() {
+		var change RuleChangeSchema
+		var recordedAt int64
+		if err := rows.Scan(&change.ID, &recordedAt, &change.Actor, &change.ClientAddr, &change.List, &change.Action, &change.Domain, &change.Mode); err != nil {
+			return nil, err
+		}
+		if change.ClientAddr, err = openField(FieldClientAddr, change.ClientAddr); err != nil {
+			return nil, err
+		}
+		if !coveredBy(name, DomainEntry{Domain: change.Domain, Mode: change.Mode}) {
+			continue
+		}
+		change.Time = time.Unix(recordedAt, 0).UTC()
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+var proxyPrivateNetworks *string = flag.String("proxy-private-networks", "", "comma-separated addresses or CIDR networks the proxies may connect to although they are loopback, private or link-local (none if empty)")
+
+var connectPorts *string = flag.String("connect-ports", "443", "comma-separated ports the HTTP proxy opens CONNECT tunnels to")
+
+// forbiddenDestinationError is the error of a connection the proxies refuse
+// to open, so they can't be used to reach the host they run on or its
+// networks.
+type forbiddenDestinationError struct {
+	address string
+}
+
+func (e forbiddenDestinationError) Error() string {
+	return fmt.Sprintf("connecting to %s isn't allowed", e.address)
+}
+
+// destinationPolicy decides which addresses the proxies may connect to.
+// Addresses are checked once resolved, right before connecting, so a name
+// resolving to another address the second time can't get around it.
+type destinationPolicy struct {
+	mu      sync.RWMutex
+	private []netip.Prefix
+	ports   map[uint16]bool
+	// The addresses the services of this instance listen on, and the
+	// addresses of the interfaces, which the ones listening on all of
+	// them are reachable at.
+	listeners []netip.AddrPort
+	local     map[netip.Addr]bool
+}
+
+var destinations = &destinationPolicy{ports: map[uint16]bool{443: true}}
+
+func parseConnectPorts(list string) (map[uint16]bool, error) {
+	ports := make(map[uint16]bool)
+	for _, item := range splitList(list) {
+		port, err := strconv.ParseUint(item, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("\"%s\" isn't a port", item)
+		}
+		ports[uint16(port)] = true
+	}
+	return ports, nil
+}
+
+// setDestinations applies -proxy-private-networks and -connect-ports,
+// before the proxies listen.
+func setDestinations() error {
+	private, err := parsePrefixes(*proxyPrivateNetworks)
+	if err != nil {
+		return err
+	}
+	ports, err := parseConnectPorts(*connectPorts)
+	if err != nil {
+		return err
+	}
+	local := make(map[netip.Addr]bool)
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if prefix, err := netip.ParsePrefix(addr.String()); err == nil {
+				local[prefix.Addr().Unmap()] = true
+			}
+		}
+	}
+	destinations.mu.Lock()
+	defer destinations.mu.Unlock()
+	destinations.private, destinations.ports, destinations.local = private, ports, local
+	destinations.listeners = nil
+	return nil
+}
+
+// listening adds the address a service listens on, which the proxies never
+// connect to, even in -proxy-private-networks.
+func (p *destinationPolicy) listening(address string) {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.listeners = append(p.listeners, netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()))
+}
+
+// check returns a forbiddenDestinationError if the proxies must not connect
+// to the address: a service of this instance, or a loopback, private,
+// link-local or unspecified address outside -proxy-private-networks.
+func (p *destinationPolicy) check(addr netip.AddrPort) error {
+	ip := addr.Addr().Unmap()
+	forbidden := forbiddenDestinationError{address: addr.String()}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, listener := range p.listeners {
+		if listener.Port() != addr.Port() {
+			continue
+		}
+		if listener.Addr() == ip || listener.Addr().IsUnspecified() && (p.local[ip] || ip.IsLoopback() || ip.IsUnspecified()) {
+			return forbidden
+		}
+	}
+	for _, prefix := range p.private {
+		if prefix.Contains(ip) {
+			return nil
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return forbidden
+	}
+	return nil
+}
+
+// control is the net.Dialer.Control of the connections to destinations,
+// called with the resolved address.
+func (p *destinationPolicy) control(network string, address string, _ syscall.RawConn) error {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	return p.check(addr)
+}
+
+// resolve resolves the host of the address for an upstream proxy, which
+// would resolve it again otherwise, and returns the address with the first
+// IP. Every IP of the host must be allowed.
+func (p *destinationPolicy) resolve(ctx context.Context, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid port \"%s\"", port)
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if err := p.check(netip.AddrPortFrom(ip, uint16(number))); err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(ips[0].Unmap().String(), port), nil
+}
+
+// allowsConnect reports whether CONNECT tunnels may be opened to the port.
+func (p *destinationPolicy) allowsConnect(port string) bool {
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.ports[uint16(number)]
+}
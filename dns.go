@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var dnsAddress *string = flag.String("dns-address", "", "address for the DNS server blocking domains and forwarding the other queries (disabled if empty)")
+
+var dnsUpstream *string = flag.String("dns-upstream", "1.1.1.1:53", "address of the resolver the DNS server forwards queries for allowed domains to")
+
+var dnsSinkhole *string = flag.String("dns-sinkhole", "", "comma-separated addresses blocked domains resolve to instead of NXDOMAIN (e.g. 0.0.0.0, ::)")
+
+const (
+	dnsTTL     = 60
+	dnsTimeout = 5 * time.Second
+	// Large enough for any EDNS0 UDP payload.
+	dnsMaxUDPSize = 65535
+)
+
+// dnsServer answers queries for blocked domains itself and forwards the
+// rest to the upstream resolver, over the transport the query came in.
+type dnsServer struct {
+	upstream string
+	sinkhole []netip.Addr
+}
+
+func newDNSServer(upstream string, sinkhole string) (*dnsServer, error) {
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		return nil, err
+	}
+	addrs, err := parseAddrs(sinkhole)
+	if err != nil {
+		return nil, err
+	}
+	return &dnsServer{upstream: upstream, sinkhole: addrs}, nil
+}
+
+func (s *dnsServer) serve(tcp net.Listener, udp net.PacketConn) error {
+	errc := make(chan error, 2)
+	go func() { errc <- s.serveTCP(tcp) }()
+	go func() { errc <- s.serveUDP(udp) }()
+	return <-errc
+}
+
+func (s *dnsServer) serveUDP(conn net.PacketConn) error {
+	buf := make([]byte, dnsMaxUDPSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.answer(query, "udp", netAddr(addr)); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *dnsServer) serveTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *dnsServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(rpzTimeout))
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		resp := s.answer(query, "tcp", netAddr(conn.RemoteAddr()))
+		if resp == nil {
+			return
+		}
+		if err := writeTCPMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint16(len(msg))); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// answer returns the response to a query, or nil for malformed queries,
+// which are dropped.
+func (s *dnsServer) answer(query []byte, network string, client netip.Addr) []byte {
+	activeDNSQueries.Add(1)
+	defer activeDNSQueries.Add(-1)
+	defer delayPacket()
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil
+	}
+
+	var resp []byte
+	if enforce(client, strings.TrimSuffix(question.Name.String(), "."), viaDNS) {
+		msg := s.blocked(header, question)
+		resp, err = msg.Pack()
+	} else if resp, err = s.forward(query, network); err != nil {
+		slog.Warn("Forwarding of DNS query failed", "name", question.Name.String(), "error", err)
+		msg := s.reply(header, question, dnsmessage.RCodeServerFailure)
+		resp, err = msg.Pack()
+	}
+	if err != nil {
+		slog.Error("Packing of DNS response failed", "error", err)
+		return nil
+	}
+	return resp
+}
+
+func (s *dnsServer) reply(header dnsmessage.Header, question dnsmessage.Question, rcode dnsmessage.RCode) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			OpCode:             header.OpCode,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+}
+
+// blocked answers NXDOMAIN or, with a sinkhole, the sinkhole addresses of
+// the queried family. Other types get an empty answer.
+func (s *dnsServer) blocked(header dnsmessage.Header, question dnsmessage.Question) dnsmessage.Message {
+	if len(s.sinkhole) == 0 {
+		return s.reply(header, question, dnsmessage.RCodeNameError)
+	}
+	resp := s.reply(header, question, dnsmessage.RCodeSuccess)
+	for _, addr := range s.sinkhole {
+		rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+		switch {
+		case addr.Is4() && question.Type == dnsmessage.TypeA:
+			rh.Type = dnsmessage.TypeA
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AResource{A: addr.As4()}})
+		case addr.Is6() && question.Type == dnsmessage.TypeAAAA:
+			rh.Type = dnsmessage.TypeAAAA
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	return resp
+}
+
+// forward relays the query as is, so EDNS0 options and the ID survive.
+// A truncated UDP response makes the client retry over TCP, which is
+// forwarded over TCP in turn.
+func (s *dnsServer) forward(query []byte, network string) ([]byte, error) {
+	conn, err := net.DialTimeout(network, s.upstream, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxUDPSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	if n < 2 || binary.BigEndian.Uint16(buf) != binary.BigEndian.Uint16(query) {
+		return nil, errors.New("upstream response doesn't match the query")
+	}
+	return buf[:n], nil
+}
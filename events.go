@@ -0,0 +1,156 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Types of the events published on the bus.
+const (
+	EventEntryAdded    = "entry.added"
+	EventEntryRemoved  = "entry.removed"
+	EventFeedRefreshed = "feed.refreshed"
+	EventBlockEnforced = "block.enforced"
+	// A block recorded instead of enforced, under -monitor or a policy in
+	// monitor mode.
+	EventBlockMonitored = "block.monitored"
+	EventQueryAllowed   = "query.allowed"
+	EventDomainChecked  = "domain.checked"
+	EventAuthFailed     = "auth.failed"
+	// Observe mode turned on or off.
+	EventObserveChanged = "observe.changed"
+)
+
+// Where a block was enforced, or a name checked.
+const (
+	viaProxy = "proxy"
+	viaSocks = "socks"
+	viaDNS   = "dns"
+	viaMITM  = "mitm"
+	viaCheck = "check"
+)
+
+// Event is something that happened in the service. Only the fields of its
+// type are set.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// The entry added or removed.
+	Entry *DomainEntry `json:"entry,omitempty"`
+	// The URL of the refreshed feed and the number of entries it added
+	// and removed.
+	Source  string `json:"source,omitempty"`
+	Added   int    `json:"added,omitempty"`
+	Removed int    `json:"removed,omitempty"`
+	// The name blocked, allowed or checked, where and for which client,
+	// or the client that failed to authenticate.
+	Domain string `json:"domain,omitempty"`
+	Via    string `json:"via,omitempty"`
+	Client string `json:"client,omitempty"`
+	// Whether the checked name is blocked.
+	Blocked bool `json:"blocked,omitempty"`
+	// Whether observe mode was turned on.
+	Enabled bool `json:"enabled,omitempty"`
+}
+
+// Events published, by type, at /debug/vars.
+var eventCounts = expvar.NewMap("events")
+
+// subscription receives the events of its types on C.
+type subscription struct {
+	C     chan Event
+	types map[string]bool
+	bus   *eventBus
+}
+
+// eventBus delivers every published event to the subscriptions to its
+// type. Publishing never blocks: a subscriber whose buffer is full misses
+// the event, so one that only needs to know that something happened can
+// subscribe with a buffer of 1.
+type eventBus struct {
+	mu            sync.RWMutex
+	subscriptions map[*subscription]bool
+}
+
+var events = &eventBus{subscriptions: make(map[*subscription]bool)}
+
+// subscribe subscribes to the events of the types, or to all of them if
+// none is given.
+func (b *eventBus) subscribe(buffer int, types ...string) *subscription {
+	s := &subscription{C: make(chan Event, buffer), bus: b}
+	if len(types) != 0 {
+		s.types = make(map[string]bool, len(types))
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscriptions[s] = true
+	return s
+}
+
+// close stops the delivery of events and closes C.
+func (s *subscription) close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if s.bus.subscriptions[s] {
+		delete(s.bus.subscriptions, s)
+		close(s.C)
+	}
+}
+
+func (b *eventBus) publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	eventCounts.Add(e.Type, 1)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subscriptions {
+		if s.types != nil && !s.types[e.Type] {
+			continue
+		}
+		select {
+		case s.C <- e:
+		default:
+		}
+	}
+}
+
+// enforce reports whether the host is blocked for the client, like
+// isBlocked, and publishes the decision. Hosts it doesn't block are
+// checked against the sources in their canary period.
+func enforce(client netip.Addr, host string, via string) bool {
+	if !isBlocked(client, host) {
+		canaries.observe(client, host, via)
+		events.publish(Event{Type: EventQueryAllowed, Domain: lookupName(host), Via: via, Client: client.String()})
+		return false
+	}
+	return enforceBlock(client, lookupName(host), via)
+}
+
+// monitored reports whether blocks are only recorded for the client, under
+// observe mode or its named policy.
+func monitored(client netip.Addr) bool {
+	if observe.isEnabled() {
+		return true
+	}
+	policy := namedPolicies.lookup(client)
+	return policy != nil && policy.schema.Monitor
+}
+
+// enforceBlock publishes a block of the name for the client, and reports
+// whether it is enforced rather than monitored.
+func enforceBlock(client netip.Addr, name string, via string) bool {
+	if monitored(client) {
+		slog.Info("Block monitored", "domain", name, "via", via, "client", client.String())
+		events.publish(Event{Type: EventBlockMonitored, Domain: name, Via: via, Client: client.String()})
+		return false
+	}
+	events.publish(Event{Type: EventBlockEnforced, Domain: name, Via: via, Client: client.String()})
+	return true
+}
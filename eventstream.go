@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Events a stream may fall behind by before it misses some.
+	eventStreamBuffer = 256
+	// Comments keep idle streams from being closed by proxies in between.
+	eventStreamKeepAlive = 15 * time.Second
+)
+
+// Types GET /events streams, and the ones it streams without ?types.
+var (
+	streamedEvents        = []string{EventEntryAdded, EventEntryRemoved, EventFeedRefreshed, EventBlockEnforced, EventBlockMonitored, EventQueryAllowed, EventDomainChecked, EventAuthFailed, EventObserveChanged}
+	defaultStreamedEvents = []string{EventEntryAdded, EventEntryRemoved, EventBlockEnforced, EventBlockMonitored}
+)
+
+// streamsDone is closed when the API server shuts down, so the streams end
+// instead of holding the shutdown until its timeout.
+var streamsDone = make(chan struct{})
+
+var closeStreamsOnce sync.Once
+
+func closeEventStreams() {
+	closeStreamsOnce.Do(func() { close(streamsDone) })
+}
+
+// eventsHandler serves GET /events, a stream of server-sent events of the
+// types of ?types, comma-separated. Every event is sent with its type as
+// the name and the JSON of the Event as the data.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	types := defaultStreamedEvents
+	if param := r.URL.Query().Get("types"); param != "" {
+		types = strings.Split(param, ",")
+		for _, t := range types {
+			if !slices.Contains(streamedEvents, t) {
+				respondWithError(w, &APIError{Code: CodeInvalidParameter, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Event type \"%s\" is unknown; excepted one of %s.", t, strings.Join(streamedEvents, ", "))})
+				return
+			}
+		}
+	}
+	rc := http.NewResponseController(w)
+
+	stream := events.subscribe(eventStreamBuffer, types...)
+	defer stream.close()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-streamsDone:
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case e := <-stream.C:
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
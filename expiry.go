@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const selectExpiredStmt string = "SELECT domain_name, mode FROM blocked_domains WHERE expires_at <= ?"
+
+const deleteExpiredStmt string = "DELETE FROM blocked_domains WHERE domain_name = ? AND expires_at <= ?"
+
+const nextExpiryStmt string = "SELECT MIN(expires_at) FROM blocked_domains"
+
+const entryExpiryStmt string = "SELECT expires_at FROM blocked_domains WHERE domain_name = ?"
+
+// The janitor looks for expired entries at least this often, so entries
+// added by other instances sharing the database expire too.
+const maxExpiryWait = time.Minute
+
+// expiryScheduled wakes the janitor up when an entry with an expiry is
+// added, so it can wait for the earliest one.
+var expiryScheduled = make(chan struct{}, 1)
+
+func scheduleExpiry() {
+	select {
+	case expiryScheduled <- struct{}{}:
+	default:
+	}
+}
+
+// resolveExpiry turns the TTL of the entry into the time it expires at.
+// An entry may have either, or neither if it doesn't expire.
+func (e *NewEntry) resolveExpiry(now time.Time) error {
+	if e.TTL != "" {
+		if e.ExpiresAt != nil {
+			return errors.New("expiresAt and ttl can't be given together")
+		}
+		ttl, err := time.ParseDuration(e.TTL)
+		if err != nil {
+			return errors.New("ttl must be a duration such as \"90m\"")
+		}
+		expiresAt := now.Add(ttl)
+		e.ExpiresAt, e.TTL = &expiresAt, ""
+	}
+	if e.ExpiresAt != nil && !e.ExpiresAt.After(now) {
+		return errors.New("entry would expire right away")
+	}
+	return nil
+}
+
+// expiryValue is the stored form of an expiry, NULL if there is none.
+func expiryValue(expiresAt *time.Time) any {
+	if expiresAt == nil {
+		return nil
+	}
+	return expiresAt.Unix()
+}
+
+// entryExpiry returns the time the stored entry expires at, or nil.
+func entryExpiry(r *http.Request, domain string) (*time.Time, error) {
+	var stored sql.NullInt64
+	err := db.QueryRowContext(r.Context(), entryExpiryStmt, domain).Scan(&stored)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !stored.Valid) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Unix(stored.Int64, 0).UTC()
+	return &expiresAt, nil
+}
+
+// removeExpired removes the entries that expired. Like the sync of a
+// source, the removal is journaled but not audited, and the entries aren't
+// moved to the trash.
+func removeExpired(ctx context.Context) error {
+	now := time.Now().Unix()
+	tx, err := beginChange(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(selectExpiredStmt, now)
+	if err != nil {
+		return err
+	}
+	expired := make([]DomainEntry, 0)
+	for rows.Next() {
+		var entry DomainEntry
+		if err := rows.Scan(&entry.Domain, &entry.Mode); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	removed := 0
+	for _, entry := range expired {
+		result, err := tx.Exec(deleteExpiredStmt, entry.Domain, now)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			continue
+		}
+		if err := tx.record(entry, true); err != nil {
+			return err
+		}
+		removed++
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.Info("Expired entries removed", "count", removed)
+	return nil
+}
+
+// runExpiry removes the entries as they expire until ctx is done.
+func runExpiry(ctx context.Context) {
+	for {
+		if err := removeExpired(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Removing of the expired entries failed", "error", err)
+		}
+
+		wait := maxExpiryWait
+		var next sql.NullInt64
+		if err := db.QueryRowContext(ctx, nextExpiryStmt).Scan(&next); err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Looking up the next expiry failed", "error", err)
+			}
+		} else if next.Valid {
+			wait = min(max(time.Until(time.Unix(next.Int64, 0)), time.Second), maxExpiryWait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-expiryScheduled:
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const exportStmt string = "SELECT domain_name, mode FROM " + allEntries + " ORDER BY domain_name"
+
+// exportFormat writes the entries of the blocklist in the syntax of a
+// consumer. Entries the syntax can't express are written as comments.
+type exportFormat struct {
+	contentType string
+	extension   string
+	header      string
+	footer      string
+	write       func(w io.Writer, entry DomainEntry, first bool) error
+}
+
+var exportFormats = map[string]exportFormat{
+	"json": {
+		contentType: "application/json",
+		extension:   "json",
+		header:      "[",
+		footer:      "]\n",
+		write: func(w io.Writer, entry DomainEntry, first bool) error {
+			if !first {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(data)
+			return err
+		},
+	},
+	// Hosts files can only block names exactly.
+	"hosts": {
+		contentType: "text/plain; charset=utf-8",
+		extension:   "txt",
+		write: func(w io.Writer, entry DomainEntry, first bool) error {
+			if entry.Mode == ModeWildcard {
+				_, err := fmt.Fprintf(w, "# %s (wildcards aren't supported)\n", entry.Domain)
+				return err
+			}
+			_, err := fmt.Fprintf(w, "0.0.0.0 %s\n", entry.Domain)
+			return err
+		},
+	},
+	// In dnsmasq, address= blocks a domain with its subdomains and
+	// host-record only the name itself.
+	"dnsmasq": {
+		contentType: "text/plain; charset=utf-8",
+		extension:   "conf",
+		write: func(w io.Writer, entry DomainEntry, first bool) error {
+			var err error
+			switch entry.Mode {
+			case ModeSubdomain:
+				_, err = fmt.Fprintf(w, "address=/%s/0.0.0.0\n", entry.Domain)
+			case ModeExact:
+				_, err = fmt.Fprintf(w, "host-record=%s,0.0.0.0\n", entry.Domain)
+			default:
+				_, err = fmt.Fprintf(w, "# %s (wildcards aren't supported)\n", entry.Domain)
+			}
+			return err
+		},
+	},
+	"adguard": {
+		contentType: "text/plain; charset=utf-8",
+		extension:   "txt",
+		write: func(w io.Writer, entry DomainEntry, first bool) error {
+			_, err := fmt.Fprintln(w, adguardRule(entry))
+			return err
+		},
+	},
+}
+
+func unsupportedFormat(r *http.Request, name string) *APIError {
+	return &APIError{
+		Code:       CodeUnsupportedFormat,
+		Status:     "error",
+		StatusCode: http.StatusBadRequest,
+		Message:    localize(r, "Format \"%s\" isn't supported; excepted json, hosts, dnsmasq or adguard.", name),
+	}
+}
+
+// exportHandler streams the whole blocklist in the requested format, so
+// even lists with millions of entries are never held in memory.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = "json"
+	}
+	format, ok := exportFormats[name]
+	if !ok {
+		respondWithError(w, unsupportedFormat(r, name))
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), exportStmt)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"blocklist.%s\"", format.extension))
+	out := bufio.NewWriter(w)
+
+	// Once streaming started, a failure can only be signalled by aborting
+	// the response, so a truncated list is never taken for a complete one.
+	abort := func(err error) {
+		requestLogger(r).Error("Streaming failed", "method", r.Method, "path", r.URL.Path, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	if err := format.export(out, rows); err != nil {
+		abort(err)
+	}
+	if err := out.Flush(); err != nil {
+		abort(err)
+	}
+}
+
+// export writes the rows of exportStmt in the format.
+func (format exportFormat) export(w io.Writer, rows *sql.Rows) error {
+	if _, err := io.WriteString(w, format.header); err != nil {
+		return err
+	}
+	for first := true; rows.Next(); first = false {
+		var entry DomainEntry
+		if err := rows.Scan(&entry.Domain, &entry.Mode); err != nil {
+			return err
+		}
+		if err := format.write(w, entry, first); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, format.footer)
+	return err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Experimental subsystems that are off unless enabled in the configuration
+// or through /control/features/set.
+const (
+	FeatureMITM             = "mitm"
+	FeatureRegexRules       = "regex-rules"
+	FeatureAnomalyDetection = "anomaly-detection"
+)
+
+var knownFeatures = []string{FeatureMITM, FeatureRegexRules, FeatureAnomalyDetection}
+
+var enabledFeatures *string = flag.String("features", "", "comma-separated experimental features to enable ("+strings.Join(knownFeatures, ", ")+")")
+
+type featureFlags struct {
+	mu      sync.RWMutex
+	enabled map[string]bool
+}
+
+// features holds the state of the experimental subsystems. Changes made
+// through the API last until the next restart.
+var features = &featureFlags{enabled: make(map[string]bool)}
+
+func isKnownFeature(name string) bool {
+	for _, known := range knownFeatures {
+		if known == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFeatures parses the -features list.
+func parseFeatures(list string) (map[string]bool, error) {
+	enabled := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !isKnownFeature(name) {
+			return nil, fmt.Errorf("unknown feature \"%s\"", name)
+		}
+		enabled[name] = true
+	}
+	return enabled, nil
+}
+
+func (f *featureFlags) isEnabled(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.enabled[name]
+}
+
+func (f *featureFlags) set(name string, enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.enabled[name] = enabled
+}
+
+type FeatureSchema struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+type FeaturesSchema struct {
+	Features []FeatureSchema `json:"features"`
+}
+
+func (f *featureFlags) schema() FeaturesSchema {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	schema := FeaturesSchema{Features: make([]FeatureSchema, 0, len(knownFeatures))}
+	for _, name := range knownFeatures {
+		schema.Features = append(schema.Features, FeatureSchema{Name: name, Enabled: f.enabled[name]})
+	}
+	return schema
+}
+
+func featuresHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	respondWithJSON(w, features.schema())
+}
+
+func setFeatureHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensureValidPOST(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	var body FeatureSchema
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted {\"name\", \"enabled\"} object; got invalid JSON."), Status: "error"})
+		return
+	}
+	if !isKnownFeature(body.Name) {
+		respondWithError(w, &APIError{
+			Code:       CodeFeatureNotFound,
+			Status:     "error",
+			StatusCode: http.StatusNotFound,
+			Message:    localize(r, "Feature \"%s\" doesn't exist.", body.Name),
+		})
+		return
+	}
+	features.set(body.Name, body.Enabled)
+	requestLogger(r).Info("Feature set", "feature", body.Name, "enabled", body.Enabled)
+	respondWithJSON(w, features.schema())
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+var fieldHooks *string = flag.String("field-hooks", "", "comma-separated field=hook pairs sealing the fields before they are stored; fields: "+strings.Join(sealedFields, ", ")+"; hooks: hmac, aes-gcm or ones registered by the build (none if empty)")
+
+var fieldKeyFile *string = flag.String("field-key-file", "", "file holding the secret of the field hooks, at least 32 bytes for hmac and aes-gcm")
+
+// Fields the hooks can seal.
+const (
+	// The addresses of the clients in the audit log and the statistics.
+	FieldClientAddr = "client-addr"
+	// The comments of the entries and the patterns.
+	FieldComment = "comment"
+)
+
+var sealedFields = []string{FieldClientAddr, FieldComment}
+
+// FieldHook seals the values of a field before they are stored and opens
+// them once read. Hooks of client-addr must seal a value the same way every
+// time, as the statistics are added up and filtered by it. Hashing hooks
+// can't open a value and return it as stored.
+type FieldHook interface {
+	Seal(value string) (string, error)
+	Open(sealed string) (string, error)
+}
+
+// FieldHookFactory makes a hook of the secret of -field-key-file, which is
+// nil if it isn't set.
+type FieldHookFactory func(secret []byte) (FieldHook, error)
+
+var fieldHookFactories = map[string]FieldHookFactory{
+	"hmac":    newHMACHook,
+	"aes-gcm": newAESGCMHook,
+}
+
+// registerFieldHook makes a hook available to -field-hooks. Builds
+// integrating a key management service call it from the init function of
+// a file of their own, so the storage code stays as it is.
+func registerFieldHook(name string, factory FieldHookFactory) {
+	if _, ok := fieldHookFactories[name]; ok {
+		panic(fmt.Sprintf("field hook %s registered twice", name))
+	}
+	fieldHookFactories[name] = factory
+}
+
+// The hooks of the fields, by field, set once on start.
+var fieldHookSet = make(map[string]namedFieldHook)
+
+type namedFieldHook struct {
+	name string
+	hook FieldHook
+}
+
+// Longest sealed comment MySQL stores, see 0007_sealed_comments. The
+// hooks of this file seal a comment of maxCommentLength well within it.
+const maxSealedLength = 1024
+
+// errSealedTooLong is the error of sealComment for a comment too long to
+// be stored once sealed.
+var errSealedTooLong = fmt.Errorf("sealed comment is longer than %d bytes", maxSealedLength)
+
+// parseFieldHooks parses -field-hooks into the names of the hooks by field.
+func parseFieldHooks(list string) (map[string]string, error) {
+	hooks := make(map[string]string)
+	for _, item := range splitList(list) {
+		field, name, ok := strings.Cut(item, "=")
+		field, name = strings.TrimSpace(field), strings.TrimSpace(name)
+		if !ok || field == "" || name == "" {
+			return nil, fmt.Errorf("\"%s\" isn't a field=hook pair", item)
+		}
+		if !slices.Contains(sealedFields, field) {
+			return nil, fmt.Errorf("unknown field \"%s\"", field)
+		}
+		if _, ok := fieldHookFactories[name]; !ok {
+			return nil, fmt.Errorf("unknown hook \"%s\"", name)
+		}
+		if _, ok := hooks[field]; ok {
+			return nil, fmt.Errorf("field \"%s\" is given twice", field)
+		}
+		hooks[field] = name
+	}
+	return hooks, nil
+}
+
+// setFieldHooks applies -field-hooks and -field-key-file, before anything
+// is stored.
+func setFieldHooks() error {
+	hooks, err := parseFieldHooks(*fieldHooks)
+	if err != nil || len(hooks) == 0 {
+		return err
+	}
+	var secret []byte
+	if *fieldKeyFile != "" {
+		if secret, err = os.ReadFile(*fieldKeyFile); err != nil {
+			return err
+		}
+	}
+	for field, name := range hooks {
+		hook, err := fieldHookFactories[name](secret)
+		if err != nil {
+			return fmt.Errorf("hook %s: %v", name, err)
+		}
+		fieldHookSet[field] = namedFieldHook{name: name, hook: hook}
+	}
+	return nil
+}
+
+// sealField seals the value of the field with its hook, if it has one.
+// Sealed values are stored as "$hook$sealed", so values stored before the
+// hook was set, or by another one, are told apart.
+func sealField(field string, value string) (string, error) {
+	h, ok := fieldHookSet[field]
+	if !ok || value == "" {
+		return value, nil
+	}
+	sealed, err := h.hook.Seal(value)
+	if err != nil {
+		return "", fmt.Errorf("sealing of %s failed: %v", field, err)
+	}
+	return "$" + h.name + "$" + sealed, nil
+}
+
+// sealComment seals a comment like sealField, or returns errSealedTooLong
+// if the sealed comment doesn't fit the column.
+func sealComment(comment string) (string, error) {
+	sealed, err := sealField(FieldComment, comment)
+	if err == nil && len(sealed) > maxSealedLength {
+		return "", errSealedTooLong
+	}
+	return sealed, err
+}
+
+// openField opens a stored value of the field. Values stored without a
+// hook, or with a hook the field no longer has, are returned as they are.
+func openField(field string, stored string) (string, error) {
+	h, ok := fieldHookSet[field]
+	if !ok {
+		return stored, nil
+	}
+	sealed, ok := strings.CutPrefix(stored, "$"+h.name+"$")
+	if !ok {
+		return stored, nil
+	}
+	value, err := h.hook.Open(sealed)
+	if err != nil {
+		return "", fmt.Errorf("opening of %s failed: %v", field, err)
+	}
+	return value, nil
+}
+
+// deriveKey derives a key for a purpose from the secret of -field-key-file.
+func deriveKey(secret []byte, purpose string) ([]byte, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("-field-key-file must hold at least 32 bytes")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil), nil
+}
+
+// hmacHook replaces the values with a keyed hash of them, which tells the
+// values apart but can't be reversed.
+type hmacHook struct {
+	key []byte
+}
+
+func newHMACHook(secret []byte) (FieldHook, error) {
+	key, err := deriveKey(secret, "hmac")
+	if err != nil {
+		return nil, err
+	}
+	return hmacHook{key: key}, nil
+}
+
+func (h hmacHook) Seal(value string) (string, error) {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:16]), nil
+}
+
+func (h hmacHook) Open(sealed string) (string, error) {
+	return sealed, nil
+}
+
+// aesGCMHook encrypts the values with AES-256-GCM. The nonce is a keyed
+// hash of the value, so a value is always sealed the same way, which only
+// reveals which values are equal.
+type aesGCMHook struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+func newAESGCMHook(secret []byte) (FieldHook, error) {
+	key, err := deriveKey(secret, "aes-gcm")
+	if err != nil {
+		return nil, err
+	}
+	nonceKey, err := deriveKey(secret, "aes-gcm nonce")
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aesGCMHook{aead: aead, nonceKey: nonceKey}, nil
+}
+
+func (h aesGCMHook) Seal(value string) (string, error) {
+	mac := hmac.New(sha256.New, h.nonceKey)
+	mac.Write([]byte(value))
+	nonce := mac.Sum(nil)[:h.aead.NonceSize()]
+	return base64.RawURLEncoding.EncodeToString(h.aead.Seal(nonce, nonce, []byte(value), nil)), nil
+}
+
+func (h aesGCMHook) Open(sealed string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < h.aead.NonceSize() {
+		return "", errors.New("sealed value is too short")
+	}
+	value, err := h.aead.Open(nil, data[:h.aead.NonceSize()], data[h.aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
@@ -3,3 +3,17 @@ module proxy
 go 1.22.2
 
 require github.com/mattn/go-sqlite3 v1.14.24
+
+require golang.org/x/net v0.34.0
+
+require gopkg.in/yaml.v3 v3.0.1
+
+require github.com/lib/pq v1.10.9
+
+require github.com/go-sql-driver/mysql v1.9.3
+
+require golang.org/x/crypto v0.32.0
+
+require filippo.io/edwards25519 v1.1.0 // indirect
+
+require golang.org/x/text v0.21.0 // indirect
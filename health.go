@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// ready is set once the in-memory structures are warmed up and the
+// enforcing listeners are started.
+var ready atomic.Bool
+
+type ReadySchema struct {
+	Status string `json:"status"`
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	if !ready.Load() {
+		respondWithError(w, &APIError{Code: CodeNotReady, Status: "error", StatusCode: http.StatusServiceUnavailable, Message: localize(r, "The service is warming up.")})
+		return
+	}
+	respondWithJSON(w, ReadySchema{Status: "ready"})
+}
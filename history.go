@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The last serial journaled at the time. Changes journaled before they
+// were timestamped come before every timestamped one.
+const serialAtStmt string = "SELECT COALESCE(MAX(serial), 0) FROM domain_changes WHERE changed_at IS NULL OR changed_at <= ?"
+
+// How far back the history reaches: the first timestamped change, if
+// untimestamped ones come before it.
+const historyStartStmt string = "SELECT MIN(changed_at), COUNT(*) - COUNT(changed_at) FROM domain_changes"
+
+// entriesAsOf reconstructs the blocklist at the time by undoing the
+// changes journaled since. Entries stored before the journal existed and
+// never changed since are taken as always present.
+func entriesAsOf(tx *sql.Tx, asOf time.Time) ([]DomainEntry, error) {
+	var serial int64
+	if err := tx.QueryRow(serialAtStmt, asOf.Unix()).Scan(&serial); err != nil {
+		return nil, err
+	}
+	added, removed, err := netChanges(tx, serial)
+	if err != nil {
+		return nil, err
+	}
+	absent := make(map[string]bool, len(added))
+	for _, entry := range added {
+		absent[entry.Domain] = true
+	}
+
+	rows, err := tx.Query(selectAllStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]DomainEntry, 0)
+	for rows.Next() {
+		var entry DomainEntry
+		if err := rows.Scan(&entry.Domain, &entry.Mode); err != nil {
+			return nil, err
+		}
+		if !absent[entry.Domain] {
+			entries = append(entries, entry)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	entries = append(entries, removed...)
+	slices.SortFunc(entries, func(a, b DomainEntry) int {
+		return strings.Compare(a.Domain, b.Domain)
+	})
+	return entries, nil
+}
+
+// listAsOf serves GET /domains?as_of=, the page of the blocklist as it was
+// at the time.
+func listAsOf(w http.ResponseWriter, r *http.Request, tx *sql.Tx, page Page, asOf time.Time) {
+	var start sql.NullInt64
+	var untimed int
+	if err := tx.QueryRow(historyStartStmt).Scan(&start, &untimed); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if untimed != 0 && (!start.Valid || asOf.Unix() < start.Int64) {
+		message := localize(r, "History doesn't reach back to %s.", asOf.Format(time.RFC3339))
+		if start.Valid {
+			message = localize(r, "History doesn't reach back to %s; it starts at %s.", asOf.Format(time.RFC3339), time.Unix(start.Int64, 0).UTC().Format(time.RFC3339))
+		}
+		respondWithError(w, &APIError{
+			Code:       CodeInvalidParameter,
+			Status:     "error",
+			StatusCode: http.StatusBadRequest,
+			Message:    message,
+		})
+		return
+	}
+
+	entries, err := entriesAsOf(tx, asOf)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	schema := ListSchema{Domains: []DomainEntry{}, Page: page, AsOf: &asOf}
+	schema.Total = len(entries)
+	if page.Offset < len(entries) {
+		schema.Domains = entries[page.Offset:min(page.Offset+page.Limit, len(entries))]
+	}
+	respondWithPage(w, r, &schema.Page, &schema)
+}
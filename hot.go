@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var hotDomains *int = flag.Int("hot-domains", 1000, "number of the most checked names whose matches the blocklist and the allowlist keep ready (none if 0)")
+
+var hotDomainsFile *string = flag.String("hot-domains-file", "", "file the most checked names are saved to on shutdown and pinned from on start (not saved if empty)")
+
+const (
+	// How often the hot names are chosen again, after which the counts
+	// are halved, so names stop being hot once they are checked less.
+	hotInterval = time.Minute
+	// Names counted per hot name. Past that, new names are only counted
+	// once halving made room.
+	hotCandidates = 8
+)
+
+// hotSet counts the checks of names and keeps the matches of the most
+// checked ones, saving their misses the walk of the suffixes and the
+// wildcards, or the lookups of a spilled mirror.
+type hotSet struct {
+	mu      sync.Mutex
+	size    int
+	counts  map[string]int64
+	results map[string]hotResult
+	hits    int64
+	misses  int64
+}
+
+// hotResult is the match of a hot name, if cached is set.
+type hotResult struct {
+	cached     bool
+	generation uint64
+	found      bool
+	entry      DomainEntry
+}
+
+func newHotSet(size int) *hotSet {
+	return &hotSet{size: size, counts: make(map[string]int64), results: make(map[string]hotResult)}
+}
+
+// get counts a check of the name and returns its match, if the name is
+// hot and the match was cached at the generation.
+func (h *hotSet) get(name string, generation uint64) (*DomainEntry, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.counts[name]; ok || len(h.counts) < h.size*hotCandidates {
+		h.counts[name]++
+	}
+	result := h.results[name]
+	if !result.cached || result.generation != generation {
+		h.misses++
+		return nil, false
+	}
+	h.hits++
+	if !result.found {
+		return nil, true
+	}
+	entry := result.entry
+	return &entry, true
+}
+
+// put caches the match of the name, if it is hot.
+func (h *hotSet) put(name string, generation uint64, entry *DomainEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.results[name]; !ok {
+		return
+	}
+	result := hotResult{cached: true, generation: generation, found: entry != nil}
+	if entry != nil {
+		result.entry = *entry
+	}
+	h.results[name] = result
+}
+
+// choose makes the most counted names hot, keeping the matches of the
+// ones that already were, and halves the counts.
+func (h *hotSet) choose() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	names := make([]string, 0, len(h.counts))
+	for name := range h.counts {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Or(cmp.Compare(h.counts[b], h.counts[a]), strings.Compare(a, b))
+	})
+	results := make(map[string]hotResult, h.size)
+	for _, name := range names[:min(h.size, len(names))] {
+		results[name] = h.results[name]
+	}
+	h.results = results
+	for name, count := range h.counts {
+		if count /= 2; count == 0 {
+			delete(h.counts, name)
+		} else {
+			h.counts[name] = count
+		}
+	}
+}
+
+// top returns the counts of the hot names.
+func (h *hotSet) top() map[string]int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := make(map[string]int64, len(h.results))
+	for name := range h.results {
+		counts[name] = max(h.counts[name], 1)
+	}
+	return counts
+}
+
+// pin adds the counts and chooses the hot names.
+func (h *hotSet) pin(counts map[string]int64) {
+	h.mu.Lock()
+	for name, count := range counts {
+		h.counts[name] += count
+	}
+	h.mu.Unlock()
+	h.choose()
+}
+
+func (h *hotSet) stats() (names int, hits int64, misses int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.results), h.hits, h.misses
+}
+
+// setHotDomains applies -hot-domains, before the mirrors are loaded.
+func setHotDomains() {
+	if *hotDomains <= 0 {
+		return
+	}
+	blocklist.hot, allowlist.hot = newHotSet(*hotDomains), newHotSet(*hotDomains)
+}
+
+// pinHotDomains makes the names of -hot-domains-file hot and caches their
+// matches, once the mirrors are loaded.
+func pinHotDomains() error {
+	if blocklist.hot == nil || *hotDomainsFile == "" {
+		return nil
+	}
+	counts, err := readHotDomains(*hotDomainsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, mirror := range []*memoryBlocklist{blocklist, allowlist} {
+		mirror.hot.pin(counts)
+		for name := range counts {
+			mirror.match(name)
+		}
+	}
+	return nil
+}
+
+// readHotDomains reads the lines of a name and its count.
+func readHotDomains(path string) (map[string]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	counts := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		name, value, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if name == "" {
+			continue
+		}
+		count, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("line %d of %s isn't a name and a positive count", line, path)
+		}
+		counts[name] = count
+	}
+	return counts, scanner.Err()
+}
+
+// saveHotDomains writes the hot names of both mirrors to -hot-domains-file,
+// the busiest first, on shutdown.
+func saveHotDomains(context.Context) error {
+	if blocklist.hot == nil || *hotDomainsFile == "" {
+		return nil
+	}
+	counts := blocklist.hot.top()
+	for name, count := range allowlist.hot.top() {
+		counts[name] = max(counts[name], count)
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Or(cmp.Compare(counts[b], counts[a]), strings.Compare(a, b))
+	})
+	names = names[:min(*hotDomains, len(names))]
+
+	var content strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&content, "%s %d\n", name, counts[name])
+	}
+	// Written aside and renamed, so a crash can't leave half a file.
+	temporary := *hotDomainsFile + ".tmp"
+	if err := os.WriteFile(temporary, []byte(content.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, *hotDomainsFile)
+}
+
+// runHotDomains chooses the hot names every hotInterval until the context
+// is done.
+func runHotDomains(ctx context.Context) {
+	if blocklist.hot == nil {
+		return
+	}
+	ticker := time.NewTicker(hotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			blocklist.hot.choose()
+			allowlist.hot.choose()
+		}
+	}
+}
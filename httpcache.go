@@ -0,0 +1,949 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var httpCacheMemory *int = flag.Int("http-cache-memory", 0, "megabytes of the proxied plain HTTP responses cached in memory (none if 0)")
+
+var httpCacheDir *string = flag.String("http-cache-dir", "", "directory the proxied plain HTTP responses are cached in, across restarts (none if empty)")
+
+var httpCacheDisk *int = flag.Int("http-cache-disk", 1024, "megabytes of responses -http-cache-dir may hold")
+
+var httpCacheMaxObject *int = flag.Int("http-cache-max-object", 8192, "kilobytes of the largest response cached")
+
+var httpCacheTTL *string = flag.String("http-cache-ttl", "", "comma-separated domain=duration pairs, like example.com=1h, for how long the responses of the domains and their subdomains stay fresh whatever their headers say, unless those require revalidation (never cached if 0)")
+
+const (
+	// Heuristic freshness, for responses with a Last-Modified but no
+	// expiry: a tenth of their age when received, at most a day.
+	heuristicFraction = 10
+	maxHeuristicTTL   = 24 * time.Hour
+	// Rough cost of a response on top of its headers and its body.
+	cachedResponseOverhead = 256
+	cacheFileSuffix        = ".cache"
+)
+
+// Statuses a response can be cached with without saying how long it stays
+// fresh, see RFC 9110 section 15.1.
+var heuristicStatuses = []int{200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501}
+
+// Headers of a connection rather than of the response, never stored.
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// cachedResponse is a stored response, with what tells how fresh it is and
+// which requests it answers. Stored responses aren't changed; revalidating
+// one stores a copy.
+type cachedResponse struct {
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	// The values of the request headers the response varies by.
+	Vary         map[string]string `json:"vary,omitempty"`
+	ResponseTime time.Time         `json:"responseTime"`
+	// The age the response had when received, and for how long it is
+	// fresh from its origin on.
+	InitialAge time.Duration `json:"initialAge"`
+	Lifetime   time.Duration `json:"lifetime"`
+	// Set by "no-cache", whose responses are revalidated on every use.
+	Revalidate bool   `json:"revalidate,omitempty"`
+	Body       []byte `json:"-"`
+}
+
+func (c *cachedResponse) size() int64 {
+	size := int64(len(c.URL) + len(c.Body) + cachedResponseOverhead)
+	for name, values := range c.Header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
+
+func (c *cachedResponse) age(now time.Time) time.Duration {
+	return c.InitialAge + max(0, now.Sub(c.ResponseTime))
+}
+
+// matches reports whether the request sends the header values the response
+// varies by.
+func (c *cachedResponse) matches(r *http.Request) bool {
+	for name, value := range c.Vary {
+		if strings.Join(r.Header.Values(name), ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// usable reports whether the response can answer the request without
+// being revalidated.
+func (c *cachedResponse) usable(directives cacheControl, now time.Time) bool {
+	if c.Revalidate || directives.has("no-cache") {
+		return false
+	}
+	age := c.age(now)
+	if age >= c.Lifetime {
+		return false
+	}
+	if maxAge, ok := directives.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := directives.seconds("min-fresh"); ok && c.Lifetime-age < minFresh {
+		return false
+	}
+	return true
+}
+
+// response answers the request with the stored response, or with 304 Not
+// Modified if the request is conditional and the response matches it.
+func (c *cachedResponse) response(r *http.Request, now time.Time, state string) *http.Response {
+	header := c.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(c.age(now).Seconds())))
+	header.Set("X-Cache", state)
+	status, body := c.Status, c.Body
+	if notModified(r, c.Header) {
+		status, body = http.StatusNotModified, nil
+		header.Del("Content-Length")
+	}
+	if r.Method == http.MethodHead {
+		body = nil
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
+
+// notModified evaluates the validators a client sent against the stored
+// headers, If-None-Match first, see RFC 9110 section 13.2.2.
+func notModified(r *http.Request, header http.Header) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, item := range strings.Split(match, ",") {
+			if item = strings.TrimPrefix(strings.TrimSpace(item), "W/"); item == "*" || item == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// cacheControl holds the directives of Cache-Control headers, by their
+// lowercased names.
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	directives := make(cacheControl)
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			name, argument, _ := strings.Cut(strings.TrimSpace(item), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(argument, "\"")
+			}
+		}
+	}
+	return directives
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// revalidated reports whether the response must be revalidated on every use
+// or once stale, which -http-cache-ttl doesn't override.
+func (cc cacheControl) revalidated() bool {
+	return cc.has("no-cache") || cc.has("must-revalidate") || cc.has("proxy-revalidate")
+}
+
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	argument, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(argument, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, true
+	}
+	// Larger values are taken as 2^31, see RFC 9111 section 1.2.2.
+	return time.Duration(min(seconds, math.MaxInt32)) * time.Second, true
+}
+
+// freshness returns for how long a response stays fresh from its origin
+// on, see RFC 9111 section 4.2.1: s-maxage, as the cache is shared, then
+// max-age, Expires and the heuristic.
+func freshness(status int, header http.Header, directives cacheControl) time.Duration {
+	if lifetime, ok := directives.seconds("s-maxage"); ok {
+		return lifetime
+	}
+	if lifetime, ok := directives.seconds("max-age"); ok {
+		return lifetime
+	}
+	date, dateErr := http.ParseTime(header.Get("Date"))
+	if expires := header.Get("Expires"); expires != "" {
+		at, err := http.ParseTime(expires)
+		if err != nil || dateErr != nil {
+			return 0
+		}
+		return max(0, at.Sub(date))
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil || dateErr != nil || !slices.Contains(heuristicStatuses, status) {
+		return 0
+	}
+	return min(max(0, date.Sub(modified))/heuristicFraction, maxHeuristicTTL)
+}
+
+// initialAge returns the age of a response when received, see RFC 9111
+// section 4.2.3.
+func initialAge(header http.Header, requestTime time.Time, responseTime time.Time) time.Duration {
+	var apparent time.Duration
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		apparent = max(0, responseTime.Sub(date))
+	}
+	ageValue, _ := strconv.ParseInt(header.Get("Age"), 10, 64)
+	corrected := time.Duration(max(0, ageValue))*time.Second + responseTime.Sub(requestTime)
+	return max(apparent, corrected)
+}
+
+// storedHeader copies the headers of a response to store, leaving out the
+// ones of the connection.
+func storedHeader(header http.Header) http.Header {
+	stored := header.Clone()
+	for _, name := range header.Values("Connection") {
+		for _, listed := range strings.Split(name, ",") {
+			stored.Del(strings.TrimSpace(listed))
+		}
+	}
+	for _, name := range append(hopHeaders, "Age", "X-Cache") {
+		stored.Del(name)
+	}
+	return stored
+}
+
+// parseCacheTTLs parses -http-cache-ttl.
+func parseCacheTTLs(list string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+	for _, item := range splitList(list) {
+		domain, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("\"%s\" isn't a domain=duration pair", item)
+		}
+		name, err := normalizeDomain(domain)
+		if err != nil {
+			return nil, fmt.Errorf("domain \"%s\" is invalid: %v", domain, err)
+		}
+		ttl, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("\"%s\" isn't a duration that isn't negative", value)
+		}
+		ttls[name] = ttl
+	}
+	return ttls, nil
+}
+
+// responseCache keeps the responses in memory, on disk or both. Responses
+// read from the disk are kept in memory too, and responses evicted from
+// memory are still on the disk.
+type responseCache struct {
+	mu        sync.Mutex
+	memory    *memoryTier
+	disk      *diskTier
+	maxObject int64
+	ttls      map[string]time.Duration
+
+	hits          int64
+	misses        int64
+	revalidations int64
+	stores        int64
+}
+
+// httpCache is nil unless -http-cache-memory or -http-cache-dir is set.
+var httpCache *responseCache
+
+type memoryTier struct {
+	budget int64
+	bytes  int64
+	order  *list.List
+	items  map[string]*list.Element
+}
+
+type diskTier struct {
+	dir    string
+	budget int64
+	bytes  int64
+	order  *list.List
+	items  map[string]*list.Element
+}
+
+type diskItem struct {
+	url  string
+	size int64
+}
+
+// setHTTPCache applies the settings of the cache, reading the index of the
+// responses on disk.
+func setHTTPCache() error {
+	httpCache = nil
+	if *httpCacheMemory <= 0 && *httpCacheDir == "" {
+		return nil
+	}
+	ttls, err := parseCacheTTLs(*httpCacheTTL)
+	if err != nil {
+		return err
+	}
+	cache := &responseCache{maxObject: int64(*httpCacheMaxObject) << 10, ttls: ttls}
+	if *httpCacheMemory > 0 {
+		cache.memory = &memoryTier{budget: int64(*httpCacheMemory) << 20, order: list.New(), items: make(map[string]*list.Element)}
+	}
+	if *httpCacheDir != "" {
+		if cache.disk, err = openDiskTier(*httpCacheDir, int64(*httpCacheDisk)<<20); err != nil {
+			return err
+		}
+	}
+	httpCache = cache
+	return nil
+}
+
+// openDiskTier indexes the responses in the directory, the latest written
+// counting as the most recently used.
+func openDiskTier(dir string, budget int64) (*diskTier, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type file struct {
+		name     string
+		url      string
+		size     int64
+		modified time.Time
+	}
+	files := make([]file, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), cacheFileSuffix) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		stored, err := readCacheFile(path, false)
+		if err != nil {
+			slog.Warn("Cached response is unreadable; removing it", "path", path, "error", err)
+			os.Remove(path)
+			continue
+		}
+		files = append(files, file{name: entry.Name(), url: stored.URL, size: info.Size(), modified: info.ModTime()})
+	}
+	slices.SortFunc(files, func(a, b file) int { return b.modified.Compare(a.modified) })
+	tier := &diskTier{dir: dir, budget: budget, order: list.New(), items: make(map[string]*list.Element)}
+	for _, f := range files {
+		tier.items[f.name] = tier.order.PushBack(&diskItem{url: f.url, size: f.size})
+		tier.bytes += f.size
+	}
+	tier.evict()
+	return tier, nil
+}
+
+// cacheFileName is the name of the file of a response, which URLs can't
+// be used as.
+func cacheFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + cacheFileSuffix
+}
+
+// readCacheFile reads a file of a response: its metadata in JSON on the
+// first line, then its body, which is only read if withBody is set.
+func readCacheFile(path string, withBody bool) (*cachedResponse, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var stored cachedResponse
+	if err := json.Unmarshal(line, &stored); err != nil {
+		return nil, err
+	}
+	if withBody {
+		if stored.Body, err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+	return &stored, nil
+}
+
+// writeCacheFile writes the file of a response aside and renames it, so a
+// crash can't leave half of it.
+func writeCacheFile(dir string, name string, stored *cachedResponse) (int64, error) {
+	metadata, err := json.Marshal(stored)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Write(append(append(metadata, '\n'), stored.Body...))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	return int64(len(metadata) + 1 + len(stored.Body)), nil
+}
+
+func (t *memoryTier) put(key string, stored *cachedResponse) {
+	t.remove(key)
+	if stored.size() > t.budget {
+		return
+	}
+	t.items[key] = t.order.PushFront(stored)
+	t.bytes += stored.size()
+	for t.bytes > t.budget {
+		oldest := t.order.Back()
+		evicted := t.order.Remove(oldest).(*cachedResponse)
+		delete(t.items, evicted.URL)
+		t.bytes -= evicted.size()
+	}
+}
+
+func (t *memoryTier) remove(key string) bool {
+	item, ok := t.items[key]
+	if !ok {
+		return false
+	}
+	t.bytes -= t.order.Remove(item).(*cachedResponse).size()
+	delete(t.items, key)
+	return true
+}
+
+func (t *diskTier) add(name string, url string, size int64) {
+	if item, ok := t.items[name]; ok {
+		t.bytes -= t.order.Remove(item).(*diskItem).size
+	}
+	t.items[name] = t.order.PushFront(&diskItem{url: url, size: size})
+	t.bytes += size
+	t.evict()
+}
+
+func (t *diskTier) evict() {
+	for t.bytes > t.budget {
+		oldest := t.order.Back()
+		evicted := t.order.Remove(oldest).(*diskItem)
+		name := cacheFileName(evicted.url)
+		delete(t.items, name)
+		t.bytes -= evicted.size
+		if err := os.Remove(filepath.Join(t.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Removing of a cached response failed", "url", evicted.url, "error", err)
+		}
+	}
+}
+
+func (t *diskTier) remove(key string) bool {
+	name := cacheFileName(key)
+	item, ok := t.items[name]
+	if !ok {
+		return false
+	}
+	t.bytes -= t.order.Remove(item).(*diskItem).size
+	delete(t.items, name)
+	os.Remove(filepath.Join(t.dir, name))
+	return true
+}
+
+// get returns the stored response of the key. Responses read from the disk
+// are kept in memory from then on.
+func (c *responseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	if c.memory != nil {
+		if item, ok := c.memory.items[key]; ok {
+			c.memory.order.MoveToFront(item)
+			c.mu.Unlock()
+			return item.Value.(*cachedResponse)
+		}
+	}
+	if c.disk == nil {
+		c.mu.Unlock()
+		return nil
+	}
+	name := cacheFileName(key)
+	item, ok := c.disk.items[name]
+	if ok {
+		c.disk.order.MoveToFront(item)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	// Removed meanwhile, the response is simply missed.
+	stored, err := readCacheFile(filepath.Join(c.disk.dir, name), true)
+	if err != nil || stored.URL != key {
+		return nil
+	}
+	if c.memory != nil {
+		c.mu.Lock()
+		c.memory.put(key, stored)
+		c.mu.Unlock()
+	}
+	return stored
+}
+
+func (c *responseCache) put(stored *cachedResponse) {
+	if int64(len(stored.Body)) > c.maxObject {
+		return
+	}
+	c.mu.Lock()
+	c.stores++
+	if c.memory != nil {
+		c.memory.put(stored.URL, stored)
+	}
+	c.mu.Unlock()
+	if c.disk == nil {
+		return
+	}
+	name := cacheFileName(stored.URL)
+	size, err := writeCacheFile(c.disk.dir, name, stored)
+	if err != nil {
+		slog.Warn("Writing of a cached response failed", "url", stored.URL, "error", err)
+		return
+	}
+	c.mu.Lock()
+	c.disk.add(name, stored.URL, size)
+	c.mu.Unlock()
+}
+
+// purge removes the responses the function selects by their URLs and
+// returns how many it removed.
+func (c *responseCache) purge(selected func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make(map[string]bool)
+	if c.memory != nil {
+		for key := range c.memory.items {
+			if selected(key) {
+				keys[key] = true
+			}
+		}
+	}
+	if c.disk != nil {
+		for _, item := range c.disk.items {
+			if url := item.Value.(*diskItem).url; selected(url) {
+				keys[url] = true
+			}
+		}
+	}
+	for key := range keys {
+		c.remove(key)
+	}
+	return len(keys)
+}
+
+// remove removes the response of the key. It must be called with mu held.
+func (c *responseCache) remove(key string) bool {
+	removed := false
+	if c.memory != nil && c.memory.remove(key) {
+		removed = true
+	}
+	if c.disk != nil && c.disk.remove(key) {
+		removed = true
+	}
+	return removed
+}
+
+// ttl returns the -http-cache-ttl of the host, the one of the closest
+// domain covering it.
+func (c *responseCache) ttl(host string) (time.Duration, bool) {
+	for name := lookupName(host); name != ""; {
+		if ttl, ok := c.ttls[name]; ok {
+			return ttl, true
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+	return 0, false
+}
+
+// cacheKey is the URL a response is stored by. A URL has a single stored
+// response, whatever the request headers it varies by.
+func cacheKey(u *url.URL) string {
+	return u.Scheme + "://" + strings.ToLower(u.Host) + u.RequestURI()
+}
+
+// wrap returns a transport caching the responses of the next one. Without
+// a cache, it returns the next one.
+func (c *responseCache) wrap(next http.RoundTripper) http.RoundTripper {
+	if c == nil {
+		return next
+	}
+	return &cachingTransport{cache: c, next: next}
+}
+
+// cachingTransport is a shared cache in front of the origins, following
+// RFC 9111. Requests with credentials or ranges bypass it, responses
+// setting cookies aren't stored and stale responses are only served once
+// revalidated.
+type cachingTransport struct {
+	cache *responseCache
+	next  http.RoundTripper
+}
+
+func (t *cachingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		resp, err := t.next.RoundTrip(r)
+		if err == nil && resp.StatusCode < 400 {
+			t.invalidate(r, resp)
+		}
+		return resp, err
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" {
+		return t.next.RoundTrip(r)
+	}
+
+	key := cacheKey(r.URL)
+	directives := parseCacheControl(r.Header.Values("Cache-Control"))
+	if len(directives) == 0 && strings.Contains(strings.ToLower(r.Header.Get("Pragma")), "no-cache") {
+		directives["no-cache"] = ""
+	}
+	stored := t.cache.get(key)
+	if stored != nil && !stored.matches(r) {
+		stored = nil
+	}
+	now := time.Now()
+	if stored != nil && stored.usable(directives, now) {
+		t.count(&t.cache.hits)
+		return stored.response(r, now, "HIT"), nil
+	}
+	t.count(&t.cache.misses)
+	if directives.has("only-if-cached") {
+		return (&cachedResponse{Status: http.StatusGatewayTimeout, Header: make(http.Header)}).response(r, now, "MISS"), nil
+	}
+
+	outbound := r
+	validated := stored != nil && (stored.Header.Get("ETag") != "" || stored.Header.Get("Last-Modified") != "")
+	if validated {
+		outbound = r.Clone(r.Context())
+		outbound.Header.Del("If-None-Match")
+		outbound.Header.Del("If-Modified-Since")
+		if etag := stored.Header.Get("ETag"); etag != "" {
+			outbound.Header.Set("If-None-Match", etag)
+		}
+		if modified := stored.Header.Get("Last-Modified"); modified != "" {
+			outbound.Header.Set("If-Modified-Since", modified)
+		}
+	}
+	requestTime := time.Now()
+	resp, err := t.next.RoundTrip(outbound)
+	if err != nil {
+		return nil, err
+	}
+	responseTime := time.Now()
+	if validated && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		t.count(&t.cache.revalidations)
+		updated := t.revalidated(r, stored, resp.Header, requestTime, responseTime)
+		t.cache.put(updated)
+		return updated.response(r, responseTime, "REVALIDATED"), nil
+	}
+	if !t.storable(r, directives, resp) {
+		resp.Header.Set("X-Cache", "MISS")
+		return resp, nil
+	}
+
+	pending := &cachedResponse{
+		URL:          key,
+		Status:       resp.StatusCode,
+		Header:       storedHeader(resp.Header),
+		Vary:         varyValues(r, resp.Header),
+		ResponseTime: responseTime,
+		InitialAge:   initialAge(resp.Header, requestTime, responseTime),
+	}
+	t.setLifetime(r, pending)
+	resp.Header.Set("X-Cache", "MISS")
+	resp.Body = &teeBody{ReadCloser: resp.Body, limit: t.cache.maxObject, done: func(body []byte) {
+		pending.Body = body
+		t.cache.put(pending)
+	}}
+	return resp, nil
+}
+
+func (t *cachingTransport) count(counter *int64) {
+	t.cache.mu.Lock()
+	defer t.cache.mu.Unlock()
+	*counter++
+}
+
+// storable reports whether the response to the request may be stored, see
+// RFC 9111 section 3.
+func (t *cachingTransport) storable(r *http.Request, directives cacheControl, resp *http.Response) bool {
+	if r.Method != http.MethodGet || directives.has("no-store") {
+		return false
+	}
+	if resp.ContentLength > t.cache.maxObject || resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, name := range resp.Header.Values("Vary") {
+		if strings.Contains(name, "*") {
+			return false
+		}
+	}
+	response := parseCacheControl(resp.Header.Values("Cache-Control"))
+	if response.has("no-store") || response.has("private") {
+		return false
+	}
+	// The cache is shared, so the responses to requests with cookies,
+	// which may be personalized, are only stored if they are meant to be.
+	if r.Header.Get("Cookie") != "" && !response.has("public") && !response.has("s-maxage") {
+		return false
+	}
+	if ttl, ok := t.cache.ttl(r.URL.Hostname()); ok && (ttl == 0 || !response.revalidated()) {
+		return ttl > 0
+	}
+	explicit := response.has("s-maxage") || response.has("max-age") || response.has("public") || resp.Header.Get("Expires") != ""
+	if !explicit && !slices.Contains(heuristicStatuses, resp.StatusCode) {
+		return false
+	}
+	// Responses that are stale at once are only worth storing if they can
+	// be revalidated.
+	return freshness(resp.StatusCode, resp.Header, response) > 0 || resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// setLifetime sets for how long the response stays fresh, from its headers
+// or from -http-cache-ttl, unless they ask for revalidation.
+func (t *cachingTransport) setLifetime(r *http.Request, stored *cachedResponse) {
+	directives := parseCacheControl(stored.Header.Values("Cache-Control"))
+	stored.Revalidate = directives.has("no-cache")
+	stored.Lifetime = freshness(stored.Status, stored.Header, directives)
+	if ttl, ok := t.cache.ttl(r.URL.Hostname()); ok && !directives.revalidated() {
+		stored.Lifetime = ttl
+	}
+}
+
+// revalidated copies the stored response with the headers of the 304 Not
+// Modified confirming it, see RFC 9111 section 4.3.4.
+func (t *cachingTransport) revalidated(r *http.Request, stored *cachedResponse, header http.Header, requestTime time.Time, responseTime time.Time) *cachedResponse {
+	updated := *stored
+	updated.Header = stored.Header.Clone()
+	for name, values := range storedHeader(header) {
+		if name != "Content-Length" {
+			updated.Header[name] = values
+		}
+	}
+	updated.ResponseTime = responseTime
+	updated.InitialAge = initialAge(header, requestTime, responseTime)
+	t.setLifetime(r, &updated)
+	return &updated
+}
+
+// invalidate removes the responses a successful unsafe request changed, of
+// its URL and of the URLs of the same host its response points to, see
+// RFC 9111 section 4.4.
+func (t *cachingTransport) invalidate(r *http.Request, resp *http.Response) {
+	keys := []string{cacheKey(r.URL)}
+	for _, header := range []string{"Location", "Content-Location"} {
+		if location, err := r.URL.Parse(resp.Header.Get(header)); err == nil && resp.Header.Get(header) != "" && strings.EqualFold(location.Host, r.URL.Host) {
+			keys = append(keys, cacheKey(location))
+		}
+	}
+	t.cache.mu.Lock()
+	defer t.cache.mu.Unlock()
+	for _, key := range keys {
+		t.cache.remove(key)
+	}
+}
+
+// varyValues returns the values of the request headers the response varies
+// by.
+func varyValues(r *http.Request, header http.Header) map[string]string {
+	var values map[string]string
+	for _, list := range header.Values("Vary") {
+		for _, name := range strings.Split(list, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if values == nil {
+				values = make(map[string]string)
+			}
+			values[http.CanonicalHeaderKey(name)] = strings.Join(r.Header.Values(name), ",")
+		}
+	}
+	return values
+}
+
+// teeBody keeps what is read of a body, up to a limit, and passes it to
+// done once the whole body was read.
+type teeBody struct {
+	io.ReadCloser
+	limit    int64
+	buf      bytes.Buffer
+	overflow bool
+	finished bool
+	done     func(body []byte)
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.overflow && !b.finished {
+		b.finished = true
+		b.done(bytes.Clone(b.buf.Bytes()))
+	}
+	return n, err
+}
+
+type HTTPCacheSchema struct {
+	MemoryEntries int   `json:"memoryEntries"`
+	MemoryBytes   int64 `json:"memoryBytes"`
+	DiskEntries   int   `json:"diskEntries"`
+	DiskBytes     int64 `json:"diskBytes"`
+	// Requests answered from the cache, sent on to the origins, and sent
+	// on only to confirm a stored response.
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Revalidations int64 `json:"revalidations"`
+	Stores        int64 `json:"stores"`
+}
+
+func (c *responseCache) schema() HTTPCacheSchema {
+	var schema HTTPCacheSchema
+	if c == nil {
+		return schema
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	schema.Hits, schema.Misses, schema.Revalidations, schema.Stores = c.hits, c.misses, c.revalidations, c.stores
+	if c.memory != nil {
+		schema.MemoryEntries, schema.MemoryBytes = len(c.memory.items), c.memory.bytes
+	}
+	if c.disk != nil {
+		schema.DiskEntries, schema.DiskBytes = len(c.disk.items), c.disk.bytes
+	}
+	return schema
+}
+
+func init() {
+	expvar.Publish("httpCache", expvar.Func(func() any { return httpCache.schema() }))
+}
+
+type PurgeSchema struct {
+	// A URL, a domain with its subdomains, or everything.
+	URL    string `json:"url,omitempty"`
+	Domain string `json:"domain,omitempty"`
+	All    bool   `json:"all,omitempty"`
+}
+
+type PurgedSchema struct {
+	Purged int `json:"purged"`
+}
+
+// cachePurgeHandler serves POST /cache/purge, removing the cached responses
+// of a URL, of a domain with its subdomains, or all of them.
+func cachePurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensureValidPOST(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if httpCache == nil {
+		respondWithError(w, &APIError{Code: CodeFeatureNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "The HTTP cache isn't configured; set -http-cache-memory or -http-cache-dir.")})
+		return
+	}
+	var body PurgeSchema
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted {\"url\", \"domain\", \"all\"} object; got invalid JSON."), Status: "error"})
+		return
+	}
+	given := 0
+	for _, set := range []bool{body.URL != "", body.Domain != "", body.All} {
+		if set {
+			given++
+		}
+	}
+	if given != 1 {
+		respondWithError(w, &APIError{Code: CodeInvalidBody, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted one of \"url\", \"domain\" and \"all\".")})
+		return
+	}
+
+	var selected func(key string) bool
+	switch {
+	case body.URL != "":
+		u, err := url.Parse(body.URL)
+		if err != nil || u.Scheme != "http" || u.Host == "" {
+			respondWithError(w, &APIError{Code: CodeInvalidParameter, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "URL \"%s\" isn't an absolute http URL.", body.URL)})
+			return
+		}
+		key := cacheKey(u)
+		selected = func(stored string) bool { return stored == key }
+	case body.Domain != "":
+		name, err := normalizeDomain(body.Domain)
+		if err != nil {
+			respondWithError(w, invalidDomain(r, err, "Domain \"%s\" is invalid: %v.", body.Domain, err))
+			return
+		}
+		selected = func(stored string) bool {
+			u, err := url.Parse(stored)
+			return err == nil && coveredBy(lookupName(u.Hostname()), DomainEntry{Domain: name, Mode: ModeSubdomain})
+		}
+	default:
+		selected = func(string) bool { return true }
+	}
+	purged := httpCache.purge(selected)
+	requestLogger(r).Info("HTTP cache purged", "url", body.URL, "domain", body.Domain, "all", body.All, "purged", purged)
+	respondWithJSON(w, PurgedSchema{Purged: purged})
+}
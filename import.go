@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+const insertNotedStmt string = "INSERT INTO blocked_domains(domain_name, mode, comment, categories, origin) VALUES (?, ?, ?, ?, ?)"
+
+const entryNoteStmt string = "SELECT comment, categories FROM blocked_domains WHERE domain_name = ?"
+
+// maxImportErrors caps the unsupported lines reported back, as public
+// lists can contain thousands of them.
+const maxImportErrors = 100
+
+// Names every hosts file maps to the loopback address; they are not
+// blocked domains.
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+func ensurePlainText(r *http.Request) *APIError {
+	return ensureMediaType(r, "text/plain")
+}
+
+func ensureMediaType(r *http.Request, accepted ...string) *APIError {
+	contentType := r.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || !slices.Contains(accepted, mediaType) {
+		return &APIError{
+			Code:       CodeUnsupportedMediaType,
+			StatusCode: http.StatusUnsupportedMediaType,
+			Status:     "error",
+			Message:    localize(r, "Excepted content of type \"%s\", got: \"%s\".", strings.Join(accepted, ", "), contentType),
+		}
+	}
+	return nil
+}
+
+// EntryNote is what a curated list says about an entry: the text of its
+// trailing comment and the category hints in it.
+type EntryNote struct {
+	Comment    string   `json:"comment,omitempty"`
+	Categories []string `json:"categories,omitempty"`
+}
+
+// Longest comment and category list kept, which fit a VARCHAR(255) of
+// MySQL.
+const (
+	maxCommentLength    = 255
+	maxCategoriesLength = 255
+)
+
+// entryNote returns the note of the stored entry, which is empty for
+// entries that weren't imported.
+func entryNote(r *http.Request, domain string) (EntryNote, error) {
+	var note EntryNote
+	var stored string
+	err := db.QueryRowContext(r.Context(), entryNoteStmt, domain).Scan(&note.Comment, &stored)
+	if errors.Is(err, sql.ErrNoRows) {
+		return note, nil
+	}
+	if err != nil {
+		return note, err
+	}
+	note.Categories = splitCategories(stored)
+	note.Comment, err = openField(FieldComment, note.Comment)
+	return note, err
+}
+
+// parseInlineComment splits a "# comment" off the end of a line. Words in
+// brackets that are valid categories, like "[ads]", are taken out of the
+// comment as categories. The "#" has to follow whitespace, as it is part of
+// AdGuard's cosmetic rules.
+func parseInlineComment(line string) (rule string, note EntryNote) {
+	index := strings.Index(line, " #")
+	if tab := strings.Index(line, "\t#"); tab != -1 && (index == -1 || tab < index) {
+		index = tab
+	}
+	if index == -1 {
+		return line, note
+	}
+	rule, comment := line[:index], strings.TrimSpace(line[index+2:])
+
+	words := make([]string, 0)
+	length := 0
+	for _, word := range strings.Fields(comment) {
+		if len(word) > 2 && strings.HasPrefix(word, "[") && strings.HasSuffix(word, "]") {
+			category := strings.ToLower(word[1 : len(word)-1])
+			if validateCategory(category) == nil {
+				if !slices.Contains(note.Categories, category) && length+len(category)+1 < maxCategoriesLength {
+					note.Categories = append(note.Categories, category)
+					length += len(category) + 1
+				}
+				continue
+			}
+		}
+		words = append(words, word)
+	}
+	note.Comment = truncateText(strings.Join(words, " "), maxCommentLength)
+	return rule, note
+}
+
+// parseImportLine parses a line of a hosts file ("0.0.0.0 ads.example.com"),
+// of a domain-per-line list or of an AdGuard list ("||ads.example.com^"),
+// along with its trailing comment. Comments and empty lines yield ok == true
+// and no entries.
+func parseImportLine(line string) (entries []DomainEntry, note EntryNote, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+		return nil, note, true
+	}
+	line, note = parseInlineComment(line)
+	fields := strings.Fields(line)
+	if len(fields) >= 2 {
+		if _, err := netip.ParseAddr(fields[0]); err != nil {
+			return nil, note, false
+		}
+		for _, name := range fields[1:] {
+			if hostsLocalNames[name] {
+				continue
+			}
+			entry := DomainEntry{Domain: name, Mode: ModeExact}
+			if entry.normalize() != nil {
+				return nil, note, false
+			}
+			entries = append(entries, entry)
+		}
+		return entries, note, true
+	}
+	entry, ok := parseAdGuardRule(line)
+	if !ok {
+		return nil, note, false
+	}
+	if entry.Domain == "" {
+		return nil, note, true
+	}
+	return []DomainEntry{entry}, note, true
+}
+
+// importedList collects the entries of an uploaded list, with the note of
+// their first line, and the lines that couldn't be parsed.
+type importedList struct {
+	entries     []DomainEntry
+	notes       map[string]EntryNote
+	errs        []APIError
+	unsupported int
+}
+
+func newImportedList() *importedList {
+	return &importedList{entries: make([]DomainEntry, 0), notes: make(map[string]EntryNote), errs: make([]APIError, 0)}
+}
+
+func (l *importedList) add(entries []DomainEntry, note EntryNote) {
+	for _, entry := range entries {
+		if _, ok := l.notes[entry.Domain]; !ok {
+			l.notes[entry.Domain] = note
+			l.entries = append(l.entries, entry)
+		}
+	}
+}
+
+// reject counts an unsupported line, reporting the first ones.
+func (l *importedList) reject(r *http.Request, number int, line string) {
+	l.unsupported++
+	if len(l.errs) < maxImportErrors {
+		l.errs = append(l.errs, APIError{
+			Code:       CodeUnsupportedLine,
+			Status:     "error",
+			StatusCode: http.StatusBadRequest,
+			Message:    localize(r, "Line %d isn't supported: \"%s\".", number, line),
+		})
+	}
+}
+
+// scan parses the list line by line.
+func (l *importedList) scan(r *http.Request, list io.Reader, parse func(string) ([]DomainEntry, EntryNote, bool)) *APIError {
+	number := 0
+	err := scanListLines(list, func(line string, complete bool) {
+		number++
+		if !complete {
+			l.reject(r, number, line[:maxQuotedInput]+"…")
+			return
+		}
+		parsed, note, ok := parse(line)
+		if !ok {
+			l.reject(r, number, line)
+			return
+		}
+		l.add(parsed, note)
+	})
+	if err != nil {
+		return &APIError{Code: CodeInvalidBody, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Reading of the list failed: %v.", err)}
+	}
+	return nil
+}
+
+// Lines of lists longer than this are rejected whole, instead of failing
+// the list or being cut into names that weren't in it.
+const maxListLine = bufio.MaxScanTokenSize
+
+// scanListLines calls fn with every line of the list, without the line
+// ending. Lines longer than maxListLine are passed incomplete, cut to it.
+func scanListLines(list io.Reader, fn func(line string, complete bool)) error {
+	reader := bufio.NewReaderSize(list, maxListLine)
+	for {
+		line, more, err := reader.ReadLine()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		text, complete := string(line), !more
+		for more {
+			if _, more, err = reader.ReadLine(); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		fn(text, complete)
+	}
+}
+
+// merge adds the entries that aren't in the database yet, attributed to
+// the origin, and responds with how many it added.
+func (l *importedList) merge(w http.ResponseWriter, r *http.Request, origin string) {
+	if len(l.entries) == 0 {
+		respondWithError(w, &APIError{Code: CodeNoDomains, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "No domains provided."), Errors: l.errs})
+		return
+	}
+
+	tx, err := beginChange(r.Context())
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(insertNotedStmt)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer stmt.Close()
+
+	names := make([]string, len(l.entries))
+	for i, entry := range l.entries {
+		names[i] = entry.Domain
+	}
+	sourced, err := sourcedNames(tx, names)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	added := 0
+	for _, entry := range l.entries {
+		if sourced[entry.Domain] {
+			continue
+		}
+		note := l.notes[entry.Domain]
+		comment, err := sealComment(note.Comment)
+		if errors.Is(err, errSealedTooLong) {
+			respondWithError(w, &APIError{Code: CodeCommentTooLong, Status: "error", StatusCode: http.StatusUnprocessableEntity, Message: localize(r, "Comment of \"%s\" is too long to be stored sealed.", entry.Domain)})
+			return
+		} else if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if _, err := stmt.Exec(entry.Domain, entry.Mode, comment, joinCategories(note.Categories), origin); err != nil {
+			if isUniqueConstraintError(err) {
+				continue
+			}
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if err := tx.record(entry, false); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		tx.categorize(entry.Domain, note.Categories)
+		added++
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	message := localize(r, "Imported %d domains; %d were already in the database.", added, len(l.entries)-added)
+	statusCode := http.StatusCreated
+	if added == 0 {
+		statusCode = http.StatusOK
+	}
+	if l.unsupported != 0 {
+		message += " " + localize(r, "%d lines aren't supported and were skipped.", l.unsupported)
+		respondWithError(w, &APIError{Code: CodeUnsupportedLine, Status: "partial", StatusCode: statusCode, Message: message, Errors: l.errs})
+		return
+	}
+	respondWithError(w, &APIError{Code: CodeOK, Status: "success", StatusCode: statusCode, Message: message})
+}
+
+// importHandler adds the domains of a plain text list. Domains already in
+// the database are left as they are and unsupported lines are skipped;
+// both are reported back.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensurePOST(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if err := ensurePlainText(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	list := newImportedList()
+	if err := list.scan(r, r.Body, parseImportLine); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	list.merge(w, r, "")
+}
+
+// runImport uploads a list file, or the standard input for "-", to the
+// import endpoint of a running instance. It returns the exit status.
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	apiAddress := flags.String("api", "127.0.0.1:8000", "address of the API")
+	key := flags.String("api-key", "", "API key sent as a bearer token")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: proxy import [-api address] [-api-key key] file")
+		return 2
+	}
+
+	var list io.Reader = os.Stdin
+	if path := flags.Arg(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+		list = file
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+*apiAddress+"/domains/import", list)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	if *key != "" {
+		req.Header.Set("Authorization", "Bearer "+*key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode >= http.StatusBadRequest {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var apiKeyMaxAge *time.Duration = flag.Duration("api-key-max-age", 0, "age after which an API key is flagged for rotation (never if 0)")
+
+var apiKeyMaxIdle *time.Duration = flag.Duration("api-key-max-idle", 0, "time without requests after which an API key is flagged for rotation (never if 0)")
+
+const keyHashStmt string = "SELECT key_hash FROM api_key_usage WHERE name = ?"
+
+const insertKeyUsageStmt string = "INSERT INTO api_key_usage(name, key_hash, created_at) VALUES (?, ?, ?)"
+
+const resetKeyUsageStmt string = "UPDATE api_key_usage SET key_hash = ?, created_at = ?, requests = 0, last_used_at = NULL WHERE name = ? AND key_hash = ?"
+
+const addKeyUsageStmt string = "UPDATE api_key_usage SET requests = requests + ?, last_used_at = CASE WHEN last_used_at IS NULL OR last_used_at < ? THEN ? ELSE last_used_at END WHERE name = ?"
+
+const keyUsageStmt string = "SELECT created_at, requests, last_used_at FROM api_key_usage WHERE name = ?"
+
+// How often the requests counted in memory are written to the database.
+const keyUsageFlushInterval = 10 * time.Second
+
+type APIKeySchema struct {
+	Name        string     `json:"name"`
+	Owner       string     `json:"owner"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	Requests    int64      `json:"requests"`
+	LastUsed    *time.Time `json:"lastUsed,omitempty"`
+	Stale       bool       `json:"stale"`
+	StaleReason string     `json:"staleReason,omitempty"`
+}
+
+type APIKeysSchema struct {
+	Keys []APIKeySchema `json:"keys"`
+}
+
+// keyUsageTracker counts the requests of every key in memory, so
+// authenticating doesn't write to the database.
+type keyUsageTracker struct {
+	mu       sync.Mutex
+	pending  map[string]int64
+	lastUsed map[string]int64
+}
+
+var keyUsage = &keyUsageTracker{pending: make(map[string]int64), lastUsed: make(map[string]int64)}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// register records the configured keys, resetting the usage of those
+// whose secret changed, and warns about the ones due for rotation.
+func (t *keyUsageTracker) register(keys []apiKey) error {
+	now := time.Now()
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		names = append(names, k.name)
+		hash := hashKey(k.key)
+		var stored string
+		err := db.QueryRow(keyHashStmt, k.name).Scan(&stored)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// Another replica sharing the database may register it first.
+			if _, err := db.Exec(insertKeyUsageStmt, k.name, hash, now.Unix()); err != nil && !isUniqueConstraintError(err) {
+				return err
+			}
+		case err != nil:
+			return err
+		case stored != hash:
+			if _, err := db.Exec(resetKeyUsageStmt, hash, now.Unix(), k.name, stored); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range names {
+		schema, err := t.schema(context.Background(), name, now)
+		if err != nil {
+			return err
+		}
+		if schema.Stale {
+			slog.Warn("API key is due for rotation", "key", name, "reason", schema.StaleReason)
+		}
+	}
+	return nil
+}
+
+func (t *keyUsageTracker) used(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[name]++
+	t.lastUsed[name] = time.Now().Unix()
+}
+
+// flush adds the requests counted since the last flush to the database.
+// The counts that couldn't be written are kept for the next one.
+func (t *keyUsageTracker) flush(ctx context.Context) error {
+	t.mu.Lock()
+	pending, lastUsed := t.pending, t.lastUsed
+	t.pending, t.lastUsed = make(map[string]int64), make(map[string]int64)
+	t.mu.Unlock()
+
+	for name, requests := range pending {
+		if _, err := db.ExecContext(ctx, addKeyUsageStmt, requests, lastUsed[name], lastUsed[name], name); err != nil {
+			t.mu.Lock()
+			for name, requests := range pending {
+				t.pending[name] += requests
+				t.lastUsed[name] = max(t.lastUsed[name], lastUsed[name])
+			}
+			t.mu.Unlock()
+			return err
+		}
+		delete(pending, name)
+	}
+	return nil
+}
+
+func (t *keyUsageTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(keyUsageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := t.flush(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("Writing of the API key usage failed", "error", err)
+		}
+		// Picks up the keys issued or revoked by other instances sharing
+		// the database.
+		if err := apiKeyring.load(); err != nil && ctx.Err() == nil {
+			slog.Warn("Loading of the API keys failed", "error", err)
+		}
+	}
+}
+
+// schema returns the usage of the key, counting the requests not flushed
+// yet.
+func (t *keyUsageTracker) schema(ctx context.Context, name string, now time.Time) (APIKeySchema, error) {
+	schema := APIKeySchema{Name: name}
+	var createdAt int64
+	var lastUsed sql.NullInt64
+	if err := db.QueryRowContext(ctx, keyUsageStmt, name).Scan(&createdAt, &schema.Requests, &lastUsed); err != nil {
+		return schema, err
+	}
+	t.mu.Lock()
+	schema.Requests += t.pending[name]
+	if used, ok := t.lastUsed[name]; ok && used > lastUsed.Int64 {
+		lastUsed = sql.NullInt64{Int64: used, Valid: true}
+	}
+	t.mu.Unlock()
+
+	schema.CreatedAt = time.Unix(createdAt, 0).UTC()
+	idleSince := schema.CreatedAt
+	if lastUsed.Valid {
+		used := time.Unix(lastUsed.Int64, 0).UTC()
+		schema.LastUsed, idleSince = &used, used
+	}
+	switch {
+	case *apiKeyMaxAge > 0 && now.Sub(schema.CreatedAt) > *apiKeyMaxAge:
+		schema.Stale, schema.StaleReason = true, "older than -api-key-max-age"
+	case *apiKeyMaxIdle > 0 && now.Sub(idleSince) > *apiKeyMaxIdle:
+		schema.Stale, schema.StaleReason = true, "unused for longer than -api-key-max-idle"
+	}
+	return schema, nil
+}
+
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listKeysHandler(w, r)
+	case http.MethodPost:
+		issueKeyHandler(w, r)
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, POST"))
+	}
+}
+
+// listKeysHandler serves GET /keys, the usage of the valid API keys.
+func listKeysHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	valid := apiKeyring.valid(now)
+	schema := APIKeysSchema{Keys: make([]APIKeySchema, 0, len(valid))}
+	for _, entry := range valid {
+		key, err := keyUsage.schema(r.Context(), entry.name, now)
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		key.Owner = entry.owner
+		if entry.expiresAt != 0 {
+			expiresAt := time.Unix(entry.expiresAt, 0).UTC()
+			key.ExpiresAt = &expiresAt
+		}
+		schema.Keys = append(schema.Keys, key)
+	}
+	respondWithJSON(w, schema)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Catalogs translate the English messages, keyed by their format string,
+// into other languages. A missing translation falls back to English.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+const defaultLocale string = "en"
+
+var locale *string = flag.String("locale", defaultLocale, "language of messages for clients that don't ask for a supported one")
+
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]map[string]string {
+	catalogs := map[string]map[string]string{defaultLocale: {}}
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	for _, file := range files {
+		data, err := localeFiles.ReadFile(path.Join("locales", file.Name()))
+		if err != nil {
+			panic(err)
+		}
+		catalog := make(map[string]string)
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			panic(fmt.Sprintf("catalog %s is malformed: %v", file.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(file.Name(), ".json")] = catalog
+	}
+	return catalogs
+}
+
+func validateLocale(name string) error {
+	if _, ok := catalogs[name]; !ok {
+		names := make([]string, 0, len(catalogs))
+		for name := range catalogs {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("unsupported locale \"%s\"; supported are %s", name, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// requestLocale picks the supported language the client prefers the most
+// according to Accept-Language, or -locale if there is none.
+func requestLocale(r *http.Request) string {
+	best, bestQuality := *locale, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		language, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if _, ok := catalogs[language]; ok && quality > bestQuality {
+			best, bestQuality = language, quality
+		}
+	}
+	return best
+}
+
+// translate returns the message in the language of the request.
+func translate(r *http.Request, message string) string {
+	if translated, ok := catalogs[requestLocale(r)][message]; ok {
+		return translated
+	}
+	return message
+}
+
+// localize formats a message in the language of the request.
+func localize(r *http.Request, format string, args ...any) string {
+	return fmt.Sprintf(translate(r, format), args...)
+}
+
+// localized returns a copy of a predefined error in the language of the
+// request.
+func localized(r *http.Request, apiErr APIError) *APIError {
+	apiErr.Message = translate(r, apiErr.Message)
+	return &apiErr
+}
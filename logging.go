@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+var logFormat *string = flag.String("log-format", "text", "format of the log: text or json")
+
+var logLevel *string = flag.String("log-level", "info", "minimum level of the logged messages: debug, info, warn or error")
+
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown level \"%s\"", name)
+	}
+	return level, nil
+}
+
+func newLogHandler(format string, level string) (slog.Handler, error) {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	options := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(os.Stderr, options), nil
+	case "json":
+		return slog.NewJSONHandler(os.Stderr, options), nil
+	}
+	return nil, fmt.Errorf("unknown format \"%s\"", format)
+}
+
+// setupLogging makes the configured handler the default one. Messages of
+// the log package, e.g. those of net/http, go through it as well.
+func setupLogging() {
+	handler, err := newLogHandler(*logFormat, *logLevel)
+	if err != nil {
+		return
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// requestLogger returns the default logger with the request ID and the
+// client address of the request attached.
+func requestLogger(r *http.Request) *slog.Logger {
+	return slog.With("request_id", requestID(r), "client", clientAddr(r).String())
+}
+
+// statusRecorder remembers the status and the size of a response for the
+// access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += n
+	return n, err
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := rec.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("connection can't be hijacked")
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// withAccessLog logs every request once it is served.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			status := rec.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			requestLogger(r).Info("request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", status,
+				"size", rec.size,
+				"duration_ms", float64(time.Since(start).Microseconds())/1000)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -1,82 +1,177 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
-
-	"github.com/mattn/go-sqlite3"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
-const createStmt string = `CREATE TABLE IF NOT EXISTS blocked_domains(
-    domain_name TEXT NOT NULL UNIQUE
-)`
+const deleteStmt string = "DELETE FROM blocked_domains WHERE domain_name = ?"
+
+const insertStmt string = "INSERT INTO blocked_domains(domain_name, mode) VALUES (?, ?)"
 
-const existsStmt string = "SELECT EXISTS(SELECT 1 FROM blocked_domains WHERE domain_name = ?)"
+// The rows of appendHandler are appended with valuesList.
+const insertEntryRowsStmt string = "INSERT INTO blocked_domains(domain_name, mode, comment, categories, expires_at) VALUES "
 
-const deleteStmt string = "DELETE FROM blocked_domains WHERE domain_name = ?"
+const selectExistingEntriesStmt string = "SELECT domain_name FROM blocked_domains WHERE domain_name IN "
+
+// The entries of the blocklist: the manual ones in blocked_domains and the
+// ones of the sources in feed_domains. Conditions on it are pushed down to
+// the indexes of both tables.
+const allEntries string = "(SELECT domain_name, mode FROM blocked_domains UNION ALL SELECT domain_name, mode FROM feed_domains) AS entries"
+
+const countStmt string = "SELECT COUNT(*) FROM " + allEntries
+
+const listStmt string = "SELECT domain_name, mode FROM " + allEntries + " ORDER BY domain_name LIMIT ? OFFSET ?"
 
-const insertStmt string = "INSERT INTO blocked_domains VALUES (?)"
+// The search is a pattern of likeEscaped, with "!" escaping the wildcards
+// of LIKE the same on every backend.
+const countSearchStmt string = "SELECT COUNT(*) FROM " + allEntries + " WHERE domain_name LIKE ? ESCAPE '!'"
+
+const listSearchStmt string = "SELECT domain_name, mode FROM " + allEntries + " WHERE domain_name LIKE ? ESCAPE '!' ORDER BY domain_name LIMIT ? OFFSET ?"
+
+const lookupEntryStmt string = "SELECT mode FROM " + allEntries + " WHERE domain_name = ?"
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+	maxCheckBatch    = 10000
+)
 
 var db *sql.DB
 
 type APIError struct {
+	Code       string     `json:"code"`
 	Status     string     `json:"status"`
 	Message    string     `json:"message"`
 	StatusCode int        `json:"statusCode"`
 	Errors     []APIError `json:"additionalErrors,omitempty"`
+	RequestID  string     `json:"requestId,omitempty"`
 }
 
+// Machine-readable codes of APIError. Unlike the messages, which are
+// localized and may be reworded, they are stable.
+const (
+	CodeOK                   = "OK"
+	CodeInvalidJSON          = "INVALID_JSON"
+	CodeInvalidBody          = "INVALID_BODY"
+	CodeInvalidRequest       = "INVALID_REQUEST"
+	CodeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	CodeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	CodeMissingParameter     = "MISSING_PARAMETER"
+	CodeInvalidParameter     = "INVALID_PARAMETER"
+	CodeNoDomains            = "NO_DOMAINS"
+	CodeInvalidDomain        = "INVALID_DOMAIN"
+	CodeMalformedDomain      = "MALFORMED_DOMAIN"
+	CodeDomainExists         = "DOMAIN_EXISTS"
+	CodeDomainNotFound       = "DOMAIN_NOT_FOUND"
+	CodeDomainBlocked        = "DOMAIN_BLOCKED"
+	CodeUnsupportedRule      = "UNSUPPORTED_RULE"
+	CodeUnsupportedLine      = "UNSUPPORTED_LINE"
+	CodeUnsupportedFormat    = "UNSUPPORTED_FORMAT"
+	CodeFeatureNotFound      = "FEATURE_NOT_FOUND"
+	CodeSourceExists         = "SOURCE_EXISTS"
+	CodeSourceNotFound       = "SOURCE_NOT_FOUND"
+	CodeInvalidSource        = "INVALID_SOURCE"
+	CodeJobNotFound          = "JOB_NOT_FOUND"
+	CodeJobNotFinished       = "JOB_NOT_FINISHED"
+	CodeUpstreamUnreachable  = "UPSTREAM_UNREACHABLE"
+	CodeForbiddenDestination = "FORBIDDEN_DESTINATION"
+	CodeNotReady             = "NOT_READY"
+	CodeUnauthorized         = "UNAUTHORIZED"
+	CodeRateLimited          = "RATE_LIMITED"
+	CodePreconditionFailed   = "PRECONDITION_FAILED"
+	CodeInvalidCategory      = "INVALID_CATEGORY"
+	CodeInvalidExpiry        = "INVALID_EXPIRY"
+	CodeInvalidPattern       = "INVALID_PATTERN"
+	CodeCommentTooLong       = "COMMENT_TOO_LONG"
+	CodePatternExists        = "PATTERN_EXISTS"
+	CodePatternNotFound      = "PATTERN_NOT_FOUND"
+	CodeInvalidRule          = "INVALID_RULE"
+	CodeRuleNotFound         = "RULE_NOT_FOUND"
+	CodeContentBlocked       = "CONTENT_BLOCKED"
+	CodeAuthDisabled         = "AUTH_DISABLED"
+	CodeKeyNotFound          = "KEY_NOT_FOUND"
+	CodeInvalidPolicy        = "INVALID_POLICY"
+	CodePolicyExists         = "POLICY_EXISTS"
+	CodePolicyNotFound       = "POLICY_NOT_FOUND"
+	CodeClientAssigned       = "CLIENT_ASSIGNED"
+	CodeInvalidSchedule      = "INVALID_SCHEDULE"
+	CodeScheduleNotFound     = "SCHEDULE_NOT_FOUND"
+	CodeSourceEnforced       = "SOURCE_ENFORCED"
+	CodeInvalidBlockPage     = "INVALID_BLOCK_PAGE"
+	CodeBlockPageNotFound    = "BLOCK_PAGE_NOT_FOUND"
+	CodeInvalidConfig        = "INVALID_CONFIG"
+	CodeOriginNotAllowed     = "ORIGIN_NOT_ALLOWED"
+	CodeInternalError        = "INTERNAL_ERROR"
+)
+
 var (
-	InvalidJSON         = APIError{StatusCode: http.StatusBadRequest, Message: "Excepted array of strings; got invalid JSON.", Status: "error"}
-	InternalServerError = APIError{StatusCode: http.StatusInternalServerError, Message: "Internal server error.", Status: "error"}
+	InvalidJSON         = APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: "Excepted array of strings; got invalid JSON.", Status: "error"}
+	InvalidEntriesJSON  = APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: "Excepted array of strings or {\"domain\", \"mode\"} objects; got invalid JSON.", Status: "error"}
+	InternalServerError = APIError{Code: CodeInternalError, StatusCode: http.StatusInternalServerError, Message: "Internal server error.", Status: "error"}
 )
 
 func ensureJSON(r *http.Request) *APIError {
 	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
 		return &APIError{
+			Code:       CodeUnsupportedMediaType,
 			StatusCode: http.StatusUnsupportedMediaType,
 			Status:     "error",
-			Message:    fmt.Sprintf("Excepted content of type \"application/json\", got: \"%s\".", contentType),
+			Message:    localize(r, "Excepted content of type \"%s\", got: \"%s\".", "application/json", contentType),
 		}
 	}
 	return nil
 }
 
-func unexceptedMethod(excepted string, got string) *APIError {
+func unexceptedMethod(r *http.Request, excepted string) *APIError {
 	return &APIError{
+		Code:       CodeMethodNotAllowed,
 		StatusCode: http.StatusMethodNotAllowed,
 		Status:     "error",
-		Message:    fmt.Sprintf("Excepted method %s, got: %s.", excepted, got),
+		Message:    localize(r, "Excepted method %s, got: %s.", excepted, r.Method),
 	}
 }
 
 func ensurePOST(r *http.Request) *APIError {
 	if r.Method != http.MethodPost {
-		return unexceptedMethod(http.MethodPost, r.Method)
+		return unexceptedMethod(r, http.MethodPost)
 	}
 	return nil
 }
 
+// respondWithError writes the error as JSON. Failures carry the request ID
+// withRequestID assigned, so a client can quote it.
 func respondWithError(w http.ResponseWriter, err *APIError) {
+	if err.StatusCode >= http.StatusBadRequest && err.RequestID == "" {
+		err.RequestID = w.Header().Get("X-Request-ID")
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(err.StatusCode)
 	json.NewEncoder(w).Encode(err)
 }
 
+func respondWithJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
 func isUniqueConstraintError(err error) bool {
-	var sqliteError sqlite3.Error
-	if !errors.As(err, &sqliteError) {
-		return false
-	}
-	if !errors.Is(sqliteError.ExtendedCode, sqlite3.ErrConstraintUnique) {
-		return false
-	}
-	return true
+	return store.IsUniqueViolation(err)
 }
 
 func ensureValidPOST(r *http.Request) *APIError {
@@ -89,61 +184,283 @@ func ensureValidPOST(r *http.Request) *APIError {
 	return nil
 }
 
-func appendHandler(w http.ResponseWriter, r *http.Request) {
+// decodeEntries reads a non-empty array of valid entries from the body of
+// a POST request, normalizing them. It responds with the error itself.
+func decodeEntries(w http.ResponseWriter, r *http.Request) ([]NewEntry, bool) {
 	if err := ensureValidPOST(r); err != nil {
 		respondWithError(w, err)
-		return
-	}
-	var newDomains []string
-	if err := json.NewDecoder(r.Body).Decode(&newDomains); err != nil {
-		respondWithError(w, &InvalidJSON)
-		return
+		return nil, false
 	}
+	var newDomains []NewEntry
+	ok := streamEntries(w, r, func(_ int, entry NewEntry) error {
+		newDomains = append(newDomains, entry)
+		return nil
+	})
+	return newDomains, ok
+}
 
-	if len(newDomains) == 0 {
-		respondWithError(w, &APIError{Status: "error", StatusCode: http.StatusBadRequest, Message: "No domains provided."})
-		return
+// streamEntries is decodeEntries for arrays too long to hold at once: it
+// passes the entries to fn as they are read, until one of them is invalid.
+// Only if it returns true were all of them valid.
+func streamEntries(w http.ResponseWriter, r *http.Request, fn func(index int, entry NewEntry) error) bool {
+	dec := json.NewDecoder(r.Body)
+	tok, err := dec.Token()
+	if err != nil || (tok != json.Delim('[') && tok != nil) {
+		respondWithError(w, localized(r, InvalidEntriesJSON))
+		return false
 	}
 
-	tx, err := db.Begin()
-	if err != nil {
-		// TODO: Handle error
+	invalid := make([]APIError, 0)
+	now := time.Now()
+	count := 0
+	for ; tok != nil && dec.More(); count++ {
+		var entry NewEntry
+		if err := dec.Decode(&entry); err != nil {
+			respondWithError(w, localized(r, InvalidEntriesJSON))
+			return false
+		}
+		if err := checkEntry(r, &entry, count, now); err != nil {
+			invalid = append(invalid, *err)
+			continue
+		}
+		if len(invalid) != 0 {
+			continue
+		}
+		if err := fn(count, entry); err != nil {
+			respondWithInternalError(w, r, err)
+			return false
+		}
+	}
+	if tok != nil {
+		if _, err := dec.Token(); err != nil {
+			respondWithError(w, localized(r, InvalidEntriesJSON))
+			return false
+		}
 	}
 
-	stmt, err := tx.Prepare(insertStmt)
+	if count == 0 {
+		respondWithError(w, &APIError{Code: CodeNoDomains, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "No domains provided.")})
+		return false
+	}
+	if len(invalid) != 0 {
+		respondWithError(w, invalidDomains(r, invalid))
+		return false
+	}
+	return true
+}
 
+// checkEntry normalizes the entry at the index of the array, or returns
+// why it is invalid.
+func checkEntry(r *http.Request, entry *NewEntry, index int, now time.Time) *APIError {
+	if err := entry.normalize(); err != nil {
+		return invalidDomain(r, err, "Domain \"%s\" (%d in the array) is invalid: %v.", entry.Domain, index, err)
+	}
+	list, err := normalizeCategories(entry.Categories)
 	if err != nil {
-		// TODO: Handle error
+		return &APIError{
+			Code:       CodeInvalidCategory,
+			Status:     "error",
+			StatusCode: http.StatusBadRequest,
+			Message:    localize(r, "Categories of domain \"%s\" (%d in the array) are invalid: %v.", entry.Domain, index, err),
+		}
 	}
+	entry.Categories = list
+	if err := entry.resolveExpiry(now); err != nil {
+		return &APIError{
+			Code:       CodeInvalidExpiry,
+			Status:     "error",
+			StatusCode: http.StatusBadRequest,
+			Message:    localize(r, "Expiry of domain \"%s\" (%d in the array) is invalid: %v.", entry.Domain, index, err),
+		}
+	}
+	return nil
+}
 
-	defer stmt.Close()
+// appendHandler adds the entries of the body in batches of
+// insertBatchSize as they are read. The entries already in the blocklist
+// are skipped by the database and found by comparing what it inserted to
+// the batch.
+func appendHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensureValidPOST(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
 
-	errs := make([]APIError, 0, len(newDomains))
+	tx, err := beginChange(r.Context())
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
 
-	for index, name := range newDomains {
-		_, err := stmt.Exec(name)
+	// Conflicts are found when their batch is inserted, and sorted back
+	// into the order of the array.
+	type conflict struct {
+		index  int
+		domain string
+	}
+	conflicts := make([]conflict, 0)
+	expiring := false
+	batch := make([]NewEntry, 0, insertBatchSize)
+	indexes := make([]int, 0, insertBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		inserted, err := insertEntries(tx, batch)
 		if err != nil {
-			if isUniqueConstraintError(err) {
-				errs = append(errs, APIError{
-					StatusCode: http.StatusConflict,
-					Message:    fmt.Sprintf("Domain \"%s\" (%d in the array) is already in the database.", name, index),
-					Status:     "error",
-				})
+			return err
+		}
+		added := make([]DomainEntry, 0, len(inserted))
+		for i, entry := range batch {
+			if !inserted[entry.Domain] {
+				conflicts = append(conflicts, conflict{indexes[i], entry.Domain})
 				continue
 			}
-			tx.Rollback()
-			respondWithError(w, &InternalServerError)
-			return
+			added = append(added, entry.DomainEntry)
+			tx.categorize(entry.Domain, entry.Categories)
+			expiring = expiring || entry.ExpiresAt != nil
 		}
+		batch, indexes = batch[:0], indexes[:0]
+		return tx.recordAll(added, false)
+	}
+
+	// A domain repeated in the body conflicts with its first occurrence.
+	seen := make(map[string]bool)
+	total := 0
+	ok := streamEntries(w, r, func(index int, entry NewEntry) error {
+		total++
+		if seen[entry.Domain] {
+			conflicts = append(conflicts, conflict{index, entry.Domain})
+			return nil
+		}
+		seen[entry.Domain] = true
+		batch, indexes = append(batch, entry), append(indexes, index)
+		if len(batch) < insertBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if !ok {
+		return
+	}
+	if err := flush(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if expiring {
+		scheduleExpiry()
+	}
+	slices.SortFunc(conflicts, func(a, b conflict) int { return a.index - b.index })
+	errs := make([]APIError, 0, len(conflicts))
+	for _, c := range conflicts {
+		errs = append(errs, APIError{
+			Code:       CodeDomainExists,
+			StatusCode: http.StatusConflict,
+			Message:    localize(r, "Domain \"%s\" (%d in the array) is already in the database.", c.domain, c.index),
+			Status:     "error",
+		})
 	}
-	tx.Commit()
-	if len(errs) == len(newDomains) {
-		respondWithError(w, &APIError{Status: "error", StatusCode: http.StatusConflict, Message: "All of the domains are already in the database."})
+	if len(errs) == total {
+		respondWithError(w, &APIError{Code: CodeDomainExists, Status: "error", StatusCode: http.StatusConflict, Message: localize(r, "All of the domains are already in the database.")})
 	} else if len(errs) == 0 {
-		respondWithError(w, &APIError{StatusCode: http.StatusCreated, Message: "Succesfully created all of the domains.", Status: "success"})
+		respondWithError(w, &APIError{Code: CodeOK, StatusCode: http.StatusCreated, Message: localize(r, "Succesfully created all of the domains."), Status: "success"})
 	} else {
-		respondWithError(w, &APIError{Status: "partial", StatusCode: http.StatusCreated, Message: "Some of the domains are already in the database.", Errors: errs})
+		respondWithError(w, &APIError{Code: CodeDomainExists, Status: "partial", StatusCode: http.StatusCreated, Message: localize(r, "Some of the domains are already in the database."), Errors: errs})
+	}
+}
+
+// insertEntries inserts the entries of the batch that aren't in the
+// blocklist yet, and returns the domains it inserted.
+func insertEntries(tx *changeTx, batch []NewEntry) (map[string]bool, error) {
+	inserted := make(map[string]bool, len(batch))
+	names := make([]string, len(batch))
+	for i, entry := range batch {
+		names[i] = entry.Domain
+	}
+	sourced, err := sourcedNames(tx, names)
+	if err != nil {
+		return nil, err
+	}
+	if len(sourced) != 0 {
+		batch = slices.DeleteFunc(slices.Clone(batch), func(entry NewEntry) bool { return sourced[entry.Domain] })
+		if len(batch) == 0 {
+			return inserted, nil
+		}
+	}
+	stmt := store.InsertNewStmt(insertEntryRowsStmt+valuesList(len(batch), 5), "domain_name")
+	if stmt == "" {
+		fresh, err := newEntries(tx, batch)
+		if err != nil || len(fresh) == 0 {
+			return inserted, err
+		}
+		if _, err := tx.Exec(insertEntryRowsStmt+valuesList(len(fresh), 5), entryRows(fresh)...); err != nil {
+			return nil, err
+		}
+		for _, entry := range fresh {
+			inserted[entry.Domain] = true
+		}
+		return inserted, nil
+	}
+
+	rows, err := tx.Query(stmt, entryRows(batch)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		inserted[name] = true
+	}
+	return inserted, rows.Err()
+}
+
+// newEntries returns the entries of the batch that aren't in the blocklist,
+// for backends that can't skip the others while inserting.
+func newEntries(tx *changeTx, batch []NewEntry) ([]NewEntry, error) {
+	args := make([]any, len(batch))
+	for i, entry := range batch {
+		args[i] = entry.Domain
+	}
+	rows, err := tx.Query(selectExistingEntriesStmt+"("+strings.Repeat("?, ", len(batch)-1)+"?)", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	fresh := make([]NewEntry, 0, len(batch))
+	for _, entry := range batch {
+		if !existing[entry.Domain] {
+			fresh = append(fresh, entry)
+		}
+	}
+	return fresh, nil
+}
+
+// entryRows returns the arguments of insertEntryRowsStmt for the entries.
+func entryRows(entries []NewEntry) []any {
+	args := make([]any, 0, len(entries)*5)
+	for _, entry := range entries {
+		args = append(args, entry.Domain, entry.Mode, "", joinCategories(entry.Categories), expiryValue(entry.ExpiresAt))
 	}
+	return args
 }
 
 func deleteHandler(w http.ResponseWriter, r *http.Request) {
@@ -151,26 +468,44 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, err)
 		return
 	}
+	bulkDeleteHandler(w, r)
+}
+
+// bulkDeleteHandler serves DELETE /domains, whose body lists the domains
+// to remove.
+func bulkDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensureJSON(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
 	var removedDomains []string
 	if err := json.NewDecoder(r.Body).Decode(&removedDomains); err != nil {
-		respondWithError(w, &InvalidJSON)
+		respondWithError(w, localized(r, InvalidJSON))
 		return
 	}
+	removeDomains(w, r, removedDomains, "")
+}
 
+// removeDomains removes the domains. With a non-empty ifMatch, the removal
+// fails as a whole unless the stored entries match it.
+func removeDomains(w http.ResponseWriter, r *http.Request, removedDomains []string, ifMatch string) {
 	if len(removedDomains) == 0 {
-		respondWithError(w, &APIError{Status: "error", StatusCode: http.StatusBadRequest, Message: "No domains provided."})
+		respondWithError(w, &APIError{Code: CodeNoDomains, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "No domains provided.")})
 		return
 	}
 
-	tx, err := db.Begin()
+	tx, err := beginChange(r.Context())
 	if err != nil {
-		// TODO: Handle error
+		respondWithInternalError(w, r, err)
+		return
 	}
 
 	stmt, err := tx.Prepare(deleteStmt)
 
 	if err != nil {
-		// TODO: Handle error
+		tx.Rollback()
+		respondWithInternalError(w, r, err)
+		return
 	}
 
 	defer stmt.Close()
@@ -178,27 +513,63 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	errs := make([]APIError, 0, len(removedDomains))
 
 	for index, name := range removedDomains {
+		name, err := normalizeDomain(name)
+		if err != nil {
+			errs = append(errs, *invalidDomain(r, err, "Domain \"%s\" (%d in the array) is invalid: %v.", removedDomains[index], index, err))
+			continue
+		}
+		entry := DomainEntry{Domain: name}
+		if err := tx.QueryRow(lookupStmt, name).Scan(&entry.Mode); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			tx.Rollback()
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if ifMatch != "" && (entry.Mode == "" || !etagMatches(ifMatch, entry.etag())) {
+			tx.Rollback()
+			respondWithError(w, preconditionFailed(r, name))
+			return
+		}
 		result, err := stmt.Exec(name)
 		if err != nil {
 			tx.Rollback()
-			respondWithError(w, &InternalServerError)
+			respondWithInternalError(w, r, err)
 			return
 		}
 		if rows, _ := result.RowsAffected(); rows == 0 {
 			errs = append(errs, APIError{
+				Code:       CodeDomainNotFound,
 				Status:     "error",
 				StatusCode: http.StatusNotFound,
-				Message:    fmt.Sprintf("Domain \"%s\" (%d in the array) isn't in the database.", name, index),
+				Message:    localize(r, "Domain \"%s\" (%d in the array) isn't in the database.", name, index),
 			})
+			continue
+		}
+		if _, err := tx.Exec(purgeStmt, entry.Domain); err != nil {
+			tx.Rollback()
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if _, err := tx.Exec(trashStmt, entry.Domain, entry.Mode, time.Now().Unix(), apiKeyName(r)); err != nil {
+			tx.Rollback()
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if err := tx.record(entry, true); err != nil {
+			tx.Rollback()
+			respondWithInternalError(w, r, err)
+			return
 		}
 	}
-	tx.Commit()
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
 	if len(errs) == len(removedDomains) {
-		respondWithError(w, &APIError{Status: "error", StatusCode: http.StatusNotFound, Message: "All of the domains aren't in the database."})
+		respondWithError(w, &APIError{Code: CodeDomainNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "All of the domains aren't in the database.")})
 	} else if len(errs) == 0 {
-		respondWithError(w, &APIError{StatusCode: http.StatusOK, Message: "Succesfully removed all of the specified domains.", Status: "success"})
+		respondWithError(w, &APIError{Code: CodeOK, StatusCode: http.StatusOK, Message: localize(r, "Succesfully removed all of the specified domains."), Status: "success"})
 	} else {
-		respondWithError(w, &APIError{Status: "partial", StatusCode: http.StatusOK, Message: "Some of the domains aren't in the database.", Errors: errs})
+		respondWithError(w, &APIError{Code: CodeDomainNotFound, Status: "partial", StatusCode: http.StatusOK, Message: localize(r, "Some of the domains aren't in the database."), Errors: errs})
 	}
 }
 
@@ -208,58 +579,866 @@ type CheckSchema struct {
 
 func checkHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		respondWithError(w, unexceptedMethod(http.MethodGet, r.Method))
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
 		return
 	}
 
 	domain := r.URL.Query().Get("domain")
 	if domain == "" {
 		respondWithError(w, &APIError{
+			Code:       CodeMissingParameter,
 			Status:     "error",
 			StatusCode: http.StatusBadRequest,
-			Message:    "Parameter \"domain\" wasn't provided in the query!",
+			Message:    localize(r, "Parameter \"%s\" wasn't provided in the query!", "domain"),
 		})
 		return
 	}
 
-	var successCode int
-
-	db.QueryRowContext(r.Context(), existsStmt, domain).Scan(&successCode)
+	domain, apiErr := checkedDomain(r, domain)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
 
 	var schema CheckSchema
 
-	if successCode == 0 {
-		schema.Included = false
-	} else {
-		schema.Included = true
-	}
+	schema.Included = blockingEntry(domain) != nil
+	publishCheck(r, domain, schema.Included)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(schema)
 }
 
+// batchCheckHandler serves POST /domains/check, which checks an array of
+// domains against the in-memory blocklist at once and returns whether each
+// of them is blocked, keyed by the domain as it was sent.
+func batchCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensureValidPOST(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	var domains []string
+	if err := json.NewDecoder(r.Body).Decode(&domains); err != nil {
+		respondWithError(w, localized(r, InvalidJSON))
+		return
+	}
+	if len(domains) == 0 {
+		respondWithError(w, &APIError{Code: CodeNoDomains, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "No domains provided.")})
+		return
+	}
+	if len(domains) > maxCheckBatch {
+		respondWithError(w, &APIError{Code: CodeInvalidBody, Status: "error", StatusCode: http.StatusRequestEntityTooLarge, Message: localize(r, "Excepted at most %d domains, got %d.", maxCheckBatch, len(domains))})
+		return
+	}
+
+	results := make(map[string]bool, len(domains))
+	invalid := make([]APIError, 0)
+	for index, domain := range domains {
+		name, err := normalizeDomain(domain)
+		if err != nil {
+			invalid = append(invalid, *invalidDomain(r, err, "Domain \"%s\" (%d in the array) is invalid: %v.", domain, index, err))
+			continue
+		}
+		results[domain] = blockingEntry(name) != nil
+	}
+	if len(invalid) != 0 {
+		respondWithError(w, invalidDomains(r, invalid))
+		return
+	}
+	respondWithJSON(w, results)
+}
+
+// checksHandler keeps GET /domains/check as a deprecated alias while
+// POST /domains/check is the batch check.
+func checksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		deprecated("/domains/{name}", checkHandler)(w, r)
+	case http.MethodPost:
+		batchCheckHandler(w, r)
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, POST"))
+	}
+}
+
+// domainsHandler serves the /domains collection.
+func domainsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listHandler(w, r)
+	case http.MethodPost:
+		appendHandler(w, r)
+	case http.MethodDelete:
+		bulkDeleteHandler(w, r)
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, POST, DELETE"))
+	}
+}
+
+// checkedDomain normalizes a domain to check, so it is matched in the form
+// it would have been stored in.
+func checkedDomain(r *http.Request, domain string) (string, *APIError) {
+	name, err := normalizeDomain(domain)
+	if err != nil {
+		return "", invalidDomain(r, err, "Domain \"%s\" is invalid: %v.", domain, err)
+	}
+	return name, nil
+}
+
+// invalidDomain is the error for a domain normalizeDomain rejected: 422
+// MALFORMED_DOMAIN if the input can't be a domain at all, like a too long
+// one or one with control characters, which is cut in the message, and
+// 400 INVALID_DOMAIN otherwise.
+func invalidDomain(r *http.Request, err error, message string, args ...any) *APIError {
+	var malformed malformedDomainError
+	if !errors.As(err, &malformed) {
+		return &APIError{Code: CodeInvalidDomain, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, message, args...)}
+	}
+	for i, arg := range args {
+		if s, ok := arg.(string); ok && len(s) > maxQuotedInput {
+			args[i] = strings.ToValidUTF8(s[:maxQuotedInput], "") + "…"
+		}
+	}
+	return &APIError{Code: CodeMalformedDomain, Status: "error", StatusCode: http.StatusUnprocessableEntity, Message: localize(r, message, args...)}
+}
+
+// invalidDomains is the error for the invalid items of an array, 422 if
+// all of them are malformed.
+func invalidDomains(r *http.Request, invalid []APIError) *APIError {
+	apiErr := &APIError{Code: CodeInvalidDomain, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Some of the domains are invalid."), Errors: invalid}
+	if !slices.ContainsFunc(invalid, func(e APIError) bool { return e.Code != CodeMalformedDomain }) {
+		apiErr.Code, apiErr.StatusCode = CodeMalformedDomain, http.StatusUnprocessableEntity
+	}
+	return apiErr
+}
+
+// domainHandler serves /domains/{name}. GET responds with the entry
+// blocking the name, or 404 if it isn't blocked; DELETE removes the entry
+// of the name itself.
+func domainHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	switch r.Method {
+	case http.MethodGet:
+		name, apiErr := checkedDomain(r, name)
+		if apiErr != nil {
+			respondWithError(w, apiErr)
+			return
+		}
+		entry := blockingEntry(name)
+		publishCheck(r, name, entry != nil)
+		if entry == nil {
+			respondWithError(w, &APIError{
+				Code:       CodeDomainNotFound,
+				Status:     "error",
+				StatusCode: http.StatusNotFound,
+				Message:    localize(r, "Domain \"%s\" isn't blocked.", name),
+			})
+			return
+		}
+		source, err := entrySource(r, entry.Domain)
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		note, err := entryNote(r, entry.Domain)
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		expiresAt, err := entryExpiry(r, entry.Domain)
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		origin, err := entryOrigin(r, entry.Domain)
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		// Only the entry stored under the name itself can be updated or
+		// deleted through it, so only that one gets an ETag.
+		if entry.Domain == name {
+			w.Header().Set("ETag", entry.etag())
+		}
+		respondWithJSON(w, MatchSchema{DomainEntry: *entry, EntryNote: note, Source: source, ExpiresAt: expiresAt, Origin: origin})
+	case http.MethodPut:
+		updateDomain(w, r, name)
+	case http.MethodDelete:
+		removeDomains(w, r, []string{name}, r.Header.Get("If-Match"))
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, PUT, DELETE"))
+	}
+}
+
+type UpdateSchema struct {
+	Mode string `json:"mode"`
+}
+
+func preconditionFailed(r *http.Request, name string) *APIError {
+	return &APIError{
+		Code:       CodePreconditionFailed,
+		Status:     "error",
+		StatusCode: http.StatusPreconditionFailed,
+		Message:    localize(r, "Domain \"%s\" was changed or removed since it was read.", name),
+	}
+}
+
+// updateDomain serves PUT /domains/{name}, which changes the mode of an
+// entry. The change is journaled as the removal of the old entry and the
+// addition of the new one.
+func updateDomain(w http.ResponseWriter, r *http.Request, name string) {
+	if err := ensureJSON(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	var body UpdateSchema
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted {\"mode\"} object; got invalid JSON."), Status: "error"})
+		return
+	}
+	updated := DomainEntry{Domain: name, Mode: body.Mode}
+	if err := updated.normalize(); err != nil {
+		respondWithError(w, invalidDomain(r, err, "Domain \"%s\" is invalid: %v.", name, err))
+		return
+	}
+
+	tx, err := beginChange(r.Context())
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	current := DomainEntry{Domain: updated.Domain}
+	err = tx.QueryRow(lookupStmt, current.Domain).Scan(&current.Mode)
+	if errors.Is(err, sql.ErrNoRows) {
+		if r.Header.Get("If-Match") != "" {
+			respondWithError(w, preconditionFailed(r, current.Domain))
+			return
+		}
+		respondWithError(w, &APIError{
+			Code:       CodeDomainNotFound,
+			Status:     "error",
+			StatusCode: http.StatusNotFound,
+			Message:    localize(r, "Domain \"%s\" isn't in the database.", current.Domain),
+		})
+		return
+	}
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etagMatches(ifMatch, current.etag()) {
+		respondWithError(w, preconditionFailed(r, current.Domain))
+		return
+	}
+
+	if updated.Mode != current.Mode {
+		// The row keeps its categories, which the journaled re-add would
+		// otherwise drop from memory.
+		tx.categorize(updated.Domain, categories.of(updated.Domain))
+		if _, err := tx.Exec(updateModeStmt, updated.Mode, updated.Domain); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if err := tx.record(current, true); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if err := tx.record(updated, false); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", updated.etag())
+	respondWithJSON(w, updated)
+}
+
+// deprecated marks an RPC-style endpoint superseded by the REST routes.
+// The aliases will be removed in the next release.
+func deprecated(successor string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		next(w, r)
+	}
+}
+
+type ListSchema struct {
+	Domains []DomainEntry `json:"domains"`
+	AsOf    *time.Time    `json:"asOf,omitempty"`
+	Page
+}
+
+// queryInt parses a non-negative integer query parameter, falling back to
+// def when it is absent.
+func queryInt(r *http.Request, name string, def int) (int, *APIError) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return def, nil
+	}
+	value, err := strconv.Atoi(param)
+	if err != nil || value < 0 {
+		return 0, &APIError{
+			Code:       CodeInvalidParameter,
+			Status:     "error",
+			StatusCode: http.StatusBadRequest,
+			Message:    localize(r, "Parameter \"%s\" must be a non-negative integer, got: \"%s\".", name, param),
+		}
+	}
+	return value, nil
+}
+
+// queryTime parses an RFC 3339 time query parameter, falling back to def
+// when it is absent.
+func queryTime(r *http.Request, name string, def time.Time) (time.Time, *APIError) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return def, nil
+	}
+	value, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		return time.Time{}, &APIError{
+			Code:       CodeInvalidParameter,
+			Status:     "error",
+			StatusCode: http.StatusBadRequest,
+			Message:    localize(r, "Parameter \"%s\" must be an RFC 3339 time, got: \"%s\".", name, param),
+		}
+	}
+	return value, nil
+}
+
+// likeEscaped escapes the wildcards of LIKE in s with "!".
+func likeEscaped(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+
+	page, apiErr := parsePage(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if r.URL.Query().Has("as_of") {
+		asOf, apiErr := queryTime(r, "as_of", time.Now())
+		if apiErr != nil {
+			respondWithError(w, apiErr)
+			return
+		}
+		// Categories are only known for the current entries, and past
+		// lists aren't searched.
+		for _, name := range []string{"category", "search"} {
+			if r.URL.Query().Get(name) != "" {
+				respondWithError(w, &APIError{
+					Code:       CodeInvalidParameter,
+					Status:     "error",
+					StatusCode: http.StatusBadRequest,
+					Message:    localize(r, "Parameters \"%s\" and \"%s\" can't be combined.", "as_of", name),
+				})
+				return
+			}
+		}
+		listAsOf(w, r, tx, page, asOf)
+		return
+	}
+
+	count, list, args := countStmt, listStmt, []any{}
+	search := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("search")))
+	if search != "" && r.URL.Query().Get("category") != "" {
+		respondWithError(w, &APIError{
+			Code:       CodeInvalidParameter,
+			Status:     "error",
+			StatusCode: http.StatusBadRequest,
+			Message:    localize(r, "Parameters \"%s\" and \"%s\" can't be combined.", "search", "category"),
+		})
+		return
+	}
+	if search != "" {
+		count, list, args = countSearchStmt, listSearchStmt, []any{"%" + likeEscaped(search) + "%"}
+	}
+	if category := r.URL.Query().Get("category"); category != "" {
+		category = strings.ToLower(category)
+		if err := validateCategory(category); err != nil {
+			respondWithError(w, &APIError{
+				Code:       CodeInvalidCategory,
+				Status:     "error",
+				StatusCode: http.StatusBadRequest,
+				Message:    localize(r, "Category \"%s\" is invalid: %v.", category, err),
+			})
+			return
+		}
+		count, list, args = countCategoryStmt, listCategoryStmt, []any{"%," + category + ",%"}
+	}
+
+	schema := ListSchema{Domains: []DomainEntry{}, Page: page}
+	if err := tx.QueryRow(count, args...).Scan(&schema.Total); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	rows, err := tx.Query(list, append(args, schema.Limit, schema.Offset)...)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry DomainEntry
+		if err := rows.Scan(&entry.Domain, &entry.Mode); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		schema.Domains = append(schema.Domains, entry)
+	}
+	if err := rows.Err(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	respondWithPage(w, r, &schema.Page, &schema)
+}
+
+// ensureColumn adds a column missing from a table created by an older
+// version of the service.
+func ensureColumn(table string, column string, definition string) error {
+	var count int
+	if err := db.QueryRow(store.ColumnExistsStmt(), table, column).Scan(&count); err != nil {
+		return err
+	}
+	if count != 0 {
+		return nil
+	}
+	_, err := db.Exec(store.Schema(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)))
+	return err
+}
+
 var address *string = flag.String("address", ":8000", "address for a web application")
 
-func main() {
-	flag.Parse()
+var databaseBackend *string = flag.String("database-backend", backendSQLite, "database backend: sqlite, postgres or mysql")
+
+var databasePath *string = flag.String("database", "database/db.db", "path to the SQLite database, or the connection string of PostgreSQL or MySQL")
 
+var shutdownTimeout *time.Duration = flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for in-flight requests when shutting down")
+
+// connectDatabase opens the database of the backend as it is.
+func connectDatabase(backend string, name string) error {
 	var err error
-	db, err = sql.Open("sqlite3", "database/db.db")
+	store, err = newStore(backend)
+	if err != nil {
+		return err
+	}
+	db, err = sql.Open(databaseDriver(store.Driver()), name)
+	if err != nil {
+		return fmt.Errorf("database name is invalid: %v", err)
+	}
+	return nil
+}
 
+// openDatabase opens the database of the backend and migrates its schema
+// to the latest version.
+func openDatabase(backend string, name string) error {
+	if err := connectDatabase(backend, name); err != nil {
+		return err
+	}
+	migrations, err := loadMigrations(backend)
 	if err != nil {
-		log.Fatalf("Database name is invalid: %v\n", err)
+		return fmt.Errorf("loading of the migrations failed: %v", err)
 	}
+	return migrate(migrations)
+}
+
+func registerHandlers() {
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/openapi.json", openAPIHandler)
+	http.HandleFunc("/ui/", serveUI)
+	registerPublicExport()
+	http.HandleFunc("/domains", domainsHandler)
+	http.HandleFunc("/domains/{name}", domainHandler)
+	http.HandleFunc("/domains/{name}/override", overrideHandler)
+	http.HandleFunc("/domains/{name}/decisions", decisionsHandler)
+	http.HandleFunc("/domains/changes", changesHandler)
+	http.HandleFunc("/domains/import", importHandler)
+	http.HandleFunc("/domains/backfill", backfillHandler)
+	http.HandleFunc("/domains/export", exportHandler)
+	http.HandleFunc("/domains/trash", trashHandler)
+	http.HandleFunc("/domains/trash/restore", restoreHandler)
+	http.HandleFunc("/domains/check/bulk", bulkCheckHandler)
+	http.HandleFunc("/domains/check/bulk/{id}", bulkJobHandler)
+	http.HandleFunc("/domains/check/bulk/{id}/results", bulkResultsHandler)
+	http.HandleFunc("/sources", sourcesHandler)
+	http.HandleFunc("/sources/{id}", sourceHandler)
+	http.HandleFunc("/allowlist", allowlistHandler)
+	http.HandleFunc("/allowlist/{name}", allowedHandler)
+	http.HandleFunc("/audit", auditHandler)
+	http.HandleFunc("/keys", keysHandler)
+	http.HandleFunc("/keys/{owner}", revokeKeysHandler)
+	http.HandleFunc("/categories", categoriesHandler)
+	http.HandleFunc("/categories/{name}", categoryHandler)
+	http.HandleFunc("/patterns", patternsHandler)
+	http.HandleFunc("/patterns/{id}", patternHandler)
+	http.HandleFunc("/mitm/rules", mitmRulesHandler)
+	http.HandleFunc("/mitm/rules/{id}", mitmRuleHandler)
+	http.HandleFunc("/mitm/ca.pem", mitmCAHandler)
+	http.HandleFunc("/policies", policiesHandler)
+	http.HandleFunc("/policies/{name}", policyHandler)
+	http.HandleFunc("/schedules", schedulesHandler)
+	http.HandleFunc("/schedules/{id}", scheduleHandler)
+	http.HandleFunc("/sources/{id}/canary", canaryHandler)
+	http.HandleFunc("/sources/{id}/promote", promoteHandler)
+	http.HandleFunc("/blockpages", blockPagesHandler)
+	http.HandleFunc("/blockpages/{category}", blockPageHandler)
+	http.HandleFunc("/blockpages/{category}/preview", blockPagePreviewHandler)
+	http.HandleFunc("/events", eventsHandler)
+	http.HandleFunc("/stats/summary", statsSummaryHandler)
+	http.HandleFunc("/stats/top-blocked", topBlockedHandler)
+	http.HandleFunc("/stats/timeline", statsTimelineHandler)
+	http.HandleFunc("/admin/config", adminConfigHandler)
+	http.HandleFunc("/admin/validate", validateHandler)
+	http.HandleFunc("/admin/memory", memoryHandler)
+	http.HandleFunc("/admin/observe", observeHandler)
+	http.HandleFunc("/admin/observe/impact", impactHandler)
+	http.HandleFunc("/admin/validate/fix", validateFixHandler)
+	http.HandleFunc("/cache/purge", cachePurgeHandler)
+
+	http.HandleFunc("/domains/append", deprecated("/domains", appendHandler))
+	http.HandleFunc("/domains/check", checksHandler)
+	http.HandleFunc("/domains/delete", deprecated("/domains", deleteHandler))
+
+	http.HandleFunc("/control/status", adguardStatusHandler)
+	http.HandleFunc("/control/filtering/status", adguardFilteringStatusHandler)
+	http.HandleFunc("/control/filtering/set_rules", adguardSetRulesHandler)
+	http.HandleFunc("/control/filtering/check_host", adguardCheckHostHandler)
 
-	defer db.Close()
+	http.HandleFunc("/control/features", featuresHandler)
+	http.HandleFunc("/control/features/set", setFeatureHandler)
 
-	_, err = db.Exec(createStmt)
+	registerChaosHandlers()
+}
+
+// boundAddresses are the addresses the services actually listen on, which
+// differ from the configured ones for ":0".
+type boundAddresses struct {
+	API   string
+	Proxy string
+	Socks string
+	RPZ   string
+	DNS   string
+}
+
+// serve starts the enabled services and, once all of them listen, calls
+// started if it isn't nil. When ctx is done or one of the services fails,
+// it stops accepting connections, waits up to -shutdown-timeout for the
+// in-flight requests and returns the error of the failed service, if any.
+func serve(ctx context.Context, started func(boundAddresses)) error {
+	if err := observe.load(ctx, *monitorMode); err != nil {
+		return fmt.Errorf("loading of observe mode failed: %v", err)
+	}
+	if err := setFieldHooks(); err != nil {
+		return fmt.Errorf("setting of the field hooks failed: %v", err)
+	}
+	if err := setHTTPCache(); err != nil {
+		return fmt.Errorf("setting of the HTTP cache failed: %v", err)
+	}
+	if err := setDestinations(); err != nil {
+		return fmt.Errorf("setting of the proxy destinations failed: %v", err)
+	}
+	var bound boundAddresses
+	errc := make(chan error, 4)
+	closers := make([]func(context.Context) error, 0, 4)
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		for _, close := range closers {
+			if err := close(shutdownCtx); err != nil {
+				slog.Warn("Shutdown wasn't graceful", "error", err)
+			}
+		}
+	}()
+
+	// The API listens during the warm-up, so /readyz can report it; the
+	// enforcing listeners only start once the blocklist is in memory.
+	api, err := net.Listen("tcp", *address)
+	if err != nil {
+		return err
+	}
+	bound.API = api.Addr().String()
+	destinations.listening(bound.API)
+	trusted, _ := parsePrefixes(*trustedProxies)
+	policies, _ = parsePolicies(*defaultPolicy, *clientPolicies)
+	keys, _ := parseAPIKeys(*apiKeys)
+	if err := keyUsage.register(keys); err != nil {
+		return fmt.Errorf("registering of the API keys failed: %v", err)
+	}
+	if err := apiKeyring.register(keys); err != nil {
+		return fmt.Errorf("loading of the API keys failed: %v", err)
+	}
+	go keyUsage.run(ctx)
+	go canaries.run(ctx)
+	go queryStats.run(ctx)
+	var public limiter
+	if *publicCheck {
+		public = newLimiter(ctx, "public-check", *publicCheckRate, *publicCheckRate)
+	}
+	tlsConfig, err := newAPITLSConfig()
 	if err != nil {
-		log.Fatalf("Execution of {createStmt} failed: %v\n", err)
+		return fmt.Errorf("TLS configuration is invalid: %v", err)
+	}
+	var handler http.Handler = http.DefaultServeMux
+	if *tlsClientCA != "" {
+		handler = withClientCert(*publicCheck, handler)
+	}
+	var clientLimiter, keyLimiter limiter
+	if *clientRateLimit > 0 {
+		clientLimiter = newLimiter(ctx, "client", *clientRateLimit, *rateLimitBurst)
+	}
+	if *keyRateLimit > 0 {
+		keyLimiter = newLimiter(ctx, "key", *keyRateLimit, *rateLimitBurst)
+	}
+	primary, _ := parsePrimary(*primaryURL)
+	var rep *replica
+	if primary != nil {
+		rep = newReplica(primary, *primaryAPIKey)
+		handler = rep.handler(handler)
+	}
+	handler = withKeyRateLimit(keyLimiter, handler)
+	cors, _ := parseCORS(*corsOrigins, *corsMethods, *corsHeaders)
+	apiServer := &http.Server{Handler: withRequestID(withClientAddr(trusted, withAccessLog(withRecovery(withCORS(cors, withClientRateLimit(clientLimiter, withAuth(keys, public, handler))))))), TLSConfig: tlsConfig}
+	apiServer.RegisterOnShutdown(closeEventStreams)
+	// The usage is flushed once the in-flight requests are done.
+	closers = append(closers, apiServer.Shutdown, keyUsage.flush, canaries.flush, queryStats.flush)
+	go func() {
+		if tlsConfig != nil {
+			errc <- apiServer.ServeTLS(api, "", "")
+			return
+		}
+		errc <- apiServer.Serve(api)
+	}()
+
+	setMemoryBudgets()
+	setHotDomains()
+	if err := blocklist.load(); err != nil {
+		return fmt.Errorf("loading of the blocklist failed: %v", err)
+	}
+	if err := allowlist.load(); err != nil {
+		return fmt.Errorf("loading of the allowlist failed: %v", err)
+	}
+	if err := pinHotDomains(); err != nil {
+		return fmt.Errorf("pinning of the hot names failed: %v", err)
+	}
+	closers = append(closers, saveHotDomains)
+	go runHotDomains(ctx)
+	if err := categories.load(); err != nil {
+		return fmt.Errorf("loading of the categories failed: %v", err)
+	}
+	if err := patterns.load(); err != nil {
+		return fmt.Errorf("loading of the patterns failed: %v", err)
+	}
+	if err := mitmRules.load(); err != nil {
+		return fmt.Errorf("loading of the MITM rules failed: %v", err)
+	}
+	if err := namedPolicies.load(); err != nil {
+		return fmt.Errorf("loading of the policies failed: %v", err)
+	}
+	scheduleLocation, _ = parseTimezone(*timezone)
+	if err := loadSchedules(); err != nil {
+		return fmt.Errorf("loading of the schedules failed: %v", err)
+	}
+	if err := canaries.load(); err != nil {
+		return fmt.Errorf("loading of the canary sources failed: %v", err)
+	}
+	if err := blockPages.load(); err != nil {
+		return fmt.Errorf("loading of the block pages failed: %v", err)
+	}
+	if *mitmHosts != "" {
+		ca, err := loadMITMCA(*mitmCACert, *mitmCAKey)
+		if err != nil {
+			return fmt.Errorf("loading of the MITM CA failed: %v", err)
+		}
+		mitmAuthority = ca
+	}
+	disabled, _ := parseCategories(*disabledCategories)
+	for _, category := range disabled {
+		categories.setEnabled(category, false)
+	}
+
+	if *rpzAddress != "" {
+		rpz, err := newRPZServer(*rpzZone, *rpzNotify, *rpzAllow, *rpzLanding)
+		if err != nil {
+			return fmt.Errorf("RPZ configuration is invalid: %v", err)
+		}
+		tcp, udp, err := listenDNS(*rpzAddress)
+		if err != nil {
+			return err
+		}
+		bound.RPZ = tcp.Addr().String()
+		destinations.listening(bound.RPZ)
+		closers = append(closers, func(context.Context) error {
+			tcp.Close()
+			return udp.Close()
+		})
+		go func() {
+			errc <- rpz.serve(tcp, udp)
+		}()
+	}
+
+	if *dnsAddress != "" {
+		dns, err := newDNSServer(*dnsUpstream, *dnsSinkhole)
+		if err != nil {
+			return fmt.Errorf("DNS configuration is invalid: %v", err)
+		}
+		tcp, udp, err := listenDNS(*dnsAddress)
+		if err != nil {
+			return err
+		}
+		bound.DNS = tcp.Addr().String()
+		destinations.listening(bound.DNS)
+		closers = append(closers, func(context.Context) error {
+			tcp.Close()
+			return udp.Close()
+		})
+		go func() {
+			errc <- dns.serve(tcp, udp)
+		}()
+	}
+
+	upstream, _ := parseUpstream(*proxyUpstream)
+
+	fetcher := &http.Client{
+		Timeout:   sourceFetchTimeout,
+		Transport: &http.Transport{Proxy: http.ProxyURL(upstream)},
+	}
+	// A replica gets the entries of the sources from the primary, which
+	// also removes the expired ones.
+	if rep != nil {
+		go rep.run(ctx)
+	} else {
+		go runSourceUpdater(ctx, fetcher)
+		go runExpiry(ctx)
+	}
+
+	if *proxyAddress != "" {
+		l, err := net.Listen("tcp", *proxyAddress)
+		if err != nil {
+			return err
+		}
+		bound.Proxy = l.Addr().String()
+		destinations.listening(bound.Proxy)
+		proxyServer := &http.Server{Handler: newForwardProxy(upstream)}
+		closers = append(closers, proxyServer.Shutdown)
+		go func() {
+			errc <- proxyServer.Serve(l)
+		}()
+	}
+
+	if *socksAddress != "" {
+		l, err := net.Listen("tcp", *socksAddress)
+		if err != nil {
+			return err
+		}
+		bound.Socks = l.Addr().String()
+		destinations.listening(bound.Socks)
+		closers = append(closers, func(context.Context) error {
+			return l.Close()
+		})
+		go func() {
+			errc <- newSocksServer(upstream).Serve(l)
+		}()
+	}
+
+	ready.Store(true)
+	if started != nil {
+		started(bound)
+	}
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		ready.Store(false)
+		slog.Info("Shutting down")
+		return nil
+	}
+}
+
+func main() {
+	// Client subcommands work against a running instance.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "openapi":
+			os.Exit(runOpenAPI(os.Args[2:]))
+		}
+	}
+
+	// "proxy scenario [flags] file" runs a scenario against a throwaway
+	// instance instead of serving.
+	args := os.Args[1:]
+	scenario := len(args) > 0 && args[0] == "scenario"
+	if scenario {
+		args = args[1:]
 	}
+	flag.CommandLine.Parse(args)
 
-	http.HandleFunc("/domains/append", appendHandler)
-	http.HandleFunc("/domains/check", checkHandler)
-	http.HandleFunc("/domains/delete", deleteHandler)
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Loading of the configuration failed: %v\n", err)
+	}
+	if err := validateConfig(); err != nil {
+		log.Fatalf("Configuration is invalid: %v\n", err)
+	}
+	setupLogging()
+	if *printConfig {
+		printEffectiveConfig(os.Stdout)
+		return
+	}
 
-	log.Fatal(http.ListenAndServe(*address, nil))
+	features.enabled, _ = parseFeatures(*enabledFeatures)
+
+	if scenario {
+		os.Exit(runScenario(flag.Args()))
+	}
+
+	if *rollbackTo >= 0 {
+		if err := rollbackDatabase(*databaseBackend, *databasePath, *rollbackTo); err != nil {
+			slog.Error("Rollback of the database schema failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := openDatabase(*databaseBackend, *databasePath); err != nil {
+		slog.Error("Opening of the database failed", "error", err)
+		os.Exit(1)
+	}
+
+	registerHandlers()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := serve(ctx, nil)
+	if closeErr := db.Close(); closeErr != nil {
+		slog.Error("Closing of the database failed", "error", closeErr)
+	}
+	if err != nil {
+		slog.Error("Serving failed", "error", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"gopkg.in/yaml.v3"
+)
+
+// Match modes of a blocked domain. An exact entry blocks only the domain
+// itself, a subdomain entry also blocks every name below it, and a
+// wildcard entry is a glob pattern (e.g. "*.tracking.example.com")
+// matched against the whole name. Regex is the mode of the matches of
+// blocked_patterns, which entries can't have.
+const (
+	ModeExact     = "exact"
+	ModeSubdomain = "subdomain"
+	ModeWildcard  = "wildcard"
+	ModeRegex     = "regex"
+)
+
+const (
+	maxDomainLength = 253
+	maxLabelLength  = 63
+	// Inputs may be URLs, so they may be longer than the domains, but not
+	// by this much.
+	maxInputLength = 4096
+	// Malformed inputs are cut to this many bytes when quoted.
+	maxQuotedInput = 64
+)
+
+// malformedDomainError is returned for inputs that can't be a domain in
+// any form, rather than domains that are invalid.
+type malformedDomainError string
+
+func (e malformedDomainError) Error() string {
+	return string(e)
+}
+
+const lookupStmt string = "SELECT mode FROM blocked_domains WHERE domain_name = ?"
+
+const updateModeStmt string = "UPDATE blocked_domains SET mode = ? WHERE domain_name = ?"
+
+type DomainEntry struct {
+	Domain string `json:"domain"`
+	Mode   string `json:"mode"`
+}
+
+// UnmarshalJSON accepts either a bare domain name, which is matched
+// exactly, or a {"domain": ..., "mode": ...} object.
+func (e *DomainEntry) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*e = DomainEntry{Domain: name, Mode: ModeExact}
+		return nil
+	}
+	type plain DomainEntry
+	var entry plain
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+	if entry.Mode == "" {
+		entry.Mode = ModeExact
+	}
+	*e = DomainEntry(entry)
+	return nil
+}
+
+// NewEntry is an entry of a request adding entries, which may name the
+// categories of the entry and when it expires, either as a time or as a
+// duration: {"domain": ..., "categories": ["ads"], "ttl": "2h"}.
+type NewEntry struct {
+	DomainEntry
+	Categories []string
+	ExpiresAt  *time.Time
+	TTL        string
+}
+
+func (e *NewEntry) UnmarshalJSON(data []byte) error {
+	if err := e.DomainEntry.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	var extra struct {
+		Categories []string   `json:"categories"`
+		ExpiresAt  *time.Time `json:"expiresAt"`
+		TTL        string     `json:"ttl"`
+	}
+	if err := json.Unmarshal(data, &extra); err != nil {
+		// Bare domain names have no categories.
+		var name string
+		if json.Unmarshal(data, &name) == nil {
+			return nil
+		}
+		return err
+	}
+	e.Categories, e.ExpiresAt, e.TTL = extra.Categories, extra.ExpiresAt, extra.TTL
+	return nil
+}
+
+// UnmarshalYAML accepts the same forms as UnmarshalJSON.
+func (e *DomainEntry) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*e = DomainEntry{Domain: node.Value, Mode: ModeExact}
+		return nil
+	}
+	type plain struct {
+		Domain string `yaml:"domain"`
+		Mode   string `yaml:"mode"`
+	}
+	var entry plain
+	if err := node.Decode(&entry); err != nil {
+		return err
+	}
+	if entry.Mode == "" {
+		entry.Mode = ModeExact
+	}
+	*e = DomainEntry(entry)
+	return nil
+}
+
+// normalizeDomain turns user input into the form domains are stored and
+// matched in: the host of a URL or a "host:port", lowercase, without the
+// trailing dot and with internationalized labels in punycode. Labels with
+// glob characters are left for the wildcard checks. IP addresses, bare or
+// in brackets like "[2001:db8::1]:443", are in their canonical form.
+func normalizeDomain(name string) (string, error) {
+	if len(name) > maxInputLength {
+		return "", malformedDomainError(fmt.Sprintf("input is longer than %d bytes", maxInputLength))
+	}
+	if !utf8.ValidString(name) {
+		return "", malformedDomainError("input isn't valid UTF-8")
+	}
+	name = strings.TrimSpace(name)
+	if i := strings.IndexFunc(name, unicode.IsControl); i != -1 {
+		c, _ := utf8.DecodeRuneInString(name[i:])
+		return "", malformedDomainError(fmt.Sprintf("input contains control character %U", c))
+	}
+	if strings.Contains(name, "://") {
+		u, err := url.Parse(name)
+		if err != nil {
+			return "", errors.New("URL is malformed")
+		}
+		name = u.Hostname()
+	} else {
+		name, _, _ = strings.Cut(name, "/")
+		if host, _, err := net.SplitHostPort(name); err == nil {
+			name = host
+		}
+	}
+	if addr, ok := parseHostAddr(name); ok {
+		return addr, nil
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == "" {
+		return "", errors.New("domain is empty")
+	}
+
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if strings.ContainsAny(label, "*?[") {
+			continue
+		}
+		if !isASCII(label) {
+			ascii, err := idna.Lookup.ToASCII(label)
+			if err != nil {
+				return "", fmt.Errorf("label \"%s\" isn't a valid internationalized name", label)
+			}
+			labels[i], label = ascii, ascii
+		}
+		if err := validateLabel(label); err != nil {
+			return "", err
+		}
+	}
+	name = strings.Join(labels, ".")
+	if len(name) > maxDomainLength {
+		return "", malformedDomainError(fmt.Sprintf("domain is longer than %d bytes", maxDomainLength))
+	}
+	return name, nil
+}
+
+// parseHostAddr returns the canonical form of a host that is an IP
+// address. The zone is dropped, and IPv4-mapped addresses are matched as
+// the IPv4 ones.
+func parseHostAddr(host string) (string, bool) {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return "", false
+	}
+	return addr.WithZone("").Unmap().String(), true
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// validateLabel allows underscores besides letters, digits and hyphens, as
+// blocklists contain names such as "_dmarc.example.com".
+func validateLabel(label string) error {
+	if label == "" {
+		return errors.New("domain contains an empty label")
+	}
+	if len(label) > maxLabelLength {
+		return fmt.Errorf("label \"%s\" is longer than %d characters", label, maxLabelLength)
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return fmt.Errorf("label \"%s\" starts or ends with a hyphen", label)
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("label \"%s\" contains \"%c\"", label, c)
+		}
+	}
+	return nil
+}
+
+// lookupName is the name to match a host against. Hosts that aren't valid
+// domains are matched as they are, so they are still caught by wildcards.
+func lookupName(host string) string {
+	if name, err := normalizeDomain(host); err == nil {
+		return name
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// etag is a strong validator of the entry as it is stored, for If-Match.
+func (e DomainEntry) etag() string {
+	sum := sha256.Sum256([]byte(e.Domain + "\x00" + e.Mode))
+	return "\"" + hex.EncodeToString(sum[:8]) + "\""
+}
+
+// etagMatches reports whether an If-Match header lists the ETag. Weak
+// ETags never match, as If-Match uses the strong comparison.
+func etagMatches(header string, etag string) bool {
+	for _, item := range strings.Split(header, ",") {
+		if item = strings.TrimSpace(item); item == "*" || item == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize normalizes the domain in place and validates it against the
+// mode.
+func (e *DomainEntry) normalize() error {
+	name, err := normalizeDomain(e.Domain)
+	if err != nil {
+		return err
+	}
+	e.Domain = name
+	switch e.Mode {
+	case ModeExact, ModeSubdomain:
+		if strings.ContainsAny(e.Domain, "*?[") {
+			return fmt.Errorf("patterns are only allowed in mode \"%s\"", ModeWildcard)
+		}
+	case ModeWildcard:
+		if !strings.ContainsAny(e.Domain, "*?[") {
+			return errors.New("wildcard doesn't contain a pattern")
+		}
+		if _, err := path.Match(e.Domain, ""); err != nil {
+			return errors.New("wildcard pattern is malformed")
+		}
+	default:
+		return fmt.Errorf("unknown mode \"%s\"", e.Mode)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"flag"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"sync"
+)
+
+var mirrorMemory *int = flag.Int("mirror-memory", 0, "megabytes each of the mirrors of the blocklist and the allowlist may take before the exact entries they can't fit are looked up in the database (unlimited if 0)")
+
+const lookupExactBlockedStmt string = "SELECT COUNT(*) FROM " + allEntries + " WHERE domain_name = ? AND mode = ?"
+
+const lookupExactAllowedStmt string = "SELECT COUNT(*) FROM allowed_domains WHERE domain_name = ? AND mode = ?"
+
+// Rough costs of the entries of a mirror on 64-bit platforms, on top of
+// their names: the headers of the strings and the slots of the maps, and
+// a map per label of the suffixes.
+const (
+	exactEntryOverhead    = 40
+	suffixLabelOverhead   = 80
+	wildcardEntryOverhead = 16
+	lookupEntryOverhead   = 120
+	// Spilled mirrors cache at least as much, even if their suffixes and
+	// wildcards take the whole budget.
+	minLookupCacheBytes = 1 << 20
+)
+
+func exactEntryBytes(name string) int64 {
+	return int64(len(name) + exactEntryOverhead)
+}
+
+func suffixEntryBytes(name string) int64 {
+	labels := int64(len(reversedLabels(name)))
+	return int64(len(name)) + labels*suffixLabelOverhead
+}
+
+func wildcardEntryBytes(pattern string) int64 {
+	return int64(len(pattern) + wildcardEntryOverhead)
+}
+
+// setMemoryBudgets applies -mirror-memory, before the mirrors are loaded.
+func setMemoryBudgets() {
+	budget := int64(*mirrorMemory) << 20
+	blocklist.budget, blocklist.lookup = budget, lookupExactBlockedStmt
+	allowlist.budget, allowlist.lookup = budget, lookupExactAllowedStmt
+}
+
+// spill drops the exact entries, which are looked up in the database from
+// then on. It must be called with mu held for writing.
+func (b *memoryBlocklist) spill() {
+	slog.Warn("Mirror exceeds its memory budget; looking up exact entries in the database", "entries", len(b.exact), "budget", b.budget)
+	b.exact = make(map[string]bool)
+	b.exactBytes = 0
+	b.spilled = true
+	b.lookups = newLookupCache(b.budget - b.suffixBytes - b.wildcardBytes)
+}
+
+// hasExact reports whether the name is an exact entry. Lookups of spilled
+// mirrors failing count as a miss, so the database being down doesn't
+// block every name, and aren't cached. It must be called with mu held.
+func (b *memoryBlocklist) hasExact(name string) bool {
+	if !b.spilled {
+		return b.exact[name]
+	}
+	if found, ok := b.lookups.get(name); ok {
+		return found
+	}
+	var count int
+	if err := db.QueryRow(b.lookup, name, ModeExact).Scan(&count); err != nil {
+		slog.Error("Lookup of an exact entry failed", "domain", name, "error", err)
+		return false
+	}
+	b.lookups.put(name, count > 0)
+	return count > 0
+}
+
+// lookupCache keeps the results of the latest lookups of a spilled mirror,
+// evicting the least recently used ones past its budget.
+type lookupCache struct {
+	mu        sync.Mutex
+	budget    int64
+	bytes     int64
+	order     *list.List
+	items     map[string]*list.Element
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type lookupResult struct {
+	name  string
+	found bool
+}
+
+func newLookupCache(budget int64) *lookupCache {
+	return &lookupCache{budget: max(budget, minLookupCacheBytes), order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lookupCache) get(name string) (found bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.items[name]
+	if !ok {
+		c.misses++
+		return false, false
+	}
+	c.hits++
+	c.order.MoveToFront(item)
+	return item.Value.(*lookupResult).found, true
+}
+
+func (c *lookupCache) put(name string, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if item, ok := c.items[name]; ok {
+		item.Value.(*lookupResult).found = found
+		c.order.MoveToFront(item)
+		return
+	}
+	c.items[name] = c.order.PushFront(&lookupResult{name: name, found: found})
+	c.bytes += int64(len(name) + lookupEntryOverhead)
+	for c.bytes > c.budget {
+		oldest := c.order.Back()
+		result := c.order.Remove(oldest).(*lookupResult)
+		delete(c.items, result.name)
+		c.bytes -= int64(len(result.name) + lookupEntryOverhead)
+		c.evictions++
+	}
+}
+
+// update corrects a cached result after a change to the entry was
+// committed. Names not cached are left to be looked up.
+func (c *lookupCache) update(name string, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if item, ok := c.items[name]; ok {
+		item.Value.(*lookupResult).found = found
+	}
+}
+
+type MirrorMemorySchema struct {
+	Name      string `json:"name"`
+	Exact     int    `json:"exact"`
+	Wildcards int    `json:"wildcards"`
+	// Estimates of the bytes the entries take, and the budget, 0 if
+	// unlimited.
+	Bytes  int64 `json:"bytes"`
+	Budget int64 `json:"budget"`
+	// Spilled mirrors look the exact entries up in the database, caching
+	// the results.
+	Spilled         bool  `json:"spilled"`
+	CachedLookups   int   `json:"cachedLookups"`
+	LookupBytes     int64 `json:"lookupBytes"`
+	LookupHits      int64 `json:"lookupHits"`
+	LookupMisses    int64 `json:"lookupMisses"`
+	LookupEvictions int64 `json:"lookupEvictions"`
+	// The most checked names, whose matches are kept ready, and the checks
+	// of names answered from them or not.
+	HotNames  int   `json:"hotNames"`
+	HotHits   int64 `json:"hotHits"`
+	HotMisses int64 `json:"hotMisses"`
+}
+
+type MemorySchema struct {
+	// Bytes of the heap in use, and obtained from the system in total.
+	HeapBytes   uint64               `json:"heapBytes"`
+	SystemBytes uint64               `json:"systemBytes"`
+	Goroutines  int                  `json:"goroutines"`
+	Mirrors     []MirrorMemorySchema `json:"mirrors"`
+}
+
+func (b *memoryBlocklist) memory(name string) MirrorMemorySchema {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	schema := MirrorMemorySchema{Name: name, Exact: len(b.exact), Wildcards: len(b.wildcards), Bytes: b.exactBytes + b.suffixBytes + b.wildcardBytes, Budget: b.budget, Spilled: b.spilled}
+	if b.hot != nil {
+		schema.HotNames, schema.HotHits, schema.HotMisses = b.hot.stats()
+	}
+	if b.lookups != nil {
+		b.lookups.mu.Lock()
+		defer b.lookups.mu.Unlock()
+		schema.CachedLookups, schema.LookupBytes = len(b.lookups.items), b.lookups.bytes
+		schema.LookupHits, schema.LookupMisses, schema.LookupEvictions = b.lookups.hits, b.lookups.misses, b.lookups.evictions
+		schema.Bytes += b.lookups.bytes
+	}
+	return schema
+}
+
+func memoryReport() MemorySchema {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return MemorySchema{
+		HeapBytes:   stats.HeapInuse,
+		SystemBytes: stats.Sys,
+		Goroutines:  runtime.NumGoroutine(),
+		Mirrors:     []MirrorMemorySchema{blocklist.memory("blocklist"), allowlist.memory("allowlist")},
+	}
+}
+
+// The report is also published at /debug/vars, for the tooling already
+// scraping the gauges there.
+func init() {
+	expvar.Publish("memory", expvar.Func(func() any { return memoryReport() }))
+}
+
+// memoryHandler serves GET /admin/memory, the memory the service takes and
+// the estimates of its mirrors against their budgets.
+func memoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	respondWithJSON(w, memoryReport())
+}
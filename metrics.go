@@ -0,0 +1,11 @@
+package main
+
+import "expvar"
+
+// Gauges of work in flight, published at /debug/vars so deployment tooling
+// can wait for a node to drain before restarting it.
+var (
+	activeTunnels       = expvar.NewInt("activeTunnels")
+	activeProxyRequests = expvar.NewInt("activeProxyRequests")
+	activeDNSQueries    = expvar.NewInt("activeDNSQueries")
+)
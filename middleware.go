@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"runtime/debug"
+)
+
+type requestIDKey struct{}
+
+func newRequestID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID assigns every request an ID, returned in the X-Request-ID
+// header and in internal error responses, so they can be matched with the
+// log.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := newRequestID()
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// withRecovery turns a panicking handler into an internal error response
+// instead of a dropped connection.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			requestLogger(r).Error("Handler panicked", "method", r.Method, "path", r.URL.Path, "panic", v, "stack", string(debug.Stack()))
+			respondWithError(w, internalError(r))
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func internalError(r *http.Request) *APIError {
+	apiErr := localized(r, InternalServerError)
+	apiErr.RequestID = requestID(r)
+	return apiErr
+}
+
+// respondWithInternalError logs the underlying error and responds with
+// InternalServerError carrying the request ID.
+func respondWithInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	requestLogger(r).Error("Request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+	respondWithError(w, internalError(r))
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var rollbackTo *int = flag.Int("rollback-to", -1, "roll the database schema back to the version, then exit (none if negative)")
+
+// The schema is upgraded by the migrations in migrations/, named like
+// 0002_indexes.up.sql, applied in order of their version on start. A
+// migration may come with a .down.sql file undoing it, and either file
+// with a variant for a backend, like 0002_indexes.down.mysql.sql, used
+// instead on that backend. Statements are separated by semicolons and
+// translated by Store.Schema, like the table definitions used to be.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// The migrations applied to the database, one row each.
+const createSchemaVersionStmt string = `CREATE TABLE IF NOT EXISTS schema_version(
+    version INTEGER NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    applied_at INTEGER NOT NULL
+)`
+
+const schemaVersionStmt string = "SELECT COALESCE(MAX(version), 0) FROM schema_version"
+
+const insertSchemaVersionStmt string = "INSERT INTO schema_version(version, name, applied_at) VALUES (?, ?, ?)"
+
+const deleteSchemaVersionStmt string = "DELETE FROM schema_version WHERE version = ?"
+
+// The first migration creates the schema the service had before, which
+// databases created then may have only some of. It is applied without a
+// transaction, as MySQL can't roll DDL back anyway; all of its statements
+// and the upgrade of such databases can be repeated if it is cut short.
+const baselineVersion = 1
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)(?:\.([a-z]+))?\.sql$`)
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	// Empty if the migration can't be rolled back.
+	down string
+}
+
+// loadMigrations reads the migrations for the backend, by version.
+func loadMigrations(backend string) ([]migration, error) {
+	files, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*migration)
+	// Whether the statements of a direction of a version are the variant
+	// of the backend, which wins over the shared ones.
+	specific := make(map[string]bool)
+	for _, file := range files {
+		match := migrationFileName.FindStringSubmatch(file.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration \"%s\" isn't named like 0001_name.up.sql", file.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		direction, variant := match[3], match[4]
+		if variant != "" && variant != backend {
+			continue
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		}
+		if m.name != match[2] {
+			return nil, fmt.Errorf("migrations \"%s\" and \"%s\" have the same version", m.name, match[2])
+		}
+		key := match[1] + direction
+		if specific[key] && variant == "" {
+			continue
+		}
+		data, err := migrationFiles.ReadFile("migrations/" + file.Name())
+		if err != nil {
+			return nil, err
+		}
+		if direction == "up" {
+			m.up = string(data)
+		} else {
+			m.down = string(data)
+		}
+		specific[key] = variant != ""
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d has no .up.sql file", m.version)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b migration) int { return a.version - b.version })
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// splitStatements splits a migration into its statements, dropping the
+// comments, which take whole lines.
+func splitStatements(script string) []string {
+	lines := strings.Split(script, "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			kept = append(kept, line)
+		}
+	}
+	stmts := make([]string, 0)
+	for _, stmt := range strings.Split(strings.Join(kept, "\n"), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			stmts = append(stmts, store.Schema(stmt))
+		}
+	}
+	return stmts
+}
+
+func schemaVersion() (int, error) {
+	if _, err := db.Exec(store.Schema(createSchemaVersionStmt)); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRow(schemaVersionStmt).Scan(&version)
+	return version, err
+}
+
+// migrate applies the migrations the database hasn't had yet.
+func migrate(migrations []migration) error {
+	version, err := schemaVersion()
+	if err != nil {
+		return fmt.Errorf("reading of the schema version failed: %v", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema is at version %d, newer than %d of this version of the service; roll it back with -rollback-to of the newer one", version, len(migrations))
+	}
+	for _, m := range migrations[version:] {
+		if m.version == baselineVersion {
+			err = applyBaseline(m)
+		} else {
+			err = applyMigration(m, m.up, false)
+		}
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		slog.Info("Database schema migrated", "version", m.version, "name", m.name)
+	}
+	return nil
+}
+
+// rollback undoes the migrations after the version, latest first.
+func rollback(migrations []migration, target int) error {
+	version, err := schemaVersion()
+	if err != nil {
+		return fmt.Errorf("reading of the schema version failed: %v", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema is at version %d, which only a newer version of the service can roll back", version)
+	}
+	if target < baselineVersion {
+		return fmt.Errorf("the schema can't be rolled back before version %d", baselineVersion)
+	}
+	for i := version - 1; i >= target; i-- {
+		m := migrations[i]
+		if m.down == "" {
+			return fmt.Errorf("migration %d (%s) can't be rolled back", m.version, m.name)
+		}
+		if err := applyMigration(m, m.down, true); err != nil {
+			return fmt.Errorf("rollback of migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		slog.Info("Database schema rolled back", "version", m.version-1, "name", m.name)
+	}
+	return nil
+}
+
+// applyMigration runs the statements of a direction of the migration and
+// records it in the same transaction.
+func applyMigration(m migration, script string, down bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range splitStatements(script) {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if down {
+		_, err = tx.Exec(deleteSchemaVersionStmt, m.version)
+	} else {
+		_, err = tx.Exec(insertSchemaVersionStmt, m.version, m.name, time.Now().Unix())
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func applyBaseline(m migration) error {
+	for _, stmt := range splitStatements(m.up) {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if err := upgradeLegacySchema(); err != nil {
+		return err
+	}
+	_, err := db.Exec(insertSchemaVersionStmt, m.version, m.name, time.Now().Unix())
+	if isUniqueConstraintError(err) {
+		// Another instance sharing the database applied it meanwhile.
+		return nil
+	}
+	return err
+}
+
+// upgradeLegacySchema adds what the tables of a database created before
+// the migrations may lack.
+func upgradeLegacySchema() error {
+	for _, table := range []string{"blocked_domains", "domain_changes"} {
+		if err := ensureColumn(table, "mode", "TEXT NOT NULL DEFAULT 'exact'"); err != nil {
+			return fmt.Errorf("adding of column \"mode\" to %s failed: %v", table, err)
+		}
+	}
+	for _, table := range []string{"blocked_domains", "allowed_domains"} {
+		if err := ensureColumn(table, "source", "INTEGER"); err != nil {
+			return fmt.Errorf("adding of column \"source\" to %s failed: %v", table, err)
+		}
+	}
+	for _, column := range []string{"comment", "categories", "origin"} {
+		if err := ensureColumn("blocked_domains", column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return fmt.Errorf("adding of column \"%s\" to blocked_domains failed: %v", column, err)
+		}
+	}
+	if err := ensureColumn("blocked_domains", "expires_at", "INTEGER"); err != nil {
+		return fmt.Errorf("adding of column \"expires_at\" to blocked_domains failed: %v", err)
+	}
+	if err := ensureColumn("domain_changes", "changed_at", "INTEGER"); err != nil {
+		return fmt.Errorf("adding of column \"changed_at\" to domain_changes failed: %v", err)
+	}
+	if err := ensureColumn("blocklist_sources", "canary_until", "INTEGER"); err != nil {
+		return fmt.Errorf("adding of column \"canary_until\" to blocklist_sources failed: %v", err)
+	}
+	if err := migrateCategorySchedules(); err != nil {
+		return fmt.Errorf("moving of the category schedules failed: %v", err)
+	}
+	return nil
+}
+
+// rollbackDatabase rolls the schema of the database back to the version,
+// for -rollback-to.
+func rollbackDatabase(backend string, name string, version int) error {
+	if err := connectDatabase(backend, name); err != nil {
+		return err
+	}
+	defer db.Close()
+	migrations, err := loadMigrations(backend)
+	if err != nil {
+		return fmt.Errorf("loading of the migrations failed: %v", err)
+	}
+	return rollback(migrations, version)
+}
@@ -0,0 +1,217 @@
+-- The schema the service had when migrations were introduced. Every
+-- statement is idempotent, as databases created before then already have
+-- some of the tables.
+
+CREATE TABLE IF NOT EXISTS blocked_domains(
+    domain_name TEXT NOT NULL UNIQUE,
+    mode TEXT NOT NULL DEFAULT 'exact',
+    source INTEGER,
+    comment TEXT NOT NULL DEFAULT '',
+    categories TEXT NOT NULL DEFAULT '',
+    expires_at INTEGER,
+    origin TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS domain_changes(
+    serial INTEGER PRIMARY KEY AUTOINCREMENT,
+    domain_name TEXT NOT NULL,
+    removed BOOLEAN NOT NULL,
+    mode TEXT NOT NULL DEFAULT 'exact',
+    changed_at INTEGER
+);
+
+-- Remote blocklists the service subscribes to. Their entries are kept in
+-- feed_domains since 0005, with the ID of the source; blocked_domains only
+-- holds the manual entries, which are never touched by a sync, and leaves
+-- its source column NULL.
+CREATE TABLE IF NOT EXISTS blocklist_sources(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    url TEXT NOT NULL UNIQUE,
+    update_interval INTEGER NOT NULL,
+    last_updated INTEGER,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_update INTEGER NOT NULL DEFAULT 0,
+    canary_until INTEGER
+);
+
+-- Exceptions to the blocklist. A name matching an allowed entry is never
+-- blocked, whichever blocked entry or source it matches too. Overrides of
+-- an entry of a source carry the ID of the source and go away with it.
+CREATE TABLE IF NOT EXISTS allowed_domains(
+    domain_name TEXT NOT NULL UNIQUE,
+    mode TEXT NOT NULL DEFAULT 'exact',
+    source INTEGER
+);
+
+-- Domains removed through the API are kept here until they are restored or
+-- purged, so an accidental deletion can be undone. Removing a domain again
+-- replaces its previous record.
+CREATE TABLE IF NOT EXISTS deleted_domains(
+    domain_name TEXT NOT NULL UNIQUE,
+    mode TEXT NOT NULL,
+    deleted_at INTEGER NOT NULL,
+    deleted_by TEXT NOT NULL DEFAULT ''
+);
+
+-- Every change made through the API to the blocklist, the allowlist, the
+-- patterns or the API keys, with the name of the API key and the address
+-- of the client. Changes the service makes on its own, like the sync of a
+-- source, aren't recorded.
+CREATE TABLE IF NOT EXISTS audit_log(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    recorded_at INTEGER NOT NULL,
+    actor TEXT NOT NULL DEFAULT '',
+    client_addr TEXT NOT NULL DEFAULT '',
+    list TEXT NOT NULL,
+    action TEXT NOT NULL,
+    domain_name TEXT NOT NULL,
+    mode TEXT NOT NULL
+);
+
+-- Requests counted by every replica, per key and minute.
+CREATE TABLE IF NOT EXISTS rate_limits(
+    rate_key TEXT NOT NULL,
+    window_start INTEGER NOT NULL,
+    hits INTEGER NOT NULL,
+    UNIQUE(rate_key, window_start)
+);
+
+-- The serial of the primary the local copy is at.
+CREATE TABLE IF NOT EXISTS replica_state(
+    id INTEGER PRIMARY KEY,
+    serial INTEGER NOT NULL
+);
+
+-- The usage of every API key, by name. A key is as old as its secret:
+-- configuring a new secret under the name starts the count over.
+CREATE TABLE IF NOT EXISTS api_key_usage(
+    name TEXT NOT NULL UNIQUE,
+    key_hash TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    requests INTEGER NOT NULL DEFAULT 0,
+    last_used_at INTEGER
+);
+
+-- The keys of every user: those issued through the API and, matched by
+-- hash, the configured ones, so they can be expired or revoked too. A
+-- configured key given a new secret is a new key.
+CREATE TABLE IF NOT EXISTS api_keys(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    owner TEXT NOT NULL,
+    key_hash TEXT NOT NULL UNIQUE,
+    issued INTEGER NOT NULL DEFAULT 0,
+    created_at INTEGER NOT NULL,
+    expires_at INTEGER,
+    revoked_at INTEGER
+);
+
+-- Regular expressions blocking the names they match, for the rules a
+-- suffix or a glob can't express. They are only enforced with the
+-- regex-rules feature, and only for names no entry blocks.
+CREATE TABLE IF NOT EXISTS blocked_patterns(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    pattern TEXT NOT NULL UNIQUE,
+    comment TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL
+);
+
+-- Rules applied to the decrypted traffic of the intercepted sites. A rule
+-- blocks the requests under its path prefix, or with a content type only
+-- the responses of that type. An empty domain applies to every intercepted
+-- site.
+CREATE TABLE IF NOT EXISTS mitm_rules(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    domain_name TEXT NOT NULL DEFAULT '',
+    path_prefix TEXT NOT NULL DEFAULT '',
+    content_type TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL
+);
+
+-- Named policies give the clients of their subnets blocking of their own,
+-- on top of the blocklist and the allowlist every client shares: names a
+-- policy allows are never blocked for its clients, names it blocks always
+-- are. A policy may also change the decision for names no rule matches.
+CREATE TABLE IF NOT EXISTS policies(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    default_policy TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS policy_entries(
+    policy INTEGER NOT NULL,
+    domain_name TEXT NOT NULL,
+    mode TEXT NOT NULL DEFAULT 'exact',
+    allowed INTEGER NOT NULL DEFAULT 0
+);
+
+-- A subnet belongs to a single policy.
+CREATE TABLE IF NOT EXISTS policy_clients(
+    policy INTEGER NOT NULL,
+    prefix TEXT NOT NULL UNIQUE
+);
+
+-- Schedules are time windows of a category or of a domain, for every
+-- client or for the clients of a named policy: "social" enforced from 09:00
+-- to 17:00, or youtube.com blocked from 20:00 to 07:00 on school nights. A
+-- category with block windows is only enforced within them, and allow
+-- windows lift the enforcement instead. A domain is blocked within its block
+-- windows on top of the lists, and let through within its allow windows
+-- even if a list blocks it. When windows of the same category or name
+-- overlap, the heaviest wins, then the one of the policy, then blocking.
+CREATE TABLE IF NOT EXISTS schedules(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    category TEXT NOT NULL DEFAULT '',
+    domain_name TEXT NOT NULL DEFAULT '',
+    mode TEXT NOT NULL DEFAULT '',
+    policy TEXT NOT NULL DEFAULT '',
+    action TEXT NOT NULL,
+    days TEXT NOT NULL DEFAULT '',
+    start_time TEXT NOT NULL,
+    end_time TEXT NOT NULL,
+    weight INTEGER NOT NULL DEFAULT 0,
+    created_at INTEGER NOT NULL
+);
+
+-- Sources added with a canary period are synced into canary_entries
+-- instead of the blocklist, so they block nothing; the names they would
+-- have blocked are logged and counted in canary_hits until the operator
+-- promotes the source to enforcing. blocklist_sources.canary_until is
+-- NULL for enforcing sources.
+CREATE TABLE IF NOT EXISTS canary_entries(
+    source INTEGER NOT NULL,
+    domain_name TEXT NOT NULL,
+    mode TEXT NOT NULL DEFAULT 'exact'
+);
+
+CREATE TABLE IF NOT EXISTS canary_hits(
+    source INTEGER NOT NULL,
+    domain_name TEXT NOT NULL,
+    hits INTEGER NOT NULL DEFAULT 0,
+    last_seen INTEGER NOT NULL,
+    UNIQUE(source, domain_name)
+);
+
+-- Block pages are HTML templates the proxy answers blocked requests of
+-- browsers with, instead of the JSON error. The page of a category is shown
+-- for the names its entries block and the "default" one for the others;
+-- without either, browsers get the JSON error too.
+CREATE TABLE IF NOT EXISTS block_pages(
+    category TEXT NOT NULL UNIQUE,
+    template LONGTEXT NOT NULL,
+    updated_at INTEGER NOT NULL
+);
+
+-- The decisions of the enforcement points and the checks of the API are
+-- counted in memory and added to query_stats every flush, aggregated by
+-- the minute, name, client and decision. Rows older than -stats-retention
+-- are pruned.
+CREATE TABLE IF NOT EXISTS query_stats(
+    bucket INTEGER NOT NULL,
+    domain_name TEXT NOT NULL,
+    client TEXT NOT NULL,
+    via TEXT NOT NULL,
+    blocked INTEGER NOT NULL,
+    hits INTEGER NOT NULL DEFAULT 0,
+    UNIQUE(bucket, domain_name, client, via, blocked)
+);
@@ -0,0 +1,2 @@
+DROP INDEX audit_log_domain ON audit_log;
+DROP INDEX query_stats_domain ON query_stats;
@@ -0,0 +1,2 @@
+DROP INDEX audit_log_domain;
+DROP INDEX query_stats_domain;
@@ -0,0 +1,3 @@
+-- The decisions for a domain read the audit log and the statistics by it.
+CREATE INDEX audit_log_domain ON audit_log(domain_name);
+CREATE INDEX query_stats_domain ON query_stats(domain_name, bucket);
@@ -0,0 +1,2 @@
+-- Clients of a policy in monitor mode get what it would block.
+ALTER TABLE policies ADD COLUMN monitor INTEGER NOT NULL DEFAULT 0;
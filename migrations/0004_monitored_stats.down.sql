@@ -0,0 +1 @@
+DROP TABLE monitored_stats;
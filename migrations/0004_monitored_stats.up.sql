@@ -0,0 +1,11 @@
+-- Blocks monitored rather than enforced, counted in query_stats as allowed
+-- and here again, for the projected impact of enforcing them.
+CREATE TABLE IF NOT EXISTS monitored_stats(
+    bucket INTEGER NOT NULL,
+    domain_name TEXT NOT NULL,
+    client TEXT NOT NULL,
+    via TEXT NOT NULL,
+    hits INTEGER NOT NULL DEFAULT 0,
+    UNIQUE(bucket, domain_name, client, via)
+);
+CREATE INDEX monitored_stats_domain ON monitored_stats(domain_name, bucket);
@@ -0,0 +1,3 @@
+INSERT INTO blocked_domains(domain_name, mode, source)
+    SELECT domain_name, mode, source FROM feed_domains;
+DROP TABLE feed_domains;
@@ -0,0 +1,13 @@
+-- The entries of the sources move out of blocked_domains, which keeps the
+-- manual ones, so feeds of millions of names don't slow down the queries
+-- and the backups of those. A name is still either a manual entry or the
+-- entry of a single source. blocked_domains.source is left NULL.
+CREATE TABLE IF NOT EXISTS feed_domains(
+    domain_name TEXT NOT NULL UNIQUE,
+    mode TEXT NOT NULL DEFAULT 'exact',
+    source INTEGER NOT NULL
+);
+CREATE INDEX feed_domains_source ON feed_domains(source);
+INSERT INTO feed_domains(domain_name, mode, source)
+    SELECT domain_name, mode, source FROM blocked_domains WHERE source IS NOT NULL;
+DELETE FROM blocked_domains WHERE source IS NOT NULL;
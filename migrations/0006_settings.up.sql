@@ -0,0 +1,6 @@
+-- Settings changed through the API, which outlive restarts, by name. The
+-- values are JSON.
+CREATE TABLE IF NOT EXISTS settings(
+    name TEXT NOT NULL UNIQUE,
+    value LONGTEXT NOT NULL
+);
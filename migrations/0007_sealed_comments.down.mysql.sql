@@ -0,0 +1,2 @@
+ALTER TABLE blocked_domains MODIFY comment TEXT NOT NULL DEFAULT '';
+ALTER TABLE blocked_patterns MODIFY comment TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+-- Comments sealed by the field hooks are longer than the 255 bytes a TEXT
+-- column takes in MySQL, see maxSealedLength.
+ALTER TABLE blocked_domains MODIFY comment VARCHAR(1024) NOT NULL DEFAULT '';
+ALTER TABLE blocked_patterns MODIFY comment VARCHAR(1024) NOT NULL DEFAULT '';
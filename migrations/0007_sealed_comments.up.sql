@@ -0,0 +1,2 @@
+-- Only MySQL limits the length of the comments, which the field hooks make
+-- longer; see the .mysql variant.
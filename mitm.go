@@ -0,0 +1,580 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var mitmHosts *string = flag.String("mitm-hosts", "", "comma-separated domains whose HTTPS traffic the proxy decrypts, with their subdomains, to apply the MITM rules; requires the mitm feature (none if empty)")
+
+var mitmCACert *string = flag.String("mitm-ca-cert", "database/mitm-ca.pem", "path to the PEM certificate of the CA signing the certificates of the intercepted sites; generated along with -mitm-ca-key if both are missing")
+
+var mitmCAKey *string = flag.String("mitm-ca-key", "database/mitm-ca-key.pem", "path to the PEM private key of -mitm-ca-cert")
+
+const insertMITMRuleStmt string = "INSERT INTO mitm_rules(domain_name, path_prefix, content_type, created_at) VALUES (?, ?, ?, ?)"
+
+const deleteMITMRuleStmt string = "DELETE FROM mitm_rules WHERE id = ?"
+
+const selectMITMRulesStmt string = "SELECT id, domain_name, path_prefix, content_type, created_at FROM mitm_rules ORDER BY id"
+
+const maxMITMRuleLength = 255
+
+// How long the generated certificates of the intercepted sites are valid,
+// and how many are kept.
+const (
+	mitmCertValidity = 7 * 24 * time.Hour
+	maxMITMCerts     = 1000
+)
+
+type MITMRuleSchema struct {
+	ID          int64     `json:"id"`
+	Domain      string    `json:"domain,omitempty"`
+	PathPrefix  string    `json:"pathPrefix,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type MITMRulesSchema struct {
+	Rules    []MITMRuleSchema `json:"rules"`
+	Enforced bool             `json:"enforced"`
+}
+
+type NewMITMRuleSchema struct {
+	Domain      string `json:"domain"`
+	PathPrefix  string `json:"pathPrefix"`
+	ContentType string `json:"contentType"`
+}
+
+// matches reports whether the rule applies to the path of the host. The
+// content type, if any, is left to the caller.
+func (rule MITMRuleSchema) matches(hostname string, path string) bool {
+	if rule.Domain != "" && hostname != rule.Domain && !strings.HasSuffix(hostname, "."+rule.Domain) {
+		return false
+	}
+	return strings.HasPrefix(path, rule.PathPrefix)
+}
+
+// matchesType reports whether the media type is the content type of the
+// rule or, for a rule ending with "/" like "video/", one of its subtypes.
+func (rule MITMRuleSchema) matchesType(mediaType string) bool {
+	if strings.HasSuffix(rule.ContentType, "/") {
+		return strings.HasPrefix(mediaType, rule.ContentType)
+	}
+	return mediaType == rule.ContentType
+}
+
+type mitmRuleSet struct {
+	mu    sync.RWMutex
+	rules []MITMRuleSchema
+}
+
+var mitmRules = &mitmRuleSet{}
+
+func (s *mitmRuleSet) load() error {
+	rows, err := db.Query(selectMITMRulesStmt)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	rules := make([]MITMRuleSchema, 0)
+	for rows.Next() {
+		var rule MITMRuleSchema
+		var createdAt int64
+		if err := rows.Scan(&rule.ID, &rule.Domain, &rule.PathPrefix, &rule.ContentType, &createdAt); err != nil {
+			return err
+		}
+		rule.CreatedAt = time.Unix(createdAt, 0).UTC()
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = rules
+	return nil
+}
+
+// blockingRequest returns the rule blocking the request, or nil.
+func (s *mitmRuleSet) blockingRequest(hostname string, path string) *MITMRuleSchema {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, rule := range s.rules {
+		if rule.ContentType == "" && rule.matches(hostname, path) {
+			return &rule
+		}
+	}
+	return nil
+}
+
+// blockingResponse returns the rule blocking the response, or nil.
+func (s *mitmRuleSet) blockingResponse(hostname string, path string, mediaType string) *MITMRuleSchema {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, rule := range s.rules {
+		if rule.ContentType != "" && rule.matches(hostname, path) && rule.matchesType(mediaType) {
+			return &rule
+		}
+	}
+	return nil
+}
+
+func parseMITMHosts(list string) ([]string, error) {
+	hosts := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		host, err := normalizeDomain(item)
+		if err != nil {
+			return nil, fmt.Errorf("domain \"%s\" is invalid: %v", item, err)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// mitmCA signs the certificates the proxy presents for the intercepted
+// sites. Clients have to trust it.
+type mitmCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	// All of the site certificates share one key, so none has to be
+	// generated per site.
+	leafKey *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// mitmAuthority is the CA of the proxy, or nil without -mitm-hosts.
+var mitmAuthority *mitmCA
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// loadMITMCA loads the CA, or generates it if neither of its files exists.
+func loadMITMCA(certPath string, keyPath string) (*mitmCA, error) {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		if err := generateMITMCA(certPath, keyPath); err != nil {
+			return nil, fmt.Errorf("generating of the CA failed: %v", err)
+		}
+		slog.Info("Generated the MITM CA; clients must trust it to reach the intercepted sites", "cert", certPath)
+	}
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s isn't a CA certificate", certPath)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s can't sign", keyPath)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &mitmCA{cert: cert, key: key, leafKey: leafKey, certs: make(map[string]*tls.Certificate)}, nil
+}
+
+func generateMITMCA(certPath string, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "proxy MITM CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+// certificate returns a certificate for the name signed by the CA.
+func (ca *mitmCA) certificate(name string) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if cert, ok := ca.certs[name]; ok && time.Until(cert.Leaf.NotAfter) > time.Hour {
+		return cert, nil
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(mitmCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip, err := netip.ParseAddr(name); err == nil {
+		template.IPAddresses = []net.IP{ip.AsSlice()}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &ca.leafKey.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if len(ca.certs) >= maxMITMCerts {
+		ca.certs = make(map[string]*tls.Certificate)
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: ca.leafKey, Leaf: leaf}
+	ca.certs[name] = cert
+	return cert, nil
+}
+
+// mitmProxy applies the MITM rules to the traffic of the intercepted
+// sites, which it forwards itself.
+type mitmProxy struct {
+	ca      *mitmCA
+	hosts   []string
+	forward *httputil.ReverseProxy
+}
+
+// blockedContentError is returned by ModifyResponse for a response a rule
+// blocks.
+type blockedContentError struct {
+	mediaType string
+}
+
+func (e *blockedContentError) Error() string {
+	return "content of type " + e.mediaType + " is blocked"
+}
+
+func newMITMProxy(ca *mitmCA, hosts []string, transport http.RoundTripper) *mitmProxy {
+	m := &mitmProxy{ca: ca, hosts: hosts}
+	m.forward = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			// The site is the one the tunnel was opened to, whatever
+			// Host the decrypted request names.
+			pr.Out.Host = ""
+		},
+		Transport: transport,
+		ModifyResponse: func(resp *http.Response) error {
+			mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			hostname := lookupName(resp.Request.URL.Hostname())
+			if mitmRules.blockingResponse(hostname, resp.Request.URL.Path, mediaType) != nil && enforceBlock(mitmClient(resp.Request), hostname, viaMITM) {
+				return &blockedContentError{mediaType: mediaType}
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			var blocked *blockedContentError
+			if errors.As(err, &blocked) {
+				respondWithError(w, &APIError{
+					Code:       CodeContentBlocked,
+					Status:     "error",
+					StatusCode: http.StatusForbidden,
+					Message:    localize(r, "Content of type \"%s\" from \"%s\" is blocked.", blocked.mediaType, r.URL.Hostname()),
+				})
+				return
+			}
+			respondWithError(w, &APIError{
+				Code:       CodeUpstreamUnreachable,
+				Status:     "error",
+				StatusCode: http.StatusBadGateway,
+				Message:    localize(r, "Couldn't reach \"%s\": %v.", r.URL.Host, err),
+			})
+		},
+	}
+	return m
+}
+
+// intercepts reports whether the traffic of the host is decrypted, which
+// takes both the mitm feature and the host in -mitm-hosts.
+func (m *mitmProxy) intercepts(hostname string) bool {
+	if m == nil || !features.isEnabled(FeatureMITM) {
+		return false
+	}
+	hostname = lookupName(hostname)
+	for _, host := range m.hosts {
+		if hostname == host || strings.HasSuffix(hostname, "."+host) {
+			return true
+		}
+	}
+	return false
+}
+
+// mitmClient returns the address of the client behind the request.
+func mitmClient(r *http.Request) netip.Addr {
+	peer, _ := netip.ParseAddrPort(r.RemoteAddr)
+	return peer.Addr()
+}
+
+// ServeHTTP forwards a request with an absolute URL unless a rule blocks
+// its path or the type of the response.
+func (m *mitmProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hostname := lookupName(r.URL.Hostname())
+	if mitmRules.blockingRequest(hostname, r.URL.Path) != nil && enforceBlock(mitmClient(r), hostname, viaMITM) {
+		respondWithError(w, &APIError{
+			Code:       CodeContentBlocked,
+			Status:     "error",
+			StatusCode: http.StatusForbidden,
+			Message:    localize(r, "Path \"%s\" of \"%s\" is blocked.", r.URL.Path, hostname),
+		})
+		return
+	}
+	peer, _ := netip.ParseAddrPort(r.RemoteAddr)
+	setDecisionHeaders(r, peer.Addr(), hostname)
+	activeProxyRequests.Add(1)
+	defer activeProxyRequests.Add(-1)
+	m.forward.ServeHTTP(w, r)
+}
+
+// prefixedConn reads what was buffered before the connection was hijacked
+// first.
+type prefixedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// singleListener accepts one connection, then blocks until it is closed.
+type singleListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *singleListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *singleListener) Close() error {
+	return nil
+}
+
+func (l *singleListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// serve terminates TLS on the tunnel to the host, a "host:port", with a
+// certificate of the CA and serves the decrypted requests until the client
+// closes the connection.
+func (m *mitmProxy) serve(client net.Conn, buffered io.Reader, host string) {
+	hostname, _, _ := net.SplitHostPort(host)
+	conn := tls.Server(&prefixedConn{Conn: client, reader: io.MultiReader(buffered, client)}, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return m.ca.certificate(hostname)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+
+	closed := make(chan struct{})
+	var closeOnce sync.Once
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme, r.URL.Host = "https", host
+			m.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: dialTimeout,
+		IdleTimeout:       90 * time.Second,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				closeOnce.Do(func() { close(closed) })
+			}
+		},
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+	}
+	go server.Serve(&singleListener{conn: conn, closed: closed})
+	<-closed
+}
+
+func mitmRulesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		mitmRules.mu.RLock()
+		schema := MITMRulesSchema{Rules: append([]MITMRuleSchema{}, mitmRules.rules...), Enforced: features.isEnabled(FeatureMITM) && mitmAuthority != nil}
+		mitmRules.mu.RUnlock()
+		respondWithJSON(w, schema)
+	case http.MethodPost:
+		addMITMRuleHandler(w, r)
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, POST"))
+	}
+}
+
+func addMITMRuleHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensureJSON(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	var body NewMITMRuleSchema
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted {\"domain\", \"pathPrefix\", \"contentType\"} object; got invalid JSON."), Status: "error"})
+		return
+	}
+	invalid := func(message string, args ...any) {
+		respondWithError(w, &APIError{Code: CodeInvalidRule, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, message, args...)})
+	}
+	rule := MITMRuleSchema{PathPrefix: body.PathPrefix, ContentType: strings.ToLower(strings.TrimSpace(body.ContentType))}
+	if body.Domain != "" {
+		domain, err := normalizeDomain(body.Domain)
+		if err != nil {
+			invalid("Domain \"%s\" is invalid: %v.", body.Domain, err)
+			return
+		}
+		rule.Domain = domain
+	}
+	if rule.PathPrefix == "" && rule.ContentType == "" {
+		invalid("Rule must have a path prefix, a content type or both.")
+		return
+	}
+	if rule.PathPrefix != "" && !strings.HasPrefix(rule.PathPrefix, "/") {
+		invalid("Path prefix \"%s\" must start with \"/\".", rule.PathPrefix)
+		return
+	}
+	if rule.ContentType != "" && (!strings.Contains(rule.ContentType, "/") || strings.ContainsAny(rule.ContentType, " ;")) {
+		invalid("Content type \"%s\" must be a media type like \"video/mp4\", or \"video/\" for all of its subtypes.", body.ContentType)
+		return
+	}
+	if len(rule.PathPrefix) > maxMITMRuleLength || len(rule.ContentType) > maxMITMRuleLength {
+		invalid("Path prefix and content type must be at most %d characters long.", maxMITMRuleLength)
+		return
+	}
+
+	rule.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+	// Rules aren't unique, so the ID comes from the insert.
+	rule.ID, err = insertID(tx, insertMITMRuleStmt, rule.Domain, rule.PathPrefix, rule.ContentType, rule.CreatedAt.Unix())
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := mitmRules.load(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// mitmRuleHandler serves DELETE /mitm/rules/{id}.
+func mitmRuleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		respondWithError(w, unexceptedMethod(r, http.MethodDelete))
+		return
+	}
+	notFound := &APIError{Code: CodeRuleNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "Rule \"%s\" doesn't exist.", r.PathValue("id"))}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, notFound)
+		return
+	}
+	result, err := db.ExecContext(r.Context(), deleteMITMRuleStmt, id)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		respondWithError(w, notFound)
+		return
+	}
+	if err := mitmRules.load(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	respondWithError(w, &APIError{Code: CodeOK, StatusCode: http.StatusOK, Message: localize(r, "Succesfully removed the rule."), Status: "success"})
+}
+
+// mitmCAHandler serves GET /mitm/ca.pem, the certificate clients have to
+// trust for the intercepted sites.
+func mitmCAHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	if mitmAuthority == nil {
+		respondWithError(w, &APIError{Code: CodeFeatureNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "MITM isn't configured; set -mitm-hosts.")})
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: mitmAuthority.cert.Raw})
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+const insertPolicyStmt string = "INSERT INTO policies(name, default_policy, monitor, created_at) VALUES (?, ?, ?, ?)"
+
+const policyIDStmt string = "SELECT id FROM policies WHERE name = ?"
+
+const updatePolicyStmt string = "UPDATE policies SET default_policy = ?, monitor = ? WHERE id = ?"
+
+const deletePolicyStmt string = "DELETE FROM policies WHERE id = ?"
+
+const insertPolicyEntryStmt string = "INSERT INTO policy_entries(policy, domain_name, mode, allowed) VALUES (?, ?, ?, ?)"
+
+const deletePolicyEntriesStmt string = "DELETE FROM policy_entries WHERE policy = ?"
+
+const insertPolicyClientStmt string = "INSERT INTO policy_clients(policy, prefix) VALUES (?, ?)"
+
+const deletePolicyClientsStmt string = "DELETE FROM policy_clients WHERE policy = ?"
+
+const selectPoliciesStmt string = "SELECT id, name, default_policy, monitor, created_at FROM policies ORDER BY name"
+
+const selectPolicyEntriesStmt string = "SELECT policy, domain_name, mode, allowed FROM policy_entries ORDER BY domain_name"
+
+const selectPolicyClientsStmt string = "SELECT policy, prefix FROM policy_clients ORDER BY prefix"
+
+var policyNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type NewPolicySchema struct {
+	Name string `json:"name"`
+	// The decision for names no rule matches, allow or deny; empty keeps
+	// the one of -client-policies.
+	Default string `json:"default,omitempty"`
+	// Whether what the policy blocks is only recorded, and forwarded, for
+	// its clients.
+	Monitor bool          `json:"monitor,omitempty"`
+	Clients []string      `json:"clients"`
+	Blocked []DomainEntry `json:"blocked"`
+	Allowed []DomainEntry `json:"allowed"`
+}
+
+type PolicySchema struct {
+	NewPolicySchema
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type PoliciesSchema struct {
+	Policies []PolicySchema `json:"policies"`
+}
+
+type namedPolicy struct {
+	schema PolicySchema
+	// nil keeps the decision of -client-policies.
+	deny    *bool
+	blocked *memoryBlocklist
+	allowed *memoryBlocklist
+}
+
+type policyClient struct {
+	prefix netip.Prefix
+	policy *namedPolicy
+}
+
+// policyDirectory mirrors the named policies and the subnets of their
+// clients, narrowest first.
+type policyDirectory struct {
+	mu       sync.RWMutex
+	policies []*namedPolicy
+	clients  []policyClient
+}
+
+var namedPolicies = &policyDirectory{}
+
+// newEntrySet returns a loaded in-memory set of the entries.
+func newEntrySet(entries []DomainEntry) *memoryBlocklist {
+	set := newMemoryBlocklist("")
+	for _, entry := range entries {
+		set.add(entry)
+	}
+	set.warmOnce.Do(func() { close(set.warm) })
+	return set
+}
+
+func (d *policyDirectory) load() error {
+	byID := make(map[int64]*namedPolicy)
+	policies := make([]*namedPolicy, 0)
+	rows, err := db.Query(selectPoliciesStmt)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, createdAt int64
+		p := &namedPolicy{}
+		if err := rows.Scan(&id, &p.schema.Name, &p.schema.Default, &p.schema.Monitor, &createdAt); err != nil {
+			return err
+		}
+		p.schema.CreatedAt = time.Unix(createdAt, 0).UTC()
+		p.schema.Clients, p.schema.Blocked, p.schema.Allowed = []string{}, []DomainEntry{}, []DomainEntry{}
+		if p.schema.Default != "" {
+			deny, _ := parsePolicy(p.schema.Default)
+			p.deny = &deny
+		}
+		byID[id] = p
+		policies = append(policies, p)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	entries, err := db.Query(selectPolicyEntriesStmt)
+	if err != nil {
+		return err
+	}
+	defer entries.Close()
+	for entries.Next() {
+		var id int64
+		var entry DomainEntry
+		var allowed bool
+		if err := entries.Scan(&id, &entry.Domain, &entry.Mode, &allowed); err != nil {
+			return err
+		}
+		if p := byID[id]; p != nil && allowed {
+			p.schema.Allowed = append(p.schema.Allowed, entry)
+		} else if p != nil {
+			p.schema.Blocked = append(p.schema.Blocked, entry)
+		}
+	}
+	if err := entries.Err(); err != nil {
+		return err
+	}
+
+	clients := make([]policyClient, 0)
+	prefixes, err := db.Query(selectPolicyClientsStmt)
+	if err != nil {
+		return err
+	}
+	defer prefixes.Close()
+	for prefixes.Next() {
+		var id int64
+		var value string
+		if err := prefixes.Scan(&id, &value); err != nil {
+			return err
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if p := byID[id]; p != nil && err == nil {
+			p.schema.Clients = append(p.schema.Clients, value)
+			clients = append(clients, policyClient{prefix: prefix, policy: p})
+		}
+	}
+	if err := prefixes.Err(); err != nil {
+		return err
+	}
+	slices.SortStableFunc(clients, func(a, b policyClient) int {
+		return cmp.Compare(b.prefix.Bits(), a.prefix.Bits())
+	})
+	for _, p := range policies {
+		p.blocked, p.allowed = newEntrySet(p.schema.Blocked), newEntrySet(p.schema.Allowed)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.policies, d.clients = policies, clients
+	return nil
+}
+
+// lookup returns the policy of the narrowest subnet holding the client, or
+// nil if the client has none.
+func (d *policyDirectory) lookup(client netip.Addr) *namedPolicy {
+	client = client.Unmap()
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, c := range d.clients {
+		if c.prefix.Contains(client) {
+			return c.policy
+		}
+	}
+	return nil
+}
+
+func (d *policyDirectory) find(name string) *namedPolicy {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, p := range d.policies {
+		if p.schema.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// validatePolicy normalizes the policy, or returns the error to respond
+// with.
+func validatePolicy(r *http.Request, body *NewPolicySchema) *APIError {
+	invalid := func(message string, args ...any) *APIError {
+		return &APIError{Code: CodeInvalidPolicy, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, message, args...)}
+	}
+	if !policyNamePattern.MatchString(body.Name) {
+		return invalid("Policy name must be 1 to 64 letters, digits, \"-\" or \"_\".")
+	}
+	if body.Default != "" {
+		if _, err := parsePolicy(body.Default); err != nil {
+			return invalid("Default of the policy is invalid: %v.", err)
+		}
+	}
+	for i, client := range body.Clients {
+		prefixes, err := parsePrefixes(client)
+		if err != nil || len(prefixes) != 1 {
+			return invalid("Client \"%s\" isn't an address or a subnet.", client)
+		}
+		body.Clients[i] = prefixes[0].String()
+	}
+	for _, list := range [][]DomainEntry{body.Blocked, body.Allowed} {
+		for i := range list {
+			if err := list[i].normalize(); err != nil {
+				return invalid("Domain \"%s\" is invalid: %v.", list[i].Domain, err)
+			}
+		}
+	}
+	return nil
+}
+
+// storePolicy replaces the clients and the entries of the policy. It
+// returns the client that already belongs to another policy, if any.
+func storePolicy(tx *sql.Tx, id int64, body NewPolicySchema) (string, error) {
+	for _, stmt := range []string{deletePolicyClientsStmt, deletePolicyEntriesStmt} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return "", err
+		}
+	}
+	for _, client := range body.Clients {
+		if _, err := tx.Exec(insertPolicyClientStmt, id, client); isUniqueConstraintError(err) {
+			return client, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	for allowed, list := range [][]DomainEntry{body.Blocked, body.Allowed} {
+		for _, entry := range list {
+			if _, err := tx.Exec(insertPolicyEntryStmt, id, entry.Domain, entry.Mode, allowed); err != nil {
+				return "", err
+			}
+		}
+	}
+	return "", nil
+}
+
+func policyNotFound(r *http.Request, name string) *APIError {
+	return &APIError{Code: CodePolicyNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "Policy \"%s\" doesn't exist.", name)}
+}
+
+func decodePolicy(w http.ResponseWriter, r *http.Request) (NewPolicySchema, bool) {
+	var body NewPolicySchema
+	if err := ensureJSON(r); err != nil {
+		respondWithError(w, err)
+		return body, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted {\"name\", \"default\", \"monitor\", \"clients\", \"blocked\", \"allowed\"} object; got invalid JSON."), Status: "error"})
+		return body, false
+	}
+	return body, true
+}
+
+func policiesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		namedPolicies.mu.RLock()
+		schema := PoliciesSchema{Policies: make([]PolicySchema, 0, len(namedPolicies.policies))}
+		for _, p := range namedPolicies.policies {
+			schema.Policies = append(schema.Policies, p.schema)
+		}
+		namedPolicies.mu.RUnlock()
+		respondWithJSON(w, schema)
+	case http.MethodPost:
+		body, ok := decodePolicy(w, r)
+		if !ok {
+			return
+		}
+		savePolicy(w, r, body, true)
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, POST"))
+	}
+}
+
+// policyHandler serves GET, PUT and DELETE /policies/{name}.
+func policyHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	switch r.Method {
+	case http.MethodGet:
+		policy := namedPolicies.find(name)
+		if policy == nil {
+			respondWithError(w, policyNotFound(r, name))
+			return
+		}
+		respondWithJSON(w, policy.schema)
+	case http.MethodPut:
+		body, ok := decodePolicy(w, r)
+		if !ok {
+			return
+		}
+		if body.Name == "" {
+			body.Name = name
+		}
+		if body.Name != name {
+			respondWithError(w, &APIError{Code: CodeInvalidPolicy, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Policies can't be renamed.")})
+			return
+		}
+		if namedPolicies.find(name) == nil {
+			respondWithError(w, policyNotFound(r, name))
+			return
+		}
+		savePolicy(w, r, body, false)
+	case http.MethodDelete:
+		removePolicy(w, r, name)
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, PUT, DELETE"))
+	}
+}
+
+// savePolicy creates the policy, or replaces the existing one.
+func savePolicy(w http.ResponseWriter, r *http.Request, body NewPolicySchema, create bool) {
+	if err := validatePolicy(r, &body); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if create {
+		_, err = tx.Exec(insertPolicyStmt, body.Name, body.Default, body.Monitor, time.Now().Unix())
+		if isUniqueConstraintError(err) {
+			respondWithError(w, &APIError{Code: CodePolicyExists, Status: "error", StatusCode: http.StatusConflict, Message: localize(r, "Policy \"%s\" already exists.", body.Name)})
+			return
+		}
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+	}
+	var id int64
+	if err := tx.QueryRow(policyIDStmt, body.Name).Scan(&id); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if !create {
+		if _, err := tx.Exec(updatePolicyStmt, body.Default, body.Monitor, id); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+	}
+	assigned, err := storePolicy(tx, id, body)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if assigned != "" {
+		respondWithError(w, &APIError{Code: CodeClientAssigned, Status: "error", StatusCode: http.StatusConflict, Message: localize(r, "Client \"%s\" already belongs to another policy.", assigned)})
+		return
+	}
+	if err := audit(r.Context(), tx, auditPolicies, DomainEntry{Domain: body.Name}, false); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := namedPolicies.load(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	status := http.StatusOK
+	if create {
+		status = http.StatusCreated
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(namedPolicies.find(body.Name).schema)
+}
+
+func removePolicy(w http.ResponseWriter, r *http.Request, name string) {
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow(policyIDStmt, name).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, policyNotFound(r, name))
+		return
+	}
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	for _, stmt := range []string{deletePolicyClientsStmt, deletePolicyEntriesStmt, deletePolicyStmt} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+	}
+	if _, err := tx.Exec(deletePolicySchedulesStmt, name); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := audit(r.Context(), tx, auditPolicies, DomainEntry{Domain: name}, true); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := namedPolicies.load(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := loadSchedules(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	respondWithError(w, &APIError{Code: CodeOK, StatusCode: http.StatusOK, Message: localize(r, "Succesfully removed policy \"%s\".", name), Status: "success"})
+}
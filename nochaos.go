@@ -0,0 +1,19 @@
+//go:build !chaos
+
+package main
+
+// Without the chaos build tag the fault injection hooks do nothing.
+
+func databaseDriver(name string) string {
+	return name
+}
+
+func injectUpstreamFailure(address string) error {
+	return nil
+}
+
+func delayPacket() {}
+
+func registerChaosHandlers() {}
+
+var chaosOperations []apiOperation
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const addMonitoredStatsStmt string = "UPDATE monitored_stats SET hits = hits + ? WHERE bucket = ? AND domain_name = ? AND client = ? AND via = ?"
+
+const insertMonitoredStatsStmt string = "INSERT INTO monitored_stats(bucket, domain_name, client, via, hits) VALUES (?, ?, ?, ?, ?)"
+
+const pruneMonitoredStatsStmt string = "DELETE FROM monitored_stats WHERE bucket < ?"
+
+const monitoredSummaryStmt string = "SELECT COALESCE(SUM(hits), 0), COUNT(DISTINCT client), COUNT(DISTINCT domain_name) FROM monitored_stats" + statsFilter
+
+const monitoredByViaStmt string = "SELECT via, SUM(hits) AS total, COUNT(DISTINCT client) FROM monitored_stats" + statsFilter + " GROUP BY via ORDER BY total DESC, via"
+
+const topMonitoredStmt string = "SELECT domain_name, SUM(hits) AS total, COUNT(DISTINCT client) FROM monitored_stats" + statsFilter + " GROUP BY domain_name ORDER BY total DESC, domain_name LIMIT ?"
+
+// observeState is the global observe mode, in which no client gets blocked
+// and the blocks are monitored instead. It is stored as a setting, so it
+// outlives restarts; -monitor turns it on at startup.
+//
+// The RPZ zone is empty in observe mode, so the resolvers transferring it
+// don't block either. Every toggle bumps the serial of the zone, which is
+// that of the journal plus the number of toggles.
+type observeState struct {
+	mu      sync.RWMutex
+	enabled bool
+	since   time.Time
+	toggles int64
+	// The serial of the zone right after the last toggle, before which
+	// secondaries can only get the zone whole.
+	toggledAt int64
+}
+
+var observe = &observeState{}
+
+type storedObserveState struct {
+	Enabled   bool      `json:"enabled"`
+	Since     time.Time `json:"since"`
+	Toggles   int64     `json:"toggles"`
+	ToggledAt int64     `json:"toggledAt"`
+}
+
+// load restores the stored state, then turns observe mode on for -monitor.
+func (o *observeState) load(ctx context.Context, monitor bool) error {
+	var stored storedObserveState
+	if _, err := loadSetting(ctx, settingObserve, &stored); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	o.enabled, o.since, o.toggles, o.toggledAt = stored.Enabled, stored.Since, stored.Toggles, stored.ToggledAt
+	o.mu.Unlock()
+	if monitor {
+		return o.set(ctx, true)
+	}
+	return nil
+}
+
+func (o *observeState) isEnabled() bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.enabled
+}
+
+// set turns observe mode on or off and stores it.
+func (o *observeState) set(ctx context.Context, enabled bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if enabled == o.enabled {
+		return nil
+	}
+	var serial int64
+	if err := db.QueryRowContext(ctx, latestSerialStmt).Scan(&serial); err != nil {
+		return err
+	}
+	stored := storedObserveState{Enabled: enabled, Since: o.since, Toggles: o.toggles + 1}
+	stored.ToggledAt = serial + stored.Toggles
+	if enabled {
+		stored.Since = time.Now().UTC()
+	}
+	if err := saveSetting(ctx, settingObserve, stored); err != nil {
+		return err
+	}
+	o.enabled, o.since, o.toggles, o.toggledAt = stored.Enabled, stored.Since, stored.Toggles, stored.ToggledAt
+	events.publish(Event{Type: EventObserveChanged, Enabled: enabled})
+	return nil
+}
+
+// zone returns whether the RPZ zone is empty, and the serial of the zone
+// for the serial of the journal.
+func (o *observeState) zone(serial int64) (bool, int64) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.enabled, serial + o.toggles
+}
+
+// journalSerial returns the serial of the journal a secondary at the serial
+// of the zone is at, or false if it has to transfer the zone whole.
+func (o *observeState) journalSerial(serial int64) (int64, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.enabled || serial < o.toggledAt {
+		return 0, false
+	}
+	return serial - o.toggles, true
+}
+
+type ObserveSchema struct {
+	Enabled bool `json:"enabled"`
+	// When observe mode was last turned on, if it is.
+	Since *time.Time `json:"since,omitempty"`
+}
+
+func (o *observeState) schema() ObserveSchema {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	schema := ObserveSchema{Enabled: o.enabled}
+	if o.enabled {
+		since := o.since
+		schema.Since = &since
+	}
+	return schema
+}
+
+func addMonitoredStats(tx *sql.Tx, key statsKey, hits int64) error {
+	client, err := sealField(FieldClientAddr, key.client)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(addMonitoredStatsStmt, hits, key.bucket, key.domain, client, key.via)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows != 0 {
+		return nil
+	}
+	_, err = tx.Exec(insertMonitoredStatsStmt, key.bucket, key.domain, client, key.via, hits)
+	if isUniqueConstraintError(err) {
+		_, err = tx.Exec(addMonitoredStatsStmt, hits, key.bucket, key.domain, client, key.via)
+	}
+	return err
+}
+
+// observeHandler serves /admin/observe. GET responds with the state of
+// observe mode, PUT turns it on or off.
+func observeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		respondWithJSON(w, observe.schema())
+	case http.MethodPut:
+		if err := ensureJSON(r); err != nil {
+			respondWithError(w, err)
+			return
+		}
+		var body ObserveSchema
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondWithError(w, &APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted {\"enabled\"} object; got invalid JSON."), Status: "error"})
+			return
+		}
+		if err := observe.set(r.Context(), body.Enabled); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		requestLogger(r).Warn("Observe mode set", "enabled", body.Enabled)
+		respondWithJSON(w, observe.schema())
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, PUT"))
+	}
+}
+
+type MonitoredViaSchema struct {
+	Via     string `json:"via"`
+	Hits    int64  `json:"hits"`
+	Clients int64  `json:"clients"`
+}
+
+type ImpactSchema struct {
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	// All the decisions in the range, and the ones that were monitored
+	// blocks, which enforcing would have blocked.
+	Queries      int64   `json:"queries"`
+	WouldBlock   int64   `json:"wouldBlock"`
+	BlockedRatio float64 `json:"blockedRatio"`
+	// Clients and names the monitored blocks concerned.
+	Clients int64                    `json:"clients"`
+	Domains int64                    `json:"domains"`
+	Via     []MonitoredViaSchema     `json:"via"`
+	Top     []TopBlockedDomainSchema `json:"top"`
+}
+
+// impactHandler serves GET /admin/observe/impact, what enforcing the blocks
+// monitored in the range, under observe mode or a policy in monitor mode,
+// would have blocked. It takes the parameters of /stats/top-blocked.
+func impactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	q, apiErr := parseStatsQuery(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	limit, apiErr := queryTopLimit(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+
+	schema := ImpactSchema{Since: q.since, Until: q.until, Via: make([]MonitoredViaSchema, 0), Top: make([]TopBlockedDomainSchema, 0)}
+	var blocked, clients, domains int64
+	if err := db.QueryRowContext(r.Context(), statsSummaryStmt, q.args()...).Scan(&schema.Queries, &blocked, &clients, &domains); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := db.QueryRowContext(r.Context(), monitoredSummaryStmt, q.args()...).Scan(&schema.WouldBlock, &schema.Clients, &schema.Domains); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if schema.Queries != 0 {
+		schema.BlockedRatio = float64(schema.WouldBlock) / float64(schema.Queries)
+	}
+
+	rows, err := db.QueryContext(r.Context(), monitoredByViaStmt, q.args()...)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var via MonitoredViaSchema
+		if err := rows.Scan(&via.Via, &via.Hits, &via.Clients); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		schema.Via = append(schema.Via, via)
+	}
+	if err := rows.Err(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	rows, err = db.QueryContext(r.Context(), topMonitoredStmt, append(q.args(), limit)...)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var domain TopBlockedDomainSchema
+		if err := rows.Scan(&domain.Domain, &domain.Hits, &domain.Clients); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		schema.Top = append(schema.Top, domain)
+	}
+	if err := rows.Err(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	respondWithJSON(w, schema)
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiParam is a query or header parameter of an endpoint. Its type is an
+// OpenAPI type, or "date-time" for RFC 3339 times.
+type apiParam struct {
+	name        string
+	in          string
+	typ         string
+	required    bool
+	description string
+}
+
+// apiOperation describes an endpoint for the OpenAPI document. Bodies and
+// responses are given as values of their Go types, or as media types for
+// the ones that aren't JSON. Without a response, the endpoint responds
+// with an APIError carrying the status.
+type apiOperation struct {
+	method     string
+	path       string
+	id         string
+	summary    string
+	params     []apiParam
+	body       any
+	bodyTypes  []string
+	status     int
+	response   any
+	media      []string
+	public     bool
+	deprecated bool
+}
+
+func query(name string, typ string, description string) apiParam {
+	return apiParam{name: name, in: "query", typ: typ, description: description}
+}
+
+var pageParams = []apiParam{
+	query("limit", "integer", "number of items listed"),
+	query("offset", "integer", "number of items skipped"),
+}
+
+var statsParams = []apiParam{
+	query("since", "date-time", ""),
+	query("until", "date-time", ""),
+	query("client", "string", "address of the client"),
+	query("via", "string", "enforcement point, or check for the checks of the API"),
+}
+
+var apiOperations = []apiOperation{
+	{method: http.MethodGet, path: "/readyz", id: "getReadiness", summary: "Reports whether the service finished warming up.", response: ReadySchema{}, public: true},
+	{method: http.MethodGet, path: "/openapi.json", id: "getOpenAPI", summary: "Returns this document.", media: []string{"application/json"}, public: true},
+	{method: http.MethodGet, path: "/debug/vars", id: "getVars", summary: "Returns the counters of the service.", media: []string{"application/json"}},
+
+	{method: http.MethodGet, path: "/domains", id: "listDomains", summary: "Lists the blocklist, or a category of it, or the blocklist as it was at a time.", params: append(pageParams, query("category", "string", "category listed"), query("search", "string", "part of the names listed"), query("as_of", "date-time", "time the blocklist is listed as of")), response: ListSchema{}},
+	{method: http.MethodPost, path: "/domains", id: "addDomains", summary: "Adds entries to the blocklist.", body: []NewEntry{}, status: http.StatusCreated},
+	{method: http.MethodDelete, path: "/domains", id: "removeDomains", summary: "Moves entries of the blocklist to the trash.", body: []string{}},
+	{method: http.MethodGet, path: "/domains/{name}", id: "getDomain", summary: "Returns the entry blocking the name.", response: MatchSchema{}},
+	{method: http.MethodPut, path: "/domains/{name}", id: "updateDomain", summary: "Changes the mode of an entry.", body: UpdateSchema{}, response: DomainEntry{}},
+	{method: http.MethodDelete, path: "/domains/{name}", id: "removeDomain", summary: "Moves an entry to the trash.", params: []apiParam{{name: "If-Match", in: "header", typ: "string", description: "ETag of the entry as it was read"}}},
+	{method: http.MethodPost, path: "/domains/{name}/override", id: "overrideDomain", summary: "Allows a name blocked by a source.", status: http.StatusCreated, response: MatchSchema{}},
+	{method: http.MethodGet, path: "/domains/changes", id: "listChanges", summary: "Returns the entries added and removed since a serial.", params: []apiParam{query("since", "integer", "serial the changes are listed since; 0 lists the whole blocklist as added")}, response: ChangesSchema{}},
+	{method: http.MethodPost, path: "/domains/import", id: "importDomains", summary: "Adds the domains of a hosts file, a domain list or an AdGuard list.", bodyTypes: []string{"text/plain"}, status: http.StatusCreated},
+	{method: http.MethodPost, path: "/domains/backfill", id: "backfillDomains", summary: "Adds the domains a device blocked on its own, attributed to the device.", params: []apiParam{{name: "device", in: "query", typ: "string", required: true, description: "name of the device"}}, bodyTypes: []string{"text/plain", "application/json"}, status: http.StatusCreated},
+	{method: http.MethodGet, path: "/public/blocklist/{format}", id: "getPublicExport", summary: "Exports the blocklist, as json, hosts, dnsmasq or adguard, to anyone if -public-export is set.", media: []string{"application/json", "text/plain"}, public: true},
+	{method: http.MethodGet, path: "/domains/export", id: "exportDomains", summary: "Exports the blocklist.", params: []apiParam{query("format", "string", "json, hosts, dnsmasq or adguard")}, media: []string{"application/json", "text/plain"}},
+	{method: http.MethodGet, path: "/domains/trash", id: "listTrash", summary: "Lists the removed entries.", params: append(pageParams, query("deleter", "string", "name of the API key that removed the entries")), response: TrashSchema{}},
+	{method: http.MethodDelete, path: "/domains/trash", id: "purgeTrash", summary: "Removes entries from the trash for good.", body: []string{}},
+	{method: http.MethodPost, path: "/domains/trash/restore", id: "restoreDomains", summary: "Restores entries from the trash.", body: []string{}},
+	{method: http.MethodGet, path: "/domains/check", id: "checkDomain", summary: "Reports whether a domain is blocked.", params: []apiParam{{name: "domain", in: "query", typ: "string", required: true}}, response: CheckSchema{}},
+	{method: http.MethodPost, path: "/domains/check", id: "checkDomains", summary: "Reports whether each of the domains is blocked.", body: []string{}, response: map[string]bool{}},
+	{method: http.MethodPost, path: "/domains/check/bulk", id: "startBulkCheck", summary: "Starts checking a list of domains in the background.", bodyTypes: []string{"text/plain", "text/csv"}, status: http.StatusAccepted, response: BulkJobSchema{}},
+	{method: http.MethodGet, path: "/domains/check/bulk/{id}", id: "getBulkCheck", summary: "Returns the progress of a bulk check.", response: BulkJobSchema{}},
+	{method: http.MethodGet, path: "/domains/check/bulk/{id}/results", id: "getBulkCheckResults", summary: "Returns the results of a finished bulk check.", media: []string{"text/csv"}},
+	{method: http.MethodPost, path: "/domains/append", id: "appendDomains", summary: "Adds entries to the blocklist; use POST /domains.", body: []NewEntry{}, status: http.StatusCreated, deprecated: true},
+	{method: http.MethodPost, path: "/domains/delete", id: "deleteDomains", summary: "Moves entries to the trash; use DELETE /domains.", body: []string{}, deprecated: true},
+
+	{method: http.MethodGet, path: "/sources", id: "listSources", summary: "Lists the sources the blocklist is synced from.", params: pageParams, response: SourcesSchema{}},
+	{method: http.MethodPost, path: "/sources", id: "addSource", summary: "Adds a source.", body: NewSourceSchema{}, status: http.StatusCreated, response: SourceSchema{}},
+	{method: http.MethodDelete, path: "/sources/{id}", id: "removeSource", summary: "Removes a source and its entries."},
+	{method: http.MethodGet, path: "/sources/{id}/canary", id: "getCanaryReport", summary: "Reports what a source in its canary period would have blocked.", response: CanaryReportSchema{}},
+	{method: http.MethodGet, path: "/events", id: "streamEvents", summary: "Streams the events of the types as server-sent events, named by type.", params: []apiParam{query("types", "string", "comma-separated types; entry.added, entry.removed and block.enforced by default")}, media: []string{"text/event-stream"}},
+	{method: http.MethodGet, path: "/stats/summary", id: "getStatsSummary", summary: "Counts the decisions of a range, the last day by default.", params: statsParams, response: StatsSummarySchema{}},
+	{method: http.MethodGet, path: "/stats/top-blocked", id: "getTopBlocked", summary: "Lists the names blocked the most in a range.", params: append(statsParams, query("limit", "integer", "number of names listed")), response: TopBlockedSchema{}},
+	{method: http.MethodGet, path: "/stats/timeline", id: "getStatsTimeline", summary: "Counts the decisions in every interval of a range.", params: append(statsParams, query("interval", "string", "duration of the intervals, like 5m")), response: TimelineSchema{}},
+	{method: http.MethodGet, path: "/domains/{name}/decisions", id: "listDecisions", summary: "Lists the decisions made for a name in a range and the changes to the rules covering it.", params: append(statsParams, pageParams...), response: DecisionLogSchema{}},
+	{method: http.MethodGet, path: "/blockpages", id: "listBlockPages", summary: "Lists the block pages browsers are shown instead of the JSON error.", response: BlockPagesSchema{}},
+	{method: http.MethodGet, path: "/blockpages/{category}", id: "getBlockPage", summary: "Returns the template of the block page of a category, or the default one.", media: []string{"text/html"}},
+	{method: http.MethodPut, path: "/blockpages/{category}", id: "saveBlockPage", summary: "Uploads the template of the block page of a category, or the default one.", bodyTypes: []string{"text/html"}, response: BlockPageSchema{}},
+	{method: http.MethodDelete, path: "/blockpages/{category}", id: "removeBlockPage", summary: "Removes a block page."},
+	{method: http.MethodGet, path: "/blockpages/{category}/preview", id: "previewBlockPage", summary: "Renders a block page as it is shown for a name.", params: []apiParam{query("domain", "string", "name the page is rendered for")}, media: []string{"text/html"}},
+	{method: http.MethodPost, path: "/sources/{id}/promote", id: "promoteSource", summary: "Ends the canary period of a source, enforcing its entries."},
+
+	{method: http.MethodGet, path: "/allowlist", id: "listAllowed", summary: "Lists the allowlist.", params: pageParams, response: ListSchema{}},
+	{method: http.MethodPost, path: "/allowlist", id: "allowDomains", summary: "Adds entries to the allowlist.", body: []NewEntry{}, status: http.StatusCreated},
+	{method: http.MethodDelete, path: "/allowlist", id: "disallowDomains", summary: "Removes entries from the allowlist.", body: []string{}},
+	{method: http.MethodGet, path: "/allowlist/{name}", id: "getAllowed", summary: "Returns the entry allowing the name.", response: DomainEntry{}},
+	{method: http.MethodDelete, path: "/allowlist/{name}", id: "disallowDomain", summary: "Removes an entry from the allowlist."},
+
+	{method: http.MethodGet, path: "/audit", id: "listAudit", summary: "Lists the changes made through the API.", params: append(pageParams, query("since", "date-time", ""), query("until", "date-time", ""), query("actor", "string", "name of the API key"), query("domain", "string", "")), response: AuditSchema{}},
+
+	{method: http.MethodGet, path: "/keys", id: "listKeys", summary: "Lists the valid API keys and their usage.", response: APIKeysSchema{}},
+	{method: http.MethodPost, path: "/keys", id: "issueKey", summary: "Issues a new key to a user, whose keys stay valid for an overlap.", body: NewAPIKeySchema{}, status: http.StatusCreated, response: IssuedAPIKeySchema{}},
+	{method: http.MethodDelete, path: "/keys/{owner}", id: "revokeKeys", summary: "Revokes every key of a user."},
+
+	{method: http.MethodGet, path: "/categories", id: "listCategories", summary: "Lists the categories.", response: CategoriesSchema{}},
+	{method: http.MethodPut, path: "/categories/{name}", id: "setCategory", summary: "Enables or disables a category.", body: CategoryStateSchema{}, response: CategoriesSchema{}},
+
+	{method: http.MethodGet, path: "/patterns", id: "listPatterns", summary: "Lists the regular expressions blocking names.", params: pageParams, response: PatternsSchema{}},
+	{method: http.MethodPost, path: "/patterns", id: "addPattern", summary: "Adds a pattern.", body: NewPatternSchema{}, status: http.StatusCreated, response: PatternSchema{}},
+	{method: http.MethodDelete, path: "/patterns/{id}", id: "removePattern", summary: "Removes a pattern."},
+
+	{method: http.MethodGet, path: "/mitm/rules", id: "listMITMRules", summary: "Lists the rules applied to intercepted HTTPS traffic.", response: MITMRulesSchema{}},
+	{method: http.MethodPost, path: "/mitm/rules", id: "addMITMRule", summary: "Adds a rule.", body: NewMITMRuleSchema{}, status: http.StatusCreated, response: MITMRuleSchema{}},
+	{method: http.MethodDelete, path: "/mitm/rules/{id}", id: "removeMITMRule", summary: "Removes a rule."},
+	{method: http.MethodGet, path: "/mitm/ca.pem", id: "getMITMCA", summary: "Returns the CA clients have to trust for the intercepted sites.", media: []string{"application/x-pem-file"}},
+
+	{method: http.MethodGet, path: "/policies", id: "listPolicies", summary: "Lists the named policies and the clients they apply to.", response: PoliciesSchema{}},
+	{method: http.MethodPost, path: "/policies", id: "addPolicy", summary: "Adds a named policy.", body: NewPolicySchema{}, status: http.StatusCreated, response: PolicySchema{}},
+	{method: http.MethodGet, path: "/policies/{name}", id: "getPolicy", summary: "Returns a named policy.", response: PolicySchema{}},
+	{method: http.MethodPut, path: "/policies/{name}", id: "replacePolicy", summary: "Replaces the default, the clients and the entries of a named policy.", body: NewPolicySchema{}, response: PolicySchema{}},
+	{method: http.MethodDelete, path: "/policies/{name}", id: "removePolicy", summary: "Removes a named policy."},
+
+	{method: http.MethodGet, path: "/schedules", id: "listSchedules", summary: "Lists the time windows of the categories and the domains.", response: SchedulesSchema{}},
+	{method: http.MethodPost, path: "/schedules", id: "addSchedule", summary: "Adds a time window to a category or a domain, for every client or those of a named policy.", body: NewScheduleSchema{}, status: http.StatusCreated, response: ScheduleSchema{}},
+	{method: http.MethodGet, path: "/schedules/{id}", id: "getSchedule", summary: "Returns a time window.", response: ScheduleSchema{}},
+	{method: http.MethodPut, path: "/schedules/{id}", id: "replaceSchedule", summary: "Replaces a time window.", body: NewScheduleSchema{}, response: ScheduleSchema{}},
+	{method: http.MethodDelete, path: "/schedules/{id}", id: "removeSchedule", summary: "Removes a time window."},
+
+	{method: http.MethodGet, path: "/admin/config", id: "exportConfig", summary: "Exports the configuration, with references to environment variables in place of the secrets.", response: ConfigSchema{}},
+	{method: http.MethodPost, path: "/admin/config", id: "importConfig", summary: "Adds what an exported configuration has and the instance hasn't.", body: ConfigSchema{}, response: ConfigImportSchema{}},
+	{method: http.MethodGet, path: "/admin/observe", id: "getObserveMode", summary: "Reports whether observe mode, in which blocks are only monitored, is on.", response: ObserveSchema{}},
+	{method: http.MethodPut, path: "/admin/observe", id: "setObserveMode", summary: "Turns observe mode on or off, which empties the RPZ zone while on.", body: ObserveSchema{}, response: ObserveSchema{}},
+	{method: http.MethodGet, path: "/admin/observe/impact", id: "getObserveImpact", summary: "Reports what enforcing the blocks monitored in a range would have blocked.", params: append(statsParams, query("limit", "integer", "number of names listed")), response: ImpactSchema{}},
+	{method: http.MethodGet, path: "/admin/memory", id: "getMemory", summary: "Reports the memory the service takes and the estimates of its mirrors against their budgets.", response: MemorySchema{}},
+	{method: http.MethodGet, path: "/admin/validate", id: "validateBlocklist", summary: "Reports invalid, unnormalized, duplicate and shadowed entries.", response: ValidationSchema{}},
+	{method: http.MethodPost, path: "/admin/validate/fix", id: "fixBlocklist", summary: "Fixes the issues that can be fixed safely.", response: ValidationSchema{}},
+	{method: http.MethodPost, path: "/cache/purge", id: "purgeHTTPCache", summary: "Removes the cached responses of a URL, of a domain with its subdomains, or all of them.", body: PurgeSchema{}, response: PurgedSchema{}},
+
+	{method: http.MethodGet, path: "/control/features", id: "listFeatures", summary: "Lists the features and whether they are enabled.", response: FeaturesSchema{}},
+	{method: http.MethodPost, path: "/control/features/set", id: "setFeature", summary: "Enables or disables a feature.", body: FeatureSchema{}, response: FeaturesSchema{}},
+
+	{method: http.MethodGet, path: "/control/status", id: "getAdGuardStatus", summary: "Returns the status the way AdGuard Home does.", response: AdGuardStatus{}},
+	{method: http.MethodGet, path: "/control/filtering/status", id: "getAdGuardFilteringStatus", summary: "Returns the filtering status the way AdGuard Home does.", response: AdGuardFilteringStatus{}},
+	{method: http.MethodPost, path: "/control/filtering/set_rules", id: "setAdGuardRules", summary: "Replaces the blocklist with AdGuard user rules.", body: AdGuardSetRules{}, media: []string{}},
+	{method: http.MethodGet, path: "/control/filtering/check_host", id: "checkAdGuardHost", summary: "Checks a name the way AdGuard Home does.", params: []apiParam{{name: "name", in: "query", typ: "string", required: true}}, response: AdGuardCheckHost{}},
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// NewEntry decodes itself, so its fields are described by hand. A bare
+// domain name is accepted as well.
+var newEntryDoc = map[string]any{
+	"type": "object",
+	"properties": map[string]any{
+		"domain":     map[string]any{"type": "string"},
+		"mode":       map[string]any{"type": "string", "enum": []string{ModeExact, ModeSubdomain, ModeWildcard}},
+		"categories": map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		"expiresAt":  map[string]any{"type": "string", "format": "date-time"},
+		"ttl":        map[string]any{"type": "string"},
+	},
+	"required": []string{"domain"},
+}
+
+// schemaBuilder describes Go types as JSON schemas, collecting the named
+// structs as components.
+type schemaBuilder struct {
+	components map[string]any
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(NewEntry{}):
+		b.components["NewEntry"] = newEntryDoc
+		return map[string]any{"$ref": "#/components/schemas/NewEntry"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		if _, ok := b.components[t.Name()]; !ok {
+			// Registered before its fields, as a struct can refer to
+			// itself, like APIError.
+			b.components[t.Name()] = nil
+			b.components[t.Name()] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	required := make([]string, 0)
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" || !field.IsExported() {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if field.Anonymous && name == "" {
+				walk(field.Type)
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = b.schema(field.Type)
+			if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+	}
+	walk(t)
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) != 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// openAPIDocument describes every endpoint served by the API.
+func openAPIDocument() map[string]any {
+	b := &schemaBuilder{components: make(map[string]any)}
+	errorRef := b.schema(reflect.TypeOf(APIError{}))
+	paths := make(map[string]map[string]any)
+	for _, op := range append(apiOperations, chaosOperations...) {
+		params := make([]any, 0)
+		for _, match := range pathParamPattern.FindAllStringSubmatch(op.path, -1) {
+			params = append(params, map[string]any{"name": match[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+		for _, p := range op.params {
+			schema := map[string]any{"type": p.typ}
+			if p.typ == "date-time" {
+				schema = map[string]any{"type": "string", "format": "date-time"}
+			}
+			param := map[string]any{"name": p.name, "in": p.in, "required": p.required, "schema": schema}
+			if p.description != "" {
+				param["description"] = p.description
+			}
+			params = append(params, param)
+		}
+
+		status := op.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]any{"description": http.StatusText(status)}
+		switch {
+		case op.response != nil:
+			success["content"] = map[string]any{"application/json": map[string]any{"schema": b.schema(reflect.TypeOf(op.response))}}
+		case op.media != nil:
+			content := make(map[string]any)
+			for _, media := range op.media {
+				content[media] = map[string]any{"schema": map[string]any{"type": "string"}}
+			}
+			if len(content) != 0 {
+				success["content"] = content
+			}
+		default:
+			success["content"] = map[string]any{"application/json": map[string]any{"schema": errorRef}}
+		}
+		operation := map[string]any{
+			"operationId": op.id,
+			"summary":     op.summary,
+			"parameters":  params,
+			"responses": map[string]any{
+				strconv.Itoa(status): success,
+				"default":            map[string]any{"description": "Error", "content": map[string]any{"application/json": map[string]any{"schema": errorRef}}},
+			},
+		}
+		switch {
+		case op.body != nil:
+			operation["requestBody"] = map[string]any{"required": true, "content": map[string]any{"application/json": map[string]any{"schema": b.schema(reflect.TypeOf(op.body))}}}
+		case op.bodyTypes != nil:
+			content := make(map[string]any)
+			for _, media := range op.bodyTypes {
+				content[media] = map[string]any{"schema": map[string]any{"type": "string"}}
+			}
+			operation["requestBody"] = map[string]any{"required": true, "content": content}
+		}
+		if op.public {
+			operation["security"] = []any{}
+		}
+		if op.deprecated {
+			operation["deprecated"] = true
+		}
+		if paths[op.path] == nil {
+			paths[op.path] = make(map[string]any)
+		}
+		paths[op.path][strings.ToLower(op.method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "proxy",
+			"description": "Manages the blocklist of the proxy. Errors, and the results of changes, are APIError objects.",
+			"version":     "1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas":         b.components,
+			"securitySchemes": map[string]any{"bearer": map[string]any{"type": "http", "scheme": "bearer"}},
+		},
+		"security": []any{map[string]any{"bearer": []any{}}},
+	}
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	respondWithJSON(w, openAPIDocument())
+}
+
+// runOpenAPI prints the OpenAPI document, which the client package is
+// generated from. It returns the exit status.
+func runOpenAPI(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: proxy openapi")
+		return 2
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(openAPIDocument()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Page describes the slice of a list a response carries. It is embedded in
+// the list schemas, so its fields sit next to the items.
+type Page struct {
+	Total  int    `json:"total"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+	Next   string `json:"next,omitempty"`
+	Prev   string `json:"prev,omitempty"`
+}
+
+// parsePage reads the limit and offset query parameters.
+func parsePage(r *http.Request) (Page, *APIError) {
+	limit, apiErr := queryInt(r, "limit", defaultListLimit)
+	if apiErr != nil {
+		return Page{}, apiErr
+	}
+	offset, apiErr := queryInt(r, "offset", 0)
+	if apiErr != nil {
+		return Page{}, apiErr
+	}
+	return Page{Limit: min(limit, maxListLimit), Offset: offset}, nil
+}
+
+// pageURL is the request URL with the limit and offset replaced and every
+// other parameter kept, so filters carry over to the next page.
+func pageURL(r *http.Request, limit int, offset int) string {
+	query := r.URL.Query()
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("offset", strconv.Itoa(offset))
+	return r.URL.Path + "?" + query.Encode()
+}
+
+// respondWithPage fills in the links to the neighbouring pages, which are
+// also sent in the Link header, and writes the list schema v embedding p.
+func respondWithPage(w http.ResponseWriter, r *http.Request, p *Page, v any) {
+	if p.Limit > 0 && p.Offset+p.Limit < p.Total {
+		p.Next = pageURL(r, p.Limit, p.Offset+p.Limit)
+	}
+	if p.Offset > 0 {
+		p.Prev = pageURL(r, p.Limit, max(p.Offset-p.Limit, 0))
+	}
+
+	links := make([]string, 0, 2)
+	if p.Next != "" {
+		links = append(links, "<"+p.Next+">; rel=\"next\"")
+	}
+	if p.Prev != "" {
+		links = append(links, "<"+p.Prev+">; rel=\"prev\"")
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	respondWithJSON(w, v)
+}
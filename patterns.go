@@ -0,0 +1,318 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const insertPatternStmt string = "INSERT INTO blocked_patterns(pattern, comment, created_at) VALUES (?, ?, ?)"
+
+const patternIDStmt string = "SELECT id FROM blocked_patterns WHERE pattern = ?"
+
+const lookupPatternStmt string = "SELECT pattern FROM blocked_patterns WHERE id = ?"
+
+const deletePatternStmt string = "DELETE FROM blocked_patterns WHERE id = ?"
+
+const selectPatternsStmt string = "SELECT pattern FROM blocked_patterns"
+
+const countPatternsStmt string = "SELECT COUNT(*) FROM blocked_patterns"
+
+const listPatternsStmt string = "SELECT id, pattern, comment, created_at FROM blocked_patterns ORDER BY id LIMIT ? OFFSET ?"
+
+// Longest pattern kept, which fits a VARCHAR(255) of MySQL.
+const maxPatternLength = 255
+
+type PatternSchema struct {
+	ID        int64     `json:"id"`
+	Pattern   string    `json:"pattern"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type PatternsSchema struct {
+	Patterns []PatternSchema `json:"patterns"`
+	Enforced bool            `json:"enforced"`
+	Page
+}
+
+type NewPatternSchema struct {
+	Pattern string `json:"pattern"`
+	Comment string `json:"comment"`
+}
+
+type compiledPattern struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// patternSet mirrors blocked_patterns compiled. A name is first matched
+// against all of the patterns at once, so names no pattern matches cost a
+// single pass.
+type patternSet struct {
+	mu       sync.RWMutex
+	rules    []compiledPattern
+	combined *regexp.Regexp
+}
+
+var patterns = &patternSet{}
+
+func (p *patternSet) load() error {
+	rows, err := db.Query(selectPatternsStmt)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	rules := make([]compiledPattern, 0)
+	sources := make([]string, 0)
+	for rows.Next() {
+		var pattern string
+		if err := rows.Scan(&pattern); err != nil {
+			return err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			// Patterns are validated when added, so this one was stored by
+			// hand; it never matches rather than failing the service.
+			continue
+		}
+		rules = append(rules, compiledPattern{pattern: pattern, re: re})
+		sources = append(sources, "(?:"+pattern+")")
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	var combined *regexp.Regexp
+	if len(sources) != 0 {
+		// Too many patterns may not compile as one; each is tried then.
+		combined, _ = regexp.Compile(strings.Join(sources, "|"))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules, p.combined = rules, combined
+	return nil
+}
+
+// match returns the first pattern matching the name, or nil.
+func (p *patternSet) match(name string) *DomainEntry {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.rules) == 0 || (p.combined != nil && !p.combined.MatchString(name)) {
+		return nil
+	}
+	for _, rule := range p.rules {
+		if rule.re.MatchString(name) {
+			return &DomainEntry{Domain: rule.pattern, Mode: ModeRegex}
+		}
+	}
+	return nil
+}
+
+// matchBlocked returns the entry, or with regex-rules the pattern, blocking
+// the name regardless of the allowlist.
+func matchBlocked(name string) *DomainEntry {
+	return matchBlockedFor(name, "")
+}
+
+// matchBlockedFor is matchBlocked for the clients of the named policy, to
+// whom the schedules of the policy apply too.
+func matchBlockedFor(name string, policy string) *DomainEntry {
+	now := scheduleNow()
+	if s := domainSchedules.decide(name, policy, now); s != nil {
+		if s.schema.Action == scheduleAllow {
+			return nil
+		}
+		return &DomainEntry{Domain: s.schema.Domain, Mode: s.schema.Mode}
+	}
+	suppressed := func(domain string) bool {
+		return categories.suppressed(domain, policy, now)
+	}
+	if entry := blocklist.matchExcept(name, suppressed); entry != nil {
+		return entry
+	}
+	if features.isEnabled(FeatureRegexRules) {
+		return patterns.match(name)
+	}
+	return nil
+}
+
+func patternsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listPatternsHandler(w, r)
+	case http.MethodPost:
+		addPatternHandler(w, r)
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, POST"))
+	}
+}
+
+func listPatternsHandler(w http.ResponseWriter, r *http.Request) {
+	page, apiErr := parsePage(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	schema := PatternsSchema{Patterns: []PatternSchema{}, Enforced: features.isEnabled(FeatureRegexRules), Page: page}
+	if err := tx.QueryRow(countPatternsStmt).Scan(&schema.Total); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	rows, err := tx.Query(listPatternsStmt, schema.Limit, schema.Offset)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pattern PatternSchema
+		var createdAt int64
+		if err := rows.Scan(&pattern.ID, &pattern.Pattern, &pattern.Comment, &createdAt); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if pattern.Comment, err = openField(FieldComment, pattern.Comment); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		pattern.CreatedAt = time.Unix(createdAt, 0).UTC()
+		schema.Patterns = append(schema.Patterns, pattern)
+	}
+	if err := rows.Err(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	respondWithPage(w, r, &schema.Page, &schema)
+}
+
+func addPatternHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensureJSON(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	var body NewPatternSchema
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted {\"pattern\", \"comment\"} object; got invalid JSON."), Status: "error"})
+		return
+	}
+	if body.Pattern == "" || len(body.Pattern) > maxPatternLength {
+		respondWithError(w, &APIError{Code: CodeInvalidPattern, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Pattern must be 1 to %d characters long.", maxPatternLength)})
+		return
+	}
+	if _, err := regexp.Compile(body.Pattern); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidPattern, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Pattern \"%s\" is invalid: %v.", body.Pattern, err)})
+		return
+	}
+	comment := truncateText(body.Comment, maxCommentLength)
+	sealed, err := sealComment(comment)
+	if errors.Is(err, errSealedTooLong) {
+		respondWithError(w, &APIError{Code: CodeCommentTooLong, Status: "error", StatusCode: http.StatusUnprocessableEntity, Message: localize(r, "Comment is too long to be stored sealed.")})
+		return
+	} else if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	createdAt := time.Now().UTC().Truncate(time.Second)
+	if _, err := tx.Exec(insertPatternStmt, body.Pattern, sealed, createdAt.Unix()); err != nil {
+		if isUniqueConstraintError(err) {
+			respondWithError(w, &APIError{Code: CodePatternExists, Status: "error", StatusCode: http.StatusConflict, Message: localize(r, "Pattern \"%s\" already exists.", body.Pattern)})
+			return
+		}
+		respondWithInternalError(w, r, err)
+		return
+	}
+	// Not every driver reports the ID of the inserted row, so it is looked
+	// up by the pattern.
+	var id int64
+	if err := tx.QueryRow(patternIDStmt, body.Pattern).Scan(&id); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := audit(r.Context(), tx, auditPatterns, DomainEntry{Domain: body.Pattern, Mode: ModeRegex}, false); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := patterns.load(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(PatternSchema{ID: id, Pattern: body.Pattern, Comment: comment, CreatedAt: createdAt})
+}
+
+// patternHandler serves DELETE /patterns/{id}.
+func patternHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		respondWithError(w, unexceptedMethod(r, http.MethodDelete))
+		return
+	}
+	notFound := &APIError{Code: CodePatternNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "Pattern \"%s\" doesn't exist.", r.PathValue("id"))}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, notFound)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var pattern string
+	if err := tx.QueryRow(lookupPatternStmt, id).Scan(&pattern); errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, notFound)
+		return
+	} else if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if _, err := tx.Exec(deletePatternStmt, id); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := audit(r.Context(), tx, auditPatterns, DomainEntry{Domain: pattern, Mode: ModeRegex}, true); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := patterns.load(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	respondWithError(w, &APIError{Code: CodeOK, StatusCode: http.StatusOK, Message: localize(r, "Succesfully removed the pattern."), Status: "success"})
+}
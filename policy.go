@@ -0,0 +1,102 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+var defaultPolicy *string = flag.String("default-policy", policyAllow, "decision for names no rule matches: allow, or deny to let only allowlisted names through")
+
+var monitorMode *bool = flag.Bool("monitor", false, "start in observe mode, logging and counting what would be blocked but forwarding it, for every client, with an empty RPZ zone, until turned off through /admin/observe")
+
+var clientPolicies *string = flag.String("client-policies", "", "comma-separated subnet=policy pairs overriding -default-policy for clients in the subnet; the narrowest subnet wins")
+
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+)
+
+type clientPolicy struct {
+	prefix netip.Prefix
+	deny   bool
+}
+
+// policySet decides what happens to a name neither list matches. Under
+// deny, the blocklist no longer matters and only allowlisted names pass.
+type policySet struct {
+	deny    bool
+	clients []clientPolicy
+}
+
+var policies = &policySet{}
+
+func parsePolicy(value string) (bool, error) {
+	switch value {
+	case policyAllow:
+		return false, nil
+	case policyDeny:
+		return true, nil
+	}
+	return false, fmt.Errorf("policy \"%s\" is invalid; excepted %s or %s", value, policyAllow, policyDeny)
+}
+
+func parsePolicies(def string, clients string) (*policySet, error) {
+	deny, err := parsePolicy(def)
+	if err != nil {
+		return nil, err
+	}
+	p := &policySet{deny: deny}
+	for _, item := range strings.Split(clients, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		subnet, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("\"%s\" isn't a subnet=policy pair", item)
+		}
+		prefixes, err := parsePrefixes(subnet)
+		if err != nil {
+			return nil, err
+		}
+		if len(prefixes) != 1 {
+			return nil, fmt.Errorf("\"%s\" isn't a subnet=policy pair", item)
+		}
+		deny, err := parsePolicy(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		p.clients = append(p.clients, clientPolicy{prefix: prefixes[0], deny: deny})
+	}
+	slices.SortStableFunc(p.clients, func(a, b clientPolicy) int {
+		return cmp.Compare(b.prefix.Bits(), a.prefix.Bits())
+	})
+	return p, nil
+}
+
+// denies reports whether names no rule matches are blocked for the client.
+// An invalid address, like that of a client behind an unknown transport,
+// gets the default policy.
+func (p *policySet) denies(client netip.Addr) bool {
+	client = client.Unmap()
+	for _, c := range p.clients {
+		if c.prefix.Contains(client) {
+			return c.deny
+		}
+	}
+	return p.deny
+}
+
+// netAddr returns the IP address of a network address, or the zero address
+// if it has none.
+func netAddr(addr net.Addr) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
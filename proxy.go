@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var proxyAddress *string = flag.String("proxy-address", "127.0.0.1:8080", "address for the HTTP forward proxy (disabled if empty)")
+
+var decisionHeaders *bool = flag.Bool("decision-headers", false, "add X-Proxy-Decision, X-Proxy-Policy and X-Proxy-Category headers to the allowed plain HTTP and intercepted requests the proxy forwards")
+
+const dialTimeout = 10 * time.Second
+
+// isBlocked reports whether the host (without a port) is blocked for the
+// client: under the allow policy if it is in the blocklist and not in the
+// allowlist, under the deny policy if it isn't in the allowlist. The named
+// policy of the client, if it has one, is applied first.
+func isBlocked(client netip.Addr, host string) bool {
+	name := lookupName(host)
+	deny := policies.denies(client)
+	policyName := ""
+	if policy := namedPolicies.lookup(client); policy != nil {
+		policyName = policy.schema.Name
+		if policy.allowed.match(name) != nil {
+			return false
+		}
+		if policy.blocked.match(name) != nil {
+			return true
+		}
+		if policy.deny != nil {
+			deny = *policy.deny
+		}
+	}
+	if deny {
+		return allowlist.match(name) == nil
+	}
+	return blockingEntryFor(name, policyName) != nil
+}
+
+// Headers of -decision-headers. The ones a client sends are always
+// dropped, so the services behind the proxy can trust them.
+const (
+	decisionHeader = "X-Proxy-Decision"
+	policyHeader   = "X-Proxy-Policy"
+	categoryHeader = "X-Proxy-Category"
+)
+
+// setDecisionHeaders tells the upstream why the request of the client is
+// allowed: "allowlisted", "monitored" or "allowed", with the named policy
+// of the client or "default" and the categories of the entry matching the
+// name. The categories are sent even if they aren't enforced now.
+func setDecisionHeaders(r *http.Request, client netip.Addr, hostname string) {
+	for _, header := range []string{decisionHeader, policyHeader, categoryHeader} {
+		r.Header.Del(header)
+	}
+	if !*decisionHeaders {
+		return
+	}
+	name := lookupName(hostname)
+	decision := "allowed"
+	if allowlist.match(name) != nil {
+		decision = "allowlisted"
+	} else if isBlocked(client, hostname) {
+		decision = "monitored"
+	}
+	r.Header.Set(decisionHeader, decision)
+	policy := "default"
+	if named := namedPolicies.lookup(client); named != nil {
+		policy = named.schema.Name
+	}
+	r.Header.Set(policyHeader, policy)
+	if entry := blocklist.match(name); entry != nil {
+		if list := categories.of(entry.Domain); len(list) != 0 {
+			r.Header.Set(categoryHeader, strings.Join(list, ","))
+		}
+	}
+}
+
+type forwardProxy struct {
+	dialer  *outboundDialer
+	forward *httputil.ReverseProxy
+	// Without -mitm-hosts, nil.
+	mitm *mitmProxy
+}
+
+func newForwardProxy(upstream *url.URL) *forwardProxy {
+	p := &forwardProxy{dialer: newOutboundDialer(upstream)}
+	var proxy func(*http.Request) (*url.URL, error)
+	if upstream != nil {
+		proxy = http.ProxyURL(upstream)
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           p.dialer.dial,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	p.forward = &httputil.ReverseProxy{
+		// The outbound request already carries the absolute URL the
+		// client asked for, so there is nothing to rewrite.
+		Rewrite: func(*httputil.ProxyRequest) {},
+		// Only plain HTTP is cached; intercepted HTTPS isn't, see below.
+		Transport: httpCache.wrap(transport),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if apiErr := forbiddenDestination(r, err); apiErr != nil {
+				respondWithError(w, apiErr)
+				return
+			}
+			respondWithError(w, &APIError{
+				Code:       CodeUpstreamUnreachable,
+				Status:     "error",
+				StatusCode: http.StatusBadGateway,
+				Message:    localize(r, "Couldn't reach \"%s\": %v.", r.URL.Host, err),
+			})
+		},
+	}
+	if mitmAuthority != nil {
+		hosts, _ := parseMITMHosts(*mitmHosts)
+		p.mitm = newMITMProxy(mitmAuthority, hosts, transport)
+	}
+	return p
+}
+
+func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var host string
+	if r.Method == http.MethodConnect {
+		host = r.Host
+	} else if r.URL.IsAbs() && r.URL.Host != "" {
+		host = r.URL.Host
+	} else {
+		respondWithError(w, &APIError{
+			Code:       CodeInvalidRequest,
+			Status:     "error",
+			StatusCode: http.StatusBadRequest,
+			Message:    localize(r, "Excepted an absolute URL or a CONNECT request."),
+		})
+		return
+	}
+
+	hostname := host
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		hostname = name
+	}
+	peer, _ := netip.ParseAddrPort(r.RemoteAddr)
+	if enforce(peer.Addr(), hostname, viaProxy) {
+		if blockPages.serve(w, r, peer.Addr(), hostname) {
+			return
+		}
+		respondWithError(w, &APIError{
+			Code:       CodeDomainBlocked,
+			Status:     "error",
+			StatusCode: http.StatusForbidden,
+			Message:    localize(r, "Domain \"%s\" is blocked.", hostname),
+		})
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.connect(w, r, host)
+		return
+	}
+	if p.mitm.intercepts(hostname) {
+		p.mitm.ServeHTTP(w, r)
+		return
+	}
+	if p.dialer.upstream != nil {
+		// The upstream resolves the name itself, so unlike direct
+		// connections, the check can't be pinned to the address it uses.
+		port := r.URL.Port()
+		if port == "" {
+			port = "80"
+		}
+		if _, err := destinations.resolve(r.Context(), net.JoinHostPort(hostname, port)); err != nil {
+			p.forward.ErrorHandler(w, r, err)
+			return
+		}
+	}
+	setDecisionHeaders(r, peer.Addr(), hostname)
+	activeProxyRequests.Add(1)
+	defer activeProxyRequests.Add(-1)
+	p.forward.ServeHTTP(w, r)
+}
+
+// forbiddenDestination is the error to respond with if err is a
+// forbiddenDestinationError, or nil.
+func forbiddenDestination(r *http.Request, err error) *APIError {
+	var forbidden forbiddenDestinationError
+	if !errors.As(err, &forbidden) {
+		return nil
+	}
+	return &APIError{
+		Code:       CodeForbiddenDestination,
+		Status:     "error",
+		StatusCode: http.StatusForbidden,
+		Message:    localize(r, "Connecting to \"%s\" isn't allowed.", forbidden.address),
+	}
+}
+
+// connect establishes a tunnel between the client and the target host,
+// or with the host intercepted, between the client and the proxy itself.
+func (p *forwardProxy) connect(w http.ResponseWriter, r *http.Request, host string) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+	hostname, port, _ := net.SplitHostPort(host)
+	if !destinations.allowsConnect(port) {
+		respondWithError(w, &APIError{
+			Code:       CodeForbiddenDestination,
+			Status:     "error",
+			StatusCode: http.StatusForbidden,
+			Message:    localize(r, "Tunnels to port %s aren't allowed; see -connect-ports.", port),
+		})
+		return
+	}
+	if p.mitm.intercepts(hostname) {
+		p.intercept(w, r, host)
+		return
+	}
+	upstream, err := p.dialer.DialContext(r.Context(), "tcp", host)
+	if apiErr := forbiddenDestination(r, err); apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	if err != nil {
+		respondWithError(w, &APIError{
+			Code:       CodeUpstreamUnreachable,
+			Status:     "error",
+			StatusCode: http.StatusBadGateway,
+			Message:    localize(r, "Couldn't reach \"%s\": %v.", host, err),
+		})
+		return
+	}
+	defer upstream.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		respondWithInternalError(w, r, errors.New("connection can't be hijacked"))
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		slog.Error("Hijacking of the connection failed", "error", err)
+		return
+	}
+	defer client.Close()
+
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	splice(client, buffered.Reader, upstream)
+}
+
+// intercept takes over the connection to decrypt the requests to the host
+// it tunnels.
+func (p *forwardProxy) intercept(w http.ResponseWriter, r *http.Request, host string) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		respondWithInternalError(w, r, errors.New("connection can't be hijacked"))
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		slog.Error("Hijacking of the connection failed", "error", err)
+		return
+	}
+	defer client.Close()
+
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	activeTunnels.Add(1)
+	defer activeTunnels.Add(-1)
+	p.mitm.serve(client, buffered.Reader, host)
+}
+
+// splice copies data in both directions until both sides are done. Data
+// the client sent before the tunnel was established is read from buffered.
+func splice(client net.Conn, buffered io.Reader, upstream net.Conn) {
+	activeTunnels.Add(1)
+	defer activeTunnels.Add(-1)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, buffered)
+		closeWrite(upstream)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstream)
+		closeWrite(client)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
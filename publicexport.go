@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var publicExport *bool = flag.Bool("public-export", false, "serve the exported blocklist at /public/blocklist/{format} without authentication, for CDNs to cache and publish")
+
+var publicExportMaxAge *time.Duration = flag.Duration("public-export-max-age", 5*time.Minute, "how long browsers and CDNs may serve the public export before revalidating it")
+
+// How long CDNs may keep serving the public export while the service fails.
+const publicExportStaleIfError = 24 * time.Hour
+
+const publicExportPath = "/public/blocklist/"
+
+// exportSnapshot is the export in a format as of a generation of the
+// blocklist. Unlike /domains/export, the public export is rendered whole,
+// so it has a strong ETag, and only again once the blocklist changed.
+type exportSnapshot struct {
+	generation uint64
+	body       []byte
+	etag       string
+	modified   time.Time
+}
+
+var publicSnapshots = struct {
+	mu      sync.Mutex
+	formats map[string]*exportSnapshot
+}{formats: make(map[string]*exportSnapshot)}
+
+// registerPublicExport serves the public export, if -public-export is set.
+func registerPublicExport() {
+	if !*publicExport {
+		return
+	}
+	for name := range exportFormats {
+		unauthenticatedPaths[publicExportPath+name] = true
+	}
+	http.HandleFunc(publicExportPath+"{format}", publicExportHandler)
+}
+
+// exportSnapshotOf returns the export in the format as of the current
+// generation of the blocklist, rendering it again if the blocklist changed.
+// Changes committed while it is rendered have bumped the generation, so
+// they are rendered again on the next request.
+func exportSnapshotOf(r *http.Request, name string, format exportFormat) (*exportSnapshot, error) {
+	blocklist.mu.RLock()
+	generation := blocklist.generation
+	blocklist.mu.RUnlock()
+
+	publicSnapshots.mu.Lock()
+	defer publicSnapshots.mu.Unlock()
+	previous := publicSnapshots.formats[name]
+	if previous != nil && previous.generation == generation {
+		return previous, nil
+	}
+
+	rows, err := db.QueryContext(r.Context(), exportStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var body bytes.Buffer
+	if err := format.export(&body, rows); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body.Bytes())
+	snapshot := &exportSnapshot{generation: generation, body: body.Bytes(), etag: "\"" + hex.EncodeToString(sum[:16]) + "\"", modified: time.Now().UTC()}
+	// Changes that left the list as it was, like an entry added and
+	// removed again, don't make it modified.
+	if previous != nil && previous.etag == snapshot.etag {
+		snapshot.modified = previous.modified
+	}
+	publicSnapshots.formats[name] = snapshot
+	return snapshot, nil
+}
+
+// publicExportHandler serves GET /public/blocklist/{format}. Conditional
+// and range requests are answered by http.ServeContent.
+func publicExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	name := r.PathValue("format")
+	format, ok := exportFormats[name]
+	if !ok {
+		respondWithError(w, unsupportedFormat(r, name))
+		return
+	}
+	snapshot, err := exportSnapshotOf(r, name, format)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("ETag", snapshot.etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, stale-if-error=%d", int(publicExportMaxAge.Seconds()), int(publicExportStaleIfError.Seconds())))
+	// The list is public, so any page may fetch it.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", snapshot.modified, bytes.NewReader(snapshot.body))
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter keeps a token bucket per key, e.g. a client address.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter allows perMinute requests a minute per key, at most burst
+// of them at once.
+func newRateLimiter(perMinute int, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of the key. When it is empty, it
+// returns how long until the next token.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		wait := math.Ceil((1 - bucket.tokens) / l.rate)
+		return false, time.Duration(wait) * time.Second
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep forgets the buckets that have filled up again, as they are no
+// different from new ones. It runs at most once a minute.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+var clientRateLimit *int = flag.Int("rate-limit-per-ip", 0, "requests a minute a client address may send to the API (unlimited if 0)")
+
+var keyRateLimit *int = flag.Int("rate-limit-per-key", 0, "requests a minute that may be sent to the API with an API key (unlimited if 0)")
+
+var rateLimitBurst *int = flag.Int("rate-limit-burst", 10, "requests a client address or an API key may send at once within its limit")
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retry time.Duration) *APIError {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())))
+	return &APIError{
+		Code:       CodeRateLimited,
+		Status:     "error",
+		StatusCode: http.StatusTooManyRequests,
+		Message:    localize(r, "Too many requests; retry in %d seconds.", int(retry.Seconds())),
+	}
+}
+
+// withClientRateLimit limits the requests of every client address. It goes
+// before withAuth, so guessing keys is limited too. The limiter may be nil.
+// Probes aren't limited.
+func withClientRateLimit(clients limiter, next http.Handler) http.Handler {
+	if clients == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticatedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, retry := clients.allow(clientAddr(r).String()); !ok {
+			respondWithError(w, tooManyRequests(w, r, retry))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withKeyRateLimit limits the requests of every API key, once withAuth
+// named it. The limiter may be nil.
+func withKeyRateLimit(keys limiter, next http.Handler) http.Handler {
+	if keys == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name := apiKeyName(r); name != "" {
+			if ok, retry := keys.allow(name); !ok {
+				respondWithError(w, tooManyRequests(w, r, retry))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var sharedRateLimits *bool = flag.Bool("shared-rate-limits", false, "count rate limited requests in the database too, so the limits hold across replicas sharing it")
+
+const addHitsStmt string = "UPDATE rate_limits SET hits = hits + ? WHERE rate_key = ? AND window_start = ?"
+
+const insertHitsStmt string = "INSERT INTO rate_limits(rate_key, window_start, hits) VALUES (?, ?, ?)"
+
+const hitsStmt string = "SELECT hits FROM rate_limits WHERE rate_key = ? AND window_start = ?"
+
+const expireHitsStmt string = "DELETE FROM rate_limits WHERE window_start < ?"
+
+// How often a shared limiter writes its requests and reads those of the
+// other replicas.
+const rateLimitSyncInterval = time.Second
+
+type limiter interface {
+	allow(key string) (bool, time.Duration)
+}
+
+// newLimiter returns a rateLimiter, or a sharedLimiter named name synced
+// until ctx is done with -shared-rate-limits.
+func newLimiter(ctx context.Context, name string, perMinute int, burst int) limiter {
+	if !*sharedRateLimits {
+		return newRateLimiter(perMinute, burst)
+	}
+	l := newSharedLimiter(name, perMinute, burst)
+	go l.run(ctx)
+	return l
+}
+
+// sharedLimiter holds a limit across replicas by counting the requests of
+// every minute in the database. Between syncs a replica only sees its own
+// requests, so the fleet may go over the limit by what the replicas let
+// through in a sync interval; the local bucket bounds that burst.
+type sharedLimiter struct {
+	local     *rateLimiter
+	name      string
+	perMinute int64
+
+	mu      sync.Mutex
+	window  int64
+	pending map[string]int64
+	fleet   map[string]int64
+}
+
+func newSharedLimiter(name string, perMinute int, burst int) *sharedLimiter {
+	return &sharedLimiter{
+		local:     newRateLimiter(perMinute, burst),
+		name:      name,
+		perMinute: int64(perMinute),
+		pending:   make(map[string]int64),
+		fleet:     make(map[string]int64),
+	}
+}
+
+func (l *sharedLimiter) allow(key string) (bool, time.Duration) {
+	if ok, retry := l.local.allow(key); !ok {
+		return false, retry
+	}
+	now := time.Now().Unix()
+	window := now - now%60
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if window != l.window {
+		l.window = window
+		l.pending = make(map[string]int64)
+		l.fleet = make(map[string]int64)
+	}
+	if _, ok := l.fleet[key]; !ok {
+		// The first request of a key in a minute reads the counter, so a
+		// replica that hasn't seen the key yet doesn't start from zero.
+		l.mu.Unlock()
+		hits, err := addHits(context.Background(), l.name+":"+key, window, 0)
+		if err != nil {
+			slog.Warn("Reading of the rate limit failed", "limiter", l.name, "error", err)
+		}
+		l.mu.Lock()
+		if l.window == window {
+			l.fleet[key] = max(l.fleet[key], hits)
+		}
+	}
+	if l.fleet[key]+l.pending[key] >= l.perMinute {
+		return false, time.Duration(window+60-now) * time.Second
+	}
+	l.pending[key]++
+	return true, 0
+}
+
+func (l *sharedLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := l.sync(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("Syncing of the rate limits failed", "limiter", l.name, "error", err)
+		}
+	}
+}
+
+// sync adds the pending requests to the counters in the database and reads
+// back the counters of every key seen in the current minute.
+func (l *sharedLimiter) sync(ctx context.Context) error {
+	l.mu.Lock()
+	window, pending := l.window, l.pending
+	keys := make([]string, 0, len(l.fleet)+len(pending))
+	for key := range l.fleet {
+		keys = append(keys, key)
+	}
+	for key := range pending {
+		if _, ok := l.fleet[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	l.pending = make(map[string]int64)
+	l.mu.Unlock()
+
+	fleet := make(map[string]int64, len(keys))
+	for _, key := range keys {
+		hits, err := addHits(ctx, l.name+":"+key, window, pending[key])
+		if err != nil {
+			return err
+		}
+		fleet[key] = hits
+	}
+
+	l.mu.Lock()
+	if l.window == window {
+		for key, hits := range fleet {
+			l.fleet[key] = hits
+		}
+	}
+	l.mu.Unlock()
+
+	_, err := db.ExecContext(ctx, expireHitsStmt, window-60)
+	return err
+}
+
+// addHits adds to the counter of the key in the window and returns it.
+func addHits(ctx context.Context, key string, window int64, hits int64) (int64, error) {
+	if hits != 0 {
+		result, err := db.ExecContext(ctx, addHitsStmt, hits, key, window)
+		if err != nil {
+			return 0, err
+		}
+		if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+			_, err := db.ExecContext(ctx, insertHitsStmt, key, window, hits)
+			if isUniqueConstraintError(err) {
+				// Another replica inserted the counter in between.
+				_, err = db.ExecContext(ctx, addHitsStmt, hits, key, window)
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	var total int64
+	err := db.QueryRowContext(ctx, hitsStmt, key, window).Scan(&total)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return total, err
+}
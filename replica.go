@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var primaryURL *string = flag.String("primary", "", "URL of the primary API; makes this instance a replica serving checks from a synced copy and forwarding changes there (disabled if empty)")
+
+var primaryAPIKey *string = flag.String("primary-api-key", "", "API key a replica syncs from the primary with")
+
+var replicaSyncInterval *time.Duration = flag.Duration("replica-sync-interval", 15*time.Second, "how often a replica fetches the changes of the primary")
+
+const replicaSerialStmt string = "SELECT serial FROM replica_state WHERE id = 1"
+
+const updateReplicaSerialStmt string = "UPDATE replica_state SET serial = ? WHERE id = 1"
+
+const insertReplicaSerialStmt string = "INSERT INTO replica_state(id, serial) VALUES (1, ?)"
+
+// Paths a replica serves itself whatever the method: checks only read, and
+// the runtime controls apply to the instance they are sent to.
+var replicaLocalPaths = []string{"/domains/check", "/control/", "/categories/"}
+
+func parsePrimary(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	primary, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if (primary.Scheme != "http" && primary.Scheme != "https") || primary.Host == "" {
+		return nil, errors.New("primary must be an http:// or https:// URL with a host")
+	}
+	return primary, nil
+}
+
+// replica keeps the local database a copy of the blocklist and the
+// allowlist of the primary.
+type replica struct {
+	primary *url.URL
+	key     string
+	client  *http.Client
+	synced  chan struct{}
+}
+
+func newReplica(primary *url.URL, key string) *replica {
+	return &replica{
+		primary: primary,
+		key:     key,
+		client:  &http.Client{Timeout: sourceFetchTimeout},
+		synced:  make(chan struct{}, 1),
+	}
+}
+
+// handler forwards the requests changing data to the primary and serves
+// the rest from the local copy. A forwarded change is synced back right
+// away, so it shows up on the replica soon after.
+func (rep *replica) handler(next http.Handler) http.Handler {
+	forward := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(rep.primary)
+			pr.SetXForwarded()
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			if resp.StatusCode < http.StatusBadRequest {
+				rep.syncSoon()
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			respondWithError(w, &APIError{
+				Code:       CodeUpstreamUnreachable,
+				Status:     "error",
+				StatusCode: http.StatusBadGateway,
+				Message:    localize(r, "Couldn't reach \"%s\": %v.", rep.primary.Host, err),
+			})
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, prefix := range replicaLocalPaths {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		forward.ServeHTTP(w, r)
+	})
+}
+
+func (rep *replica) syncSoon() {
+	select {
+	case rep.synced <- struct{}{}:
+	default:
+	}
+}
+
+func (rep *replica) run(ctx context.Context) {
+	ticker := time.NewTicker(*replicaSyncInterval)
+	defer ticker.Stop()
+	for {
+		if err := rep.sync(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Syncing with the primary failed", "primary", rep.primary.String(), "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-rep.synced:
+		}
+	}
+}
+
+func (rep *replica) sync(ctx context.Context) error {
+	if err := rep.syncBlocklist(ctx); err != nil {
+		return fmt.Errorf("blocklist: %v", err)
+	}
+	if err := rep.syncAllowlist(ctx); err != nil {
+		return fmt.Errorf("allowlist: %v", err)
+	}
+	return nil
+}
+
+func (rep *replica) get(ctx context.Context, path string, query url.Values, v any) error {
+	u := rep.primary.JoinPath(path)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if rep.key != "" {
+		req.Header.Set("Authorization", "Bearer "+rep.key)
+	}
+	resp, err := rep.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", u.Path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// syncBlocklist applies the net changes of the primary since the serial
+// the copy is at. On the first sync, or if the primary is behind that
+// serial, e.g. because its database was replaced, the copy is rebuilt from
+// scratch out of the whole blocklist of the primary, which the changes
+// since serial 0 are.
+func (rep *replica) syncBlocklist(ctx context.Context) error {
+	var since int64
+	err := db.QueryRowContext(ctx, replicaSerialStmt).Scan(&since)
+	rebuild := errors.Is(err, sql.ErrNoRows)
+	if err != nil && !rebuild {
+		return err
+	}
+	var changes ChangesSchema
+	if err := rep.get(ctx, "/domains/changes", url.Values{"since": {strconv.FormatInt(since, 10)}}, &changes); err != nil {
+		return err
+	}
+	if changes.Serial < since {
+		rebuild = true
+		if err := rep.get(ctx, "/domains/changes", url.Values{"since": {"0"}}, &changes); err != nil {
+			return err
+		}
+	}
+	if changes.Serial == since && !rebuild {
+		return nil
+	}
+
+	tx, err := beginChange(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if rebuild {
+		rows, err := tx.Query(selectManualStmt)
+		if err != nil {
+			return err
+		}
+		current := make([]DomainEntry, 0)
+		for rows.Next() {
+			var entry DomainEntry
+			if err := rows.Scan(&entry.Domain, &entry.Mode); err != nil {
+				rows.Close()
+				return err
+			}
+			current = append(current, entry)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		changes.Removed = current
+	}
+	for _, entry := range changes.Removed {
+		result, err := tx.Exec(deleteStmt, entry.Domain)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			continue
+		}
+		if err := tx.record(entry, true); err != nil {
+			return err
+		}
+	}
+	for _, entry := range changes.Added {
+		var mode string
+		err := tx.QueryRow(lookupStmt, entry.Domain).Scan(&mode)
+		if err == nil && mode == entry.Mode {
+			continue
+		}
+		if err == nil {
+			if _, err := tx.Exec(deleteStmt, entry.Domain); err != nil {
+				return err
+			}
+			if err := tx.record(DomainEntry{Domain: entry.Domain, Mode: mode}, true); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if _, err := tx.Exec(insertStmt, entry.Domain, entry.Mode); err != nil {
+			return err
+		}
+		if err := tx.record(entry, false); err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.Exec(updateReplicaSerialStmt, changes.Serial)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		if _, err := tx.Exec(insertReplicaSerialStmt, changes.Serial); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.Info("Synced with the primary", "serial", changes.Serial, "added", len(changes.Added), "removed", len(changes.Removed))
+	return nil
+}
+
+// syncAllowlist replaces the allowlist with the one of the primary, which
+// is fetched whole as it is small and has no journal.
+func (rep *replica) syncAllowlist(ctx context.Context) error {
+	wanted := make(map[string]string)
+	for offset := 0; ; {
+		var page ListSchema
+		query := url.Values{"limit": {strconv.Itoa(maxListLimit)}, "offset": {strconv.Itoa(offset)}}
+		if err := rep.get(ctx, "/allowlist", query, &page); err != nil {
+			return err
+		}
+		for _, entry := range page.Domains {
+			wanted[entry.Domain] = entry.Mode
+		}
+		offset += len(page.Domains)
+		if len(page.Domains) == 0 || offset >= page.Total {
+			break
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(selectAllowedStmt)
+	if err != nil {
+		return err
+	}
+	removed := make([]DomainEntry, 0)
+	for rows.Next() {
+		var entry DomainEntry
+		if err := rows.Scan(&entry.Domain, &entry.Mode); err != nil {
+			rows.Close()
+			return err
+		}
+		if mode, ok := wanted[entry.Domain]; ok && mode == entry.Mode {
+			delete(wanted, entry.Domain)
+			continue
+		}
+		removed = append(removed, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(removed) == 0 && len(wanted) == 0 {
+		return nil
+	}
+
+	for _, entry := range removed {
+		if _, err := tx.Exec(deleteAllowedStmt, entry.Domain); err != nil {
+			return err
+		}
+	}
+	added := make([]DomainEntry, 0, len(wanted))
+	for name, mode := range wanted {
+		if _, err := tx.Exec(insertAllowedStmt, name, mode); err != nil {
+			return err
+		}
+		added = append(added, DomainEntry{Domain: name, Mode: mode})
+	}
+	return commitAllowlist(ctx, tx, added, removed)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var apiKeyOverlap *time.Duration = flag.Duration("api-key-overlap", 24*time.Hour, "how long the keys of a user stay valid once a replacement is issued to them")
+
+const insertAPIKeyStmt string = "INSERT INTO api_keys(owner, key_hash, issued, created_at) VALUES (?, ?, ?, ?)"
+
+const apiKeyIDStmt string = "SELECT id FROM api_keys WHERE key_hash = ?"
+
+const selectAPIKeysStmt string = "SELECT id, owner, key_hash, issued, expires_at, revoked_at FROM api_keys"
+
+// Cuts the validity of the keys of the owner short, unless they expire
+// sooner already.
+const expireAPIKeysStmt string = "UPDATE api_keys SET expires_at = ? WHERE owner = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)"
+
+const revokeAPIKeysStmt string = "UPDATE api_keys SET revoked_at = ? WHERE owner = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)"
+
+const maxKeyOwnerLength = 64
+
+type NewAPIKeySchema struct {
+	Owner   string `json:"owner"`
+	Overlap string `json:"overlap"`
+}
+
+type IssuedAPIKeySchema struct {
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	Key       string    `json:"key"`
+	CreatedAt time.Time `json:"createdAt"`
+	// When the keys the owner had until now stop being valid, if there
+	// were any.
+	ReplacedUntil *time.Time `json:"replacedUntil,omitempty"`
+}
+
+type keyringEntry struct {
+	name      string
+	owner     string
+	hash      string
+	expiresAt int64
+	revoked   bool
+}
+
+func (e keyringEntry) valid(now time.Time) bool {
+	return !e.revoked && (e.expiresAt == 0 || now.Unix() < e.expiresAt)
+}
+
+// keyring holds the keys accepted by the API. It is reloaded from the
+// database after every change, and periodically for the changes made by
+// other instances sharing it.
+type keyring struct {
+	mu         sync.RWMutex
+	configured []apiKey
+	keys       []keyringEntry
+}
+
+var apiKeyring = &keyring{}
+
+// register adds the configured keys to the database, so their validity can
+// be cut short like that of the issued ones.
+func (k *keyring) register(keys []apiKey) error {
+	now := time.Now().Unix()
+	for _, key := range keys {
+		if _, err := db.Exec(insertAPIKeyStmt, key.name, hashKey(key.key), 0, now); err != nil && !isUniqueConstraintError(err) {
+			return err
+		}
+	}
+	k.mu.Lock()
+	k.configured = keys
+	k.mu.Unlock()
+	return k.load()
+}
+
+func (k *keyring) load() error {
+	rows, err := db.Query(selectAPIKeysStmt)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	stored := make(map[string]keyringEntry)
+	issued := make([]keyringEntry, 0)
+	for rows.Next() {
+		var id int64
+		var entry keyringEntry
+		var isIssued bool
+		var expiresAt, revokedAt sql.NullInt64
+		if err := rows.Scan(&id, &entry.owner, &entry.hash, &isIssued, &expiresAt, &revokedAt); err != nil {
+			return err
+		}
+		entry.expiresAt, entry.revoked = expiresAt.Int64, revokedAt.Valid
+		if isIssued {
+			entry.name = issuedKeyName(entry.owner, id)
+			issued = append(issued, entry)
+		} else {
+			stored[entry.hash] = entry
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keys := make([]keyringEntry, 0, len(k.configured)+len(issued))
+	for _, key := range k.configured {
+		entry := stored[hashKey(key.key)]
+		entry.name, entry.owner, entry.hash = key.name, key.name, hashKey(key.key)
+		keys = append(keys, entry)
+	}
+	k.keys = append(keys, issued...)
+	return nil
+}
+
+// issuedKeyName names an issued key after its owner, who may hold several.
+func issuedKeyName(owner string, id int64) string {
+	return fmt.Sprintf("%s#%d", owner, id)
+}
+
+// authenticate returns the name of the valid key the token is. Every key
+// is compared, in constant time, so the time taken doesn't tell which one
+// was close.
+func (k *keyring) authenticate(token string, now time.Time) (string, bool) {
+	hash := hashKey(token)
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	name := ""
+	for _, key := range k.keys {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(key.hash)) == 1 && key.valid(now) {
+			name = key.name
+		}
+	}
+	return name, name != ""
+}
+
+// valid returns the keys accepted at the time.
+func (k *keyring) valid(now time.Time) []keyringEntry {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := make([]keyringEntry, 0, len(k.keys))
+	for _, key := range k.keys {
+		if key.valid(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func validateKeyOwner(owner string) error {
+	if owner == "" || len(owner) > maxKeyOwnerLength {
+		return fmt.Errorf("owner must be 1 to %d characters long", maxKeyOwnerLength)
+	}
+	if strings.ContainsAny(owner, ":,# \t") {
+		return errors.New("owner can't contain \":\", \",\", \"#\" or spaces")
+	}
+	return nil
+}
+
+// enabled reports whether keys can be issued, which they only can with
+// -api-keys set.
+func (k *keyring) enabled() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return len(k.configured) != 0
+}
+
+// issueKey issues a new key to the owner in the transaction. The keys the
+// owner had until then stay valid for the overlap.
+func issueKey(ctx context.Context, tx *sql.Tx, owner string, overlap time.Duration) (IssuedAPIKeySchema, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return IssuedAPIKeySchema{}, err
+	}
+	key := hex.EncodeToString(secret)
+	now := time.Now().UTC().Truncate(time.Second)
+	until := now.Add(overlap)
+
+	result, err := tx.ExecContext(ctx, expireAPIKeysStmt, until.Unix(), owner, until.Unix())
+	if err != nil {
+		return IssuedAPIKeySchema{}, err
+	}
+	replaced, _ := result.RowsAffected()
+	if _, err := tx.ExecContext(ctx, insertAPIKeyStmt, owner, hashKey(key), 1, now.Unix()); err != nil {
+		return IssuedAPIKeySchema{}, err
+	}
+	var id int64
+	if err := tx.QueryRowContext(ctx, apiKeyIDStmt, hashKey(key)).Scan(&id); err != nil {
+		return IssuedAPIKeySchema{}, err
+	}
+	schema := IssuedAPIKeySchema{Name: issuedKeyName(owner, id), Owner: owner, Key: key, CreatedAt: now}
+	if replaced != 0 {
+		schema.ReplacedUntil = &until
+	}
+	if _, err := tx.ExecContext(ctx, insertKeyUsageStmt, schema.Name, hashKey(key), now.Unix()); err != nil {
+		return IssuedAPIKeySchema{}, err
+	}
+	if err := audit(ctx, tx, auditKeys, DomainEntry{Domain: schema.Name}, false); err != nil {
+		return IssuedAPIKeySchema{}, err
+	}
+	return schema, nil
+}
+
+// issueKeyHandler serves POST /keys: it issues a new key to the owner, whose
+// keys until then stay valid for the overlap.
+func issueKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if !apiKeyring.enabled() {
+		respondWithError(w, &APIError{Code: CodeAuthDisabled, Status: "error", StatusCode: http.StatusConflict, Message: localize(r, "API keys can only be issued with -api-keys set.")})
+		return
+	}
+	if err := ensureJSON(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	var body NewAPIKeySchema
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted {\"owner\", \"overlap\"} object; got invalid JSON."), Status: "error"})
+		return
+	}
+	if err := validateKeyOwner(body.Owner); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidParameter, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Owner \"%s\" is invalid: %v.", body.Owner, err)})
+		return
+	}
+	overlap := *apiKeyOverlap
+	if body.Overlap != "" {
+		d, err := time.ParseDuration(body.Overlap)
+		if err != nil || d < 0 {
+			respondWithError(w, &APIError{Code: CodeInvalidParameter, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Overlap \"%s\" is invalid; excepted a duration like \"24h\".", body.Overlap)})
+			return
+		}
+		overlap = d
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+	schema, err := issueKey(r.Context(), tx, body.Owner, overlap)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := apiKeyring.load(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(schema)
+}
+
+// revokeKeysHandler serves DELETE /keys/{owner}: every key of the owner,
+// configured or issued, stops being valid at once.
+func revokeKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		respondWithError(w, unexceptedMethod(r, http.MethodDelete))
+		return
+	}
+	owner := r.PathValue("owner")
+	now := time.Now()
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(revokeAPIKeysStmt, now.Unix(), owner, now.Unix())
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	revoked, _ := result.RowsAffected()
+	if revoked == 0 {
+		respondWithError(w, &APIError{Code: CodeKeyNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "User \"%s\" has no valid keys.", owner)})
+		return
+	}
+	if err := audit(r.Context(), tx, auditKeys, DomainEntry{Domain: owner}, true); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := apiKeyring.load(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	respondWithError(w, &APIError{Code: CodeOK, StatusCode: http.StatusOK, Message: localize(r, "Succesfully revoked %d keys of \"%s\".", revoked, owner), Status: "success"})
+}
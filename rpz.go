@@ -0,0 +1,589 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var rpzAddress *string = flag.String("rpz-address", "", "address for serving the blocklist as an RPZ zone over DNS (disabled if empty)")
+
+var rpzZone *string = flag.String("rpz-zone", "rpz.local.", "name of the served RPZ zone")
+
+var rpzNotify *string = flag.String("rpz-notify", "", "comma-separated addresses of secondaries to NOTIFY about zone changes")
+
+var rpzLanding *string = flag.String("rpz-landing", "", "comma-separated addresses blocked domains resolve to instead of NXDOMAIN (e.g. of a block page)")
+
+var rpzAllow *string = flag.String("rpz-allow", "", "comma-separated client subnets allowed to query the RPZ zone (everyone if empty)")
+
+const (
+	rpzTTL               = 300
+	rpzRecordsPerMessage = 200
+	rpzTimeout           = 30 * time.Second
+	rpzNotifyTimeout     = 2 * time.Second
+	rpzNotifyAttempts    = 3
+)
+
+// dnsmessage doesn't define the IXFR query type.
+const rpzTypeIXFR dnsmessage.Type = 251
+
+type rpzServer struct {
+	origin      dnsmessage.Name
+	secondaries []string
+	allowed     []netip.Prefix
+	landing     []netip.Addr
+}
+
+// parsePrefixes parses a comma-separated list of subnets in CIDR notation.
+// Bare addresses are treated as single-host subnets.
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// parseAddrs parses a comma-separated list of addresses.
+func parseAddrs(list string) ([]netip.Addr, error) {
+	addrs := make([]netip.Addr, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr.Unmap())
+	}
+	return addrs, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func newRPZServer(zone string, notify string, allow string, landing string) (*rpzServer, error) {
+	zone = strings.ToLower(zone)
+	if !strings.HasSuffix(zone, ".") {
+		zone += "."
+	}
+	origin, err := dnsmessage.NewName(zone)
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := parsePrefixes(allow)
+	if err != nil {
+		return nil, err
+	}
+	s := &rpzServer{origin: origin, allowed: allowed}
+	if s.landing, err = parseAddrs(landing); err != nil {
+		return nil, err
+	}
+	for _, addr := range strings.Split(notify, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			s.secondaries = append(s.secondaries, addr)
+		}
+	}
+	return s, nil
+}
+
+// listenDNS listens on the address over both TCP and UDP. With port 0 the
+// UDP socket takes the port picked for TCP.
+func listenDNS(address string) (net.Listener, net.PacketConn, error) {
+	tcp, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		tcp.Close()
+		return nil, nil, err
+	}
+	return tcp, udp, nil
+}
+
+// serve answers zone transfers over TCP and SOA queries over UDP until one
+// of the listeners fails.
+func (s *rpzServer) serve(tcp net.Listener, udp net.PacketConn) error {
+	go s.notifyLoop()
+
+	errc := make(chan error, 2)
+	go func() { errc <- s.serveTCP(tcp) }()
+	go func() { errc <- s.serveUDP(udp) }()
+	return <-errc
+}
+
+func (s *rpzServer) serveTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *rpzServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(rpzTimeout))
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		var req dnsmessage.Message
+		if err := req.Unpack(buf); err != nil {
+			return
+		}
+		for _, resp := range s.respond(&req, conn.RemoteAddr(), true) {
+			packed, err := resp.Pack()
+			if err != nil {
+				slog.Error("Packing of RPZ response failed", "error", err)
+				return
+			}
+			if err := binary.Write(conn, binary.BigEndian, uint16(len(packed))); err != nil {
+				return
+			}
+			if _, err := conn.Write(packed); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *rpzServer) serveUDP(conn net.PacketConn) error {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		var req dnsmessage.Message
+		if err := req.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		for _, resp := range s.respond(&req, addr, false) {
+			packed, err := resp.Pack()
+			if err != nil {
+				slog.Error("Packing of RPZ response failed", "error", err)
+				continue
+			}
+			conn.WriteTo(packed, addr)
+		}
+	}
+}
+
+func (s *rpzServer) soa(serial uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: s.origin, Class: dnsmessage.ClassINET, TTL: rpzTTL},
+		Body: &dnsmessage.SOAResource{
+			NS:      dnsmessage.MustNewName("localhost."),
+			MBox:    dnsmessage.MustNewName("hostmaster.localhost."),
+			Serial:  serial,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			MinTTL:  rpzTTL,
+		},
+	}
+}
+
+func (s *rpzServer) ns() dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: s.origin, Class: dnsmessage.ClassINET, TTL: rpzTTL},
+		Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName("localhost.")},
+	}
+}
+
+// owners returns the names inside the zone that implement the entry. RPZ
+// only knows leading "*." wildcards, so other patterns can't be published.
+func owners(entry DomainEntry) []string {
+	switch entry.Mode {
+	case ModeSubdomain:
+		return []string{entry.Domain, "*." + entry.Domain}
+	case ModeWildcard:
+		if suffix, ok := strings.CutPrefix(entry.Domain, "*."); ok && !strings.ContainsAny(suffix, "*?[") {
+			return []string{entry.Domain}
+		}
+		return nil
+	}
+	return []string{entry.Domain}
+}
+
+// entry returns the policy records for the entry: "CNAME ." (NXDOMAIN) or,
+// with landing addresses configured, local-data A/AAAA records. Names that
+// can't be represented inside the zone are skipped.
+func (s *rpzServer) entry(entry DomainEntry) []dnsmessage.Resource {
+	records := make([]dnsmessage.Resource, 0)
+	for _, owner := range owners(entry) {
+		name, err := dnsmessage.NewName(owner + "." + s.origin.String())
+		if err != nil {
+			continue
+		}
+		header := func(t dnsmessage.Type) dnsmessage.ResourceHeader {
+			return dnsmessage.ResourceHeader{Name: name, Type: t, Class: dnsmessage.ClassINET, TTL: rpzTTL}
+		}
+		if len(s.landing) == 0 {
+			records = append(records, dnsmessage.Resource{Header: header(dnsmessage.TypeCNAME), Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(".")}})
+			continue
+		}
+		for _, addr := range s.landing {
+			if addr.Is4() {
+				records = append(records, dnsmessage.Resource{Header: header(dnsmessage.TypeA), Body: &dnsmessage.AResource{A: addr.As4()}})
+			} else {
+				records = append(records, dnsmessage.Resource{Header: header(dnsmessage.TypeAAAA), Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+			}
+		}
+	}
+	return records
+}
+
+func (s *rpzServer) entries(entries []DomainEntry) []dnsmessage.Resource {
+	records := make([]dnsmessage.Resource, 0, len(entries))
+	for _, entry := range entries {
+		records = append(records, s.entry(entry)...)
+	}
+	return records
+}
+
+// domainOf returns the blocked domain encoded by an owner name inside the
+// zone, or false if the name is outside of it. The apex yields "".
+func (s *rpzServer) domainOf(name dnsmessage.Name) (string, bool) {
+	owner, origin := strings.ToLower(name.String()), s.origin.String()
+	if owner == origin {
+		return "", true
+	}
+	if origin == "." {
+		return strings.TrimSuffix(owner, "."), true
+	}
+	domain, found := strings.CutSuffix(owner, "."+origin)
+	return domain, found
+}
+
+func (s *rpzServer) reply(req *dnsmessage.Message, rcode dnsmessage.RCode) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               req.ID,
+			Response:         true,
+			OpCode:           req.OpCode,
+			Authoritative:    rcode != dnsmessage.RCodeRefused,
+			RecursionDesired: req.RecursionDesired,
+			RCode:            rcode,
+		},
+		Questions: req.Questions,
+	}
+}
+
+// respond refuses queries from clients outside of the allowed subnets and
+// handles the rest.
+func (s *rpzServer) respond(req *dnsmessage.Message, client net.Addr, tcp bool) []dnsmessage.Message {
+	activeDNSQueries.Add(1)
+	defer activeDNSQueries.Add(-1)
+	defer delayPacket()
+
+	if len(s.allowed) != 0 && !req.Response {
+		addr, err := netip.ParseAddrPort(client.String())
+		if err != nil || !containsAddr(s.allowed, addr.Addr()) {
+			return []dnsmessage.Message{s.reply(req, dnsmessage.RCodeRefused)}
+		}
+	}
+	return s.handle(context.Background(), req, tcp)
+}
+
+func (s *rpzServer) handle(ctx context.Context, req *dnsmessage.Message, tcp bool) []dnsmessage.Message {
+	if req.Response {
+		return nil
+	}
+	if req.OpCode != 0 {
+		return []dnsmessage.Message{s.reply(req, dnsmessage.RCodeNotImplemented)}
+	}
+	if len(req.Questions) != 1 {
+		return []dnsmessage.Message{s.reply(req, dnsmessage.RCodeFormatError)}
+	}
+	q := req.Questions[0]
+	domain, inZone := s.domainOf(q.Name)
+	if !inZone || q.Class != dnsmessage.ClassINET {
+		return []dnsmessage.Message{s.reply(req, dnsmessage.RCodeRefused)}
+	}
+
+	var err error
+	var msgs []dnsmessage.Message
+	switch {
+	case q.Type == dnsmessage.TypeAXFR && domain == "" && tcp:
+		msgs, err = s.axfr(ctx, req)
+	case q.Type == rpzTypeIXFR && domain == "" && tcp:
+		msgs, err = s.ixfr(ctx, req)
+	case q.Type == dnsmessage.TypeAXFR || q.Type == rpzTypeIXFR:
+		// Over UDP the current SOA tells the secondary to retry over TCP.
+		msgs, err = s.query(ctx, req, "", dnsmessage.TypeSOA)
+	default:
+		msgs, err = s.query(ctx, req, domain, q.Type)
+	}
+	if err != nil {
+		slog.Error("RPZ query failed", "name", q.Name.String(), "error", err)
+		return []dnsmessage.Message{s.reply(req, dnsmessage.RCodeServerFailure)}
+	}
+	return msgs
+}
+
+func (s *rpzServer) query(ctx context.Context, req *dnsmessage.Message, domain string, qtype dnsmessage.Type) ([]dnsmessage.Message, error) {
+	var serial int64
+	if err := db.QueryRowContext(ctx, latestSerialStmt).Scan(&serial); err != nil {
+		return nil, err
+	}
+	empty, serial := observe.zone(serial)
+	resp := s.reply(req, dnsmessage.RCodeSuccess)
+	if domain == "" {
+		switch qtype {
+		case dnsmessage.TypeSOA:
+			resp.Answers = append(resp.Answers, s.soa(uint32(serial)))
+		case dnsmessage.TypeNS:
+			resp.Answers = append(resp.Answers, s.ns())
+		default:
+			resp.Authorities = append(resp.Authorities, s.soa(uint32(serial)))
+		}
+		return []dnsmessage.Message{resp}, nil
+	}
+
+	// The owner name is either the entry itself or, for "*.domain", a
+	// subdomain entry of the domain.
+	names := []string{domain}
+	if parent, ok := strings.CutPrefix(domain, "*."); ok {
+		names = append(names, parent)
+	}
+	if empty {
+		// Observe mode leaves every name out of the zone.
+		names = nil
+	}
+	records := make([]dnsmessage.Resource, 0)
+	for _, name := range names {
+		entry := DomainEntry{Domain: name}
+		err := db.QueryRowContext(ctx, lookupEntryStmt, name).Scan(&entry.Mode)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, record := range s.entry(entry) {
+			if strings.EqualFold(record.Header.Name.String(), req.Questions[0].Name.String()) {
+				records = append(records, record)
+			}
+		}
+		if len(records) != 0 {
+			break
+		}
+	}
+	if len(records) == 0 {
+		resp.RCode = dnsmessage.RCodeNameError
+		resp.Authorities = append(resp.Authorities, s.soa(uint32(serial)))
+		return []dnsmessage.Message{resp}, nil
+	}
+	for _, record := range records {
+		// A CNAME answers every type, local data only its own.
+		if record.Header.Type == dnsmessage.TypeCNAME || record.Header.Type == qtype || qtype == dnsmessage.TypeALL {
+			resp.Answers = append(resp.Answers, record)
+		}
+	}
+	if len(resp.Answers) == 0 {
+		resp.Authorities = append(resp.Authorities, s.soa(uint32(serial)))
+	}
+	return []dnsmessage.Message{resp}, nil
+}
+
+// transfer splits the records of a zone transfer into several messages.
+func (s *rpzServer) transfer(req *dnsmessage.Message, records []dnsmessage.Resource) []dnsmessage.Message {
+	msgs := make([]dnsmessage.Message, 0, len(records)/rpzRecordsPerMessage+1)
+	for len(records) > 0 {
+		n := min(len(records), rpzRecordsPerMessage)
+		resp := s.reply(req, dnsmessage.RCodeSuccess)
+		if len(msgs) != 0 {
+			resp.Questions = nil
+		}
+		resp.Answers = records[:n]
+		records = records[n:]
+		msgs = append(msgs, resp)
+	}
+	return msgs
+}
+
+func (s *rpzServer) axfr(ctx context.Context, req *dnsmessage.Message) ([]dnsmessage.Message, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var serial int64
+	if err := tx.QueryRow(latestSerialStmt).Scan(&serial); err != nil {
+		return nil, err
+	}
+	empty, serial := observe.zone(serial)
+	domains := make([]DomainEntry, 0)
+	if !empty {
+		rows, err := tx.Query(selectAllStmt)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var entry DomainEntry
+			if err := rows.Scan(&entry.Domain, &entry.Mode); err != nil {
+				return nil, err
+			}
+			domains = append(domains, entry)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	soa := s.soa(uint32(serial))
+	records := []dnsmessage.Resource{soa, s.ns()}
+	records = append(records, s.entries(domains)...)
+	records = append(records, soa)
+	return s.transfer(req, records), nil
+}
+
+func (s *rpzServer) ixfr(ctx context.Context, req *dnsmessage.Message) ([]dnsmessage.Message, error) {
+	var clientSerial int64 = -1
+	for _, rr := range req.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			clientSerial = int64(soa.Serial)
+		}
+	}
+	if clientSerial < 0 {
+		return []dnsmessage.Message{s.reply(req, dnsmessage.RCodeFormatError)}, nil
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var serial int64
+	if err := tx.QueryRow(latestSerialStmt).Scan(&serial); err != nil {
+		return nil, err
+	}
+	_, serial = observe.zone(serial)
+	if clientSerial > serial {
+		// The secondary is ahead of us (e.g. the database was recreated),
+		// so only a full transfer can bring it back in sync.
+		tx.Rollback()
+		return s.axfr(ctx, req)
+	}
+	soa := s.soa(uint32(serial))
+	if clientSerial == serial {
+		resp := s.reply(req, dnsmessage.RCodeSuccess)
+		resp.Answers = []dnsmessage.Resource{soa}
+		return []dnsmessage.Message{resp}, nil
+	}
+
+	// Observe mode empties or fills the zone, which the journal doesn't
+	// tell.
+	journalSerial, ok := observe.journalSerial(clientSerial)
+	if !ok {
+		tx.Rollback()
+		return s.axfr(ctx, req)
+	}
+	added, removed, err := netChanges(tx, journalSerial)
+	if err != nil {
+		return nil, err
+	}
+	records := []dnsmessage.Resource{soa, s.soa(uint32(clientSerial))}
+	records = append(records, s.entries(removed)...)
+	records = append(records, soa)
+	records = append(records, s.entries(added)...)
+	records = append(records, soa)
+	return s.transfer(req, records), nil
+}
+
+// notifyLoop sends a NOTIFY to the configured secondaries whenever the
+// blocklist or observe mode changed. Changes made while one is sent are
+// covered by the next.
+func (s *rpzServer) notifyLoop() {
+	changes := events.subscribe(1, EventEntryAdded, EventEntryRemoved, EventObserveChanged)
+	for range changes.C {
+		for _, addr := range s.secondaries {
+			if err := s.sendNotify(addr); err != nil {
+				slog.Warn("NOTIFY failed", "secondary", addr, "error", err)
+			}
+		}
+	}
+}
+
+func (s *rpzServer) sendNotify(addr string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	id := uint16(time.Now().UnixNano())
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, OpCode: 4, Authoritative: true},
+		Questions: []dnsmessage.Question{{Name: s.origin, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 512)
+	for attempt := 0; attempt < rpzNotifyAttempts; attempt++ {
+		if _, err = conn.Write(packed); err != nil {
+			continue
+		}
+		conn.SetReadDeadline(time.Now().Add(rpzNotifyTimeout))
+		var n int
+		if n, err = conn.Read(buf); err != nil {
+			continue
+		}
+		var resp dnsmessage.Message
+		if err = resp.Unpack(buf[:n]); err == nil && resp.Response && resp.ID == id {
+			return nil
+		}
+	}
+	if err == nil {
+		err = errors.New("no acknowledgement received")
+	}
+	return err
+}
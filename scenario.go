@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/yaml.v3"
+)
+
+// A scenario is a script of mutations and expected decisions, replayed by
+// "proxy scenario" against a throwaway instance:
+//
+//	blocked:
+//	  - ads.example.com
+//	  - {domain: tracker.example.com, mode: subdomain}
+//	steps:
+//	  - http: ads.example.com
+//	    expect: blocked
+//	  - dns: cdn.tracker.example.com
+//	    expect: blocked
+//	  - unblock: ads.example.com
+//	  - connect: ads.example.com:443
+//	    expect: allowed
+type Scenario struct {
+	Blocked []DomainEntry  `yaml:"blocked"`
+	Steps   []ScenarioStep `yaml:"steps"`
+}
+
+// ScenarioStep sets exactly one of the actions. block and unblock change
+// the blocklist through the API; the others make a request and compare
+// the decision with Expect.
+type ScenarioStep struct {
+	Block   *DomainEntry `yaml:"block"`
+	Unblock string       `yaml:"unblock"`
+	Check   string       `yaml:"check"`
+	HTTP    string       `yaml:"http"`
+	Connect string       `yaml:"connect"`
+	Socks   string       `yaml:"socks"`
+	DNS     string       `yaml:"dns"`
+	Expect  string       `yaml:"expect"`
+}
+
+const (
+	decisionBlocked = "blocked"
+	decisionAllowed = "allowed"
+)
+
+const scenarioTimeout = 10 * time.Second
+
+func loadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var scenario Scenario
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&scenario); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for index, step := range scenario.Steps {
+		if err := step.validate(); err != nil {
+			return nil, fmt.Errorf("%s: step %d: %v", path, index+1, err)
+		}
+	}
+	return &scenario, nil
+}
+
+func (step ScenarioStep) action() (kind string, target string) {
+	switch {
+	case step.Block != nil:
+		return "block", step.Block.Domain
+	case step.Unblock != "":
+		return "unblock", step.Unblock
+	case step.Check != "":
+		return "check", step.Check
+	case step.HTTP != "":
+		return "http", step.HTTP
+	case step.Connect != "":
+		return "connect", step.Connect
+	case step.Socks != "":
+		return "socks", step.Socks
+	case step.DNS != "":
+		return "dns", step.DNS
+	}
+	return "", ""
+}
+
+func (step ScenarioStep) validate() error {
+	actions := 0
+	for _, set := range []bool{step.Block != nil, step.Unblock != "", step.Check != "", step.HTTP != "", step.Connect != "", step.Socks != "", step.DNS != ""} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return errors.New("excepted exactly one action")
+	}
+	kind, _ := step.action()
+	if kind == "block" || kind == "unblock" {
+		if step.Expect != "" {
+			return fmt.Errorf("%s doesn't take \"expect\"", kind)
+		}
+		if step.Block != nil {
+			return step.Block.normalize()
+		}
+		return nil
+	}
+	if step.Expect != decisionBlocked && step.Expect != decisionAllowed {
+		return fmt.Errorf("excepted \"expect\" to be \"%s\" or \"%s\", got: \"%s\"", decisionBlocked, decisionAllowed, step.Expect)
+	}
+	return nil
+}
+
+// runScenario starts every service on an ephemeral loopback port with a
+// temporary database, replays the scenario and reports the result of
+// each step. It returns the exit status.
+func runScenario(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: proxy scenario [flags] file")
+		return 2
+	}
+	scenario, err := loadScenario(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	dir, err := os.MkdirTemp("", "proxy-scenario")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	if err := openDatabase(backendSQLite, filepath.Join(dir, "db.db")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	for _, setting := range []*string{address, proxyAddress, socksAddress, rpzAddress} {
+		*setting = "127.0.0.1:0"
+	}
+	registerHandlers()
+	ctx, stop := context.WithCancel(context.Background())
+	started := make(chan boundAddresses, 1)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- serve(ctx, func(bound boundAddresses) { started <- bound })
+	}()
+	var bound boundAddresses
+	select {
+	case bound = <-started:
+	case err := <-errc:
+		stop()
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer func() {
+		stop()
+		<-errc
+	}()
+
+	runner := &scenarioRunner{bound: bound, client: &http.Client{Timeout: scenarioTimeout}}
+	if keys, _ := parseAPIKeys(*apiKeys); len(keys) != 0 {
+		runner.apiKey = keys[0].key
+	}
+	if len(scenario.Blocked) != 0 {
+		if err := runner.block(scenario.Blocked); err != nil {
+			fmt.Fprintf(os.Stderr, "Seeding of the blocklist failed: %v\n", err)
+			return 1
+		}
+	}
+
+	failed := 0
+	for index, step := range scenario.Steps {
+		kind, target := step.action()
+		decision, err := runner.run(step)
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("FAIL %d %s %s: %v\n", index+1, kind, target, err)
+		case step.Expect != "" && decision != step.Expect:
+			failed++
+			fmt.Printf("FAIL %d %s %s: excepted %s, got %s\n", index+1, kind, target, step.Expect, decision)
+		default:
+			fmt.Println(strings.TrimSpace(fmt.Sprintf("ok   %d %s %s %s", index+1, kind, target, decision)))
+		}
+	}
+	fmt.Printf("%d steps, %d failed\n", len(scenario.Steps), failed)
+	if failed != 0 {
+		return 1
+	}
+	return 0
+}
+
+type scenarioRunner struct {
+	bound  boundAddresses
+	client *http.Client
+	apiKey string
+}
+
+func (r *scenarioRunner) run(step ScenarioStep) (string, error) {
+	switch kind, target := step.action(); kind {
+	case "block":
+		return "", r.block([]DomainEntry{*step.Block})
+	case "unblock":
+		return "", r.unblock(target)
+	case "check":
+		return r.check(target)
+	case "http":
+		return r.http(target)
+	case "connect":
+		return r.connect(target)
+	case "socks":
+		return r.socks(target)
+	default:
+		return r.dns(target)
+	}
+}
+
+func (r *scenarioRunner) api(method string, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://"+r.bound.API+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if r.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+r.apiKey)
+	}
+	return r.client.Do(req)
+}
+
+func (r *scenarioRunner) block(entries []DomainEntry) error {
+	resp, err := r.api(http.MethodPost, "/domains", entries)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("API responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func (r *scenarioRunner) unblock(name string) error {
+	resp, err := r.api(http.MethodDelete, "/domains/"+url.PathEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("API responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func (r *scenarioRunner) check(name string) (string, error) {
+	resp, err := r.api(http.MethodGet, "/domains/"+url.PathEscape(name), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return decisionBlocked, nil
+	case http.StatusNotFound:
+		return decisionAllowed, nil
+	}
+	return "", fmt.Errorf("API responded with %s", resp.Status)
+}
+
+// proxyDecision tells a refusal of the proxy from any other outcome, as
+// allowed destinations needn't be reachable from the test machine, and
+// neither need they be outside the networks the proxy refuses.
+func proxyDecision(resp *http.Response) string {
+	if resp.StatusCode != http.StatusForbidden {
+		return decisionAllowed
+	}
+	var apiErr APIError
+	if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Code == CodeForbiddenDestination {
+		return decisionAllowed
+	}
+	return decisionBlocked
+}
+
+func (r *scenarioRunner) http(host string) (string, error) {
+	client := &http.Client{
+		Timeout:   scenarioTimeout,
+		Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: r.bound.Proxy})},
+	}
+	resp, err := client.Get("http://" + host + "/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return proxyDecision(resp), nil
+}
+
+func (r *scenarioRunner) connect(target string) (string, error) {
+	conn, err := net.DialTimeout("tcp", r.bound.Proxy, scenarioTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(scenarioTimeout))
+
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: target}, Host: target, Header: make(http.Header)}
+	if err := req.Write(conn); err != nil {
+		return "", err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return proxyDecision(resp), nil
+}
+
+func (r *scenarioRunner) socks(target string) (string, error) {
+	host, portText, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.DialTimeout("tcp", r.bound.Socks, scenarioTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(scenarioTimeout))
+
+	msg := []byte{socksVersion, 1, socksMethodNoAuth}
+	msg = append(msg, socksVersion, socksCommandConnect, 0, socksAddressDomain, byte(len(host)))
+	msg = append(msg, host...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(port))
+	if _, err := conn.Write(msg); err != nil {
+		return "", err
+	}
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:2]); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return "", err
+	}
+	if reply[1] == socksNotAllowed {
+		return decisionBlocked, nil
+	}
+	return decisionAllowed, nil
+}
+
+// dns looks the name up in the RPZ zone the way a resolver does: the name
+// itself first, then the "*." owners of its parents.
+func (r *scenarioRunner) dns(name string) (string, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	owners := []string{name}
+	labels := strings.Split(name, ".")
+	for i := 1; i < len(labels); i++ {
+		owners = append(owners, "*."+strings.Join(labels[i:], "."))
+	}
+	for _, owner := range owners {
+		found, err := r.queryRPZ(owner)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			return decisionBlocked, nil
+		}
+	}
+	return decisionAllowed, nil
+}
+
+func (r *scenarioRunner) queryRPZ(owner string) (bool, error) {
+	if origin := strings.TrimSuffix(*rpzZone, "."); origin != "" {
+		owner += "." + origin
+	}
+	qname, err := dnsmessage.NewName(owner + ".")
+	if err != nil {
+		return false, err
+	}
+	req := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1},
+		Questions: []dnsmessage.Question{{Name: qname, Type: dnsmessage.TypeALL, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := req.Pack()
+	if err != nil {
+		return false, err
+	}
+	conn, err := net.DialTimeout("udp", r.bound.RPZ, scenarioTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(scenarioTimeout))
+	if _, err := conn.Write(packed); err != nil {
+		return false, err
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return false, err
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf[:n]); err != nil {
+		return false, err
+	}
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+		return len(resp.Answers) != 0, nil
+	case dnsmessage.RCodeNameError:
+		return false, nil
+	}
+	return false, fmt.Errorf("RPZ responded with %s", resp.RCode)
+}
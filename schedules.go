@@ -0,0 +1,507 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var timezone *string = flag.String("timezone", "", "IANA time zone the schedules are evaluated in, like Europe/Berlin (the local one of the host if empty)")
+
+// The windows of categories used to be stored in category_schedules.
+const copyCategorySchedulesStmt string = "INSERT INTO schedules(category, policy, action, days, start_time, end_time, weight, created_at) SELECT category, policy, action, days, start_time, end_time, weight, created_at FROM category_schedules ORDER BY id"
+
+const dropCategorySchedulesStmt string = "DROP TABLE category_schedules"
+
+const insertScheduleStmt string = "INSERT INTO schedules(category, domain_name, mode, policy, action, days, start_time, end_time, weight, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+
+const updateScheduleStmt string = "UPDATE schedules SET category = ?, domain_name = ?, mode = ?, policy = ?, action = ?, days = ?, start_time = ?, end_time = ?, weight = ? WHERE id = ?"
+
+const selectScheduleStmt string = "SELECT id, category, domain_name, mode, policy, action, days, start_time, end_time, weight, created_at FROM schedules WHERE id = ?"
+
+const deleteScheduleStmt string = "DELETE FROM schedules WHERE id = ?"
+
+const deletePolicySchedulesStmt string = "DELETE FROM schedules WHERE policy = ?"
+
+const selectSchedulesStmt string = "SELECT id, category, domain_name, mode, policy, action, days, start_time, end_time, weight, created_at FROM schedules ORDER BY id"
+
+const (
+	scheduleBlock = "block"
+	scheduleAllow = "allow"
+)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// scheduleLocation is the time zone of -timezone.
+var scheduleLocation *time.Location = time.Local
+
+func parseTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// scheduleNow is the time the windows are evaluated at.
+func scheduleNow() time.Time {
+	return time.Now().In(scheduleLocation)
+}
+
+type NewScheduleSchema struct {
+	// The category whose entries the window enforces or lifts; empty for a
+	// window of a domain.
+	Category string `json:"category,omitempty"`
+	// The name the window blocks or lets through, matched in the mode like
+	// an entry; empty for a window of a category.
+	Domain string `json:"domain,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+	// The named policy whose clients the window applies to; empty for
+	// every client.
+	Policy string `json:"policy,omitempty"`
+	Action string `json:"action"`
+	// The days the window starts on, like "mon"; empty for every day.
+	Days []string `json:"days,omitempty"`
+	// "15:04" times in -timezone; a window ending before it starts ends
+	// the next day, and one ending when it starts lasts the whole day.
+	Start  string `json:"start"`
+	End    string `json:"end"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+type ScheduleSchema struct {
+	ID int64 `json:"id"`
+	NewScheduleSchema
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type SchedulesSchema struct {
+	Schedules []ScheduleSchema `json:"schedules"`
+	Timezone  string           `json:"timezone"`
+}
+
+type schedule struct {
+	schema ScheduleSchema
+	days   [7]bool
+	// Minutes since midnight.
+	start int
+	end   int
+	// The entry of a window of a domain.
+	entry *memoryBlocklist
+}
+
+// active reports whether the window is open at the time.
+func (s *schedule) active(now time.Time) bool {
+	minute, day := now.Hour()*60+now.Minute(), now.Weekday()
+	switch {
+	case s.start == s.end:
+		return s.days[day]
+	case s.start < s.end:
+		return s.days[day] && minute >= s.start && minute < s.end
+	case minute >= s.start:
+		return s.days[day]
+	}
+	// Past midnight, in a window that started the day before.
+	return minute < s.end && s.days[(day+6)%7]
+}
+
+// outweighs reports whether the window wins over the other when both are
+// open.
+func (s *schedule) outweighs(other *schedule) bool {
+	if s.schema.Weight != other.schema.Weight {
+		return s.schema.Weight > other.schema.Weight
+	}
+	if (s.schema.Policy != "") != (other.schema.Policy != "") {
+		return s.schema.Policy != ""
+	}
+	return s.schema.Action == scheduleBlock && other.schema.Action == scheduleAllow
+}
+
+// target is the category or the entry of the window, for the audit log.
+func (s ScheduleSchema) target() DomainEntry {
+	if s.Category != "" {
+		return DomainEntry{Domain: s.Category}
+	}
+	return DomainEntry{Domain: s.Domain, Mode: s.Mode}
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("time \"%s\" isn't like \"15:04\"", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// newSchedule validates the schedule, normalizing its category or domain
+// and its days.
+func newSchedule(schema ScheduleSchema) (*schedule, error) {
+	s := &schedule{}
+	schema.Category = strings.ToLower(strings.TrimSpace(schema.Category))
+	switch {
+	case (schema.Category == "") == (schema.Domain == ""):
+		return nil, errors.New("excepted either a category or a domain")
+	case schema.Category != "":
+		if err := validateCategory(schema.Category); err != nil {
+			return nil, err
+		}
+		schema.Mode = ""
+	default:
+		entry := DomainEntry{Domain: schema.Domain, Mode: cmp.Or(schema.Mode, ModeExact)}
+		if err := entry.normalize(); err != nil {
+			return nil, fmt.Errorf("domain \"%s\" is invalid: %v", schema.Domain, err)
+		}
+		schema.Domain, schema.Mode = entry.Domain, entry.Mode
+		s.entry = newEntrySet([]DomainEntry{entry})
+	}
+	if schema.Action != scheduleBlock && schema.Action != scheduleAllow {
+		return nil, fmt.Errorf("action \"%s\" is invalid; excepted %s or %s", schema.Action, scheduleBlock, scheduleAllow)
+	}
+	days := make([]string, 0, len(schema.Days))
+	for _, day := range schema.Days {
+		day = strings.ToLower(strings.TrimSpace(day))
+		i := slices.Index(weekdays, day)
+		if i == -1 {
+			return nil, fmt.Errorf("day \"%s\" is invalid; excepted one of %s", day, strings.Join(weekdays, ", "))
+		}
+		if !s.days[i] {
+			s.days[i] = true
+			days = append(days, day)
+		}
+	}
+	if len(days) == 0 {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	schema.Days = days
+	var err error
+	if s.start, err = parseClock(schema.Start); err != nil {
+		return nil, err
+	}
+	if s.end, err = parseClock(schema.End); err != nil {
+		return nil, err
+	}
+	s.schema = schema
+	return s, nil
+}
+
+// migrateCategorySchedules moves the windows of categories from
+// category_schedules, if the table is left, to schedules.
+func migrateCategorySchedules() error {
+	var count int
+	if err := db.QueryRow(store.ColumnExistsStmt(), "category_schedules", "id").Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{copyCategorySchedulesStmt, dropCategorySchedulesStmt} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type scheduleScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSchedule(row scheduleScanner) (ScheduleSchema, error) {
+	var schema ScheduleSchema
+	var days string
+	var createdAt int64
+	if err := row.Scan(&schema.ID, &schema.Category, &schema.Domain, &schema.Mode, &schema.Policy, &schema.Action, &days, &schema.Start, &schema.End, &schema.Weight, &createdAt); err != nil {
+		return schema, err
+	}
+	schema.CreatedAt = time.Unix(createdAt, 0).UTC()
+	if days != "" {
+		schema.Days = strings.Split(days, ",")
+	}
+	return schema, nil
+}
+
+// domainWindows mirrors the windows of domains, which are few enough to be
+// matched one by one.
+type domainWindows struct {
+	mu   sync.RWMutex
+	list []*schedule
+}
+
+var domainSchedules = &domainWindows{}
+
+// decide returns the open window of the name for the clients of the
+// policy, "" for those without one, that wins at the time, or nil.
+func (d *domainWindows) decide(name string, policy string, now time.Time) *schedule {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var winner *schedule
+	for _, s := range d.list {
+		if s.schema.Policy != "" && s.schema.Policy != policy {
+			continue
+		}
+		if s.active(now) && (winner == nil || s.outweighs(winner)) && s.entry.match(name) != nil {
+			winner = s
+		}
+	}
+	return winner
+}
+
+func loadSchedules() error {
+	rows, err := db.Query(selectSchedulesStmt)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	byCategory := make(map[string][]*schedule)
+	domains := make([]*schedule, 0)
+	for rows.Next() {
+		schema, err := scanSchedule(rows)
+		if err != nil {
+			return err
+		}
+		s, err := newSchedule(schema)
+		if err != nil {
+			// Schedules are validated when added, so this one was stored
+			// by hand; it is skipped rather than failing the service.
+			continue
+		}
+		if s.schema.Category != "" {
+			byCategory[s.schema.Category] = append(byCategory[s.schema.Category], s)
+		} else {
+			domains = append(domains, s)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	categories.mu.Lock()
+	categories.schedules = byCategory
+	categories.mu.Unlock()
+	domainSchedules.mu.Lock()
+	domainSchedules.list = domains
+	domainSchedules.mu.Unlock()
+	return nil
+}
+
+// enforcedLocked reports whether the entries of the category block for the
+// clients of the policy, "" for those without one, at the time. c.mu must
+// be held.
+func (c *categoryIndex) enforcedLocked(category string, policy string, now time.Time) bool {
+	var winner *schedule
+	windows := false
+	for _, s := range c.schedules[category] {
+		if s.schema.Policy != "" && s.schema.Policy != policy {
+			continue
+		}
+		if s.schema.Action == scheduleBlock {
+			windows = true
+		}
+		if s.active(now) && (winner == nil || s.outweighs(winner)) {
+			winner = s
+		}
+	}
+	switch {
+	case winner != nil:
+		return winner.schema.Action == scheduleBlock
+	case windows:
+		return false
+	}
+	return !c.disabled[category]
+}
+
+func schedulesSchema(now time.Time) SchedulesSchema {
+	schema := SchedulesSchema{Schedules: make([]ScheduleSchema, 0), Timezone: scheduleLocation.String()}
+	add := func(s *schedule) {
+		item := s.schema
+		item.Active = s.active(now)
+		schema.Schedules = append(schema.Schedules, item)
+	}
+	categories.mu.RLock()
+	for _, list := range categories.schedules {
+		for _, s := range list {
+			add(s)
+		}
+	}
+	categories.mu.RUnlock()
+	domainSchedules.mu.RLock()
+	for _, s := range domainSchedules.list {
+		add(s)
+	}
+	domainSchedules.mu.RUnlock()
+	slices.SortFunc(schema.Schedules, func(a, b ScheduleSchema) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return schema
+}
+
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		respondWithJSON(w, schedulesSchema(scheduleNow()))
+	case http.MethodPost:
+		saveSchedule(w, r, 0)
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, POST"))
+	}
+}
+
+// scheduleHandler serves GET, PUT and DELETE /schedules/{id}.
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, scheduleNotFound(r))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		schema, err := scanSchedule(db.QueryRowContext(r.Context(), selectScheduleStmt, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, scheduleNotFound(r))
+			return
+		} else if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if s, err := newSchedule(schema); err == nil {
+			schema = s.schema
+			schema.Active = s.active(scheduleNow())
+		}
+		respondWithJSON(w, schema)
+	case http.MethodPut:
+		saveSchedule(w, r, id)
+	case http.MethodDelete:
+		removeSchedule(w, r, id)
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, PUT, DELETE"))
+	}
+}
+
+func scheduleNotFound(r *http.Request) *APIError {
+	return &APIError{Code: CodeScheduleNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "Schedule \"%s\" doesn't exist.", r.PathValue("id"))}
+}
+
+// saveSchedule adds the schedule of the body, or replaces the one with the
+// ID if it isn't 0.
+func saveSchedule(w http.ResponseWriter, r *http.Request, id int64) {
+	if err := ensureJSON(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	var body NewScheduleSchema
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted {\"category\", \"domain\", \"mode\", \"policy\", \"action\", \"days\", \"start\", \"end\", \"weight\"} object; got invalid JSON."), Status: "error"})
+		return
+	}
+	s, err := newSchedule(ScheduleSchema{NewScheduleSchema: body})
+	if err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidSchedule, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Schedule is invalid: %v.", err)})
+		return
+	}
+	if s.schema.Policy != "" && namedPolicies.find(s.schema.Policy) == nil {
+		respondWithError(w, policyNotFound(r, s.schema.Policy))
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	schema := s.schema
+	days := strings.Join(schema.Days, ",")
+	if id == 0 {
+		schema.CreatedAt = time.Now().UTC().Truncate(time.Second)
+		// Schedules have nothing unique to look the ID of an inserted one
+		// up by, so it comes from the insert.
+		schema.ID, err = insertID(tx, insertScheduleStmt, schema.Category, schema.Domain, schema.Mode, schema.Policy, schema.Action, days, schema.Start, schema.End, schema.Weight, schema.CreatedAt.Unix())
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+	} else {
+		stored, err := scanSchedule(tx.QueryRow(selectScheduleStmt, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, scheduleNotFound(r))
+			return
+		} else if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		schema.ID, schema.CreatedAt = id, stored.CreatedAt
+		if _, err := tx.Exec(updateScheduleStmt, schema.Category, schema.Domain, schema.Mode, schema.Policy, schema.Action, days, schema.Start, schema.End, schema.Weight, id); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+	}
+	if err := audit(r.Context(), tx, auditSchedules, schema.target(), false); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := loadSchedules(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	schema.Active = s.active(scheduleNow())
+	w.Header().Set("Content-Type", "application/json")
+	if id == 0 {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(schema)
+}
+
+func removeSchedule(w http.ResponseWriter, r *http.Request, id int64) {
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	schema, err := scanSchedule(tx.QueryRow(selectScheduleStmt, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, scheduleNotFound(r))
+		return
+	} else if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if _, err := tx.Exec(deleteScheduleStmt, id); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := audit(r.Context(), tx, auditSchedules, schema.target(), true); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if err := loadSchedules(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	respondWithError(w, &APIError{Code: CodeOK, StatusCode: http.StatusOK, Message: localize(r, "Succesfully removed the schedule."), Status: "success"})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+const selectSettingStmt string = "SELECT value FROM settings WHERE name = ?"
+
+const updateSettingStmt string = "UPDATE settings SET value = ? WHERE name = ?"
+
+const insertSettingStmt string = "INSERT INTO settings(name, value) VALUES (?, ?)"
+
+// Names of the settings stored in the database.
+const settingObserve = "observe"
+
+// loadSetting decodes the stored setting into v, and reports whether it was
+// ever stored.
+func loadSetting(ctx context.Context, name string, v any) (bool, error) {
+	var value string
+	err := db.QueryRowContext(ctx, selectSettingStmt, name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal([]byte(value), v)
+}
+
+func saveSetting(ctx context.Context, name string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	result, err := db.ExecContext(ctx, updateSettingStmt, string(value), name)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows != 0 {
+		return nil
+	}
+	_, err = db.ExecContext(ctx, insertSettingStmt, name, string(value))
+	if isUniqueConstraintError(err) {
+		_, err = db.ExecContext(ctx, updateSettingStmt, string(value), name)
+	}
+	return err
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var socksAddress *string = flag.String("socks-address", "", "address for the SOCKS5 proxy (disabled if empty)")
+
+const socksHandshakeTimeout = 30 * time.Second
+
+const socksVersion byte = 5
+
+const (
+	socksMethodNoAuth       byte = 0x00
+	socksMethodNoAcceptable byte = 0xff
+)
+
+const socksCommandConnect byte = 1
+
+const (
+	socksAddressIPv4   byte = 1
+	socksAddressDomain byte = 3
+	socksAddressIPv6   byte = 4
+)
+
+const (
+	socksSucceeded               byte = 0
+	socksGeneralFailure          byte = 1
+	socksNotAllowed              byte = 2
+	socksNetworkUnreachable      byte = 3
+	socksHostUnreachable         byte = 4
+	socksConnectionRefused       byte = 5
+	socksCommandNotSupported     byte = 7
+	socksAddressTypeNotSupported byte = 8
+)
+
+var errSocksVersion = errors.New("unsupported SOCKS version")
+
+type socksServer struct {
+	dialer *outboundDialer
+}
+
+func newSocksServer(upstream *url.URL) *socksServer {
+	return &socksServer{dialer: newOutboundDialer(upstream)}
+}
+
+func (s *socksServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *socksServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	if err := s.negotiate(conn); err != nil {
+		return
+	}
+	host, port, reply, err := s.readRequest(conn)
+	if err != nil {
+		return
+	}
+	if reply != socksSucceeded {
+		s.reply(conn, reply, nil)
+		return
+	}
+
+	// The hostname is checked before it is resolved, so the blocklist
+	// applies even though the client never reveals the address to us.
+	if enforce(netAddr(conn.RemoteAddr()), host, viaSocks) {
+		s.reply(conn, socksNotAllowed, nil)
+		return
+	}
+
+	upstream, err := s.dialer.DialContext(context.Background(), "tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		s.reply(conn, socksDialError(err), nil)
+		return
+	}
+	defer upstream.Close()
+
+	if err := s.reply(conn, socksSucceeded, upstream.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	splice(conn, conn, upstream)
+}
+
+// negotiate picks the authentication method. Only "no authentication" is
+// supported.
+func (s *socksServer) negotiate(conn net.Conn) error {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return errSocksVersion
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	for _, method := range methods {
+		if method == socksMethodNoAuth {
+			_, err := conn.Write([]byte{socksVersion, socksMethodNoAuth})
+			return err
+		}
+	}
+	conn.Write([]byte{socksVersion, socksMethodNoAcceptable})
+	return errors.New("no acceptable authentication method")
+}
+
+// readRequest reads the CONNECT request. A reply code other than
+// socksSucceeded means the request was read but can't be served.
+func (s *socksServer) readRequest(conn net.Conn) (host string, port uint16, reply byte, err error) {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", 0, 0, err
+	}
+	if header[0] != socksVersion {
+		return "", 0, 0, errSocksVersion
+	}
+
+	switch header[3] {
+	case socksAddressIPv4, socksAddressIPv6:
+		addr := make([]byte, net.IPv4len)
+		if header[3] == socksAddressIPv6 {
+			addr = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", 0, 0, err
+		}
+		host = net.IP(addr).String()
+	case socksAddressDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return "", 0, 0, err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", 0, 0, err
+		}
+		host = string(name)
+	default:
+		return "", 0, socksAddressTypeNotSupported, nil
+	}
+	if err := binary.Read(conn, binary.BigEndian, &port); err != nil {
+		return "", 0, 0, err
+	}
+
+	if header[1] != socksCommandConnect {
+		return host, port, socksCommandNotSupported, nil
+	}
+	return host, port, socksSucceeded, nil
+}
+
+func (s *socksServer) reply(conn net.Conn, code byte, bound net.Addr) error {
+	msg := []byte{socksVersion, code, 0}
+	addr, ok := bound.(*net.TCPAddr)
+	if !ok {
+		addr = &net.TCPAddr{IP: net.IPv4zero}
+	}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		msg = append(msg, socksAddressIPv4)
+		msg = append(msg, ip4...)
+	} else {
+		msg = append(msg, socksAddressIPv6)
+		msg = append(msg, addr.IP.To16()...)
+	}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(addr.Port))
+	_, err := conn.Write(msg)
+	return err
+}
+
+func socksDialError(err error) byte {
+	var dnsErr *net.DNSError
+	var forbidden forbiddenDestinationError
+	switch {
+	case errors.As(err, &forbidden):
+		return socksNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetworkUnreachable
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH), os.IsTimeout(err):
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const insertSourceStmt string = "INSERT INTO blocklist_sources(url, update_interval, canary_until) VALUES (?, ?, ?)"
+
+const sourceIDStmt string = "SELECT id FROM blocklist_sources WHERE url = ?"
+
+const deleteSourceStmt string = "DELETE FROM blocklist_sources WHERE id = ?"
+
+const listSourcesStmt string = "SELECT id, url, update_interval, last_updated, last_error, canary_until FROM blocklist_sources ORDER BY id LIMIT ? OFFSET ?"
+
+const countSourcesStmt string = "SELECT COUNT(*) FROM blocklist_sources"
+
+const dueSourcesStmt string = "SELECT id, url, update_interval, canary_until FROM blocklist_sources WHERE next_update <= ?"
+
+const sourceUpdatedStmt string = "UPDATE blocklist_sources SET last_updated = ?, last_error = '', next_update = ? WHERE id = ?"
+
+// Longest error kept in last_error, which fits a VARCHAR(255) of MySQL.
+const maxErrorLength = 255
+
+const sourceFailedStmt string = "UPDATE blocklist_sources SET last_error = ?, next_update = ? WHERE id = ?"
+
+const sourceEntriesStmt string = "SELECT domain_name, mode FROM feed_domains WHERE source = ?"
+
+// The rows of applySource are appended with valuesList.
+const insertSourcedRowsStmt string = "INSERT INTO feed_domains(domain_name, mode, source) VALUES "
+
+// The names of applySource are appended as an IN list.
+const deleteSourcedStmt string = "DELETE FROM feed_domains WHERE source = ? AND domain_name IN "
+
+const selectSourcedNamesStmt string = "SELECT domain_name FROM feed_domains WHERE domain_name IN "
+
+const (
+	defaultSourceInterval = 24 * time.Hour
+	minSourceInterval     = 5 * time.Minute
+	sourceCheckInterval   = time.Minute
+	sourceFetchTimeout    = 5 * time.Minute
+)
+
+type SourceSchema struct {
+	ID          int64      `json:"id"`
+	URL         string     `json:"url"`
+	Interval    string     `json:"interval"`
+	LastUpdated *time.Time `json:"lastUpdated"`
+	LastError   string     `json:"lastError,omitempty"`
+	// Until when the entries of the source are only logged, if they are.
+	CanaryUntil *time.Time `json:"canaryUntil,omitempty"`
+}
+
+type SourcesSchema struct {
+	Sources []SourceSchema `json:"sources"`
+	Page
+}
+
+type NewSourceSchema struct {
+	URL      string `json:"url"`
+	Interval string `json:"interval"`
+	// Days the entries are only logged for before the source can be
+	// promoted to enforcing; 0 enforces them at once.
+	CanaryDays int `json:"canaryDays,omitempty"`
+}
+
+// sourcesChanged wakes the updater up when a source is added, so it
+// doesn't wait for the next check.
+var sourcesChanged = make(chan struct{}, 1)
+
+func sourcesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listSourcesHandler(w, r)
+	case http.MethodPost:
+		addSourceHandler(w, r)
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, POST"))
+	}
+}
+
+func listSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	page, apiErr := parsePage(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	schema := SourcesSchema{Sources: []SourceSchema{}, Page: page}
+	if err := tx.QueryRow(countSourcesStmt).Scan(&schema.Total); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	rows, err := tx.Query(listSourcesStmt, schema.Limit, schema.Offset)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var source SourceSchema
+		var interval int64
+		var lastUpdated, canaryUntil sql.NullInt64
+		if err := rows.Scan(&source.ID, &source.URL, &interval, &lastUpdated, &source.LastError, &canaryUntil); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		source.Interval = (time.Duration(interval) * time.Second).String()
+		if lastUpdated.Valid {
+			updated := time.Unix(lastUpdated.Int64, 0).UTC()
+			source.LastUpdated = &updated
+		}
+		if canaryUntil.Valid {
+			until := time.Unix(canaryUntil.Int64, 0).UTC()
+			source.CanaryUntil = &until
+		}
+		schema.Sources = append(schema.Sources, source)
+	}
+	if err := rows.Err(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	respondWithPage(w, r, &schema.Page, &schema)
+}
+
+func addSourceHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensureJSON(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	var body NewSourceSchema
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, &APIError{Code: CodeInvalidJSON, StatusCode: http.StatusBadRequest, Message: localize(r, "Excepted {\"url\", \"interval\"} object; got invalid JSON."), Status: "error"})
+		return
+	}
+	interval, apiErr := validateSource(r, body)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	schema := SourceSchema{URL: body.URL, Interval: interval.String()}
+	canaryUntil := sourceCanaryUntil(body.CanaryDays)
+	if canaryUntil.Valid {
+		until := time.Unix(canaryUntil.Int64, 0).UTC()
+		schema.CanaryUntil = &until
+	}
+
+	_, err := db.ExecContext(r.Context(), insertSourceStmt, body.URL, int64(interval/time.Second), canaryUntil)
+	if err != nil {
+		if isUniqueConstraintError(err) {
+			respondWithError(w, &APIError{Code: CodeSourceExists, Status: "error", StatusCode: http.StatusConflict, Message: localize(r, "Source \"%s\" already exists.", body.URL)})
+			return
+		}
+		respondWithInternalError(w, r, err)
+		return
+	}
+	// Not every driver reports the ID of the inserted row, so it is looked
+	// up by the URL.
+	if err := db.QueryRowContext(r.Context(), sourceIDStmt, body.URL).Scan(&schema.ID); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	select {
+	case sourcesChanged <- struct{}{}:
+	default:
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(schema)
+}
+
+// validateSource returns the update interval of the source, or the error
+// to respond with.
+func validateSource(r *http.Request, body NewSourceSchema) (time.Duration, *APIError) {
+	if u, err := url.Parse(body.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return 0, &APIError{Code: CodeInvalidSource, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "URL \"%s\" must be an http:// or https:// URL.", body.URL)}
+	}
+	interval := defaultSourceInterval
+	if body.Interval != "" {
+		parsed, err := time.ParseDuration(body.Interval)
+		if err != nil || parsed < minSourceInterval {
+			return 0, &APIError{Code: CodeInvalidSource, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Interval must be a duration of at least %s, got: \"%s\".", minSourceInterval, body.Interval)}
+		}
+		interval = parsed
+	}
+	if body.CanaryDays < 0 || body.CanaryDays > maxCanaryDays {
+		return 0, &APIError{Code: CodeInvalidSource, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Canary period must be 0 to %d days, got: %d.", maxCanaryDays, body.CanaryDays)}
+	}
+	return interval, nil
+}
+
+// sourceCanaryUntil is the end of a canary period of the days starting
+// now, or NULL for none.
+func sourceCanaryUntil(days int) sql.NullInt64 {
+	if days == 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: time.Now().UTC().Truncate(time.Second).AddDate(0, 0, days).Unix(), Valid: true}
+}
+
+// sourceHandler serves DELETE /sources/{id}, which removes the source with
+// all of its entries.
+func sourceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		respondWithError(w, unexceptedMethod(r, http.MethodDelete))
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, &APIError{Code: CodeSourceNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "Source \"%s\" doesn't exist.", r.PathValue("id"))})
+		return
+	}
+
+	tx, err := beginChange(r.Context())
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(deleteSourceStmt, id)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		respondWithError(w, &APIError{Code: CodeSourceNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "Source \"%s\" doesn't exist.", r.PathValue("id"))})
+		return
+	}
+	if _, _, err := applySource(tx, id, map[string]string{}); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	overrides, err := tx.Exec(deleteOverridesStmt, id)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	for _, stmt := range []string{deleteCanaryEntriesStmt, deleteCanaryHitsStmt} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	canaries.forget(id)
+	if err := canaries.load(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if rows, _ := overrides.RowsAffected(); rows != 0 {
+		if err := allowlist.load(); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+	}
+	respondWithError(w, &APIError{Code: CodeOK, StatusCode: http.StatusOK, Message: localize(r, "Succesfully removed the source with its domains."), Status: "success"})
+}
+
+// applySource makes the entries of the source match wanted, which maps
+// domains to their modes. Domains that are already blocked manually or by
+// another source are left to them. Feeds can list millions of names, so
+// the rows are changed in batches.
+func applySource(tx *changeTx, id int64, wanted map[string]string) (added int, removed int, err error) {
+	rows, err := tx.Query(sourceEntriesStmt, id)
+	if err != nil {
+		return 0, 0, err
+	}
+	stale := make([]DomainEntry, 0)
+	for rows.Next() {
+		var entry DomainEntry
+		if err := rows.Scan(&entry.Domain, &entry.Mode); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		if wanted[entry.Domain] == entry.Mode {
+			delete(wanted, entry.Domain)
+		} else {
+			stale = append(stale, entry)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	for start := 0; start < len(stale); start += insertBatchSize {
+		batch := stale[start:min(start+insertBatchSize, len(stale))]
+		args := make([]any, 0, len(batch)+1)
+		args = append(args, id)
+		for _, entry := range batch {
+			args = append(args, entry.Domain)
+		}
+		if _, err := tx.Exec(deleteSourcedStmt+valuesList(1, len(batch)), args...); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := tx.recordAll(stale, true); err != nil {
+		return 0, 0, err
+	}
+
+	names := make([]string, 0, len(wanted))
+	for name := range wanted {
+		names = append(names, name)
+	}
+	fresh := make([]DomainEntry, 0, len(wanted))
+	for start := 0; start < len(names); start += insertBatchSize {
+		batch := names[start:min(start+insertBatchSize, len(names))]
+		taken, err := takenNames(tx, batch)
+		if err != nil {
+			return 0, 0, err
+		}
+		args := make([]any, 0, len(batch)*3)
+		for _, name := range batch {
+			if !taken[name] {
+				fresh = append(fresh, DomainEntry{Domain: name, Mode: wanted[name]})
+				args = append(args, name, wanted[name], id)
+			}
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if _, err := tx.Exec(insertSourcedRowsStmt+valuesList(len(args)/3, 3), args...); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := tx.recordAll(fresh, false); err != nil {
+		return 0, 0, err
+	}
+	return len(fresh), len(stale), nil
+}
+
+// sourcedNames returns which of the names are entries of a source. Manual
+// entries can only be added for the other ones, as a name is either the
+// entry of a source or a manual one. The names are locked until the
+// transaction ends, so no source takes them meanwhile.
+func sourcedNames(tx *changeTx, names []string) (map[string]bool, error) {
+	if stmt := store.LockEntriesStmt(); stmt != "" {
+		if _, err := tx.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	sourced := make(map[string]bool)
+	for start := 0; start < len(names); start += insertBatchSize {
+		batch := names[start:min(start+insertBatchSize, len(names))]
+		args := make([]any, len(batch))
+		for i, name := range batch {
+			args[i] = name
+		}
+		rows, err := tx.Query(store.LockingRead(selectSourcedNamesStmt+valuesList(1, len(batch))), args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			sourced[name] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return sourced, nil
+}
+
+// takenNames returns which of the names are manual entries or entries of
+// a source, which applySource leaves to them. Like sourcedNames, it locks
+// the names.
+func takenNames(tx *changeTx, names []string) (map[string]bool, error) {
+	taken, err := sourcedNames(tx, names)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]any, len(names))
+	for i, name := range names {
+		args[i] = name
+	}
+	rows, err := tx.Query(store.LockingRead(selectExistingEntriesStmt+valuesList(1, len(names))), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		taken[name] = true
+	}
+	return taken, rows.Err()
+}
+
+// fetchSource downloads the list and parses it like /domains/import,
+// skipping unsupported lines.
+func fetchSource(ctx context.Context, client *http.Client, sourceURL string) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server responded with %s", resp.Status)
+	}
+
+	wanted := make(map[string]string)
+	err = scanListLines(resp.Body, func(line string, complete bool) {
+		if !complete {
+			return
+		}
+		entries, _, _ := parseImportLine(line)
+		for _, entry := range entries {
+			wanted[entry.Domain] = entry.Mode
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(wanted) == 0 {
+		return nil, errors.New("list contains no domains")
+	}
+	return wanted, nil
+}
+
+// syncSource fetches the source and applies its entries, or stores them
+// if the source is in its canary period.
+func syncSource(ctx context.Context, client *http.Client, id int64, sourceURL string, canary bool) error {
+	wanted, err := fetchSource(ctx, client, sourceURL)
+	if err != nil {
+		return err
+	}
+	if canary {
+		if err := storeCanary(ctx, id, wanted); err != nil {
+			return err
+		}
+		slog.Info("Canary source synced", "source", sourceURL, "entries", len(wanted))
+		return nil
+	}
+	tx, err := beginChange(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	added, removed, err := applySource(tx, id, wanted)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.Info("Source synced", "source", sourceURL, "added", added, "removed", removed)
+	events.publish(Event{Type: EventFeedRefreshed, Source: sourceURL, Added: added, Removed: removed})
+	return nil
+}
+
+// updateSources syncs the sources that are due. A failed sync is retried
+// after the regular interval; its error is kept for GET /sources.
+func updateSources(ctx context.Context, client *http.Client) error {
+	rows, err := db.QueryContext(ctx, dueSourcesStmt, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	type dueSource struct {
+		id       int64
+		url      string
+		interval int64
+		canary   sql.NullInt64
+	}
+	due := make([]dueSource, 0)
+	for rows.Next() {
+		var source dueSource
+		if err := rows.Scan(&source.id, &source.url, &source.interval, &source.canary); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, source)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, source := range due {
+		now := time.Now().Unix()
+		if err := syncSource(ctx, client, source.id, source.url, source.canary.Valid); err != nil {
+			slog.Warn("Sync of source failed", "source", source.url, "error", err)
+			_, err = db.ExecContext(ctx, sourceFailedStmt, truncateText(err.Error(), maxErrorLength), now+source.interval, source.id)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := db.ExecContext(ctx, sourceUpdatedStmt, now, now+source.interval, source.id); err != nil {
+			return err
+		}
+		if source.canary.Valid && now >= source.canary.Int64 {
+			// Reminds of the source on every sync until it is promoted.
+			report, err := canaryReport(ctx, source.id, time.Unix(now, 0))
+			if err != nil {
+				return err
+			}
+			slog.Warn("Canary period of source ended; promote it to enforce its entries", "source", source.url, "entries", report.Entries, "domains", report.Domains, "hits", report.Hits)
+		}
+	}
+	return nil
+}
+
+// runSourceUpdater keeps the sources up to date until ctx is done.
+func runSourceUpdater(ctx context.Context, client *http.Client) {
+	ticker := time.NewTicker(sourceCheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := updateSources(ctx, client); err != nil && ctx.Err() == nil {
+			slog.Error("Updating of the sources failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-sourcesChanged:
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"flag"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var statsRetention *time.Duration = flag.Duration("stats-retention", 7*24*time.Hour, "how long the statistics of the decisions are kept (none are recorded if 0)")
+
+const addQueryStatsStmt string = "UPDATE query_stats SET hits = hits + ? WHERE bucket = ? AND domain_name = ? AND client = ? AND via = ? AND blocked = ?"
+
+const insertQueryStatsStmt string = "INSERT INTO query_stats(bucket, domain_name, client, via, blocked, hits) VALUES (?, ?, ?, ?, ?, ?)"
+
+const pruneQueryStatsStmt string = "DELETE FROM query_stats WHERE bucket < ?"
+
+const statsFilter string = " WHERE bucket >= ? AND bucket < ? AND (? = '' OR client = ?) AND (? = '' OR via = ?)"
+
+const statsSummaryStmt string = "SELECT COALESCE(SUM(hits), 0), COALESCE(SUM(CASE WHEN blocked = 1 THEN hits ELSE 0 END), 0), COUNT(DISTINCT client), COUNT(DISTINCT domain_name) FROM query_stats" + statsFilter
+
+const topBlockedStmt string = "SELECT domain_name, SUM(hits) AS total, COUNT(DISTINCT client) FROM query_stats" + statsFilter + " AND blocked = 1 GROUP BY domain_name ORDER BY total DESC, domain_name LIMIT ?"
+
+const statsTimelineStmt string = "SELECT bucket - bucket % ?, SUM(CASE WHEN blocked = 1 THEN hits ELSE 0 END), SUM(CASE WHEN blocked = 0 THEN hits ELSE 0 END) FROM query_stats" + statsFilter + " GROUP BY 1 ORDER BY 1"
+
+const (
+	statsBucket        = time.Minute
+	statsFlushInterval = 10 * time.Second
+	statsPruneInterval = time.Hour
+	// Events the recorder may fall behind by before it misses some.
+	statsBuffer = 4096
+	// Counts the recorder keeps between flushes before it misses new ones,
+	// so a database down for long doesn't grow them without bound.
+	maxPendingStats = 100000
+	// Range the endpoints cover without ?since.
+	defaultStatsRange       = 24 * time.Hour
+	defaultTopBlocked       = 10
+	maxTopBlocked           = 100
+	defaultTimelineInterval = time.Hour
+	maxTimelinePoints       = 1440
+)
+
+type StatsSummarySchema struct {
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	Queries int64     `json:"queries"`
+	Blocked int64     `json:"blocked"`
+	Allowed int64     `json:"allowed"`
+	// Share of the queries blocked, from 0 to 1.
+	BlockedRatio float64 `json:"blockedRatio"`
+	Clients      int64   `json:"clients"`
+	Domains      int64   `json:"domains"`
+}
+
+type TopBlockedDomainSchema struct {
+	Domain  string `json:"domain"`
+	Hits    int64  `json:"hits"`
+	Clients int64  `json:"clients"`
+}
+
+type TopBlockedSchema struct {
+	Since   time.Time                `json:"since"`
+	Until   time.Time                `json:"until"`
+	Domains []TopBlockedDomainSchema `json:"domains"`
+}
+
+type TimelinePointSchema struct {
+	Time    time.Time `json:"time"`
+	Blocked int64     `json:"blocked"`
+	Allowed int64     `json:"allowed"`
+}
+
+type TimelineSchema struct {
+	Since    time.Time             `json:"since"`
+	Until    time.Time             `json:"until"`
+	Interval string                `json:"interval"`
+	Points   []TimelinePointSchema `json:"points"`
+}
+
+type statsKey struct {
+	bucket  int64
+	domain  string
+	client  string
+	via     string
+	blocked bool
+}
+
+// statsRecorder counts the decisions published on the bus in memory, like
+// keyUsageTracker.
+type statsRecorder struct {
+	mu      sync.Mutex
+	pending map[statsKey]int64
+	// Monitored blocks, counted as allowed in pending too.
+	monitored map[statsKey]int64
+}
+
+var queryStats = &statsRecorder{pending: make(map[statsKey]int64), monitored: make(map[statsKey]int64)}
+
+// Decisions the recorder missed for holding maxPendingStats counts already,
+// published at /debug/vars.
+var missedStats = expvar.NewInt("missedStats")
+
+func (s *statsRecorder) record(e Event) {
+	blocked := e.Type == EventBlockEnforced || e.Blocked
+	key := statsKey{bucket: e.Time.Truncate(statsBucket).Unix(), domain: e.Domain, client: e.Client, via: e.Via, blocked: blocked}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.add(s.pending, key, 1) {
+		return
+	}
+	if e.Type == EventBlockMonitored {
+		s.add(s.monitored, key, 1)
+	}
+}
+
+// add adds the hits to the count of the key, unless the counts are full and
+// the key isn't counted yet. It reports whether the hits were added.
+func (s *statsRecorder) add(counts map[statsKey]int64, key statsKey, hits int64) bool {
+	if _, ok := counts[key]; !ok && len(counts) >= maxPendingStats {
+		missedStats.Add(hits)
+		return false
+	}
+	counts[key] += hits
+	return true
+}
+
+// flush adds the decisions counted since the last flush to the database in
+// one transaction, so it costs a single sync however many keys there are.
+// If it fails, they are all kept for the next one.
+func (s *statsRecorder) flush(ctx context.Context) error {
+	s.mu.Lock()
+	pending, monitored := s.pending, s.monitored
+	s.pending, s.monitored = make(map[statsKey]int64), make(map[statsKey]int64)
+	s.mu.Unlock()
+	if len(pending) == 0 && len(monitored) == 0 {
+		return nil
+	}
+
+	err := writeStats(ctx, pending, monitored)
+	if err != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for key, hits := range pending {
+			s.add(s.pending, key, hits)
+		}
+		for key, hits := range monitored {
+			s.add(s.monitored, key, hits)
+		}
+	}
+	return err
+}
+
+func writeStats(ctx context.Context, pending, monitored map[statsKey]int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for key, hits := range pending {
+		if err := addQueryStats(tx, key, hits); err != nil {
+			return err
+		}
+	}
+	for key, hits := range monitored {
+		if err := addMonitoredStats(tx, key, hits); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func addQueryStats(tx *sql.Tx, key statsKey, hits int64) error {
+	blocked := 0
+	if key.blocked {
+		blocked = 1
+	}
+	client, err := sealField(FieldClientAddr, key.client)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(addQueryStatsStmt, hits, key.bucket, key.domain, client, key.via, blocked)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows != 0 {
+		return nil
+	}
+	_, err = tx.Exec(insertQueryStatsStmt, key.bucket, key.domain, client, key.via, blocked, hits)
+	if isUniqueConstraintError(err) {
+		// Another instance sharing the database inserted it meanwhile.
+		_, err = tx.Exec(addQueryStatsStmt, hits, key.bucket, key.domain, client, key.via, blocked)
+	}
+	return err
+}
+
+// run records the decisions published until the context is done, unless
+// -stats-retention is 0. Monitored blocks count as allowed, as they were
+// forwarded, and are kept apart for the projected impact.
+func (s *statsRecorder) run(ctx context.Context) {
+	if *statsRetention <= 0 {
+		return
+	}
+	decisions := events.subscribe(statsBuffer, EventBlockEnforced, EventBlockMonitored, EventQueryAllowed, EventDomainChecked)
+	defer decisions.close()
+	ticker := time.NewTicker(statsFlushInterval)
+	defer ticker.Stop()
+	var pruned time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-decisions.C:
+			s.record(e)
+			continue
+		case <-ticker.C:
+		}
+		if err := s.flush(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("Writing of the statistics failed", "error", err)
+		}
+		if time.Since(pruned) < statsPruneInterval {
+			continue
+		}
+		pruned = time.Now()
+		for _, prune := range []string{pruneQueryStatsStmt, pruneMonitoredStatsStmt} {
+			if _, err := db.ExecContext(ctx, prune, pruned.Add(-*statsRetention).Unix()); err != nil && ctx.Err() == nil {
+				slog.Warn("Pruning of the statistics failed", "error", err)
+			}
+		}
+	}
+}
+
+// publishCheck publishes the decision of a check of the API for the client
+// sending it.
+func publishCheck(r *http.Request, name string, blocked bool) {
+	client, _ := r.Context().Value(clientAddrKey{}).(netip.Addr)
+	events.publish(Event{Type: EventDomainChecked, Domain: name, Via: viaCheck, Client: client.String(), Blocked: blocked})
+}
+
+type statsQuery struct {
+	since  time.Time
+	until  time.Time
+	client string
+	via    string
+}
+
+func (q statsQuery) args() []any {
+	return []any{q.since.Unix(), q.until.Unix(), q.client, q.client, q.via, q.via}
+}
+
+// parseStatsQuery reads the range and the filters the endpoints share:
+// ?since and ?until, the last day by default, ?client and ?via.
+func parseStatsQuery(r *http.Request) (statsQuery, *APIError) {
+	var q statsQuery
+	var apiErr *APIError
+	if q.until, apiErr = queryTime(r, "until", time.Now()); apiErr != nil {
+		return q, apiErr
+	}
+	if q.since, apiErr = queryTime(r, "since", q.until.Add(-defaultStatsRange)); apiErr != nil {
+		return q, apiErr
+	}
+	q.since, q.until = q.since.UTC().Truncate(time.Second), q.until.UTC().Truncate(time.Second)
+	if !q.since.Before(q.until) {
+		return q, &APIError{Code: CodeInvalidParameter, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Parameter \"%s\" must be before \"%s\".", "since", "until")}
+	}
+	if client := r.URL.Query().Get("client"); client != "" {
+		addr, err := netip.ParseAddr(client)
+		if err != nil {
+			return q, &APIError{Code: CodeInvalidParameter, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Parameter \"%s\" must be an IP address, got: \"%s\".", "client", client)}
+		}
+		// Stored addresses are sealed the same way every time, so the
+		// sealed one is looked for.
+		if q.client, err = sealField(FieldClientAddr, addr.Unmap().String()); err != nil {
+			requestLogger(r).Error("Request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+			return q, internalError(r)
+		}
+	}
+	q.via = r.URL.Query().Get("via")
+	return q, nil
+}
+
+// statsSummaryHandler serves GET /stats/summary.
+func statsSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	q, apiErr := parseStatsQuery(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	schema := StatsSummarySchema{Since: q.since, Until: q.until}
+	if err := db.QueryRowContext(r.Context(), statsSummaryStmt, q.args()...).Scan(&schema.Queries, &schema.Blocked, &schema.Clients, &schema.Domains); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	schema.Allowed = schema.Queries - schema.Blocked
+	if schema.Queries != 0 {
+		schema.BlockedRatio = float64(schema.Blocked) / float64(schema.Queries)
+	}
+	respondWithJSON(w, schema)
+}
+
+// queryTopLimit reads ?limit of the names listed the most.
+func queryTopLimit(r *http.Request) (int, *APIError) {
+	param := r.URL.Query().Get("limit")
+	if param == "" {
+		return defaultTopBlocked, nil
+	}
+	value, err := strconv.Atoi(param)
+	if err != nil || value < 1 || value > maxTopBlocked {
+		return 0, &APIError{Code: CodeInvalidParameter, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Parameter \"%s\" must be an integer from %d to %d, got: \"%s\".", "limit", 1, maxTopBlocked, param)}
+	}
+	return value, nil
+}
+
+// topBlockedHandler serves GET /stats/top-blocked, the names blocked the
+// most, up to ?limit.
+func topBlockedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	q, apiErr := parseStatsQuery(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	limit, apiErr := queryTopLimit(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), topBlockedStmt, append(q.args(), limit)...)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	schema := TopBlockedSchema{Since: q.since, Until: q.until, Domains: make([]TopBlockedDomainSchema, 0)}
+	for rows.Next() {
+		var domain TopBlockedDomainSchema
+		if err := rows.Scan(&domain.Domain, &domain.Hits, &domain.Clients); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		schema.Domains = append(schema.Domains, domain)
+	}
+	if err := rows.Err(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	respondWithJSON(w, schema)
+}
+
+// statsTimelineHandler serves GET /stats/timeline, the decisions in every
+// ?interval of the range, including the empty ones.
+func statsTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	q, apiErr := parseStatsQuery(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	interval := defaultTimelineInterval
+	if param := r.URL.Query().Get("interval"); param != "" {
+		value, err := time.ParseDuration(param)
+		if err != nil || value < statsBucket || value%statsBucket != 0 {
+			respondWithError(w, &APIError{Code: CodeInvalidParameter, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Parameter \"%s\" must be a whole number of minutes, got: \"%s\".", "interval", param)})
+			return
+		}
+		interval = value
+	}
+	// Points start at multiples of the interval since the epoch, so the
+	// same range is split the same way on every call.
+	first := q.since.Truncate(interval)
+	if points := q.until.Sub(first) / interval; points >= maxTimelinePoints {
+		respondWithError(w, &APIError{Code: CodeInvalidParameter, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "Range covers %d intervals; at most %d are allowed.", points+1, maxTimelinePoints)})
+		return
+	}
+	step := int64(interval / time.Second)
+	counts := make(map[int64]TimelinePointSchema)
+	rows, err := db.QueryContext(r.Context(), statsTimelineStmt, append([]any{step}, q.args()...)...)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var start int64
+		var point TimelinePointSchema
+		if err := rows.Scan(&start, &point.Blocked, &point.Allowed); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		counts[start] = point
+	}
+	if err := rows.Err(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	schema := TimelineSchema{Since: q.since, Until: q.until, Interval: interval.String(), Points: make([]TimelinePointSchema, 0)}
+	for t := first; t.Before(q.until); t = t.Add(interval) {
+		point := counts[t.Unix()]
+		point.Time = t
+		schema.Points = append(schema.Points, point)
+	}
+	respondWithJSON(w, schema)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Store hides the differences between the database backends. The
+// statements of the service are written for SQLite with ? placeholders and
+// only use SQL the other backends share; the table definitions are
+// translated by Schema.
+type Store interface {
+	// Driver is the name the database/sql driver is registered under.
+	Driver() string
+	// Schema translates a table or column definition to the backend.
+	Schema(stmt string) string
+	// ColumnExistsStmt counts the columns named by the second argument in
+	// the table named by the first one.
+	ColumnExistsStmt() string
+	IsUniqueViolation(err error) bool
+	// InsertNewStmt turns an INSERT into one that skips the rows
+	// conflicting with a unique column and returns the column of the rows
+	// it inserts, or returns "" if the backend can't.
+	InsertNewStmt(insert string, column string) string
+	// InsertIDStmt turns an INSERT of a row into one returning its id
+	// column, or returns "" if the backend can't, whose driver reports the
+	// ID instead.
+	InsertIDStmt(insert string) string
+	// LockEntriesStmt returns the statement keeping other transactions
+	// from adding entries until the transaction ends, or "" if the backend
+	// needs none. A name is in either blocked_domains or feed_domains,
+	// which the transactions adding it check first.
+	LockEntriesStmt() string
+	// LockingRead turns a SELECT into one reading the latest rows and
+	// keeping other transactions from inserting the rows it would have read
+	// until the transaction ends, if LockEntriesStmt doesn't.
+	LockingRead(query string) string
+}
+
+const (
+	backendSQLite   = "sqlite"
+	backendPostgres = "postgres"
+	backendMySQL    = "mysql"
+)
+
+var store Store = sqliteStore{}
+
+// Bulk inserts write this many rows per statement, which keeps them below
+// the limit on parameters of every backend.
+const insertBatchSize = 500
+
+// valuesList returns the VALUES of a multi-row INSERT, like "(?, ?), (?, ?)".
+func valuesList(rows, columns int) string {
+	row := "(" + strings.Repeat("?, ", columns-1) + "?)"
+	return strings.Repeat(row+", ", rows-1) + row
+}
+
+// insertID inserts a row with the statement and returns its ID, for tables
+// without another unique column to look the row up by.
+func insertID(tx *sql.Tx, insert string, args ...any) (int64, error) {
+	var id int64
+	if stmt := store.InsertIDStmt(insert); stmt != "" {
+		err := tx.QueryRow(stmt, args...).Scan(&id)
+		return id, err
+	}
+	result, err := tx.Exec(insert, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func newStore(backend string) (Store, error) {
+	switch backend {
+	case backendSQLite:
+		return sqliteStore{}, nil
+	case backendPostgres:
+		return postgresStore{}, nil
+	case backendMySQL:
+		return mysqlStore{}, nil
+	}
+	return nil, fmt.Errorf("backend \"%s\" isn't supported; excepted %s, %s or %s", backend, backendSQLite, backendPostgres, backendMySQL)
+}
+
+type sqliteStore struct{}
+
+func (sqliteStore) Driver() string { return "sqlite3" }
+
+func (sqliteStore) Schema(stmt string) string { return stmt }
+
+func (sqliteStore) InsertNewStmt(insert string, column string) string {
+	return insert + " ON CONFLICT DO NOTHING RETURNING " + column
+}
+
+// Transactions of SQLite are serializable, so the one that checked a name
+// another one added meanwhile fails to write.
+func (sqliteStore) LockEntriesStmt() string { return "" }
+
+func (sqliteStore) LockingRead(query string) string { return query }
+
+func (sqliteStore) InsertIDStmt(insert string) string { return insert + " RETURNING id" }
+
+func (sqliteStore) ColumnExistsStmt() string {
+	return "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+}
+
+func (sqliteStore) IsUniqueViolation(err error) bool {
+	var sqliteError sqlite3.Error
+	if !errors.As(err, &sqliteError) {
+		return false
+	}
+	return errors.Is(sqliteError.ExtendedCode, sqlite3.ErrConstraintUnique)
+}
+
+type postgresStore struct{}
+
+var postgresSchema = strings.NewReplacer(
+	"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+	"INTEGER", "BIGINT",
+	"LONGTEXT", "TEXT",
+)
+
+func (postgresStore) Driver() string { return postgresDriver }
+
+func (postgresStore) Schema(stmt string) string { return postgresSchema.Replace(stmt) }
+
+func (postgresStore) InsertNewStmt(insert string, column string) string {
+	return insert + " ON CONFLICT DO NOTHING RETURNING " + column
+}
+
+// The rows of a name that isn't there yet can't be locked, so the tables
+// are. The lock conflicts with itself and with writing, but not with
+// reading.
+func (postgresStore) LockEntriesStmt() string {
+	return "LOCK TABLE blocked_domains, feed_domains IN SHARE ROW EXCLUSIVE MODE"
+}
+
+func (postgresStore) LockingRead(query string) string { return query }
+
+// lib/pq doesn't implement LastInsertId.
+func (postgresStore) InsertIDStmt(insert string) string { return insert + " RETURNING id" }
+
+func (postgresStore) ColumnExistsStmt() string {
+	return "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?"
+}
+
+func (postgresStore) IsUniqueViolation(err error) bool {
+	var pqError *pq.Error
+	return errors.As(err, &pqError) && pqError.Code == "23505"
+}
+
+// MySQL can't index TEXT columns or give them a default, so every text
+// column becomes a VARCHAR long enough for any domain name. Longer source
+// URLs are rejected by the database. LONGTEXT columns, which SQLite takes
+// as TEXT, hold documents and are neither indexed nor defaulted.
+type mysqlStore struct{}
+
+var mysqlSchema = strings.NewReplacer(
+	"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGINT AUTO_INCREMENT PRIMARY KEY",
+	"INTEGER", "BIGINT",
+	"LONGTEXT", "MEDIUMTEXT",
+	"TEXT", "VARCHAR(255)",
+)
+
+func (mysqlStore) Driver() string { return "mysql" }
+
+func (mysqlStore) Schema(stmt string) string { return mysqlSchema.Replace(stmt) }
+
+// MySQL has no RETURNING, so the rows that would conflict are looked up
+// before inserting.
+func (mysqlStore) InsertNewStmt(insert string, column string) string { return "" }
+
+// LOCK TABLES would commit the transaction, but InnoDB locks the gaps of
+// the unique index a locking read finds no rows in, and one of two
+// transactions adding the name to different tables fails with a deadlock.
+func (mysqlStore) LockEntriesStmt() string { return "" }
+
+func (mysqlStore) LockingRead(query string) string { return query + " FOR UPDATE" }
+
+func (mysqlStore) InsertIDStmt(insert string) string { return "" }
+
+func (mysqlStore) ColumnExistsStmt() string {
+	return "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?"
+}
+
+func (mysqlStore) IsUniqueViolation(err error) bool {
+	var mysqlError *mysql.MySQLError
+	return errors.As(err, &mysqlError) && mysqlError.Number == 1062
+}
+
+// truncateText shortens a text to at most n bytes, without splitting a
+// character, so it fits the narrowest text column of all backends.
+func truncateText(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !isRuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+const postgresDriver string = "postgres-rebind"
+
+func init() {
+	sql.Register(postgresDriver, rebindDriver{})
+}
+
+// rebindDriver adapts PostgreSQL to the statements of the service: it
+// rewrites the ? placeholders to $1, $2 and so on, and runs every statement
+// of a transaction under a savepoint. A failed statement aborts the whole
+// transaction in PostgreSQL, while the handlers expect to go on after a
+// unique violation, as they do with SQLite.
+type rebindDriver struct{}
+
+func (rebindDriver) Open(name string) (driver.Conn, error) {
+	conn, err := pq.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &rebindConn{Conn: conn}, nil
+}
+
+type rebindConn struct {
+	driver.Conn
+	inTx bool
+}
+
+func (c *rebindConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *rebindConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, rebind(query))
+	if err != nil {
+		return nil, err
+	}
+	return &rebindStmt{Stmt: stmt, conn: c}, nil
+}
+
+func (c *rebindConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	tx, err := c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.inTx = true
+	return &rebindTx{Tx: tx, conn: c}, nil
+}
+
+func (c *rebindConn) exec(ctx context.Context, query string) error {
+	_, err := c.Conn.(driver.ExecerContext).ExecContext(ctx, query, nil)
+	return err
+}
+
+type rebindTx struct {
+	driver.Tx
+	conn *rebindConn
+}
+
+func (tx *rebindTx) Commit() error {
+	tx.conn.inTx = false
+	return tx.Tx.Commit()
+}
+
+func (tx *rebindTx) Rollback() error {
+	tx.conn.inTx = false
+	return tx.Tx.Rollback()
+}
+
+type rebindStmt struct {
+	driver.Stmt
+	conn *rebindConn
+}
+
+func (s *rebindStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	exec := s.Stmt.(driver.StmtExecContext)
+	if !s.conn.inTx {
+		return exec.ExecContext(ctx, args)
+	}
+	if err := s.conn.exec(ctx, "SAVEPOINT statement"); err != nil {
+		return nil, err
+	}
+	result, err := exec.ExecContext(ctx, args)
+	if err != nil {
+		if rollbackErr := s.conn.exec(ctx, "ROLLBACK TO SAVEPOINT statement"); rollbackErr != nil {
+			return nil, rollbackErr
+		}
+		return nil, err
+	}
+	if err := s.conn.exec(ctx, "RELEASE SAVEPOINT statement"); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *rebindStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+}
+
+// rebind numbers the ? placeholders of a query, leaving string literals and
+// quoted identifiers alone.
+func rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
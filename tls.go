@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var tlsCert *string = flag.String("tls-cert", "", "path to the PEM certificate the API is served with (plain HTTP if empty)")
+
+var tlsKey *string = flag.String("tls-key", "", "path to the PEM private key of -tls-cert")
+
+var acmeDomains *string = flag.String("acme-domains", "", "comma-separated names the API obtains certificates for from Let's Encrypt instead of -tls-cert; the API must be reachable on port 443 under them")
+
+var acmeCache *string = flag.String("acme-cache", "database/acme", "directory keeping the certificates obtained from Let's Encrypt")
+
+var acmeEmail *string = flag.String("acme-email", "", "contact address given to Let's Encrypt")
+
+var tlsClientCA *string = flag.String("tls-client-ca", "", "path to PEM certificates of the CAs whose client certificates the management endpoints require (not required if empty)")
+
+// newAPITLSConfig returns the TLS configuration of the API, or nil if the
+// API is served over plain HTTP.
+func newAPITLSConfig() (*tls.Config, error) {
+	var config *tls.Config
+	switch {
+	case *acmeDomains != "" && (*tlsCert != "" || *tlsKey != ""):
+		return nil, errors.New("-acme-domains can't be combined with -tls-cert and -tls-key")
+	case *acmeDomains != "":
+		domains := make([]string, 0)
+		for _, domain := range strings.Split(*acmeDomains, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				domains = append(domains, domain)
+			}
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(*acmeCache),
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Email:      *acmeEmail,
+		}
+		config = manager.TLSConfig()
+	case *tlsCert != "" || *tlsKey != "":
+		if *tlsCert == "" || *tlsKey == "" {
+			return nil, errors.New("-tls-cert and -tls-key must be given together")
+		}
+		certificate, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		config = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	}
+
+	if *tlsClientCA == "" {
+		return config, nil
+	}
+	if config == nil {
+		return nil, errors.New("-tls-client-ca requires -tls-cert or -acme-domains")
+	}
+	data, err := os.ReadFile(*tlsClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s contains no PEM certificates", *tlsClientCA)
+	}
+	// The certificate is verified if given, and withClientCert requires it
+	// wherever a key would be required, so probes can still connect.
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	config.ClientCAs = pool
+	return config, nil
+}
+
+// withClientCert requires a verified client certificate, except on the
+// paths served without a key.
+func withClientCert(public bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verified := r.TLS != nil && len(r.TLS.VerifiedChains) != 0
+		if verified || unauthenticatedPaths[r.URL.Path] || (public && isPublicCheck(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		respondWithError(w, &APIError{
+			Code:       CodeUnauthorized,
+			Status:     "error",
+			StatusCode: http.StatusUnauthorized,
+			Message:    localize(r, "Excepted a client certificate signed by a trusted CA."),
+		})
+	})
+}
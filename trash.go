@@ -0,0 +1,248 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const trashStmt string = "INSERT INTO deleted_domains(domain_name, mode, deleted_at, deleted_by) VALUES (?, ?, ?, ?)"
+
+const lookupTrashStmt string = "SELECT mode FROM deleted_domains WHERE domain_name = ?"
+
+const purgeStmt string = "DELETE FROM deleted_domains WHERE domain_name = ?"
+
+const trashFilter string = " WHERE (? = '' OR deleted_by = ?) AND deleted_at >= ? AND deleted_at <= ?"
+
+const countTrashStmt string = "SELECT COUNT(*) FROM deleted_domains" + trashFilter
+
+const listTrashStmt string = "SELECT domain_name, mode, deleted_at, deleted_by FROM deleted_domains" + trashFilter + " ORDER BY deleted_at DESC, domain_name LIMIT ? OFFSET ?"
+
+type TrashEntrySchema struct {
+	Domain    string    `json:"domain"`
+	Mode      string    `json:"mode"`
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy,omitempty"`
+}
+
+type TrashSchema struct {
+	Domains []TrashEntrySchema `json:"domains"`
+	Page
+}
+
+// trashHandler serves GET /domains/trash, filtered by the name of the API
+// key that deleted the domains and by the time of the deletion, and
+// DELETE /domains/trash, which purges the listed domains for good.
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listTrashHandler(w, r)
+	case http.MethodDelete:
+		names, ok := decodeNames(w, r)
+		if !ok {
+			return
+		}
+		purgeDomains(w, r, names)
+	default:
+		respondWithError(w, unexceptedMethod(r, "GET, DELETE"))
+	}
+}
+
+// decodeNames reads an array of domains from a JSON body and normalizes
+// them. It responds with the error itself.
+func decodeNames(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	if err := ensureJSON(r); err != nil {
+		respondWithError(w, err)
+		return nil, false
+	}
+	var names []string
+	if err := json.NewDecoder(r.Body).Decode(&names); err != nil {
+		respondWithError(w, localized(r, InvalidJSON))
+		return nil, false
+	}
+	if len(names) == 0 {
+		respondWithError(w, &APIError{Code: CodeNoDomains, Status: "error", StatusCode: http.StatusBadRequest, Message: localize(r, "No domains provided.")})
+		return nil, false
+	}
+	invalid := make([]APIError, 0)
+	for index, name := range names {
+		normalized, err := normalizeDomain(name)
+		if err != nil {
+			invalid = append(invalid, *invalidDomain(r, err, "Domain \"%s\" (%d in the array) is invalid: %v.", name, index, err))
+		}
+		names[index] = normalized
+	}
+	if len(invalid) != 0 {
+		respondWithError(w, invalidDomains(r, invalid))
+		return nil, false
+	}
+	return names, true
+}
+
+func listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	page, apiErr := parsePage(r)
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	since, apiErr := queryTime(r, "since", time.Unix(0, 0))
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	until, apiErr := queryTime(r, "until", time.Now())
+	if apiErr != nil {
+		respondWithError(w, apiErr)
+		return
+	}
+	deleter := r.URL.Query().Get("deleter")
+
+	tx, err := db.BeginTx(r.Context(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	schema := TrashSchema{Domains: []TrashEntrySchema{}, Page: page}
+	if err := tx.QueryRow(countTrashStmt, deleter, deleter, since.Unix(), until.Unix()).Scan(&schema.Total); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	rows, err := tx.Query(listTrashStmt, deleter, deleter, since.Unix(), until.Unix(), schema.Limit, schema.Offset)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry TrashEntrySchema
+		var deletedAt int64
+		if err := rows.Scan(&entry.Domain, &entry.Mode, &deletedAt, &entry.DeletedBy); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		entry.DeletedAt = time.Unix(deletedAt, 0).UTC()
+		schema.Domains = append(schema.Domains, entry)
+	}
+	if err := rows.Err(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+
+	respondWithPage(w, r, &schema.Page, &schema)
+}
+
+// restoreHandler serves POST /domains/trash/restore, which adds the listed
+// domains back to the blocklist with the mode they had.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensurePOST(r); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	names, ok := decodeNames(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := beginChange(r.Context())
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	sourced, err := sourcedNames(tx, names)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	errs := make([]APIError, 0)
+	for index, name := range names {
+		entry := DomainEntry{Domain: name}
+		err := tx.QueryRow(lookupTrashStmt, name).Scan(&entry.Mode)
+		if errors.Is(err, sql.ErrNoRows) {
+			errs = append(errs, APIError{
+				Code:       CodeDomainNotFound,
+				Status:     "error",
+				StatusCode: http.StatusNotFound,
+				Message:    localize(r, "Domain \"%s\" (%d in the array) isn't in the trash.", name, index),
+			})
+			continue
+		}
+		if err == nil && !sourced[name] {
+			_, err = tx.Exec(insertStmt, entry.Domain, entry.Mode)
+		}
+		// The name of an entry of a source is taken like a manual one.
+		if isUniqueConstraintError(err) || err == nil && sourced[name] {
+			errs = append(errs, APIError{
+				Code:       CodeDomainExists,
+				Status:     "error",
+				StatusCode: http.StatusConflict,
+				Message:    localize(r, "Domain \"%s\" (%d in the array) is already in the database.", name, index),
+			})
+			continue
+		}
+		if err == nil {
+			_, err = tx.Exec(purgeStmt, name)
+		}
+		if err == nil {
+			err = tx.record(entry, false)
+		}
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if len(errs) == len(names) {
+		respondWithError(w, &APIError{Code: errs[0].Code, Status: "error", StatusCode: errs[0].StatusCode, Message: localize(r, "None of the domains could be restored."), Errors: errs})
+	} else if len(errs) == 0 {
+		respondWithError(w, &APIError{Code: CodeOK, StatusCode: http.StatusOK, Message: localize(r, "Succesfully restored all of the domains."), Status: "success"})
+	} else {
+		respondWithError(w, &APIError{Code: errs[0].Code, Status: "partial", StatusCode: http.StatusOK, Message: localize(r, "Some of the domains couldn't be restored."), Errors: errs})
+	}
+}
+
+func purgeDomains(w http.ResponseWriter, r *http.Request, names []string) {
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	errs := make([]APIError, 0)
+	for index, name := range names {
+		result, err := tx.Exec(purgeStmt, name)
+		if err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			errs = append(errs, APIError{
+				Code:       CodeDomainNotFound,
+				Status:     "error",
+				StatusCode: http.StatusNotFound,
+				Message:    localize(r, "Domain \"%s\" (%d in the array) isn't in the trash.", name, index),
+			})
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	if len(errs) == len(names) {
+		respondWithError(w, &APIError{Code: CodeDomainNotFound, Status: "error", StatusCode: http.StatusNotFound, Message: localize(r, "All of the domains aren't in the trash.")})
+	} else if len(errs) == 0 {
+		respondWithError(w, &APIError{Code: CodeOK, StatusCode: http.StatusOK, Message: localize(r, "Succesfully purged all of the domains."), Status: "success"})
+	} else {
+		respondWithError(w, &APIError{Code: CodeDomainNotFound, Status: "partial", StatusCode: http.StatusOK, Message: localize(r, "Some of the domains aren't in the trash."), Errors: errs})
+	}
+}
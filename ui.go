@@ -0,0 +1,36 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The admin UI is a single page calling the API from the browser, with
+// the key entered there. Its files are served to anyone, see
+// unauthenticatedPaths.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+var uiHandler http.Handler = func() http.Handler {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/ui", http.FileServerFS(files))
+}()
+
+// serveUI serves GET /ui/ and the files of the page.
+func serveUI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	// The page only loads its own files and calls its own origin, and is
+	// never framed, so injected markup can't reach the key.
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-cache")
+	uiHandler.ServeHTTP(w, r)
+}
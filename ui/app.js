@@ -0,0 +1,155 @@
+"use strict";
+
+// The key is kept in the browser, and sent as a bearer token to the API
+// served from the same origin as the page.
+const keyStorage = "proxy-api-key";
+const pageSize = 50;
+
+let offset = 0;
+let search = "";
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+function show(text, ok) {
+  const message = $("message");
+  message.textContent = text;
+  message.className = ok ? "ok" : "";
+  message.hidden = !text;
+}
+
+async function api(method, path, body) {
+  const headers = {};
+  const key = localStorage.getItem(keyStorage);
+  if (key) {
+    headers["Authorization"] = "Bearer " + key;
+  }
+  const init = { method: method, headers: headers };
+  if (body !== undefined) {
+    headers["Content-Type"] = "application/json";
+    init.body = JSON.stringify(body);
+  }
+  const response = await fetch(path, init);
+  let data = null;
+  if ((response.headers.get("Content-Type") || "").startsWith("application/json")) {
+    data = await response.json();
+  }
+  if (response.status === 401) {
+    $("key").focus();
+    throw new Error("Enter an API key to manage the blocklist.");
+  }
+  if (!response.ok) {
+    throw new Error(data && data.message ? data.message : response.status + " " + response.statusText);
+  }
+  return data;
+}
+
+async function loadStats() {
+  const summary = await api("GET", "/stats/summary");
+  $("stat-queries").textContent = summary.queries.toLocaleString();
+  $("stat-blocked").textContent = summary.blocked.toLocaleString();
+  $("stat-ratio").textContent = (summary.blockedRatio * 100).toFixed(1) + "%";
+  $("stat-clients").textContent = summary.clients.toLocaleString();
+
+  const top = await api("GET", "/stats/top-blocked?limit=10");
+  const list = $("top-blocked");
+  list.replaceChildren();
+  for (const entry of top.domains) {
+    const item = document.createElement("li");
+    item.textContent = entry.domain + " (" + entry.hits.toLocaleString() + ")";
+    list.append(item);
+  }
+}
+
+async function loadDomains() {
+  const params = new URLSearchParams({ limit: pageSize, offset: offset });
+  if (search) {
+    params.set("search", search);
+  }
+  const page = await api("GET", "/domains?" + params);
+  const rows = $("domain-rows");
+  rows.replaceChildren();
+  for (const entry of page.domains) {
+    const row = document.createElement("tr");
+    const domain = document.createElement("td");
+    domain.textContent = entry.domain;
+    const mode = document.createElement("td");
+    mode.textContent = entry.mode;
+    const actions = document.createElement("td");
+    const remove = document.createElement("button");
+    remove.type = "button";
+    remove.textContent = "Remove";
+    remove.addEventListener("click", () => removeDomain(entry.domain));
+    actions.append(remove);
+    row.append(domain, mode, actions);
+    rows.append(row);
+  }
+  const last = Math.min(page.offset + page.domains.length, page.total);
+  $("range").textContent = page.total === 0 ? "No domains" : page.offset + 1 + "–" + last + " of " + page.total;
+  $("prev").disabled = page.offset === 0;
+  $("next").disabled = last >= page.total;
+}
+
+async function removeDomain(domain) {
+  try {
+    await api("DELETE", "/domains/" + encodeURIComponent(domain));
+    show("Moved " + domain + " to the trash.", true);
+    await loadDomains();
+  } catch (err) {
+    show(err.message);
+  }
+}
+
+async function refresh() {
+  try {
+    show("");
+    await Promise.all([loadStats(), loadDomains()]);
+  } catch (err) {
+    show(err.message);
+  }
+}
+
+$("key-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+  const key = $("key").value.trim();
+  if (key) {
+    localStorage.setItem(keyStorage, key);
+  } else {
+    localStorage.removeItem(keyStorage);
+  }
+  $("key").value = "";
+  refresh();
+});
+
+$("add-form").addEventListener("submit", async (event) => {
+  event.preventDefault();
+  const domain = $("add-domain").value.trim();
+  try {
+    await api("POST", "/domains", [{ domain: domain, mode: $("add-mode").value }]);
+    $("add-domain").value = "";
+    show("Blocked " + domain + ".", true);
+    await loadDomains();
+  } catch (err) {
+    show(err.message);
+  }
+});
+
+$("search-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+  search = $("search").value.trim();
+  offset = 0;
+  loadDomains().catch((err) => show(err.message));
+});
+
+$("prev").addEventListener("click", () => {
+  offset = Math.max(0, offset - pageSize);
+  loadDomains().catch((err) => show(err.message));
+});
+
+$("next").addEventListener("click", () => {
+  offset += pageSize;
+  loadDomains().catch((err) => show(err.message));
+});
+
+refresh();
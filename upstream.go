@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var proxyUpstream *string = flag.String("proxy-upstream", "", "URL of an HTTP proxy all outbound connections go through (direct if empty)")
+
+func parseUpstream(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	upstream, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if upstream.Scheme != "http" || upstream.Host == "" {
+		return nil, errors.New("upstream must be an http:// URL with a host")
+	}
+	if upstream.Port() == "" {
+		upstream.Host = net.JoinHostPort(upstream.Hostname(), "80")
+	}
+	return upstream, nil
+}
+
+// outboundDialer opens the connections of both proxies, either directly or
+// through a CONNECT tunnel of the upstream proxy. Destinations are checked
+// by destinations, the upstream itself isn't.
+type outboundDialer struct {
+	net.Dialer
+	guarded  net.Dialer
+	upstream *url.URL
+}
+
+func newOutboundDialer(upstream *url.URL) *outboundDialer {
+	return &outboundDialer{
+		Dialer:   net.Dialer{Timeout: dialTimeout},
+		guarded:  net.Dialer{Timeout: dialTimeout, Control: destinations.control},
+		upstream: upstream,
+	}
+}
+
+// dial connects to the address itself, regardless of the upstream. Without
+// an upstream, every address dialed is a destination; with one, only the
+// upstream is.
+func (d *outboundDialer) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	if err := injectUpstreamFailure(address); err != nil {
+		return nil, err
+	}
+	if d.upstream == nil {
+		return d.guarded.DialContext(ctx, network, address)
+	}
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+func (d *outboundDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	if d.upstream == nil {
+		return d.dial(ctx, network, address)
+	}
+	// The upstream is asked for the address checked here rather than for
+	// the name, which it would resolve again.
+	address, err := destinations.resolve(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.dial(ctx, "tcp", d.upstream.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := d.upstream.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused to connect to %s: %s", address, resp.Status)
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn reads whatever the upstream sent right after its CONNECT
+// response before reading from the connection itself.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return c.Conn.Close()
+}
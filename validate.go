@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const selectValidatedStmt string = "SELECT domain_name, mode, categories, expires_at FROM blocked_domains ORDER BY domain_name"
+
+const renameStmt string = "UPDATE blocked_domains SET domain_name = ? WHERE domain_name = ?"
+
+// Kinds of anomalies the validation reports.
+const (
+	issueInvalid      = "invalid"
+	issueUnnormalized = "unnormalized"
+	issueDuplicate    = "duplicate"
+	issueShadowed     = "shadowed"
+	issueExpired      = "expired"
+)
+
+// Repairs of an issue. Removed entries are moved to the trash, so a
+// repair can be undone.
+const (
+	fixRemove = "remove"
+	fixRename = "rename"
+)
+
+type ValidationIssueSchema struct {
+	Domain string `json:"domain"`
+	Mode   string `json:"mode"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+	// Target is the normalized name of a rename, or the entry a duplicate
+	// or a shadowed entry is redundant with.
+	Target string `json:"target,omitempty"`
+	Fix    string `json:"fix,omitempty"`
+	Fixed  bool   `json:"fixed,omitempty"`
+}
+
+type ValidationSchema struct {
+	Scanned int                     `json:"scanned"`
+	Fixable int                     `json:"fixable"`
+	Fixed   int                     `json:"fixed"`
+	Issues  []ValidationIssueSchema `json:"issues"`
+}
+
+type validatedEntry struct {
+	DomainEntry
+	categories []string
+	expiresAt  sql.NullInt64
+}
+
+// validate scans the manual entries of the blocklist for anomalies. The
+// entries of the sources come and go with their syncs, so they are neither
+// scanned nor taken as covering others. Entries stored unnormalized
+// never match, as names are normalized before they are looked up, so
+// removing or renaming them is safe. A shadowed entry is only removed if
+// the entry covering it has no categories and doesn't expire, as the
+// shadowed entry would otherwise matter again once a category is disabled
+// or the covering entry is gone.
+func validate(tx *changeTx) (*ValidationSchema, error) {
+	rows, err := tx.Query(selectValidatedStmt)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]validatedEntry, 0)
+	for rows.Next() {
+		var entry validatedEntry
+		var stored string
+		if err := rows.Scan(&entry.Domain, &entry.Mode, &stored, &entry.expiresAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entry.categories = splitCategories(stored)
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	schema := &ValidationSchema{Scanned: len(entries), Issues: []ValidationIssueSchema{}}
+	report := func(issue ValidationIssueSchema) {
+		if issue.Fix != "" {
+			schema.Fixable++
+		}
+		schema.Issues = append(schema.Issues, issue)
+	}
+
+	taken := make(map[string]bool, len(entries))
+	targets := make([]string, 0)
+	for _, entry := range entries {
+		taken[entry.Domain] = true
+		normalized := entry.DomainEntry
+		if normalized.normalize() == nil && normalized.Domain != entry.Domain {
+			targets = append(targets, normalized.Domain)
+		}
+	}
+	// Names of the entries of the sources can't be renamed to either.
+	sourced, err := sourcedNames(tx, targets)
+	if err != nil {
+		return nil, err
+	}
+	for name := range sourced {
+		taken[name] = true
+	}
+	// The entries that match as stored, which the shadowing is checked
+	// against.
+	valid := newMemoryBlocklist(selectAllStmt)
+	modes := make(map[string]string)
+	transient := make(map[string]bool)
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.expiresAt.Valid && entry.expiresAt.Int64 <= now.Unix() {
+			report(ValidationIssueSchema{
+				Domain: entry.Domain,
+				Mode:   entry.Mode,
+				Kind:   issueExpired,
+				Detail: fmt.Sprintf("expired at %s", time.Unix(entry.expiresAt.Int64, 0).UTC().Format(time.RFC3339)),
+				Fix:    fixRemove,
+			})
+			continue
+		}
+		normalized := entry.DomainEntry
+		if err := normalized.normalize(); err != nil {
+			report(ValidationIssueSchema{Domain: entry.Domain, Mode: entry.Mode, Kind: issueInvalid, Detail: err.Error()})
+			continue
+		}
+		if normalized.Domain == entry.Domain {
+			valid.add(entry.DomainEntry)
+			modes[entry.Domain] = entry.Mode
+			transient[entry.Domain] = len(entry.categories) != 0 || entry.expiresAt.Valid
+			continue
+		}
+		if taken[normalized.Domain] {
+			report(ValidationIssueSchema{
+				Domain: entry.Domain,
+				Mode:   entry.Mode,
+				Kind:   issueDuplicate,
+				Detail: fmt.Sprintf("differs from \"%s\" only in its spelling", normalized.Domain),
+				Target: normalized.Domain,
+				Fix:    fixRemove,
+			})
+			continue
+		}
+		taken[normalized.Domain] = true
+		report(ValidationIssueSchema{
+			Domain: entry.Domain,
+			Mode:   entry.Mode,
+			Kind:   issueUnnormalized,
+			Detail: fmt.Sprintf("never matches, as names are looked up as \"%s\"", normalized.Domain),
+			Target: normalized.Domain,
+			Fix:    fixRename,
+		})
+	}
+
+	for _, entry := range entries {
+		mode, ok := modes[entry.Domain]
+		if !ok {
+			continue
+		}
+		covering := valid.covering(DomainEntry{Domain: entry.Domain, Mode: mode})
+		if covering == nil {
+			continue
+		}
+		issue := ValidationIssueSchema{
+			Domain: entry.Domain,
+			Mode:   mode,
+			Kind:   issueShadowed,
+			Detail: fmt.Sprintf("is covered by the %s entry \"%s\"", covering.Mode, covering.Domain),
+			Target: covering.Domain,
+		}
+		if !transient[covering.Domain] {
+			issue.Fix = fixRemove
+		}
+		report(issue)
+	}
+	return schema, nil
+}
+
+// covering returns the most specific other entry blocking every name the
+// entry blocks, or nil if there is none. A wildcard is only known to be
+// covered by a subdomain entry above the labels after its last pattern, as
+// the names it matches all end with them.
+func (b *memoryBlocklist) covering(entry DomainEntry) *DomainEntry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	name := entry.Domain
+	strict := entry.Mode == ModeSubdomain
+	if entry.Mode == ModeWildcard {
+		labels := strings.Split(name, ".")
+		fixed := len(labels)
+		for fixed > 0 && !strings.ContainsAny(labels[fixed-1], "*?[") {
+			fixed--
+		}
+		name = strings.Join(labels[fixed:], ".")
+		if name == "" {
+			return nil
+		}
+	}
+
+	labels := reversedLabels(name)
+	deepest := ""
+	node := &b.suffixes
+	for i, label := range labels {
+		child, ok := node.children[label]
+		if !ok {
+			break
+		}
+		if child.subdomain && (!strict || i < len(labels)-1) {
+			deepest = joinReversed(labels[:i+1])
+		}
+		node = child
+	}
+	if deepest != "" {
+		return &DomainEntry{Domain: deepest, Mode: ModeSubdomain}
+	}
+
+	if entry.Mode == ModeExact {
+		for _, pattern := range b.wildcards {
+			if matched, _ := path.Match(pattern, name); matched {
+				return &DomainEntry{Domain: pattern, Mode: ModeWildcard}
+			}
+		}
+	}
+	return nil
+}
+
+// repair applies the fix of the issue in the transaction.
+func repair(tx *changeTx, r *http.Request, issue ValidationIssueSchema) error {
+	entry := DomainEntry{Domain: issue.Domain, Mode: issue.Mode}
+	switch issue.Fix {
+	case fixRemove:
+		if _, err := tx.Exec(deleteStmt, entry.Domain); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(purgeStmt, entry.Domain); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(trashStmt, entry.Domain, entry.Mode, time.Now().Unix(), apiKeyName(r)); err != nil {
+			return err
+		}
+		return tx.record(entry, true)
+	case fixRename:
+		if _, err := tx.Exec(renameStmt, issue.Target, entry.Domain); err != nil {
+			return err
+		}
+		if err := tx.record(entry, true); err != nil {
+			return err
+		}
+		tx.categorize(issue.Target, categories.of(entry.Domain))
+		return tx.record(DomainEntry{Domain: issue.Target, Mode: entry.Mode}, false)
+	}
+	return nil
+}
+
+// validateHandler serves GET /admin/validate, which reports the anomalies
+// of the blocklist and how they would be repaired.
+func validateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, unexceptedMethod(r, http.MethodGet))
+		return
+	}
+	tx, err := beginChange(r.Context())
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	schema, err := validate(tx)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	respondWithJSON(w, schema)
+}
+
+// validateFixHandler serves POST /admin/validate/fix, which repairs the
+// issues that can be repaired safely and reports all of them.
+func validateFixHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, unexceptedMethod(r, http.MethodPost))
+		return
+	}
+	tx, err := beginChange(r.Context())
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	schema, err := validate(tx)
+	if err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	for i := range schema.Issues {
+		if schema.Issues[i].Fix == "" {
+			continue
+		}
+		if err := repair(tx, r, schema.Issues[i]); err != nil {
+			respondWithInternalError(w, r, err)
+			return
+		}
+		schema.Issues[i].Fixed = true
+		schema.Fixed++
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInternalError(w, r, err)
+		return
+	}
+	requestLogger(r).Info("Blocklist repaired", "fixed", schema.Fixed)
+	respondWithJSON(w, schema)
+}